@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+var errForbidden = fmt.Errorf("you don't have permission to do this")
+
+// checkView writes an error and returns false if the authenticated user can't view the devices, rules and
+// traffic of the user. It is a 404 so the ids of other people's things can't be probed.
+func checkView(w http.ResponseWriter, r *http.Request, userID uuid.UUID, what string) bool {
+	if !principalFrom(r).Access.CanView(userID) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("get %s: not found", what))
+		return false
+	}
+	return true
+}
+
+// checkManage writes an error and returns false if the authenticated user can't change the devices and
+// rules of the user.
+func checkManage(w http.ResponseWriter, r *http.Request, userID uuid.UUID, what string) bool {
+	if !checkView(w, r, userID, what) {
+		return false
+	}
+	if !principalFrom(r).Access.CanManage(userID) {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return false
+	}
+	return true
+}
+
+// checkAdminister writes an error and returns false if the authenticated user can't change the user's
+// account (see database.Access.CanAdminister).
+func (s *server) checkAdminister(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (*database.User, bool) {
+	if !principalFrom(r).Access.IsAdmin() {
+		writeError(w, http.StatusForbidden, errForbidden) // before looking the user up so ids can't be probed
+		return nil, false
+	}
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		writeDBError(w, "get user", err)
+		return nil, false
+	}
+	if !principalFrom(r).Access.CanAdminister(user) {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// requestOwner returns the user whose device made the logged request. Requests without a known device
+// belong to nobody and are only visible to admins, so uuid.Nil is returned for them.
+func (s *server) requestOwner(lr *database.LoggedRequest) (uuid.UUID, error) {
+	if lr.DeviceID == nil {
+		return uuid.Nil, nil
+	}
+	device, err := s.db.GetDeviceByID(*lr.DeviceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, nil // the device was deleted
+	} else if err != nil {
+		return uuid.Nil, err
+	}
+	return device.User.ID, nil
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+// maxAccessDuration is the longest access can be approved for; anything longer should be a rule.
+const maxAccessDuration = 7 * 24 * time.Hour
+
+type approveAccessRequest struct {
+	Minutes int `json:"minutes"` // how long access is given for, defaults to an hour
+}
+
+func (s *server) handleListAccessRequests(w http.ResponseWriter, r *http.Request) {
+	var requests []*database.AccessRequest
+	var err error
+	if access := principalFrom(r).Access; access.IsAdmin() {
+		requests, err = s.db.GetAccessRequests()
+	} else {
+		requests, err = s.db.GetAccessRequestsByUserIDs(access.UserIDs())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get access requests: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (s *server) handleApproveAccessRequest(w http.ResponseWriter, r *http.Request) {
+	var req approveAccessRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode approval: %w", err))
+		return
+	}
+	duration := time.Duration(req.Minutes) * time.Minute
+	if req.Minutes == 0 {
+		duration = time.Hour
+	}
+	if duration <= 0 || duration > maxAccessDuration {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("minutes must be between 1 and %d", int(maxAccessDuration.Minutes())))
+		return
+	}
+	a, ok := s.pendingAccessRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.ApproveAccessRequest(a.ID, principalUserID(r), time.Now().Add(duration)); err != nil {
+		writeDBError(w, "approve access request", err)
+		return
+	}
+	proxy.InvalidateAccessExceptions()
+	s.writeAccessRequest(w, a.ID)
+}
+
+func (s *server) handleDenyAccessRequest(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.pendingAccessRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.DenyAccessRequest(a.ID, principalUserID(r)); err != nil {
+		writeDBError(w, "deny access request", err)
+		return
+	}
+	s.writeAccessRequest(w, a.ID)
+}
+
+// handleRevokeAccessRequest ends an approved access request before it expires.
+func (s *server) handleRevokeAccessRequest(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.accessRequestFor(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.RevokeAccessRequest(a.ID); err != nil {
+		writeDBError(w, "revoke access request", err)
+		return
+	}
+	proxy.InvalidateAccessExceptions()
+	s.writeAccessRequest(w, a.ID)
+}
+
+// accessRequestFor returns the access request in the path if the authenticated user can manage its device.
+func (s *server) accessRequestFor(w http.ResponseWriter, r *http.Request) (*database.AccessRequest, bool) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	a, err := s.db.GetAccessRequestByID(id)
+	if err != nil {
+		writeDBError(w, "get access request", err)
+		return nil, false
+	}
+	if !checkManage(w, r, a.UserID, "access request") {
+		return nil, false
+	}
+	return a, true
+}
+
+func (s *server) pendingAccessRequest(w http.ResponseWriter, r *http.Request) (*database.AccessRequest, bool) {
+	a, ok := s.accessRequestFor(w, r)
+	if ok && a.Status != database.AccessPending {
+		writeError(w, http.StatusConflict, fmt.Errorf("access request was already %s", a.Status))
+		return nil, false
+	}
+	return a, ok
+}
+
+func (s *server) writeAccessRequest(w http.ResponseWriter, id uuid.UUID) {
+	a, err := s.db.GetAccessRequestByID(id)
+	if err != nil {
+		writeDBError(w, "get access request", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+// request returns a request to the admin api authenticated as user, who manages the users in managed. The
+// id path value is set to id if it isn't empty.
+func request(method, target, id string, body any, user *database.User, managed ...uuid.UUID) *http.Request {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(b))
+	if id != "" {
+		r.SetPathValue("id", id)
+	}
+	p := &principal{User: user, Scope: auth.ScopeFullAdmin, Access: database.NewAccess(user, managed)}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	member := &database.User{ID: uuid.New(), Username: "alice", Role: database.RoleMember}
+	kid := uuid.New() // in a group alice manages
+	viewer := &database.User{ID: uuid.New(), Username: "carol", Role: database.RoleViewer}
+	other := uuid.New() // another household
+	rule := database.Rule{
+		User:       database.User{ID: other},
+		Title:      "block games",
+		Trigger:    database.TriggerIncomingRequest,
+		Condition:  database.Condition{Operator: database.OperatorCT, Field: "ctx-host", Value: "games"},
+		RuleAction: database.Action{Type: database.ActionBlockRequest},
+		Scope:      database.RuleScopeUser,
+	}
+
+	// the server has no database: every request here must be refused before one would be needed
+	s := &server{throttler: auth.NewThrottler(5, 0)}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		r       *http.Request
+		status  int
+	}{
+		{"member gets another user", s.handleGetUser, request("GET", "/api/users/x", other.String(), nil, member, kid), http.StatusNotFound},
+		{"member lists another user's devices", s.handleListDevices, request("GET", "/api/devices?user="+other.String(), "", nil, member, kid), http.StatusNotFound},
+		{"member lists another user's rules", s.handleListRules, request("GET", "/api/rules?user="+other.String(), "", nil, member, kid), http.StatusNotFound},
+		{"member creates a device for another user", s.handleCreateDevice, request("POST", "/api/devices", "", deviceRequest{UserID: other, Name: "phone"}, member, kid), http.StatusNotFound},
+		{"member creates a rule for another user", s.handleCreateRule, request("POST", "/api/rules", "", rule, member, kid), http.StatusNotFound},
+		{"member changes another user's password", s.handleUpdatePassword, request("PUT", "/api/users/x/password", other.String(), userRequest{Password: "new password"}, member, kid), http.StatusForbidden},
+		{"member changes a managed user's password", s.handleUpdatePassword, request("PUT", "/api/users/x/password", kid.String(), userRequest{Password: "new password"}, member, kid), http.StatusForbidden},
+		{"member deletes a managed user", s.handleDeleteUser, request("DELETE", "/api/users/x", kid.String(), nil, member, kid), http.StatusForbidden},
+		{"member promotes themselves", s.handleUpdateRole, request("PUT", "/api/users/x/role", member.ID.String(), roleRequest{Role: database.RoleAdmin}, member), http.StatusForbidden},
+		{"viewer gets another user", s.handleGetUser, request("GET", "/api/users/x", other.String(), nil, viewer), http.StatusNotFound},
+		{"viewer lists another user's rules", s.handleListRules, request("GET", "/api/rules?user="+other.String(), "", nil, viewer), http.StatusNotFound},
+		{"viewer creates a device for themselves", s.handleCreateDevice, request("POST", "/api/devices", "", deviceRequest{UserID: viewer.ID, Name: "phone"}, viewer), http.StatusForbidden},
+		{"viewer creates a rule for themselves", s.handleCreateRule, request("POST", "/api/rules", "", database.Rule{User: database.User{ID: viewer.ID}, Title: rule.Title, Trigger: rule.Trigger, Condition: rule.Condition, RuleAction: rule.RuleAction, Scope: rule.Scope}, viewer), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, tt.r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestDeleteDeviceIsForAdmins(t *testing.T) {
+	for _, rt := range (&server{}).routes() {
+		if rt.Method == "DELETE" && rt.Path == "/api/devices/{id}" {
+			if !rt.Admin {
+				t.Error("members can delete devices")
+			}
+			return
+		}
+	}
+	t.Error("no route deletes devices")
+}
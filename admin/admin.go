@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+type server struct {
+	db        *database.DB
+	throttler *auth.Throttler
+}
+
+// route is an admin api endpoint. Request and Response are zero values of the request and response body
+// types, used to generate the openapi document.
+type route struct {
+	Method   string
+	Path     string
+	Summary  string
+	Request  any
+	Response any
+	Public   bool   // doesn't require authentication
+	Scope    string // scope required, defaults to read-only for GET and full-admin otherwise
+	Admin    bool   // only for owners and admins, other routes check access to what they use themselves
+
+	AllowWithoutTOTP bool // usable before totp is set up when it is required
+
+	handler http.HandlerFunc
+}
+
+// Start runs the admin API on the configured admin address. It is a separate listener from the proxy so it
+// can be bound to localhost.
+func Start(db *database.DB) error {
+	s := &server{
+		db:        db,
+		throttler: auth.NewThrottler(config.DefaultConfig.Auth.MaxLoginFailures, time.Duration(config.DefaultConfig.Auth.LockoutSeconds)*time.Second),
+	}
+	mux := http.NewServeMux()
+	for _, rt := range s.routes() {
+		h := rt.handler
+		if !rt.Public {
+			h = s.requireAuth(rt, h)
+		}
+		mux.HandleFunc(rt.Method+" "+rt.Path, h)
+	}
+	mux.Handle("GET /", dashboardHandler())
+	go s.cleanup()
+	if config.DefaultConfig.Admin.APIToken == "" {
+		slog.Warn("admin api token is not configured")
+	}
+
+	slog.Info("admin listening on", "address", config.DefaultConfig.Admin.Addr)
+	if err := http.ListenAndServe(config.DefaultConfig.Admin.Addr, mux); err != nil {
+		return fmt.Errorf("admin listen and serve: %w", err)
+	}
+	return nil
+}
+
+func (rt route) requiredScope() string {
+	switch {
+	case rt.Scope != "":
+		return rt.Scope
+	case rt.Method == http.MethodGet:
+		return auth.ScopeReadOnly
+	}
+	return auth.ScopeFullAdmin
+}
+
+func (s *server) routes() []route {
+	return []route{
+		{Method: "GET", Path: "/api/openapi.json", Summary: "get the openapi document for this api", Response: map[string]any{}, Public: true, handler: s.handleOpenAPI},
+
+		{Method: "POST", Path: "/api/login", Summary: "log in as a user, setting the session cookie", Request: loginRequest{}, Response: sessionResponse{}, Public: true, handler: s.handleLogin},
+		{Method: "POST", Path: "/api/logout", Summary: "end the current session", Scope: auth.ScopeReadOnly, AllowWithoutTOTP: true, handler: s.handleLogout},
+		{Method: "GET", Path: "/api/me", Summary: "get the authenticated user, their scope and csrf token", Response: sessionResponse{}, AllowWithoutTOTP: true, handler: s.handleMe},
+		{Method: "POST", Path: "/api/totp/enroll", Summary: "start setting up two-factor authentication", Response: totpEnrollResponse{}, AllowWithoutTOTP: true, handler: s.handleTOTPEnroll},
+		{Method: "GET", Path: "/api/totp/qr.png", Summary: "get the qr code for the authenticator app while setting up two-factor authentication", AllowWithoutTOTP: true, handler: s.handleTOTPQRCode},
+		{Method: "POST", Path: "/api/totp/confirm", Summary: "finish setting up two-factor authentication, returning recovery codes", Request: totpCodeRequest{}, Response: recoveryCodesResponse{}, AllowWithoutTOTP: true, handler: s.handleTOTPConfirm},
+		{Method: "POST", Path: "/api/totp/recovery-codes", Summary: "replace your recovery codes", Request: totpCodeRequest{}, Response: recoveryCodesResponse{}, handler: s.handleTOTPRecoveryCodes},
+		{Method: "POST", Path: "/api/totp/disable", Summary: "turn off two-factor authentication", Request: totpCodeRequest{}, handler: s.handleTOTPDisable},
+		{Method: "GET", Path: "/api/sessions", Summary: "list your active sessions", Response: []database.Session{}, handler: s.handleListSessions},
+		{Method: "DELETE", Path: "/api/sessions/{id}", Summary: "revoke one of your sessions", Scope: auth.ScopeReadOnly, handler: s.handleRevokeSession},
+		{Method: "GET", Path: "/api/tokens", Summary: "list your api tokens", Response: []database.APIToken{}, handler: s.handleListTokens},
+		{Method: "POST", Path: "/api/tokens", Summary: "create an api token, the token is only returned once", Request: tokenRequest{}, Response: tokenResponse{}, handler: s.handleCreateToken},
+		{Method: "DELETE", Path: "/api/tokens/{id}", Summary: "revoke one of your api tokens", Scope: auth.ScopeReadOnly, handler: s.handleRevokeToken},
+		{Method: "GET", Path: "/api/rule-options", Summary: "list the fields, operators, triggers and actions rules can use", Response: ruleOptions{}, AllowWithoutTOTP: true, handler: s.handleRuleOptions},
+
+		{Method: "GET", Path: "/api/users", Summary: "list the users you can view", Response: []database.User{}, handler: s.handleListUsers},
+		{Method: "GET", Path: "/api/users/{id}", Summary: "get a user", Response: database.User{}, handler: s.handleGetUser},
+		{Method: "POST", Path: "/api/users", Summary: "create a user", Request: userRequest{}, Response: database.User{}, Admin: true, handler: s.handleCreateUser},
+		{Method: "PUT", Path: "/api/users/{id}/password", Summary: "change your password, or a user's password as an admin", Request: userRequest{}, handler: s.handleUpdatePassword},
+		{Method: "PUT", Path: "/api/users/{id}/role", Summary: "change a user's role", Request: roleRequest{}, Response: database.User{}, Admin: true, handler: s.handleUpdateRole},
+		{Method: "DELETE", Path: "/api/users/{id}", Summary: "delete a user with their devices and rules", Admin: true, handler: s.handleDeleteUser},
+		{Method: "DELETE", Path: "/api/users/{id}/totp", Summary: "reset a user's two-factor authentication (e.g. a lost phone)", Admin: true, handler: s.handleResetTOTP},
+
+		{Method: "GET", Path: "/api/groups", Summary: "list groups, only the ones you're in if you're not an admin", Response: []database.Group{}, handler: s.handleListGroups},
+		{Method: "POST", Path: "/api/groups", Summary: "create a group", Request: groupRequest{}, Response: database.Group{}, Admin: true, handler: s.handleCreateGroup},
+		{Method: "DELETE", Path: "/api/groups/{id}", Summary: "delete a group", Admin: true, handler: s.handleDeleteGroup},
+		{Method: "PUT", Path: "/api/groups/{id}/members/{user_id}", Summary: "add a user to a group or change whether they manage it", Request: groupMemberRequest{}, Response: database.Group{}, Admin: true, handler: s.handleSaveGroupMember},
+		{Method: "DELETE", Path: "/api/groups/{id}/members/{user_id}", Summary: "remove a user from a group", Admin: true, handler: s.handleDeleteGroupMember},
+
+		{Method: "GET", Path: "/api/devices", Summary: "list devices, optionally for one user (?user=)", Response: []database.Device{}, handler: s.handleListDevices},
+		{Method: "GET", Path: "/api/devices/{id}", Summary: "get a device", Response: database.Device{}, handler: s.handleGetDevice},
+		{Method: "POST", Path: "/api/devices", Summary: "create a device", Request: deviceRequest{}, Response: database.Device{}, handler: s.handleCreateDevice},
+		{Method: "PATCH", Path: "/api/devices/{id}", Summary: "change a device's name, group, tags, bypass lists, safe search or addresses", Request: deviceRequest{}, Response: database.Device{}, handler: s.handleUpdateDevice},
+		{Method: "DELETE", Path: "/api/devices/{id}", Summary: "delete a device", Admin: true, handler: s.handleDeleteDevice},
+		{Method: "GET", Path: "/api/devices/{id}/pac", Summary: "get the proxy auto-config file of a device, and what it does for a host (?host=)", Response: pacResponse{}, handler: s.handleDevicePAC},
+		{Method: "POST", Path: "/api/devices/{id}/credentials", Summary: "give a device a new proxy password, the password is only returned once", Response: credentialsResponse{}, handler: s.handleResetDeviceCredentials},
+		{Method: "GET", Path: "/api/enrollments", Summary: "list enrollment codes that were not used yet", Response: []database.Enrollment{}, handler: s.handleListEnrollments},
+		{Method: "POST", Path: "/api/enrollments", Summary: "create a one-time code a device can enroll itself with, the code is only returned once", Request: enrollmentRequest{}, Response: enrollmentResponse{}, handler: s.handleCreateEnrollment},
+		{Method: "DELETE", Path: "/api/enrollments/{id}", Summary: "revoke an enrollment code", handler: s.handleDeleteEnrollment},
+		{Method: "GET", Path: "/api/devices/{id}/quotas", Summary: "get the quotas of a device and how much of them it used", Response: []proxy.QuotaStatus{}, handler: s.handleDeviceQuotas},
+		{Method: "GET", Path: "/api/quotas", Summary: "list quotas, only the ones for your devices if you're not an admin", Response: []database.Quota{}, handler: s.handleListQuotas},
+		{Method: "POST", Path: "/api/quotas", Summary: "create a daily or weekly quota for a device or device group", Request: database.Quota{}, Response: database.Quota{}, handler: s.handleCreateQuota},
+		{Method: "DELETE", Path: "/api/quotas/{id}", Summary: "delete a quota", handler: s.handleDeleteQuota},
+		{Method: "GET", Path: "/api/device-groups", Summary: "list device groups", Response: []database.DeviceGroup{}, handler: s.handleListDeviceGroups},
+		{Method: "POST", Path: "/api/device-groups", Summary: "create a device group", Request: groupRequest{}, Response: database.DeviceGroup{}, Admin: true, handler: s.handleCreateDeviceGroup},
+		{Method: "PATCH", Path: "/api/device-groups/{id}", Summary: "change a device group's name or pac bypass list", Request: deviceGroupRequest{}, Response: database.DeviceGroup{}, Admin: true, handler: s.handleUpdateDeviceGroup},
+		{Method: "DELETE", Path: "/api/device-groups/{id}", Summary: "delete a device group, its devices are left without a group", Admin: true, handler: s.handleDeleteDeviceGroup},
+
+		{Method: "GET", Path: "/api/rules", Summary: "list rules, optionally for one user (?user=)", Response: []database.Rule{}, handler: s.handleListRules},
+		{Method: "GET", Path: "/api/rules/{id}", Summary: "get a rule", Response: database.Rule{}, handler: s.handleGetRule},
+		{Method: "POST", Path: "/api/rules", Summary: "create a rule", Request: database.Rule{}, Response: database.Rule{}, Scope: auth.ScopeRulesWrite, handler: s.handleCreateRule},
+		{Method: "PUT", Path: "/api/rules/{id}", Summary: "replace a rule", Request: database.Rule{}, Response: database.Rule{}, Scope: auth.ScopeRulesWrite, handler: s.handleUpdateRule},
+		{Method: "DELETE", Path: "/api/rules/{id}", Summary: "delete a rule", Scope: auth.ScopeRulesWrite, handler: s.handleDeleteRule},
+
+		{Method: "GET", Path: "/api/blocklists", Summary: "list the blocklists rules can use with in_list", Response: []database.Blocklist{}, handler: s.handleListBlocklists},
+		{Method: "POST", Path: "/api/blocklists", Summary: "add a blocklist from an http(s) or file url and load it", Request: blocklistRequest{}, Response: database.Blocklist{}, Admin: true, handler: s.handleCreateBlocklist},
+		{Method: "PATCH", Path: "/api/blocklists/{id}", Summary: "change a blocklist's name, source or refresh interval", Request: blocklistRequest{}, Response: database.Blocklist{}, Admin: true, handler: s.handleUpdateBlocklist},
+		{Method: "POST", Path: "/api/blocklists/{id}/refresh", Summary: "load a blocklist again now", Response: database.Blocklist{}, Admin: true, handler: s.handleRefreshBlocklist},
+		{Method: "DELETE", Path: "/api/blocklists/{id}", Summary: "delete a blocklist", Admin: true, handler: s.handleDeleteBlocklist},
+
+		{Method: "GET", Path: "/api/category", Summary: "get the category of a host (?host=)", Response: categoryResponse{}, handler: s.handleHostCategory},
+		{Method: "GET", Path: "/api/overrides", Summary: "list the overrides that have not expired", Response: []database.Override{}, handler: s.handleListOverrides},
+		{Method: "POST", Path: "/api/overrides", Summary: "pause a rule, pause filtering for a device or block a device for a while", Request: overrideRequest{}, Response: database.Override{}, Scope: auth.ScopeRulesWrite, handler: s.handleCreateOverride},
+		{Method: "DELETE", Path: "/api/overrides/{id}", Summary: "end an override before it expires", Scope: auth.ScopeRulesWrite, handler: s.handleDeleteOverride},
+
+		{Method: "GET", Path: "/api/access-requests", Summary: "list the most recent requests for access from the block page", Response: []database.AccessRequest{}, handler: s.handleListAccessRequests},
+		{Method: "POST", Path: "/api/access-requests/{id}/approve", Summary: "give the device access to the host for a while", Request: approveAccessRequest{}, Response: database.AccessRequest{}, handler: s.handleApproveAccessRequest},
+		{Method: "POST", Path: "/api/access-requests/{id}/deny", Summary: "deny a request for access", Response: database.AccessRequest{}, handler: s.handleDenyAccessRequest},
+		{Method: "POST", Path: "/api/access-requests/{id}/revoke", Summary: "end approved access before it expires", Response: database.AccessRequest{}, handler: s.handleRevokeAccessRequest},
+
+		{Method: "GET", Path: "/api/bans", Summary: "list bans, including expired ones", Response: []database.Ban{}, Admin: true, handler: s.handleListBans},
+		{Method: "POST", Path: "/api/bans", Summary: "ban an ip", Request: database.Ban{}, Response: database.Ban{}, Admin: true, handler: s.handleCreateBan},
+		{Method: "DELETE", Path: "/api/bans/{id}", Summary: "lift a ban", Admin: true, handler: s.handleDeleteBan},
+
+		{Method: "GET", Path: "/api/pinned-hosts", Summary: "list the hosts learned to be tunneled without mitm, including expired ones", Response: []database.PinnedHost{}, Admin: true, handler: s.handleListPinnedHosts},
+		{Method: "DELETE", Path: "/api/pinned-hosts/{host}", Summary: "use mitm for a pinned host again", Admin: true, handler: s.handleDeletePinnedHost},
+
+		{Method: "GET", Path: "/api/requests", Summary: "list the most recent requests in the request log (?limit=, ?device=)", Response: []database.LoggedRequest{}, handler: s.handleListRequests},
+		{Method: "GET", Path: "/api/requests/{id}", Summary: "get a request from the request log", Response: database.LoggedRequest{}, handler: s.handleGetRequest},
+		{Method: "GET", Path: "/api/requests/{id}/frames", Summary: "list the logged frames of a websocket connection by its handshake (?limit=)", Response: []database.WebSocketFrame{}, handler: s.handleRequestFrames},
+		{Method: "POST", Path: "/api/requests/{id}/replay", Summary: "replay a request, optionally modified, and diff the responses", Request: proxy.Modification{}, Response: proxy.ReplayResult{}, handler: s.handleReplayRequest},
+		{Method: "GET", Path: "/api/events", Summary: "stream proxied requests as server-sent events (?device=, ?rule=, ?host=)", handler: s.handleEvents},
+	}
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+const (
+	csrfHeader = "X-CSRF-Token"
+	// last used times of api tokens are only updated this often, so using a token isn't a write every time
+	tokenTouchInterval = time.Minute
+)
+
+var errUnauthenticated = fmt.Errorf("authentication required")
+
+// principal is whoever is making an authenticated admin api request.
+type principal struct {
+	User    *database.User     // nil when authenticated with the configured api token
+	Scope   string             // see auth.Scopes
+	Session *database.Session  // set when authenticated with a session cookie
+	Token   *database.APIToken // set when authenticated with an api token from the database
+	Access  *database.Access   // what the user's role and groups allow
+
+	NeedsTOTPSetup bool // totp is required by the configuration but the user hasn't set it up
+}
+
+type principalKey struct{}
+
+func principalFrom(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// principalUserID returns the id of the authenticated user, or nil for the configured api token.
+func principalUserID(r *http.Request) *uuid.UUID {
+	if p := principalFrom(r); p.User != nil {
+		return &p.User.ID
+	}
+	return nil
+}
+
+// requireAuth only calls next if the request is authenticated with at least the route's scope, and by an
+// owner or admin for admin routes. Requests authenticated with a session cookie that change anything must
+// also carry the session's csrf token.
+func (s *server) requireAuth(rt route, next http.HandlerFunc) http.HandlerFunc {
+	scope := rt.requiredScope()
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if p.NeedsTOTPSetup && !rt.AllowWithoutTOTP {
+			writeError(w, http.StatusForbidden, fmt.Errorf("two-factor authentication must be set up first"))
+			return
+		}
+		if !auth.ScopeAllows(p.Scope, scope) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("this requires the %s scope", scope))
+			return
+		}
+		if p.User == nil {
+			p.Access = database.FullAccess()
+		} else if p.Access, err = s.db.AccessFor(p.User); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("get access: %w", err))
+			return
+		}
+		if rt.Admin && !p.Access.IsAdmin() {
+			writeError(w, http.StatusForbidden, errForbidden)
+			return
+		}
+		if p.Session != nil && !isSafeMethod(r.Method) &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(p.Session.CSRFToken)) != 1 {
+			writeError(w, http.StatusForbidden, fmt.Errorf("missing or invalid csrf token"))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// authenticate authenticates the request with an api token if there is a bearer token and with the
+// session cookie otherwise.
+func (s *server) authenticate(r *http.Request) (*principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return s.authenticateSession(r)
+	}
+	configured := config.DefaultConfig.Admin.APIToken
+	if configured != "" && subtle.ConstantTimeCompare([]byte(token), []byte(configured)) == 1 {
+		return &principal{Scope: auth.ScopeFullAdmin}, nil
+	}
+
+	t, err := s.db.GetActiveAPITokenByHash(auth.HashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("invalid api token")
+	}
+	user, err := s.db.GetUserByID(t.User.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get token user: %w", err)
+	}
+	if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) > tokenTouchInterval {
+		go func() {
+			if err := s.db.TouchAPIToken(t.ID); err != nil {
+				slog.Error("update api token last used", "token", t.ID, "error", err)
+			}
+		}()
+	}
+	return &principal{User: user, Scope: t.Scope, Token: t, NeedsTOTPSetup: needsTOTPSetup(user)}, nil
+}
+
+func (s *server) authenticateSession(r *http.Request) (*principal, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	sess, err := s.db.GetActiveSessionByTokenHash(auth.HashToken(c.Value))
+	if err != nil {
+		return nil, fmt.Errorf("session expired")
+	}
+	user, err := s.db.GetUserByID(sess.User.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get session user: %w", err)
+	}
+	return &principal{User: user, Scope: auth.ScopeFullAdmin, Session: sess, NeedsTOTPSetup: needsTOTPSetup(user)}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+func (s *server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.db.GetBans()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get bans: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (s *server) handleCreateBan(w http.ResponseWriter, r *http.Request) {
+	var ban database.Ban
+	if err := readJSON(r, &ban); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode ban: %w", err))
+		return
+	}
+	ip := net.ParseIP(ban.IP)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ip: %s", ban.IP))
+		return
+	}
+	ban.IP = ip.String() // the proxy compares the normalized form
+	ban.RuleID = nil
+	id, err := s.db.InsertBan(&ban)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert ban: %w", err))
+		return
+	}
+	ban.ID = id
+	proxy.InvalidateBans()
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func (s *server) handleDeleteBan(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.db.DeleteBan(id); err != nil {
+		writeDBError(w, "delete ban", err)
+		return
+	}
+	proxy.InvalidateBans()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/domains"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+const (
+	defaultBlocklistRefresh = 24 * 60
+	minBlocklistRefresh     = 5
+)
+
+type blocklistRequest struct {
+	Name           string `json:"name,omitempty"`
+	Source         string `json:"source,omitempty"`
+	RefreshMinutes int    `json:"refresh_minutes,omitempty"`
+}
+
+// apply sets the fields of the request that are set on b and checks the result.
+func (req *blocklistRequest) apply(b *database.Blocklist) error {
+	if req.Name != "" {
+		b.Name = req.Name
+	}
+	if req.Source != "" {
+		b.Source = req.Source
+	}
+	if req.RefreshMinutes != 0 {
+		b.RefreshMinutes = req.RefreshMinutes
+	}
+	switch {
+	case b.Name == "" || strings.ContainsAny(b.Name, " \t\n"):
+		return fmt.Errorf("name is required and can't contain spaces")
+	case !domains.ValidSource(b.Source):
+		return fmt.Errorf("source must be an http, https or file url")
+	case b.RefreshMinutes < minBlocklistRefresh:
+		return fmt.Errorf("refresh_minutes must be at least %d", minBlocklistRefresh)
+	}
+	return nil
+}
+
+func (s *server) handleListBlocklists(w http.ResponseWriter, r *http.Request) {
+	lists, err := s.db.GetBlocklists()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get blocklists: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, lists)
+}
+
+// handleCreateBlocklist creates a blocklist and loads it. The list is created even if loading fails; the
+// error is in its last_error.
+func (s *server) handleCreateBlocklist(w http.ResponseWriter, r *http.Request) {
+	var req blocklistRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode blocklist: %w", err))
+		return
+	}
+	b := &database.Blocklist{RefreshMinutes: defaultBlocklistRefresh}
+	if err := req.apply(b); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := s.db.InsertBlocklist(b)
+	if errors.Is(err, database.ErrBlocklistNameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert blocklist: %w", err))
+		return
+	}
+	b.ID = id
+	proxy.RefreshBlocklist(b)
+	s.writeBlocklist(w, http.StatusCreated, b)
+}
+
+func (s *server) handleUpdateBlocklist(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.blocklistFor(w, r)
+	if !ok {
+		return
+	}
+	var req blocklistRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode blocklist: %w", err))
+		return
+	}
+	if err := req.apply(b); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := s.db.UpdateBlocklist(b)
+	if errors.Is(err, database.ErrBlocklistNameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeDBError(w, "update blocklist", err)
+		return
+	}
+	proxy.RefreshBlocklist(b)
+	s.writeBlocklist(w, http.StatusOK, b)
+}
+
+// handleRefreshBlocklist loads a list again now instead of waiting for its next refresh.
+func (s *server) handleRefreshBlocklist(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.blocklistFor(w, r)
+	if !ok {
+		return
+	}
+	proxy.RefreshBlocklist(b)
+	s.writeBlocklist(w, http.StatusOK, b)
+}
+
+func (s *server) handleDeleteBlocklist(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.db.DeleteBlocklist(id); err != nil {
+		writeDBError(w, "delete blocklist", err)
+		return
+	}
+	proxy.RemoveBlocklist(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) blocklistFor(w http.ResponseWriter, r *http.Request) (*database.Blocklist, bool) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	b, err := s.db.GetBlocklistByID(id)
+	if err != nil {
+		writeDBError(w, "get blocklist", err)
+		return nil, false
+	}
+	return b, true
+}
+
+// writeBlocklist writes the list as stored, with the result of loading it.
+func (s *server) writeBlocklist(w http.ResponseWriter, status int, b *database.Blocklist) {
+	b, err := s.db.GetBlocklistByID(b.ID)
+	if err != nil {
+		writeDBError(w, "get blocklist", err)
+		return
+	}
+	writeJSON(w, status, b)
+}
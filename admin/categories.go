@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+type categoryResponse struct {
+	Host     string `json:"host"`
+	Category string `json:"category"` // "" if the host has none
+}
+
+// handleHostCategory looks up the category of a host (?host=), to check the category databases.
+func (s *server) handleHostCategory(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	writeJSON(w, http.StatusOK, categoryResponse{Host: host, Category: proxy.HostCategory(host)})
+}
@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// the dashboard is plain html, css and javascript so it works offline without a build step
+//
+//go:embed web
+var webFS embed.FS
+
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err) // the embedded directory always exists
+	}
+	return http.FileServerFS(sub)
+}
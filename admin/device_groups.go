@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+func (s *server) handleListDeviceGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.db.GetDeviceGroups()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get device groups: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (s *server) handleCreateDeviceGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode device group: %w", err))
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is required"))
+		return
+	}
+	id, err := s.db.InsertDeviceGroup(req.Name)
+	if errors.Is(err, database.ErrDeviceGroupNameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert device group: %w", err))
+		return
+	}
+	group, err := s.db.GetDeviceGroupByID(id)
+	if err != nil {
+		writeDBError(w, "get device group", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, group)
+}
+
+type deviceGroupRequest struct {
+	Name       string   `json:"name,omitempty"`
+	PACBypass  []string `json:"pac_bypass,omitempty"`
+	SafeSearch *bool    `json:"safe_search,omitempty"`
+}
+
+func (s *server) handleUpdateDeviceGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req deviceGroupRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode device group: %w", err))
+		return
+	}
+	group, err := s.db.GetDeviceGroupByID(id)
+	if err != nil {
+		writeDBError(w, "get device group", err)
+		return
+	}
+	if req.Name != "" {
+		group.Name = req.Name
+	}
+	if req.PACBypass != nil {
+		group.PACBypass = req.PACBypass
+	}
+	if req.SafeSearch != nil {
+		group.SafeSearch = *req.SafeSearch
+	}
+	err = s.db.UpdateDeviceGroup(group)
+	if errors.Is(err, database.ErrDeviceGroupNameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeDBError(w, "update device group", err)
+		return
+	}
+	proxy.InvalidateDevices()
+	writeJSON(w, http.StatusOK, group)
+}
+
+func (s *server) handleDeleteDeviceGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.db.DeleteDeviceGroup(id); err != nil {
+		writeDBError(w, "delete device group", err)
+		return
+	}
+	proxy.InvalidateDevices()
+	w.WriteHeader(http.StatusNoContent)
+}
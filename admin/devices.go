@@ -0,0 +1,263 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// deviceRequest creates a device or changes the fields that are set. A group_id of all zeros removes the
+// device from its group.
+type deviceRequest struct {
+	UserID     uuid.UUID  `json:"user_id"` // only used when creating a device
+	Name       string     `json:"name"`
+	GroupID    *uuid.UUID `json:"group_id,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	PACBypass  []string   `json:"pac_bypass,omitempty"`
+	MITMBypass []string   `json:"mitm_bypass,omitempty"`
+	Addresses  []string   `json:"addresses,omitempty"` // ip or mac addresses, for transparent mode
+	SafeSearch *bool      `json:"safe_search,omitempty"`
+}
+
+type pacResponse struct {
+	Script string     `json:"script"`
+	PAC    *proxy.PAC `json:"pac"`
+	Host   string     `json:"host,omitempty"`
+	Result string     `json:"result,omitempty"` // what the pac file returns for the host
+}
+
+func (s *server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	var devices []*database.Device
+	var err error
+	access := principalFrom(r).Access
+	if v := r.URL.Query().Get("user"); v != "" {
+		userID, perr := uuid.Parse(v)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("parse user: %w", perr))
+			return
+		}
+		if !checkView(w, r, userID, "user") {
+			return
+		}
+		devices, err = s.db.GetDevicesByUserID(userID)
+	} else if access.IsAdmin() {
+		devices, err = s.db.GetDevices()
+	} else {
+		devices, err = s.db.GetDevicesByUserIDs(access.UserIDs())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get devices: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *server) handleGetDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	device, ok := s.deviceFor(w, r, id, checkView)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, device)
+}
+
+func (s *server) handleCreateDevice(w http.ResponseWriter, r *http.Request) {
+	var req deviceRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode device: %w", err))
+		return
+	}
+	if req.Name == "" || req.UserID == uuid.Nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user_id and name are required"))
+		return
+	}
+	if !checkManage(w, r, req.UserID, "user") {
+		return
+	}
+	if _, err := s.db.GetUserByID(req.UserID); err != nil {
+		writeDBError(w, "get user", err)
+		return
+	}
+	device := &database.Device{}
+	if !s.applyDeviceRequest(w, r, device, req) {
+		return
+	}
+	id, err := s.db.InsertDevice(req.UserID, device.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert device: %w", err))
+		return
+	}
+	if device.GroupID != nil || device.Tags != nil || device.PACBypass != nil || device.MITMBypass != nil || device.Addresses != nil || device.SafeSearch {
+		device.ID = id
+		if err := s.db.UpdateDevice(device); err != nil {
+			writeDBError(w, "update device", err)
+			return
+		}
+	}
+	s.writeDevice(w, http.StatusCreated, id)
+}
+
+func (s *server) handleUpdateDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req deviceRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode device: %w", err))
+		return
+	}
+	device, ok := s.deviceFor(w, r, id, checkManage)
+	if !ok || !s.applyDeviceRequest(w, r, device, req) {
+		return
+	}
+	if err := s.db.UpdateDevice(device); err != nil {
+		writeDBError(w, "update device", err)
+		return
+	}
+	proxy.InvalidateDevice(id)
+	s.writeDevice(w, http.StatusOK, id)
+}
+
+func (s *server) handleDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// managing a device is enough to change it, but deleting it takes administering its owner
+	device, ok := s.deviceFor(w, r, id, checkView)
+	if !ok {
+		return
+	}
+	if _, ok := s.checkAdminister(w, r, device.User.ID); !ok {
+		return
+	}
+	if err := s.db.DeleteDevice(id); err != nil {
+		writeDBError(w, "delete device", err)
+		return
+	}
+	proxy.InvalidateDevice(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDevicePAC returns the proxy auto-config file of the device and, with the host query parameter,
+// whether the device will send requests for the host through the proxy.
+func (s *server) handleDevicePAC(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	device, ok := s.deviceFor(w, r, id, checkView)
+	if !ok {
+		return
+	}
+	addr := config.DefaultConfig.PublicAddr
+	if addr == "" {
+		addr = config.DefaultConfig.Addr
+	}
+	resp := pacResponse{PAC: proxy.NewPAC(device, addr), Host: r.URL.Query().Get("host")}
+	resp.Script = resp.PAC.Script()
+	if resp.Host != "" {
+		resp.Result = resp.PAC.FindProxy(resp.Host)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// applyDeviceRequest sets the fields of device that are set in req. It writes the error response and
+// returns false if the group doesn't exist or an address is invalid. Only admins can change groups, tags,
+// bypass lists, safe search and addresses, since otherwise a device could be taken out of the rules of its
+// group or out of the proxy, or take the traffic of another device in transparent mode.
+func (s *server) applyDeviceRequest(w http.ResponseWriter, r *http.Request, device *database.Device, req deviceRequest) bool {
+	if (req.GroupID != nil || req.Tags != nil || req.PACBypass != nil || req.MITMBypass != nil || req.Addresses != nil || req.SafeSearch != nil) && !principalFrom(r).Access.IsAdmin() {
+		writeError(w, http.StatusForbidden, fmt.Errorf("only admins can change device groups, tags, bypass lists, safe search and addresses"))
+		return false
+	}
+	if req.PACBypass != nil {
+		device.PACBypass = req.PACBypass
+	}
+	if req.MITMBypass != nil {
+		device.MITMBypass = req.MITMBypass
+	}
+	if req.Addresses != nil {
+		addrs, err := normalizeAddresses(req.Addresses)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return false
+		}
+		device.Addresses = addrs
+	}
+	if req.SafeSearch != nil {
+		device.SafeSearch = *req.SafeSearch
+	}
+	if req.Name != "" {
+		device.Name = req.Name
+	}
+	if req.Tags != nil {
+		device.Tags = slices.Compact(slices.Sorted(slices.Values(req.Tags)))
+	}
+	if req.GroupID == nil {
+		return true
+	}
+	if *req.GroupID == uuid.Nil {
+		device.GroupID = nil
+		return true
+	}
+	if _, err := s.db.GetDeviceGroupByID(*req.GroupID); err != nil {
+		writeDBError(w, "get device group", err)
+		return false
+	}
+	device.GroupID = req.GroupID
+	return true
+}
+
+// normalizeAddresses checks that each address is an ip or mac address and writes them the way the proxy
+// looks them up.
+func normalizeAddresses(addrs []string) ([]string, error) {
+	normalized := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if ip := net.ParseIP(strings.TrimSpace(a)); ip != nil {
+			normalized = append(normalized, ip.String())
+		} else if mac, err := net.ParseMAC(strings.TrimSpace(a)); err == nil {
+			normalized = append(normalized, mac.String())
+		} else {
+			return nil, fmt.Errorf("invalid ip or mac address: %q", a)
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(normalized))), nil
+}
+
+// deviceFor gets the device and checks access to it with check (checkView or checkManage).
+func (s *server) deviceFor(w http.ResponseWriter, r *http.Request, id uuid.UUID, check func(http.ResponseWriter, *http.Request, uuid.UUID, string) bool) (*database.Device, bool) {
+	device, err := s.db.GetDeviceByID(id)
+	if err != nil {
+		writeDBError(w, "get device", err)
+		return nil, false
+	}
+	if !check(w, r, device.User.ID, "device") {
+		return nil, false
+	}
+	return device, true
+}
+
+func (s *server) writeDevice(w http.ResponseWriter, status int, id uuid.UUID) {
+	device, err := s.db.GetDeviceByID(id)
+	if err != nil {
+		writeDBError(w, "get device", err)
+		return
+	}
+	writeJSON(w, status, device)
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+type enrollmentRequest struct {
+	UserID     uuid.UUID `json:"user_id"`
+	DeviceName string    `json:"device_name"`
+}
+
+// enrollmentResponse is the enrollment with its code, which is only returned when it is created.
+type enrollmentResponse struct {
+	*database.Enrollment
+	Code      string `json:"code"`
+	EnrollURL string `json:"enroll_url"` // where the device enters the code, through the proxy
+}
+
+type credentialsResponse struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (s *server) handleListEnrollments(w http.ResponseWriter, r *http.Request) {
+	var enrollments []*database.Enrollment
+	var err error
+	if access := principalFrom(r).Access; access.IsAdmin() {
+		enrollments, err = s.db.GetPendingEnrollments()
+	} else {
+		enrollments, err = s.db.GetPendingEnrollmentsByUserIDs(access.UserIDs())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get enrollments: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, enrollments)
+}
+
+// handleCreateEnrollment creates a one-time code that a device can use to add itself for the user.
+func (s *server) handleCreateEnrollment(w http.ResponseWriter, r *http.Request) {
+	var req enrollmentRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode enrollment: %w", err))
+		return
+	}
+	if req.DeviceName == "" || req.UserID == uuid.Nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("user_id and device_name are required"))
+		return
+	}
+	if !checkManage(w, r, req.UserID, "user") {
+		return
+	}
+	if _, err := s.db.GetUserByID(req.UserID); err != nil {
+		writeDBError(w, "get user", err)
+		return
+	}
+
+	code := auth.NewEnrollmentCode()
+	e := &database.Enrollment{
+		User:       database.User{ID: req.UserID},
+		DeviceName: req.DeviceName,
+		ExpiresAt:  time.Now().Add(time.Duration(config.DefaultConfig.Enroll.CodeTTLMinutes) * time.Minute),
+	}
+	id, err := s.db.InsertEnrollment(e, auth.HashEnrollmentCode(code))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert enrollment: %w", err))
+		return
+	}
+	if e, err = s.db.GetEnrollmentByID(id); err != nil {
+		writeDBError(w, "get enrollment", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, enrollmentResponse{Enrollment: e, Code: code, EnrollURL: "http://" + config.DefaultConfig.Enroll.Host + "/"})
+}
+
+func (s *server) handleDeleteEnrollment(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	e, err := s.db.GetEnrollmentByID(id)
+	if err != nil {
+		writeDBError(w, "get enrollment", err)
+		return
+	}
+	if !checkManage(w, r, e.User.ID, "enrollment") {
+		return
+	}
+	if err := s.db.DeleteEnrollment(id); err != nil {
+		writeDBError(w, "delete enrollment", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetDeviceCredentials gives the device a new proxy password, e.g. if it leaked or the device was
+// added before enrollment existed. The old password stops working immediately.
+func (s *server) handleResetDeviceCredentials(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := s.deviceFor(w, r, id, checkManage); !ok {
+		return
+	}
+	secret, hash := auth.NewToken("")
+	if err := s.db.UpdateDeviceProxySecret(id, hash); err != nil {
+		writeDBError(w, "update device", err)
+		return
+	}
+	proxy.InvalidateDevice(id)
+	writeJSON(w, http.StatusOK, credentialsResponse{Username: id.String(), Password: secret})
+}
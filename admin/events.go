@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+const (
+	eventBuffer       = 256
+	keepAliveInterval = 15 * time.Second
+)
+
+// handleEvents streams proxied requests as server-sent events. The stream can be filtered with the
+// device, rule and host query parameters. Users who aren't admins only get the events of the devices they
+// can view (as of when the stream started).
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var filter proxy.Filter
+	q := r.URL.Query()
+	for _, p := range []struct {
+		key string
+		dst **uuid.UUID
+	}{{"device", &filter.DeviceID}, {"rule", &filter.RuleID}} {
+		if v := q.Get(p.key); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("parse %s: %w", p.key, err))
+				return
+			}
+			*p.dst = &id
+		}
+	}
+	filter.Host = q.Get("host")
+
+	var visible map[uuid.UUID]bool // nil if every device is visible
+	if access := principalFrom(r).Access; !access.IsAdmin() {
+		devices, err := s.db.GetDevicesByUserIDs(access.UserIDs())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("get devices: %w", err))
+			return
+		}
+		visible = make(map[uuid.UUID]bool, len(devices))
+		for _, d := range devices {
+			visible[d.ID] = true
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	sub := proxy.Events.Subscribe(filter, eventBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	var reportedDropped uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-sub.C:
+			if visible != nil && (e.DeviceID == nil || !visible[*e.DeviceID]) {
+				continue
+			}
+			if dropped := sub.Dropped(); dropped != reportedDropped {
+				// let the client know it missed events because it could not keep up
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped-reportedDropped)
+				reportedDropped = dropped
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: request\nid: %s\ndata: %s\n\n", e.ID, data)
+		}
+		flusher.Flush()
+	}
+}
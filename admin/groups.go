@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+type groupRequest struct {
+	Name string `json:"name"`
+}
+
+type groupMemberRequest struct {
+	Manager bool `json:"manager"` // managers can manage the devices and rules of the other members
+}
+
+// handleListGroups lists every group for admins and the groups the authenticated user is in otherwise.
+func (s *server) handleListGroups(w http.ResponseWriter, r *http.Request) {
+	var groups []*database.Group
+	var err error
+	if p := principalFrom(r); p.Access.IsAdmin() {
+		groups, err = s.db.GetGroups()
+	} else {
+		groups, err = s.db.GetGroupsByUserID(p.User.ID)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get groups: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (s *server) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode group: %w", err))
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is required"))
+		return
+	}
+	id, err := s.db.InsertGroup(req.Name)
+	if errors.Is(err, database.ErrGroupNameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert group: %w", err))
+		return
+	}
+	s.writeGroup(w, http.StatusCreated, id)
+}
+
+func (s *server) handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.db.DeleteGroup(id); err != nil {
+		writeDBError(w, "delete group", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSaveGroupMember adds a user to a group or changes whether they manage it.
+func (s *server) handleSaveGroupMember(w http.ResponseWriter, r *http.Request) {
+	id, userID, ok := groupMemberPath(w, r)
+	if !ok {
+		return
+	}
+	var req groupMemberRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode member: %w", err))
+		return
+	}
+	if _, err := s.db.GetGroupByID(id); err != nil {
+		writeDBError(w, "get group", err)
+		return
+	}
+	if _, err := s.db.GetUserByID(userID); err != nil {
+		writeDBError(w, "get user", err)
+		return
+	}
+	if err := s.db.SaveGroupMember(id, userID, req.Manager); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("save group member: %w", err))
+		return
+	}
+	s.writeGroup(w, http.StatusOK, id)
+}
+
+func (s *server) handleDeleteGroupMember(w http.ResponseWriter, r *http.Request) {
+	id, userID, ok := groupMemberPath(w, r)
+	if !ok {
+		return
+	}
+	if err := s.db.DeleteGroupMember(id, userID); err != nil {
+		writeDBError(w, "delete group member", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func groupMemberPath(w http.ResponseWriter, r *http.Request) (id, userID uuid.UUID, ok bool) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return uuid.Nil, uuid.Nil, false
+	}
+	userID, err = uuid.Parse(r.PathValue("user_id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parse user: %w", err))
+		return uuid.Nil, uuid.Nil, false
+	}
+	return id, userID, true
+}
+
+func (s *server) writeGroup(w http.ResponseWriter, status int, id uuid.UUID) {
+	group, err := s.db.GetGroupByID(id)
+	if err != nil {
+		writeDBError(w, "get group", err)
+		return
+	}
+	writeJSON(w, status, group)
+}
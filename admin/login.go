@@ -0,0 +1,110 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+type loginRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	TOTPCode     string `json:"totp_code,omitempty"`     // required if the user has totp enabled
+	RecoveryCode string `json:"recovery_code,omitempty"` // can be used instead of a totp code
+}
+
+var errInvalidLogin = fmt.Errorf("invalid username or password")
+
+// dummyHash is verified against when a username doesn't exist, so that the response time doesn't reveal
+// which usernames exist.
+var dummyHash = sync.OnceValue(func() string {
+	h, _ := auth.HashPassword("hat", auth.ConfiguredParams())
+	return h
+})
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode login: %w", err))
+		return
+	}
+
+	throttleKeys := []string{"user:" + strings.ToLower(req.Username), "ip:" + remoteIP(r)}
+	if ok, wait := s.throttler.Allow(throttleKeys...); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("too many failed logins, try again in %s", wait.Round(time.Second)))
+		return
+	}
+
+	user, err := s.db.GetUserByUsername(req.Username)
+	if err != nil {
+		auth.VerifyPassword(req.Password, dummyHash())
+		s.throttler.Failure(throttleKeys...)
+		writeError(w, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	ok, err := auth.VerifyPassword(req.Password, user.HashedPassword)
+	if err != nil {
+		slog.Error("verify password", "user", user.ID, "error", err)
+	}
+	if !ok {
+		s.throttler.Failure(throttleKeys...)
+		writeError(w, http.StatusUnauthorized, errInvalidLogin)
+		return
+	}
+	if user.TOTPEnabled {
+		if req.TOTPCode == "" && req.RecoveryCode == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "two-factor code required", "totp_required": true})
+			return
+		}
+		if err := s.verifySecondFactor(user, req.TOTPCode, req.RecoveryCode); err != nil {
+			s.throttler.Failure(throttleKeys...)
+			writeJSON(w, http.StatusUnauthorized, map[string]any{"error": err.Error(), "totp_required": true})
+			return
+		}
+	}
+	s.throttler.Success(throttleKeys...)
+
+	sess, err := s.startSession(w, r, user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionResponse{
+		User:              user,
+		Scope:             auth.ScopeFullAdmin,
+		CSRFToken:         sess.CSRFToken,
+		TOTPSetupRequired: needsTOTPSetup(user),
+	})
+}
+
+type ruleOptions struct {
+	Fields     []string `json:"fields"`
+	Operators  []string `json:"operators"`
+	Triggers   []string `json:"triggers"`
+	Actions    []string `json:"actions"`
+	Scopes     []string `json:"scopes"`
+	Categories []string `json:"categories"` // values of ctx-category
+	Upstreams  []string `json:"upstreams"`  // names route_via can use
+}
+
+// handleRuleOptions lists what can be used in a rule, for the dashboard's rule editor.
+func (s *server) handleRuleOptions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ruleOptions{
+		Fields:     database.Fields,
+		Operators:  []string{database.OperatorAND, database.OperatorOR, database.OperatorEQ, database.OperatorCT, database.OperatorIn},
+		Triggers:   []string{database.TriggerIncomingRequest, database.TriggerRecievedMITMRequest},
+		Actions:    []string{database.ActionBlockRequest, database.ActionBlockIP, database.ActionRedirect, database.ActionAllow, database.ActionRouteVia},
+		Scopes:     database.RuleScopes,
+		Categories: proxy.CategoryNames(),
+		Upstreams:  proxy.UpstreamNames(),
+	})
+}
@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"encoding"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument(s.routes()))
+}
+
+// openAPIDocument generates an openapi 3 document from the routes, deriving schemas from the request and
+// response types with reflection.
+func openAPIDocument(routes []route) map[string]any {
+	paths := map[string]map[string]any{}
+	for _, rt := range routes {
+		op := map[string]any{
+			"summary": rt.Summary,
+		}
+
+		var params []map[string]any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if rt.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(rt.Request))}},
+			}
+		}
+
+		responses := map[string]any{}
+		switch {
+		case rt.Response != nil:
+			responses["200"] = map[string]any{
+				"description": "success",
+				"content":     map[string]any{"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(rt.Response))}},
+			}
+		case rt.Method == http.MethodDelete:
+			responses["204"] = map[string]any{"description": "success"}
+		default:
+			responses["200"] = map[string]any{"description": "success"}
+		}
+		if !rt.Public {
+			responses["401"] = map[string]any{"description": "authentication required"}
+			op["security"] = []map[string]any{{"bearer": []string{}}}
+		}
+		if rt.Admin {
+			responses["403"] = map[string]any{"description": "requires the owner or admin role"}
+		}
+		op["responses"] = responses
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = map[string]any{}
+		}
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "hat admin api",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// schemaFor returns the json schema for values of t as encoded by encoding/json.
+func schemaFor(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return schemaFor(t.Elem())
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"} // e.g uuid.UUID
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if f.Anonymous && name == "" {
+				for k, v := range schemaFor(f.Type)["properties"].(map[string]any) {
+					props[k] = v
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if f.Type == t || (f.Type.Kind() == reflect.Slice && f.Type.Elem() == t) {
+				props[name] = map[string]any{"type": "object"} // recursive type (e.g. sub-conditions)
+				if f.Type.Kind() == reflect.Slice {
+					props[name] = map[string]any{"type": "array", "items": map[string]any{"type": "object"}}
+				}
+				continue
+			}
+			props[name] = schemaFor(f.Type)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return map[string]any{} // any value
+}
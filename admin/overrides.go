@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+// maxOverrideDuration is the longest an override can last; anything longer should be a change to the rules.
+const maxOverrideDuration = 7 * 24 * time.Hour
+
+type overrideRequest struct {
+	Kind    string    `json:"kind"`   // see database.OverrideKinds
+	Target  uuid.UUID `json:"target"` // the rule for pause_rule, otherwise the device
+	Minutes int       `json:"minutes"`
+}
+
+// handleListOverrides lists the active overrides. Users who aren't admins see the ones for devices and
+// rules they can view.
+func (s *server) handleListOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides, err := s.db.GetActiveOverrides()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get overrides: %w", err))
+		return
+	}
+	access := principalFrom(r).Access
+	if access.IsAdmin() {
+		writeJSON(w, http.StatusOK, overrides)
+		return
+	}
+	devices, err := s.db.GetDevicesByUserIDs(access.UserIDs())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get devices: %w", err))
+		return
+	}
+	rules, err := s.db.GetRulesByUserIDs(access.UserIDs())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get rules: %w", err))
+		return
+	}
+	targets := make(map[uuid.UUID]bool, len(devices)+len(rules))
+	for _, d := range devices {
+		targets[d.ID] = true
+	}
+	for _, rule := range rules {
+		targets[rule.ID] = true
+	}
+	visible := []*database.Override{}
+	for _, o := range overrides {
+		if targets[o.Target] {
+			visible = append(visible, o)
+		}
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func (s *server) handleCreateOverride(w http.ResponseWriter, r *http.Request) {
+	var req overrideRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode override: %w", err))
+		return
+	}
+	duration := time.Duration(req.Minutes) * time.Minute
+	if duration <= 0 || duration > maxOverrideDuration {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("minutes must be between 1 and %d", int(maxOverrideDuration.Minutes())))
+		return
+	}
+	o := &database.Override{Kind: req.Kind, Target: req.Target, CreatedBy: principalUserID(r), ExpiresAt: time.Now().Add(duration)}
+	if err := o.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.checkOverrideTarget(w, r, o) {
+		return
+	}
+	id, err := s.db.InsertOverride(o)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert override: %w", err))
+		return
+	}
+	if o, err = s.db.GetOverrideByID(id); err != nil {
+		writeDBError(w, "get override", err)
+		return
+	}
+	proxy.InvalidateOverrides()
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// handleDeleteOverride ends an override before it expires.
+func (s *server) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	o, err := s.db.GetOverrideByID(id)
+	if err != nil {
+		writeDBError(w, "get override", err)
+		return
+	}
+	if !s.checkOverrideTarget(w, r, o) {
+		return
+	}
+	if err := s.db.DeleteOverride(id); err != nil {
+		writeDBError(w, "delete override", err)
+		return
+	}
+	proxy.InvalidateOverrides()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkOverrideTarget writes an error and returns false if the authenticated user can't override what o
+// applies to. Pausing a rule needs the same access as changing it.
+func (s *server) checkOverrideTarget(w http.ResponseWriter, r *http.Request, o *database.Override) bool {
+	if o.Kind != database.OverridePauseRule {
+		_, ok := s.deviceFor(w, r, o.Target, checkManage)
+		return ok
+	}
+	rule, err := s.db.GetRuleByID(o.Target)
+	if err != nil {
+		writeDBError(w, "get rule", err)
+		return false
+	}
+	return checkManage(w, r, rule.User.ID, "rule") && s.checkRuleTarget(w, r, rule)
+}
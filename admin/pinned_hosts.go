@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+func (s *server) handleListPinnedHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := s.db.GetPinnedHosts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get pinned hosts: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+func (s *server) handleDeletePinnedHost(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.DeletePinnedHost(strings.ToLower(r.PathValue("host"))); err != nil {
+		writeDBError(w, "delete pinned host", err)
+		return
+	}
+	proxy.InvalidatePinnedHosts()
+	w.WriteHeader(http.StatusNoContent)
+}
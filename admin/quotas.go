@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+// handleListQuotas lists every quota for admins. Other users see the quotas that apply to devices they
+// can view.
+func (s *server) handleListQuotas(w http.ResponseWriter, r *http.Request) {
+	quotas, err := s.db.GetQuotas()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get quotas: %w", err))
+		return
+	}
+	access := principalFrom(r).Access
+	if access.IsAdmin() {
+		writeJSON(w, http.StatusOK, quotas)
+		return
+	}
+	devices, err := s.db.GetDevicesByUserIDs(access.UserIDs())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get devices: %w", err))
+		return
+	}
+	targets := make(map[uuid.UUID]bool)
+	for _, d := range devices {
+		targets[d.ID] = true
+		if d.GroupID != nil {
+			targets[*d.GroupID] = true
+		}
+	}
+	visible := []*database.Quota{}
+	for _, q := range quotas {
+		if targets[q.Target] {
+			visible = append(visible, q)
+		}
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func (s *server) handleCreateQuota(w http.ResponseWriter, r *http.Request) {
+	var q database.Quota
+	if err := readJSON(r, &q); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode quota: %w", err))
+		return
+	}
+	if err := q.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.checkQuotaTarget(w, r, &q) {
+		return
+	}
+	id, err := s.db.InsertQuota(&q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert quota: %w", err))
+		return
+	}
+	quota, err := s.db.GetQuotaByID(id)
+	if err != nil {
+		writeDBError(w, "get quota", err)
+		return
+	}
+	proxy.InvalidateQuotas()
+	writeJSON(w, http.StatusCreated, quota)
+}
+
+func (s *server) handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q, err := s.db.GetQuotaByID(id)
+	if err != nil {
+		writeDBError(w, "get quota", err)
+		return
+	}
+	if !s.checkQuotaTarget(w, r, q) {
+		return
+	}
+	if err := s.db.DeleteQuota(id); err != nil {
+		writeDBError(w, "delete quota", err)
+		return
+	}
+	proxy.InvalidateQuotas()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkQuotaTarget writes an error and returns false if the authenticated user can't change quotas of what
+// q applies to. Device quotas can be changed by whoever manages the device, group quotas only by admins.
+func (s *server) checkQuotaTarget(w http.ResponseWriter, r *http.Request, q *database.Quota) bool {
+	if q.Scope == database.QuotaScopeDevice {
+		_, ok := s.deviceFor(w, r, q.Target, checkManage)
+		return ok
+	}
+	if _, err := s.db.GetDeviceGroupByID(q.Target); err != nil {
+		writeDBError(w, "get device group", err)
+		return false
+	}
+	if !principalFrom(r).Access.IsAdmin() {
+		writeError(w, http.StatusForbidden, fmt.Errorf("only admins can change group quotas"))
+		return false
+	}
+	return true
+}
+
+func (s *server) handleDeviceQuotas(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	device, ok := s.deviceFor(w, r, id, checkView)
+	if !ok {
+		return
+	}
+	statuses, err := proxy.QuotaStatuses(device)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
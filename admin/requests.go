@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+func (s *server) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	limit := min(queryInt(r, "limit", 100), 1000)
+	var requests []*database.LoggedRequest
+	var err error
+	access := principalFrom(r).Access
+	if v := r.URL.Query().Get("device"); v != "" {
+		deviceID, perr := uuid.Parse(v)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("parse device: %w", perr))
+			return
+		}
+		if !access.IsAdmin() {
+			if _, ok := s.deviceFor(w, r, deviceID, checkView); !ok {
+				return
+			}
+		}
+		requests, err = s.db.GetRecentLoggedRequestsByDeviceID(deviceID, limit)
+	} else if access.IsAdmin() {
+		requests, err = s.db.GetRecentLoggedRequests(limit)
+	} else {
+		requests, err = s.db.GetRecentLoggedRequestsByUserIDs(access.UserIDs(), limit)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get recent requests: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (s *server) handleGetRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	request, ok := s.requestFor(w, r, id, checkView)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, request)
+}
+
+// handleRequestFrames lists the logged frames of a websocket connection, by the request of its handshake.
+func (s *server) handleRequestFrames(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := s.requestFor(w, r, id, checkView); !ok {
+		return
+	}
+	frames, err := s.db.GetWebSocketFrames(id, min(queryInt(r, "limit", 500), 5000))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get websocket frames: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, frames)
+}
+
+// requestFor gets the logged request and checks access to the user whose device made it with check
+// (checkView or checkManage).
+func (s *server) requestFor(w http.ResponseWriter, r *http.Request, id uuid.UUID, check func(http.ResponseWriter, *http.Request, uuid.UUID, string) bool) (*database.LoggedRequest, bool) {
+	request, err := s.db.GetLoggedRequestByID(id)
+	if err != nil {
+		writeDBError(w, "get request", err)
+		return nil, false
+	}
+	owner, err := s.requestOwner(request)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get request device: %w", err))
+		return nil, false
+	}
+	if !check(w, r, owner, "request") {
+		return nil, false
+	}
+	return request, true
+}
+
+func (s *server) handleReplayRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// replaying sends traffic as the device, so it needs the same access as changing its rules
+	if _, ok := s.requestFor(w, r, id, checkManage); !ok {
+		return
+	}
+	var mod proxy.Modification
+	if err := readJSON(r, &mod); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode modification: %w", err))
+		return
+	}
+	result, err := proxy.Replay(s.db, id, mod)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("request not found"))
+		return
+	} else if errors.Is(err, proxy.ErrInvalidTarget) || errors.Is(err, proxy.ErrTruncatedBody) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, proxy.ErrForbiddenTarget) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,173 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+func (s *server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	var rules []*database.Rule
+	var err error
+	access := principalFrom(r).Access
+	if v := r.URL.Query().Get("user"); v != "" {
+		userID, perr := uuid.Parse(v)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("parse user: %w", perr))
+			return
+		}
+		if !checkView(w, r, userID, "user") {
+			return
+		}
+		rules, err = s.db.GetRulesByUserID(userID)
+	} else if access.IsAdmin() {
+		rules, err = s.db.GetRules()
+	} else {
+		rules, err = s.db.GetRulesByUserIDs(access.UserIDs())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get rules: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func (s *server) handleGetRule(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rule, err := s.db.GetRuleByID(id)
+	if err != nil {
+		writeDBError(w, "get rule", err)
+		return
+	}
+	if !checkView(w, r, rule.User.ID, "rule") {
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *server) handleCreateRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := s.readRule(w, r)
+	if !ok {
+		return
+	}
+	id, err := s.db.InsertRule(rule)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert rule: %w", err))
+		return
+	}
+	rule.ID = id
+	proxy.InvalidateRules()
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (s *server) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	existing, err := s.db.GetRuleByID(id)
+	if err != nil {
+		writeDBError(w, "get rule", err)
+		return
+	}
+	if !checkManage(w, r, existing.User.ID, "rule") {
+		return
+	}
+	rule, ok := s.readRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = id
+	rule.User = existing.User // rules can't be moved between users
+	if err := s.db.UpdateRule(rule); err != nil {
+		writeDBError(w, "update rule", err)
+		return
+	}
+	proxy.InvalidateRules()
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rule, err := s.db.GetRuleByID(id)
+	if err != nil {
+		writeDBError(w, "get rule", err)
+		return
+	}
+	if !checkManage(w, r, rule.User.ID, "rule") {
+		return
+	}
+	if err := s.db.DeleteRule(id); err != nil {
+		writeDBError(w, "delete rule", err)
+		return
+	}
+	proxy.InvalidateRules()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readRule decodes and validates a rule from the request body. It writes the error response and returns
+// false if the rule is invalid.
+func (s *server) readRule(w http.ResponseWriter, r *http.Request) (*database.Rule, bool) {
+	var rule database.Rule
+	if err := readJSON(r, &rule); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode rule: %w", err))
+		return nil, false
+	}
+	if err := rule.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if name, _ := rule.RuleAction.Data.(string); rule.RuleAction.Type == database.ActionRouteVia && !proxy.IsUpstream(name) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: unknown upstream proxy: %s", database.ErrInvalidAction, name))
+		return nil, false
+	}
+	if r.Method == http.MethodPost {
+		if !checkManage(w, r, rule.User.ID, "user") {
+			return nil, false
+		}
+		if _, err := s.db.GetUserByID(rule.User.ID); err != nil {
+			writeDBError(w, "get user", err)
+			return nil, false
+		}
+	}
+	if !s.checkRuleTarget(w, r, &rule) {
+		return nil, false
+	}
+	return &rule, true
+}
+
+// checkRuleTarget writes an error and returns false if the authenticated user can't manage what the rule
+// applies to. Group and tag rules can apply to anyone's devices, so only admins can create them.
+func (s *server) checkRuleTarget(w http.ResponseWriter, r *http.Request, rule *database.Rule) bool {
+	switch rule.Scope {
+	case database.RuleScopeDevice:
+		id, _ := uuid.Parse(rule.Target) // validated
+		_, ok := s.deviceFor(w, r, id, checkManage)
+		return ok
+	case database.RuleScopeGroup:
+		id, _ := uuid.Parse(rule.Target)
+		if _, err := s.db.GetDeviceGroupByID(id); err != nil {
+			writeDBError(w, "get device group", err)
+			return false
+		}
+		fallthrough
+	case database.RuleScopeTag:
+		if !principalFrom(r).Access.IsAdmin() {
+			writeError(w, http.StatusForbidden, fmt.Errorf("only admins can create %s rules", rule.Scope))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+const (
+	sessionCookie   = "hat_session"
+	sessionLifetime = 12 * time.Hour
+)
+
+// sessionResponse is returned when logging in and by /api/me. The dashboard needs the csrf token to make
+// changes.
+type sessionResponse struct {
+	User              *database.User `json:"user"`
+	Scope             string         `json:"scope"`
+	CSRFToken         string         `json:"csrf_token,omitempty"`
+	TOTPSetupRequired bool           `json:"totp_setup_required,omitempty"` // nothing else can be used until totp is set up
+}
+
+// startSession creates a session for the user and sets the session cookie.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, user *database.User) (*database.Session, error) {
+	token, hash := auth.NewToken("")
+	csrf, _ := auth.NewToken("")
+	sess := &database.Session{
+		User:      *user,
+		CSRFToken: csrf,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+	var err error
+	if sess.ID, err = s.db.InsertSession(sess, hash); err != nil {
+		return nil, fmt.Errorf("insert session: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return sess, nil
+}
+
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	if p.Session != nil {
+		if err := s.db.RevokeSession(p.Session.ID, p.User.ID); err != nil {
+			writeDBError(w, "revoke session", err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMe returns the authenticated user. Requests authenticated with the configured api token get an
+// empty user.
+func (s *server) handleMe(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	resp := sessionResponse{User: p.User, Scope: p.Scope, TOTPSetupRequired: p.NeedsTOTPSetup}
+	if p.User == nil {
+		resp.User = &database.User{}
+	}
+	if p.Session != nil {
+		resp.CSRFToken = p.Session.CSRFToken
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	if p.User == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the configured api token has no sessions"))
+		return
+	}
+	sessions, err := s.db.GetActiveSessionsByUserID(p.User.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get sessions: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if p.User == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("revoke session: not found"))
+		return
+	}
+	if err := s.db.RevokeSession(id, p.User.ID); err != nil {
+		writeDBError(w, "revoke session", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cleanup periodically deletes long expired sessions and expired overrides.
+func (s *server) cleanup() {
+	for range time.Tick(time.Hour) {
+		if err := s.db.DeleteExpiredSessions(); err != nil {
+			slog.Error("delete expired sessions", "error", err)
+		}
+		if err := s.db.DeleteExpiredOverrides(); err != nil {
+			slog.Error("delete expired overrides", "error", err)
+		}
+	}
+}
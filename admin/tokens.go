@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+const apiTokenPrefix = "hat_"
+
+type tokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type tokenResponse struct {
+	database.APIToken
+	Token string `json:"token"` // only ever returned when the token is created
+}
+
+func (s *server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	if p.User == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("api tokens belong to users"))
+		return
+	}
+	tokens, err := s.db.GetAPITokensByUserID(p.User.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get api tokens: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (s *server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	if p.User == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("api tokens belong to users"))
+		return
+	}
+	var req tokenRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode token: %w", err))
+		return
+	}
+	if req.Name == "" || !slices.Contains(auth.Scopes, req.Scope) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name and a scope (%v) are required", auth.Scopes))
+		return
+	}
+	if !auth.ScopeAllows(p.Scope, req.Scope) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("can't create a token with more access than your own"))
+		return
+	}
+
+	token, hash := auth.NewToken(apiTokenPrefix)
+	t := database.APIToken{User: *p.User, Name: req.Name, Scope: req.Scope}
+	id, err := s.db.InsertAPIToken(&t, hash)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert api token: %w", err))
+		return
+	}
+	t.ID = id
+	writeJSON(w, http.StatusCreated, tokenResponse{APIToken: t, Token: token})
+}
+
+func (s *server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if p.User == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("revoke api token: not found"))
+		return
+	}
+	if err := s.db.RevokeAPIToken(id, p.User.ID); err != nil {
+		writeDBError(w, "revoke api token", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,240 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+const recoveryCodeCount = 10
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"` // for typing into an authenticator app instead of scanning the qr code
+	URI    string `json:"uri"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"` // only ever returned once
+}
+
+func needsTOTPSetup(user *database.User) bool {
+	return config.DefaultConfig.Auth.RequireTOTP && user != nil && !user.TOTPEnabled
+}
+
+// verifySecondFactor checks a totp code (or, if it is empty, a recovery code) of a user with totp enabled.
+func (s *server) verifySecondFactor(user *database.User, code, recoveryCode string) error {
+	if code == "" {
+		ok, err := s.db.UseRecoveryCode(user.ID, auth.HashRecoveryCode(recoveryCode))
+		if err != nil {
+			return fmt.Errorf("use recovery code: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("invalid recovery code")
+		}
+		slog.Info("recovery code used", "user", user.ID)
+		return nil
+	}
+	return s.useTOTPCode(user, code)
+}
+
+// useTOTPCode checks a totp code and records it as used so it can't be replayed.
+func (s *server) useTOTPCode(user *database.User, code string) error {
+	step, ok := auth.VerifyTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return fmt.Errorf("invalid two-factor code")
+	}
+	fresh, err := s.db.UseTOTPStep(user.ID, step)
+	if err != nil {
+		return fmt.Errorf("use totp step: %w", err)
+	}
+	if !fresh {
+		return fmt.Errorf("two-factor code was already used")
+	}
+	return nil
+}
+
+// sessionUser returns the user of a dashboard session. Two-factor settings can't be changed with api
+// tokens, so a stolen token can't be used to lock the user out.
+func sessionUser(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	p := principalFrom(r)
+	if p.Session == nil {
+		writeError(w, http.StatusForbidden, fmt.Errorf("two-factor authentication can only be managed from a dashboard session"))
+		return nil, false
+	}
+	return p.User, true
+}
+
+func (s *server) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		writeError(w, http.StatusConflict, fmt.Errorf("two-factor authentication is already enabled"))
+		return
+	}
+	secret := auth.NewTOTPSecret()
+	if err := s.db.UpdateUserTOTP(user.ID, secret, false); err != nil {
+		writeDBError(w, "update totp", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, totpEnrollResponse{
+		Secret: secret,
+		URI:    auth.TOTPProvisioningURI(config.DefaultConfig.Auth.TOTPIssuer, user.Username, secret),
+	})
+}
+
+// handleTOTPQRCode renders the provisioning uri as a png. It is only available while enrolling, so the
+// secret can't be read again once totp is enabled.
+func (s *server) handleTOTPQRCode(w http.ResponseWriter, r *http.Request) {
+	user, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no two-factor enrollment in progress"))
+		return
+	}
+	png, err := qrcode.Encode(auth.TOTPProvisioningURI(config.DefaultConfig.Auth.TOTPIssuer, user.Username, user.TOTPSecret), qrcode.Medium, 256)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("encode qr code: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+func (s *server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	var req totpCodeRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode code: %w", err))
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		writeError(w, http.StatusConflict, fmt.Errorf("no two-factor enrollment in progress"))
+		return
+	}
+	// proving the authenticator app has the secret before enabling it makes sure the user isn't locked out
+	step, ok := auth.VerifyTOTP(user.TOTPSecret, req.Code, time.Now())
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid two-factor code"))
+		return
+	}
+	if err := s.db.UpdateUserTOTP(user.ID, user.TOTPSecret, true); err != nil {
+		writeDBError(w, "update totp", err)
+		return
+	}
+	if _, err := s.db.UseTOTPStep(user.ID, step); err != nil {
+		slog.Error("use totp step", "user", user.ID, "error", err)
+	}
+	s.writeNewRecoveryCodes(w, user)
+}
+
+func (s *server) handleTOTPRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if !s.checkCurrentTOTP(w, r, user) {
+		return
+	}
+	s.writeNewRecoveryCodes(w, user)
+}
+
+func (s *server) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := sessionUser(w, r)
+	if !ok {
+		return
+	}
+	if config.DefaultConfig.Auth.RequireTOTP {
+		writeError(w, http.StatusForbidden, fmt.Errorf("two-factor authentication is required"))
+		return
+	}
+	if !s.checkCurrentTOTP(w, r, user) {
+		return
+	}
+	if err := s.disableTOTP(user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetTOTP lets an admin turn off two-factor authentication for a user who lost their authenticator.
+// The user is logged out everywhere.
+func (s *server) handleResetTOTP(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := s.checkAdminister(w, r, id); !ok {
+		return
+	}
+	if err := s.disableTOTP(id); err != nil {
+		writeDBError(w, "reset totp", err)
+		return
+	}
+	if err := s.db.RevokeSessionsByUserID(id); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("revoke sessions: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) disableTOTP(userID uuid.UUID) error {
+	if err := s.db.UpdateUserTOTP(userID, "", false); err != nil {
+		return err
+	}
+	if err := s.db.DeleteRecoveryCodes(userID); err != nil {
+		return fmt.Errorf("delete recovery codes: %w", err)
+	}
+	return nil
+}
+
+// checkCurrentTOTP requires a valid totp code in the request body before changing two-factor settings.
+func (s *server) checkCurrentTOTP(w http.ResponseWriter, r *http.Request, user *database.User) bool {
+	var req totpCodeRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode code: %w", err))
+		return false
+	}
+	if !user.TOTPEnabled {
+		writeError(w, http.StatusConflict, fmt.Errorf("two-factor authentication is not enabled"))
+		return false
+	}
+	if err := s.useTOTPCode(user, req.Code); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func (s *server) writeNewRecoveryCodes(w http.ResponseWriter, user *database.User) {
+	codes := auth.NewRecoveryCodes(recoveryCodeCount)
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = auth.HashRecoveryCode(c)
+	}
+	if err := s.db.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("store recovery codes: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -0,0 +1,253 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+const minPasswordLength = 8
+
+type userRequest struct {
+	Username        string `json:"username,omitempty"` // only used when creating a user
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password,omitempty"` // required to change your own password
+	Role            string `json:"role,omitempty"`             // only used when creating a user, defaults to member
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// handleListUsers lists the users the authenticated user can view: everyone for admins, and themselves and
+// the users in groups they manage otherwise.
+func (s *server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetUsers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("get users: %w", err))
+		return
+	}
+	access := principalFrom(r).Access
+	users = slices.DeleteFunc(users, func(u *database.User) bool { return !access.CanView(u.ID) })
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !checkView(w, r, id, "user") {
+		return
+	}
+	user, err := s.db.GetUserByID(id)
+	if err != nil {
+		writeDBError(w, "get user", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, ok := s.checkAdminister(w, r, id)
+	if !ok || !s.checkNotLastOwner(w, user) {
+		return
+	}
+	if err := s.db.DeleteUser(id); err != nil {
+		writeDBError(w, "delete user", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode user: %w", err))
+		return
+	}
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("username is required"))
+		return
+	}
+	if req.Role == "" {
+		req.Role = database.RoleMember
+	}
+	if !slices.Contains(database.Roles, req.Role) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("role must be one of %s", strings.Join(database.Roles, ", ")))
+		return
+	}
+	if !principalFrom(r).Access.CanGrant(req.Role) {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	hash, ok := hashNewPassword(w, req.Password)
+	if !ok {
+		return
+	}
+	id, err := s.db.InsertUser(req.Username, hash, req.Role)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("insert user: %w", err))
+		return
+	}
+	user, err := s.db.GetUserByID(id)
+	if err != nil {
+		writeDBError(w, "get user", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// handleUpdatePassword changes the password of the authenticated user, who has to confirm the current one,
+// or of another user for admins.
+func (s *server) handleUpdatePassword(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p := principalFrom(r)
+	self := p.User != nil && p.User.ID == id
+	if !self {
+		if _, ok := s.checkAdminister(w, r, id); !ok {
+			return
+		}
+	}
+	var req userRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode password: %w", err))
+		return
+	}
+	if self && !s.checkCurrentPassword(w, r, p.User, req.CurrentPassword) {
+		return
+	}
+	hash, ok := hashNewPassword(w, req.Password)
+	if !ok {
+		return
+	}
+	if err := s.db.UpdateUserPassword(id, hash); err != nil {
+		writeDBError(w, "update password", err)
+		return
+	}
+	// log out everywhere in case the old password was compromised
+	if err := s.db.RevokeSessionsByUserID(id); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("revoke sessions: %w", err))
+		return
+	}
+	if err := s.db.RevokeAPITokensByUserID(id); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("revoke api tokens: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCurrentPassword writes an error and returns false if password isn't user's current password, so a
+// stolen session or token can't be turned into the account itself. Failures count towards the login
+// throttle of the user.
+func (s *server) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user *database.User, password string) bool {
+	if password == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("current_password is required"))
+		return false
+	}
+	throttleKeys := []string{"user:" + strings.ToLower(user.Username), "ip:" + remoteIP(r)}
+	if ok, wait := s.throttler.Allow(throttleKeys...); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("too many failed attempts, try again in %s", wait.Round(time.Second)))
+		return false
+	}
+	ok, err := auth.VerifyPassword(password, user.HashedPassword)
+	if err != nil {
+		slog.Error("verify password", "user", user.ID, "error", err)
+	}
+	if !ok {
+		s.throttler.Failure(throttleKeys...)
+		writeError(w, http.StatusForbidden, fmt.Errorf("current password is wrong"))
+		return false
+	}
+	s.throttler.Success(throttleKeys...)
+	return true
+}
+
+func (s *server) handleUpdateRole(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req roleRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode role: %w", err))
+		return
+	}
+	if !slices.Contains(database.Roles, req.Role) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("role must be one of %s", strings.Join(database.Roles, ", ")))
+		return
+	}
+	user, ok := s.checkAdminister(w, r, id)
+	if !ok {
+		return
+	}
+	if !principalFrom(r).Access.CanGrant(req.Role) {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if req.Role != database.RoleOwner && !s.checkNotLastOwner(w, user) {
+		return
+	}
+	if err := s.db.UpdateUserRole(id, req.Role); err != nil {
+		writeDBError(w, "update role", err)
+		return
+	}
+	user.Role = req.Role
+	writeJSON(w, http.StatusOK, user)
+}
+
+// checkNotLastOwner writes an error and returns false if user is the only owner, who can't be removed or
+// demoted or nobody could manage admins anymore.
+func (s *server) checkNotLastOwner(w http.ResponseWriter, user *database.User) bool {
+	if user.Role != database.RoleOwner {
+		return true
+	}
+	n, err := s.db.CountOwners()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("count owners: %w", err))
+		return false
+	}
+	if n <= 1 {
+		writeError(w, http.StatusConflict, fmt.Errorf("%s is the only owner", user.Username))
+		return false
+	}
+	return true
+}
+
+// hashNewPassword checks the password's length and hashes it. It writes the error response and returns
+// false if that fails.
+func hashNewPassword(w http.ResponseWriter, password string) (string, bool) {
+	if len(password) < minPasswordLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("password must be at least %d characters", minPasswordLength))
+		return "", false
+	}
+	hash, err := auth.HashPassword(password, auth.ConfiguredParams())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("hash password: %w", err))
+		return "", false
+	}
+	return hash, true
+}
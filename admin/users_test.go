@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+func TestUpdateOwnPasswordRequiresCurrentPassword(t *testing.T) {
+	hash, err := auth.HashPassword("old password", auth.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &database.User{ID: uuid.New(), Username: "Alice", HashedPassword: hash, Role: database.RoleAdmin}
+	// the server has no database, so only requests refused before the password is changed can pass
+	s := &server{throttler: auth.NewThrottler(2, time.Minute)}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"password": "new password"}`, http.StatusBadRequest},
+		{`{"password": "new password", "current_password": "guess"}`, http.StatusForbidden},
+		{`{"password": "new password", "current_password": "guess"}`, http.StatusForbidden},
+		// locked out now, even with the right password
+		{`{"password": "new password", "current_password": "old password"}`, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/api/users/"+user.ID.String()+"/password", strings.NewReader(tt.body))
+		r.SetPathValue("id", user.ID.String())
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &principal{User: user, Scope: auth.ScopeFullAdmin}))
+		w := httptest.NewRecorder()
+		s.handleUpdatePassword(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+		}
+	}
+}
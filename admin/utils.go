@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encode json response", "error", err)
+	}
+}
+
+// writeDBError writes a 404 if err is pgx.ErrNoRows and a 500 otherwise.
+func writeDBError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: not found", action))
+		return
+	}
+	writeError(w, http.StatusInternalServerError, fmt.Errorf("%s: %w", action, err))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// readJSON decodes the request body into v. An empty body leaves v unchanged.
+func readJSON(r *http.Request, v any) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func pathID(r *http.Request) (uuid.UUID, error) {
+	return uuid.Parse(r.PathValue("id"))
+}
+
+// queryInt returns the integer query parameter key or def if it is missing or invalid.
+func queryInt(r *http.Request, key string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// remoteIP returns the ip of the client without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
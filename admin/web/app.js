@@ -0,0 +1,616 @@
+"use strict";
+
+// small helpers so the rest of the file stays readable. everything is rendered with textContent so
+// values coming from traffic (hosts, urls) can never inject html.
+function el(tag, attrs, ...children) {
+	const node = document.createElement(tag);
+	for (const [k, v] of Object.entries(attrs || {})) {
+		if (k.startsWith("on")) node.addEventListener(k.slice(2), v);
+		else if (k === "class") node.className = v;
+		else if (v !== undefined && v !== null && v !== false) node.setAttribute(k, v);
+	}
+	for (const child of children.flat()) {
+		if (child === null || child === undefined) continue;
+		node.append(child instanceof Node ? child : document.createTextNode(String(child)));
+	}
+	return node;
+}
+
+async function api(method, path, body) {
+	const headers = {};
+	if (body !== undefined) headers["Content-Type"] = "application/json";
+	if (method !== "GET" && state.csrf) headers["X-CSRF-Token"] = state.csrf;
+	const resp = await fetch(path, {
+		method,
+		headers,
+		body: body === undefined ? undefined : JSON.stringify(body),
+		credentials: "same-origin",
+	});
+	if (resp.status === 401 && path !== "/api/login") {
+		showLogin();
+		throw new Error("not logged in");
+	}
+	if (resp.status === 204) return null;
+	const data = resp.headers.get("Content-Type")?.startsWith("application/json") ? await resp.json() : {};
+	if (!resp.ok) throw Object.assign(new Error(data.error || resp.statusText), { data });
+	return data;
+}
+
+function showError(err) {
+	document.getElementById("error").textContent = err ? err.message : "";
+}
+
+const state = { me: null, csrf: null, options: null, devices: [], users: [], tab: "devices" };
+
+// login
+
+function showLogin() {
+	document.getElementById("app").hidden = true;
+	document.getElementById("login").hidden = false;
+}
+
+document.getElementById("login-form").addEventListener("submit", async (e) => {
+	e.preventDefault();
+	const form = new FormData(e.target);
+	const body = { username: form.get("username"), password: form.get("password") };
+	const code = (form.get("code") || "").trim();
+	// totp codes are 6 digits, anything else is treated as a recovery code
+	if (/^\d{6}$/.test(code)) body.totp_code = code;
+	else if (code) body.recovery_code = code;
+	try {
+		await api("POST", "/api/login", body);
+		document.getElementById("login-error").textContent = "";
+		document.getElementById("login-totp").hidden = true;
+		e.target.reset();
+		await start();
+	} catch (err) {
+		if (err.data && err.data.totp_required) document.getElementById("login-totp").hidden = false;
+		document.getElementById("login-error").textContent = err.message;
+	}
+});
+
+document.getElementById("logout").addEventListener("click", async () => {
+	await api("POST", "/api/logout").catch(() => {});
+	showLogin();
+});
+
+// tabs
+
+for (const button of document.querySelectorAll("nav button")) {
+	button.addEventListener("click", () => switchTab(button.dataset.tab));
+}
+
+function switchTab(tab) {
+	state.tab = tab;
+	for (const button of document.querySelectorAll("nav button")) {
+		button.classList.toggle("active", button.dataset.tab === tab);
+	}
+	for (const node of document.querySelectorAll(".tab")) {
+		node.hidden = node.id !== "tab-" + tab;
+	}
+	showError(null);
+	renderers[tab]().catch(showError);
+}
+
+// isAdmin is true for owners, admins and the configured api token (which has no user). Everyone else only
+// gets their own devices and rules, and those of the groups they manage, from the api.
+function isAdmin() {
+	return !state.me.role || state.me.role === "owner" || state.me.role === "admin";
+}
+
+function userName(id) {
+	const user = state.users.find((u) => u.id === id);
+	return user ? user.username : id;
+}
+
+function formatBytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function deviceName(id) {
+	const device = state.devices.find((d) => d.id === id);
+	return device ? device.name : id || "unknown";
+}
+
+// overrideButtons shows a button that turns on a temporary override of kind for target, or ends it if
+// it is active. overrides are the active ones from /api/overrides.
+function overrideButtons(overrides, kind, target, label, minutes, rerender) {
+	const active = overrides.find((o) => o.kind === kind && o.target === target);
+	if (active) {
+		return el("button", {
+			title: "until " + new Date(active.expires_at).toLocaleString(),
+			onclick: () => api("DELETE", "/api/overrides/" + active.id).then(rerender).catch(showError),
+		}, "End: " + label);
+	}
+	return el("button", {
+		onclick: () => api("POST", "/api/overrides", { kind, target, minutes }).then(rerender).catch(showError),
+	}, label);
+}
+
+async function showQuotas(device, showCard) {
+	const statuses = (await api("GET", "/api/devices/" + device.id + "/quotas")) || [];
+	const reload = () => showQuotas(device, showCard).catch(showError);
+	const limit = (used, max, format) => max ? format(used) + " of " + format(max) : "";
+	const minutes = (n) => n + " min";
+	const mb = (placeholder) => el("input", { type: "number", min: "0", placeholder });
+	const day = mb("MB per day"), week = mb("MB per week"), mins = mb("minutes per day");
+	const category = el("input", { placeholder: "category (optional)" });
+	showCard(
+		el("h3", {}, "Quotas of " + device.name),
+		el("table", {},
+			el("tr", {}, el("th", {}, "Applies to"), el("th", {}, "Category"), el("th", {}, "Today"), el("th", {}, "This week"), el("th", {}, "Minutes today"), el("th", {}, "Status"), el("th", {})),
+			statuses.map(({ quota: q, usage: u, exceeded, resets_at }) => el("tr", {},
+				el("td", {}, q.scope === "group" ? "group " + (device.group || q.target) : "device"),
+				el("td", {}, q.category || "all"),
+				el("td", {}, limit(u.bytes_today, q.max_bytes_per_day, formatBytes)),
+				el("td", {}, limit(u.bytes_this_week, q.max_bytes_per_week, formatBytes)),
+				el("td", {}, limit(u.minutes_today, q.max_minutes_per_day, minutes)),
+				el("td", { class: exceeded ? "status-blocked" : "" }, exceeded ? "exceeded until " + new Date(resets_at).toLocaleString() : "ok"),
+				el("td", {}, state.me.role === "viewer" || (q.scope === "group" && !isAdmin()) ? "" :
+					el("button", { class: "danger", onclick: () => api("DELETE", "/api/quotas/" + q.id).then(reload).catch(showError) }, "Delete")),
+			)),
+		),
+		state.me.role === "viewer" ? "" : el("div", { class: "row" },
+			day, week, mins, category,
+			el("button", {
+				onclick: () => api("POST", "/api/quotas", {
+					scope: "device",
+					target: device.id,
+					category: category.value.trim(),
+					max_bytes_per_day: Number(day.value) * 1024 * 1024,
+					max_bytes_per_week: Number(week.value) * 1024 * 1024,
+					max_minutes_per_day: Number(mins.value),
+				}).then(reload).catch(showError),
+			}, "Add quota"),
+		),
+	);
+}
+
+async function showFrames(request, output) {
+	const frames = (await api("GET", "/api/requests/" + request.id + "/frames")) || [];
+	output.replaceChildren(el("div", { class: "card" },
+		el("h3", {}, "Frames of " + request.url),
+		frames.length ? el("table", {},
+			el("tr", {}, el("th", {}, "Time"), el("th", {}, "From"), el("th", {}, "Type"), el("th", {}, "Size"), el("th", {}, "Text")),
+			frames.map((f) => el("tr", {},
+				el("td", {}, new Date(f.created_at).toLocaleTimeString()),
+				el("td", {}, f.from_client ? "client" : "server"),
+				el("td", {}, f.opcode + (f.close_code ? " " + f.close_code : "")),
+				el("td", {}, formatBytes(f.size)),
+				el("td", { class: "url", title: f.text || "" }, f.text || ""),
+			)),
+		) : el("p", {}, "No frames were logged. Frames are only logged if capture.websocket_frames is on."),
+	));
+}
+
+const renderers = {
+	async devices() {
+		state.users = (await api("GET", "/api/users")) || [];
+		state.devices = (await api("GET", "/api/devices")) || [];
+		const overrides = (await api("GET", "/api/overrides")) || [];
+		const root = document.getElementById("tab-devices");
+		const output = el("div", {});
+		const showCard = (...lines) => output.replaceChildren(el("div", { class: "card" }, ...lines));
+		const nameInput = el("input", { placeholder: "device name" });
+		const userSelect = el("select", {}, state.users.map((u) => el("option", { value: u.id, selected: u.id === state.me.id }, u.username)));
+		root.replaceChildren(
+			state.me.role === "viewer" ? "" : el("div", { class: "row" },
+				nameInput, userSelect,
+				el("button", {
+					onclick: async () => {
+						try {
+							const e = await api("POST", "/api/enrollments", { user_id: userSelect.value, device_name: nameInput.value.trim() });
+							showCard(
+								el("p", {}, "On the device, set the proxy to this server, open ", el("code", {}, e.enroll_url), " and enter this code:"),
+								el("pre", {}, e.code),
+								el("p", {}, "It expires " + new Date(e.expires_at).toLocaleString() + " and can only be used once."),
+							);
+						} catch (err) {
+							showError(err);
+						}
+					},
+				}, "Enroll a device"),
+			),
+			output,
+			el("table", {},
+				el("tr", {}, el("th", {}, "Name"), el("th", {}, "User"), el("th", {}, "Group"), el("th", {}, "Tags"), el("th", {}, "Last seen"), el("th", {}, "Requests"), el("th", {}, "Traffic"), el("th", {}, "Safe search"), el("th", {}, "Addresses"), el("th", {}, "ID"), el("th", {})),
+				state.devices.map((d) => el("tr", {},
+					el("td", {}, d.name),
+					el("td", {}, userName(d.user.id)),
+					el("td", {}, d.group || ""),
+					el("td", {}, (d.tags || []).join(", ")),
+					el("td", { title: [d.last_ip, d.last_user_agent].filter(Boolean).join("\n") }, d.last_seen_at ? new Date(d.last_seen_at).toLocaleString() : "never"),
+					el("td", {}, d.total_requests),
+					el("td", {}, formatBytes(d.total_bytes)),
+					el("td", {}, el("input", {
+						type: "checkbox",
+						checked: d.safe_search,
+						disabled: !isAdmin(),
+						title: "safe search and youtube restricted mode, also on for every device if its group has it on",
+						onchange: (e) => api("PATCH", "/api/devices/" + d.id, { safe_search: e.target.checked }).catch(showError),
+					})),
+					el("td", {}, el("input", {
+						value: (d.addresses || []).join(", "),
+						disabled: !isAdmin(),
+						placeholder: "ip or mac addresses",
+						title: "identify the device by these addresses in transparent mode",
+						onchange: (e) => api("PATCH", "/api/devices/" + d.id, { addresses: e.target.value.split(",").map((a) => a.trim()).filter(Boolean) })
+							.then(renderers.devices).catch(showError),
+					})),
+					el("td", {}, d.id),
+					el("td", {},
+						el("button", { onclick: () => { state.trafficDevice = d.id; switchTab("traffic"); } }, "Traffic"), " ",
+						el("button", { onclick: () => showQuotas(d, showCard).catch(showError) }, "Quotas"), " ",
+						state.me.role === "viewer" ? "" : [
+							overrideButtons(overrides, "pause_device", d.id, "Pause filtering 1h", 60, renderers.devices), " ",
+							overrideButtons(overrides, "block_device", d.id, "Internet off 1h", 60, renderers.devices), " ",
+						],
+						state.me.role === "viewer" ? "" : el("button", {
+							onclick: async () => {
+								try {
+									const c = await api("POST", "/api/devices/" + d.id + "/credentials");
+									showCard(
+										el("p", {}, "New proxy credentials for " + d.name + ". The old password no longer works and this one is only shown once:"),
+										el("pre", {}, "username: " + c.username + "\npassword: " + c.password),
+									);
+								} catch (err) {
+									showError(err);
+								}
+							},
+						}, "New password"),
+					),
+				)),
+			),
+		);
+	},
+
+	async rules() {
+		state.users = (await api("GET", "/api/users")) || [];
+		const rules = (await api("GET", "/api/rules")) || [];
+		const overrides = (await api("GET", "/api/overrides")) || [];
+		const root = document.getElementById("tab-rules");
+		root.replaceChildren(
+			state.me.role === "viewer" ? "" : el("div", { class: "row" }, el("button", { onclick: () => editRule(null) }, "New rule")),
+			el("div", { id: "rule-editor" }),
+			el("table", {},
+				el("tr", {}, el("th", {}, "Title"), el("th", {}, "User"), el("th", {}, "Applies to"), el("th", {}, "Trigger"), el("th", {}, "Action"), el("th", {}, "In effect"), el("th", {})),
+				rules.map((r) => el("tr", {},
+					el("td", {}, r.title),
+					el("td", {}, userName(r.user.id)),
+					el("td", {}, r.scope === "user" ? "user" : r.scope + " " + r.target),
+					el("td", {}, r.trigger),
+					el("td", {}, r.action.type + (r.action.data ? " " + r.action.data : "")),
+					el("td", {}, el("input", {
+						type: "checkbox",
+						checked: r.in_effect,
+						onchange: (e) => api("PUT", "/api/rules/" + r.id, { ...r, in_effect: e.target.checked }).catch(showError),
+					})),
+					el("td", {},
+						el("button", { onclick: () => editRule(r) }, "Edit"), " ",
+						overrideButtons(overrides, "pause_rule", r.id, "Pause 30 min", 30, renderers.rules), " ",
+						el("button", { class: "danger", onclick: () => api("DELETE", "/api/rules/" + r.id).then(renderers.rules).catch(showError) }, "Delete"),
+					),
+				)),
+			),
+		);
+	},
+
+	async lists() {
+		const lists = (await api("GET", "/api/blocklists")) || [];
+		const pinned = isAdmin() ? (await api("GET", "/api/pinned-hosts")) || [] : [];
+		const root = document.getElementById("tab-lists");
+		const name = el("input", { placeholder: "name" });
+		const source = el("input", { placeholder: "https://... or file:///...", size: 50 });
+		const refresh = el("input", { type: "number", min: "5", value: "1440", title: "refresh every n minutes" });
+		root.replaceChildren(
+			el("p", {}, "Use a list in a rule with the in_list operator on ctx-host and the list's name as the value."),
+			isAdmin() ? el("div", { class: "row" },
+				name, source, refresh,
+				el("button", {
+					onclick: () => api("POST", "/api/blocklists", { name: name.value.trim(), source: source.value.trim(), refresh_minutes: Number(refresh.value) })
+						.then(renderers.lists).catch(showError),
+				}, "Add list"),
+			) : "",
+			el("table", {},
+				el("tr", {}, el("th", {}, "Name"), el("th", {}, "Source"), el("th", {}, "Domains"), el("th", {}, "Refreshed"), el("th", {}, "Every"), el("th", {})),
+				lists.map((b) => el("tr", {},
+					el("td", {}, b.name),
+					el("td", { class: "url", title: b.source }, b.source),
+					el("td", {}, b.entries),
+					el("td", { class: b.last_error ? "status-blocked" : "", title: b.last_error || "" }, b.refreshed_at ? new Date(b.refreshed_at).toLocaleString() + (b.last_error ? " (failed)" : "") : "never"),
+					el("td", {}, b.refresh_minutes + " min"),
+					el("td", {}, isAdmin() ? [
+						el("button", { onclick: () => api("POST", "/api/blocklists/" + b.id + "/refresh").then(renderers.lists).catch(showError) }, "Refresh"), " ",
+						el("button", { class: "danger", onclick: () => api("DELETE", "/api/blocklists/" + b.id).then(renderers.lists).catch(showError) }, "Delete"),
+					] : ""),
+				)),
+			),
+			isAdmin() ? [
+				el("h2", {}, "Pinned hosts"),
+				el("p", {}, "Hosts whose clients kept rejecting the mitm certificate, tunneled without mitm until they expire."),
+				el("table", {},
+					el("tr", {}, el("th", {}, "Host"), el("th", {}, "Aborted handshakes"), el("th", {}, "Learned"), el("th", {}, "Expires"), el("th", {})),
+					pinned.filter((p) => new Date(p.expires_at) > new Date()).map((p) => el("tr", {},
+						el("td", {}, p.host),
+						el("td", {}, p.failures),
+						el("td", {}, new Date(p.learned_at).toLocaleString()),
+						el("td", {}, new Date(p.expires_at).toLocaleString()),
+						el("td", {}, el("button", { class: "danger", onclick: () => api("DELETE", "/api/pinned-hosts/" + encodeURIComponent(p.host)).then(renderers.lists).catch(showError) }, "Use mitm again")),
+					)),
+				),
+			] : "",
+		);
+	},
+
+	async traffic() {
+		state.devices = (await api("GET", "/api/devices")) || [];
+		const device = state.trafficDevice || "";
+		const requests = (await api("GET", "/api/requests?limit=200" + (device ? "&device=" + device : ""))) || [];
+		const root = document.getElementById("tab-traffic");
+		const output = el("div", {});
+		root.replaceChildren(
+			el("div", { class: "row" },
+				"Device ",
+				el("select", { onchange: (e) => { state.trafficDevice = e.target.value; renderers.traffic().catch(showError); } },
+					el("option", { value: "" }, "all"),
+					state.devices.map((d) => el("option", { value: d.id, selected: d.id === device }, d.name)),
+				),
+				el("button", { onclick: () => renderers.traffic().catch(showError) }, "Refresh"),
+			),
+			output,
+			el("table", {},
+				el("tr", {}, el("th", {}, "Time"), el("th", {}, "Device"), el("th", {}, "Method"), el("th", {}, "URL"), el("th", {}, "Status"), el("th", {}, "ms"), el("th", {})),
+				requests.map((r) => el("tr", {},
+					el("td", {}, new Date(r.created_at).toLocaleTimeString()),
+					el("td", {}, deviceName(r.device_id)),
+					el("td", {}, r.method),
+					el("td", { class: "url", title: r.url }, r.url),
+					el("td", { class: r.rule_id ? "status-blocked" : "" }, r.status_code),
+					el("td", {}, r.duration_ms),
+					el("td", {}, r.status_code === 101 ? el("button", { onclick: () => showFrames(r, output).catch(showError) }, "Frames") : ""),
+				)),
+			),
+		);
+	},
+
+	async access() {
+		const requests = (await api("GET", "/api/access-requests")) || [];
+		const root = document.getElementById("tab-access");
+		const act = (a, action, body) => api("POST", "/api/access-requests/" + a.id + "/" + action, body).then(renderers.access).catch(showError);
+		const active = (a) => a.status === "approved" && new Date(a.expires_at) > new Date();
+		const status = (a) => a.status === "approved" ? (active(a) ? "approved until " + new Date(a.expires_at).toLocaleString() : "expired") : a.status;
+		const canDecide = state.me.role !== "viewer";
+		root.replaceChildren(
+			el("div", { class: "row" }, el("button", { onclick: () => renderers.access().catch(showError) }, "Refresh")),
+			el("table", {},
+				el("tr", {}, el("th", {}, "Time"), el("th", {}, "Device"), el("th", {}, "Host"), el("th", {}, "Reason"), el("th", {}, "Status"), el("th", {})),
+				requests.map((a) => {
+					const duration = el("select", {}, [[15, "15 minutes"], [60, "1 hour"], [180, "3 hours"], [1440, "1 day"]].map(([m, label]) => el("option", { value: m, selected: m === 60 }, label)));
+					return el("tr", {},
+						el("td", {}, new Date(a.created_at).toLocaleString()),
+						el("td", {}, a.device_name),
+						el("td", {}, a.host),
+						el("td", {}, a.reason || ""),
+						el("td", {}, status(a)),
+						el("td", {},
+							canDecide && a.status === "pending" ? [
+								duration, " ",
+								el("button", { onclick: () => act(a, "approve", { minutes: Number(duration.value) }) }, "Approve"), " ",
+								el("button", { class: "danger", onclick: () => act(a, "deny") }, "Deny"),
+							] : "",
+							canDecide && active(a) ? el("button", { class: "danger", onclick: () => act(a, "revoke") }, "Revoke") : "",
+						),
+					);
+				}),
+			),
+		);
+	},
+
+	async bans() {
+		const bans = (await api("GET", "/api/bans")) || [];
+		const root = document.getElementById("tab-bans");
+		const active = (b) => !b.expires_at || new Date(b.expires_at) > new Date();
+		root.replaceChildren(
+			el("table", {},
+				el("tr", {}, el("th", {}, "IP"), el("th", {}, "Reason"), el("th", {}, "Expires"), el("th", {})),
+				bans.filter(active).map((b) => el("tr", {},
+					el("td", {}, b.ip),
+					el("td", {}, b.reason),
+					el("td", {}, b.expires_at ? new Date(b.expires_at).toLocaleString() : "never"),
+					el("td", {}, el("button", { onclick: () => api("DELETE", "/api/bans/" + b.id).then(renderers.bans).catch(showError) }, "Lift")),
+				)),
+			),
+		);
+	},
+
+	async security() {
+		const me = await api("GET", "/api/me");
+		state.me = me.user;
+		const root = document.getElementById("tab-security");
+		const codeInput = el("input", { placeholder: "6 digit code", autocomplete: "one-time-code" });
+		const output = el("div", {});
+		const showRecoveryCodes = (resp) => output.replaceChildren(el("div", { class: "card" },
+			el("p", {}, "Recovery codes. Store them somewhere safe, they are only shown once:"),
+			el("pre", {}, resp.recovery_codes.join("\n")),
+		));
+
+		if (!state.me.totp_enabled) {
+			root.replaceChildren(el("div", { class: "card" },
+				el("h2", {}, "Two-factor authentication"),
+				me.totp_setup_required ? el("p", { class: "error" }, "Your administrator requires two-factor authentication. Set it up to continue.") : null,
+				el("button", {
+					onclick: async () => {
+						try {
+							const enroll = await api("POST", "/api/totp/enroll");
+							output.replaceChildren(
+								el("p", {}, "Scan this code with your authenticator app, or enter the secret manually:"),
+								el("img", { src: "/api/totp/qr.png?" + Date.now(), alt: "qr code", width: 256, height: 256 }),
+								el("pre", {}, enroll.secret),
+								el("div", { class: "row" }, codeInput, el("button", {
+									onclick: async () => {
+										try {
+											showRecoveryCodes(await api("POST", "/api/totp/confirm", { code: codeInput.value.trim() }));
+											state.me.totp_enabled = true;
+										} catch (err) {
+											showError(err);
+										}
+									},
+								}, "Confirm")),
+							);
+						} catch (err) {
+							showError(err);
+						}
+					},
+				}, "Set up two-factor authentication"),
+				output,
+			));
+			return;
+		}
+
+		root.replaceChildren(el("div", { class: "card" },
+			el("h2", {}, "Two-factor authentication"),
+			el("p", {}, "Two-factor authentication is enabled."),
+			el("div", { class: "row" }, codeInput,
+				el("button", { onclick: () => api("POST", "/api/totp/recovery-codes", { code: codeInput.value.trim() }).then(showRecoveryCodes).catch(showError) }, "New recovery codes"),
+				el("button", { class: "danger", onclick: () => api("POST", "/api/totp/disable", { code: codeInput.value.trim() }).then(renderers.security).catch(showError) }, "Turn off"),
+			),
+			output,
+		));
+	},
+};
+
+// rule editor
+
+function newCondition(op) {
+	if (op === "AND" || op === "OR") return { op, conditions: [] };
+	return { op, field: state.options.fields[0], value: "" };
+}
+
+// renderCondition renders an editable condition tree. cond is mutated in place; onRemove removes it from
+// its parent (null for the root).
+function renderCondition(cond, onRemove, rerender) {
+	const isGroup = cond.op === "AND" || cond.op === "OR";
+	const opSelect = el("select", {
+		onchange: (e) => {
+			const next = newCondition(e.target.value);
+			if (isGroup && (next.op === "AND" || next.op === "OR")) next.conditions = cond.conditions;
+			for (const k of Object.keys(cond)) delete cond[k];
+			Object.assign(cond, next);
+			rerender();
+		},
+	}, state.options.operators.map((op) => el("option", { value: op, selected: op === cond.op }, op)));
+
+	const row = el("div", { class: "row" }, opSelect);
+	if (!isGroup) {
+		row.append(
+			el("select", { onchange: (e) => { cond.field = e.target.value; rerender(); } },
+				state.options.fields.map((f) => el("option", { value: f, selected: f === cond.field }, f))),
+			el("input", {
+				value: cond.value ?? "",
+				placeholder: "value",
+				list: cond.field === "ctx-category" ? "category-names" : undefined,
+				oninput: (e) => { cond.value = e.target.value; },
+			}),
+		);
+	}
+	if (onRemove) row.append(el("button", { class: "danger", onclick: () => { onRemove(); rerender(); } }, "Remove"));
+
+	const node = el("div", { class: "condition" + (isGroup ? " group" : "") }, row);
+	if (isGroup) {
+		cond.conditions.forEach((child, i) => {
+			node.append(renderCondition(child, () => cond.conditions.splice(i, 1), rerender));
+		});
+		node.append(el("div", { class: "row" },
+			el("button", { onclick: () => { cond.conditions.push(newCondition("equals")); rerender(); } }, "Add condition"),
+			el("button", { onclick: () => { cond.conditions.push(newCondition("AND")); rerender(); } }, "Add group"),
+		));
+	}
+	return node;
+}
+
+function editRule(rule) {
+	const draft = rule ? structuredClone(rule) : {
+		title: "",
+		user: { id: state.me.id || (state.users[0] && state.users[0].id) },
+		trigger: state.options.triggers[0],
+		condition: newCondition("AND"),
+		action: { type: state.options.actions[0] },
+		in_effect: true,
+		scope: "user",
+	};
+	const root = document.getElementById("rule-editor");
+
+	const render = () => {
+		root.replaceChildren(el("div", { class: "card" },
+			el("div", { class: "row" },
+				"Title", el("input", { value: draft.title, oninput: (e) => { draft.title = e.target.value; } }),
+				"Trigger", el("select", { onchange: (e) => { draft.trigger = e.target.value; } },
+					state.options.triggers.map((t) => el("option", { value: t, selected: t === draft.trigger }, t))),
+				"User", el("select", { disabled: !!rule, onchange: (e) => { draft.user = { id: e.target.value }; } },
+					state.users.map((u) => el("option", { value: u.id, selected: u.id === draft.user.id }, u.username))),
+			),
+			el("div", { class: "row" },
+				"Applies to", el("select", { onchange: (e) => { draft.scope = e.target.value; render(); } },
+					state.options.scopes.map((s) => el("option", { value: s, selected: s === draft.scope }, s))),
+				draft.scope === "user" ? "" : el("input", {
+					value: draft.target ?? "",
+					placeholder: draft.scope === "tag" ? "tag" : draft.scope + " id",
+					oninput: (e) => { draft.target = e.target.value; },
+				}),
+			),
+			el("div", { class: "row" },
+				"Action", el("select", { onchange: (e) => { draft.action.type = e.target.value; render(); } },
+					state.options.actions.map((a) => el("option", { value: a, selected: a === draft.action.type }, a))),
+				el("input", {
+					value: draft.action.data ?? "",
+					placeholder: draft.action.type === "route_via" ? "upstream proxy" : "redirect url / ban duration",
+					list: draft.action.type === "route_via" ? "upstream-names" : undefined,
+					oninput: (e) => { draft.action.data = e.target.value || undefined; },
+				}),
+			),
+			renderCondition(draft.condition, null, render),
+			el("div", { class: "row" },
+				el("button", {
+					onclick: async () => {
+						try {
+							if (rule) await api("PUT", "/api/rules/" + rule.id, draft);
+							else await api("POST", "/api/rules", draft);
+							root.replaceChildren();
+							await renderers.rules();
+						} catch (err) {
+							showError(err);
+						}
+					},
+				}, "Save"),
+				el("button", { onclick: () => root.replaceChildren() }, "Cancel"),
+			),
+		));
+	};
+	render();
+}
+
+// startup
+
+async function start() {
+	const me = await api("GET", "/api/me");
+	state.me = me.user;
+	state.csrf = me.csrf_token;
+	state.options = await api("GET", "/api/rule-options");
+	document.getElementById("category-names")?.remove();
+	document.body.append(el("datalist", { id: "category-names" }, state.options.categories.map((c) => el("option", { value: c }))));
+	document.getElementById("upstream-names")?.remove();
+	document.body.append(el("datalist", { id: "upstream-names" }, state.options.upstreams.map((u) => el("option", { value: u }))));
+	document.getElementById("whoami").textContent = state.me.username ? state.me.username + " (" + state.me.role + ")" : "api token";
+	document.querySelector('[data-tab="bans"]').hidden = !isAdmin();
+	document.getElementById("login").hidden = true;
+	document.getElementById("app").hidden = false;
+	switchTab(me.totp_setup_required ? "security" : state.tab);
+}
+
+start().catch(() => {});
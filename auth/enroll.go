@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+// no 0/O, 1/I/L or U so codes can be read out and typed on a phone without mistakes
+const enrollmentAlphabet = "23456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewEnrollmentCode returns a random one-time code for enrolling a device, e.g. "7KQ2-M9XD-P4TW". It has
+// about 59 bits of entropy and is only valid for a short time, so a fast hash is enough to store it.
+func NewEnrollmentCode() string {
+	var b strings.Builder
+	n := big.NewInt(int64(len(enrollmentAlphabet)))
+	for i := range 12 {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		c, _ := rand.Int(rand.Reader, n)
+		b.WriteByte(enrollmentAlphabet[c.Int64()])
+	}
+	return b.String()
+}
+
+// HashEnrollmentCode hashes an enrollment code for storage, ignoring case, spaces and dashes in the input.
+func HashEnrollmentCode(code string) string {
+	return HashRecoveryCode(code)
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+// testParams keep the tests fast, the defaults take 64 MiB per hash.
+var testParams = Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyPassword("correct horse", hash); !ok || err != nil {
+		t.Errorf("VerifyPassword(right password) = %t, %v", ok, err)
+	}
+	if ok, err := VerifyPassword("Correct horse", hash); ok || err != nil {
+		t.Errorf("VerifyPassword(wrong password) = %t, %v", ok, err)
+	}
+	if other, _ := HashPassword("correct horse", testParams); other == hash {
+		t.Error("two hashes of the same password are equal, the salt isn't random")
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!$a2V5",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", // bcrypt
+	} {
+		if ok, err := VerifyPassword("password", hash); ok || !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("VerifyPassword(%q) = %t, %v, want false, ErrInvalidHash", hash, ok, err)
+		}
+	}
+}
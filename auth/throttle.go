@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttler limits login attempts per key (a username or an ip). After MaxFailures consecutive failures
+// the key is locked out, and every further failure doubles the lockout up to MaxLockout.
+type Throttler struct {
+	MaxFailures int
+	Lockout     time.Duration
+	MaxLockout  time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]*attempts
+}
+
+type attempts struct {
+	failures    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+func NewThrottler(maxFailures int, lockout time.Duration) *Throttler {
+	return &Throttler{
+		MaxFailures: maxFailures,
+		Lockout:     lockout,
+		MaxLockout:  lockout * 64,
+		attempts:    make(map[string]*attempts),
+	}
+}
+
+// Allow reports whether an attempt for every key may be made now. If not, it returns how long to wait.
+func (t *Throttler) Allow(keys ...string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, k := range keys {
+		if a, ok := t.attempts[k]; ok {
+			wait = max(wait, time.Until(a.lockedUntil))
+		}
+	}
+	return wait <= 0, wait
+}
+
+// Failure records a failed attempt for every key.
+func (t *Throttler) Failure(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, k := range keys {
+		a, ok := t.attempts[k]
+		if !ok || now.Sub(a.lastFailure) > t.MaxLockout {
+			a = &attempts{} // failures long ago don't count anymore
+			t.attempts[k] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		if over := a.failures - t.MaxFailures; over >= 0 {
+			a.lockedUntil = now.Add(min(t.Lockout<<min(over, 30), t.MaxLockout))
+		}
+	}
+	t.cleanup(now)
+}
+
+// Success forgets the failures of every key.
+func (t *Throttler) Success(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.attempts, k)
+	}
+}
+
+// cleanup drops keys that haven't failed in a while so the map doesn't grow forever. t.mu must be held.
+func (t *Throttler) cleanup(now time.Time) {
+	if len(t.attempts) < 10_000 {
+		return
+	}
+	for k, a := range t.attempts {
+		if now.Sub(a.lastFailure) > t.MaxLockout {
+			delete(t.attempts, k)
+		}
+	}
+}
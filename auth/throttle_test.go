@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottler(t *testing.T) {
+	th := NewThrottler(3, time.Minute)
+	keys := []string{"user:alice", "ip:192.0.2.1"}
+
+	for range 2 {
+		th.Failure(keys...)
+	}
+	if ok, _ := th.Allow(keys...); !ok {
+		t.Fatal("locked out before MaxFailures failures")
+	}
+	th.Failure(keys...)
+	ok, wait := th.Allow(keys...)
+	if ok || wait <= 0 || wait > time.Minute {
+		t.Fatalf("after MaxFailures failures Allow = %t, %s, want a lockout of up to a minute", ok, wait)
+	}
+	if ok, _ := th.Allow("user:alice", "ip:192.0.2.2"); ok {
+		t.Error("a locked out username is allowed from another ip")
+	}
+	if ok, _ := th.Allow("user:bob"); !ok {
+		t.Error("another user is locked out")
+	}
+
+	th.Failure(keys...)
+	if _, wait := th.Allow(keys...); wait <= time.Minute {
+		t.Errorf("another failure waits %s, want the lockout doubled", wait)
+	}
+
+	th.Success(keys...)
+	if ok, _ := th.Allow(keys...); !ok {
+		t.Error("locked out after a success")
+	}
+}
+
+func TestThrottlerMaxLockout(t *testing.T) {
+	th := NewThrottler(1, time.Second)
+	for range 100 {
+		th.Failure("ip:192.0.2.1")
+	}
+	if _, wait := th.Allow("ip:192.0.2.1"); wait > th.MaxLockout {
+		t.Errorf("lockout is %s, want at most %s", wait, th.MaxLockout)
+	}
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+)
+
+const (
+	ScopeReadOnly   = "read-only"   // can read everything but change nothing
+	ScopeRulesWrite = "rules-write" // can also create, change and delete rules
+	ScopeFullAdmin  = "full-admin"  // can do everything
+)
+
+// Scopes are ordered from least to most access.
+var Scopes = []string{ScopeReadOnly, ScopeRulesWrite, ScopeFullAdmin}
+
+// ScopeAllows reports whether a token with scope have may do something that requires scope need.
+func ScopeAllows(have, need string) bool {
+	h, n := slices.Index(Scopes, have), slices.Index(Scopes, need)
+	return h >= 0 && n >= 0 && h >= n
+}
+
+// NewToken returns a new random token with the given prefix and its hash. Only the hash should be stored.
+func NewToken(prefix string) (token, hash string) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token)
+}
+
+// HashToken hashes a token for storage. Tokens are random and long, so a fast hash is enough (unlike passwords).
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy"
+)
+
+// headerFlags collects repeated -header "Key: Value" flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string { return fmt.Sprint(map[string]string(h)) }
+
+func (h headerFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("header must be in the form \"Key: Value\"")
+	}
+	h[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	return nil
+}
+
+// stringsFlag collects a repeated string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func runCommand(db *database.DB, name string, args []string) error {
+	switch name {
+	case "replay":
+		return replayCommand(db, args)
+	case "useradd":
+		return useraddCommand(db, args)
+	}
+	return fmt.Errorf("unknown command: %s", name)
+}
+
+// replayCommand replays a logged request, optionally modified, and prints the diff of the responses.
+//
+//	hat replay [-method M] [-target URL] [-header "K: V"]... [-remove-header K]... [-body B] <request id>
+func replayCommand(db *database.DB, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	mod := proxy.Modification{SetHeaders: headerFlags{}}
+	var remove stringsFlag
+	body := fs.String("body", "", "replace the request body")
+	fs.StringVar(&mod.Method, "method", "", "replace the request method")
+	fs.StringVar(&mod.Target, "target", "", "send the request to this url instead")
+	fs.Var(headerFlags(mod.SetHeaders), "header", "set a request header (\"Key: Value\"), can be repeated")
+	fs.Var(&remove, "remove-header", "remove a request header, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: hat replay [flags] <request id>")
+	}
+	id, err := uuid.Parse(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("parse request id: %w", err)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "body" {
+			mod.Body = body
+		}
+	})
+	mod.RemoveHeaders = remove
+
+	proxy.UseDatabase(db) // replays are screened by the rules of the device
+	result, err := proxy.Replay(db, id, mod)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("replayed %s as %s\n", result.Original.ID, result.Replayed.ID)
+	fmt.Printf("status: %d -> %d\n", result.Diff.OriginalStatus, result.Diff.ReplayedStatus)
+	for _, h := range result.Diff.Headers {
+		fmt.Printf("header %s: %q -> %q\n", h.Key, h.Original, h.Replayed)
+	}
+	if !result.Diff.BodyChanged {
+		fmt.Println("body: unchanged")
+		return nil
+	}
+	fmt.Println("body:")
+	for _, line := range result.Diff.Body {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// useraddCommand creates a user. The password is read from the first line of stdin so it doesn't end up in
+// the shell history.
+//
+//	hat useradd [-role owner|admin|member|viewer] <username>
+func useraddCommand(db *database.DB, args []string) error {
+	fs := flag.NewFlagSet("useradd", flag.ContinueOnError)
+	role := fs.String("role", database.RoleMember, "the role of the user: "+strings.Join(database.Roles, ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || !slices.Contains(database.Roles, *role) {
+		return fmt.Errorf("usage: hat useradd [-role %s] <username>", strings.Join(database.Roles, "|"))
+	}
+	args = fs.Args()
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	hash, err := auth.HashPassword(password, auth.ConfiguredParams())
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	id, err := db.InsertUser(args[0], hash, *role)
+	if err != nil {
+		return fmt.Errorf("insert user: %w", err)
+	}
+	fmt.Printf("created %s %s (%s)\n", *role, args[0], id)
+	return nil
+}
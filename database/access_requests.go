@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	AccessPending  = "pending"
+	AccessApproved = "approved" // until expires_at
+	AccessDenied   = "denied"
+)
+
+const (
+	selectAccessRequests string = `SELECT a.id, a.device_id, d.device_name, d.user_id, a.host, a.rule_id, a.reason, a.status, a.created_at, a.decided_at, a.decided_by, a.expires_at FROM access_requests a JOIN devices d ON d.id = a.device_id`
+	// getAccessRequests is a SQL string to select the most recent access requests.
+	getAccessRequests string = selectAccessRequests + ` ORDER BY a.created_at DESC LIMIT 200;`
+	// getAccessRequestsByUserIDs is like getAccessRequests for the devices of any of the users. It requires an array of user IDs.
+	getAccessRequestsByUserIDs string = selectAccessRequests + ` WHERE d.user_id = ANY($1) ORDER BY a.created_at DESC LIMIT 200;`
+	getAccessRequestByID       string = selectAccessRequests + ` WHERE a.id = $1;`
+	// getActiveAccessExceptions is a SQL string to select the approved access requests that have not expired.
+	getActiveAccessExceptions string = selectAccessRequests + ` WHERE a.status = 'approved' AND a.expires_at > CURRENT_TIMESTAMP;`
+	// saveAccessRequest is a SQL string to insert a pending access request. It requires the device_id, host, rule_id and reason and returns the new request's ID.
+	saveAccessRequest string = `INSERT INTO access_requests (device_id, host, rule_id, reason) VALUES ($1, $2, $3, $4) RETURNING id;`
+	// decideAccessRequest is a SQL string to approve or deny a pending access request. It requires the ID, status, the deciding user's ID and expires_at (NULL when denied).
+	decideAccessRequest string = `UPDATE access_requests SET status = $2, decided_by = $3, expires_at = $4, decided_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'pending';`
+	// revokeAccessRequest is a SQL string to end an approval before it expires.
+	revokeAccessRequest string = `UPDATE access_requests SET expires_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'approved' AND expires_at > CURRENT_TIMESTAMP;`
+)
+
+var ErrAccessRequestPending = fmt.Errorf("access to this host was already requested")
+
+// AccessRequest asks for access to a host a device was blocked from. Once approved, rules don't block the
+// device from the host until the approval expires.
+type AccessRequest struct {
+	ID         uuid.UUID  `json:"id"`
+	DeviceID   uuid.UUID  `json:"device_id"`
+	DeviceName string     `json:"device_name"`
+	UserID     uuid.UUID  `json:"user_id"` // the device's user
+	Host       string     `json:"host"`
+	RuleID     *uuid.UUID `json:"rule_id,omitempty"` // the rule that blocked the request
+	Reason     string     `json:"reason,omitempty"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DecidedAt  *time.Time `json:"decided_at,omitempty"`
+	DecidedBy  *uuid.UUID `json:"decided_by,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+func (a *AccessRequest) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&a.ID, &a.DeviceID, &a.DeviceName, &a.UserID, &a.Host, &a.RuleID, &a.Reason, &a.Status, &a.CreatedAt, &a.DecidedAt, &a.DecidedBy, &a.ExpiresAt)
+}
+
+func (db *DB) GetAccessRequests() ([]*AccessRequest, error) {
+	return db.queryAccessRequests(getAccessRequests)
+}
+
+func (db *DB) GetAccessRequestsByUserIDs(userIDs []uuid.UUID) ([]*AccessRequest, error) {
+	return db.queryAccessRequests(getAccessRequestsByUserIDs, userIDs)
+}
+
+// GetActiveAccessExceptions returns the approved access requests that have not expired.
+func (db *DB) GetActiveAccessExceptions() ([]*AccessRequest, error) {
+	return db.queryAccessRequests(getActiveAccessExceptions)
+}
+
+func (db *DB) queryAccessRequests(sql string, args ...any) ([]*AccessRequest, error) {
+	rows, err := db.conn.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*AccessRequest, error) {
+		var a AccessRequest
+		return &a, a.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetAccessRequestByID(id uuid.UUID) (*AccessRequest, error) {
+	var a AccessRequest
+	row := db.conn.QueryRow(context.Background(), getAccessRequestByID, id)
+	if err := a.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// InsertAccessRequest stores a pending access request. It returns ErrAccessRequestPending if the device
+// already has a pending request for the host.
+func (db *DB) InsertAccessRequest(a *AccessRequest) (id uuid.UUID, err error) {
+	row := db.conn.QueryRow(context.Background(), saveAccessRequest, a.DeviceID, a.Host, a.RuleID, a.Reason)
+	err = row.Scan(&id)
+	if isUniqueViolation(err) {
+		err = ErrAccessRequestPending
+	}
+	return
+}
+
+// ApproveAccessRequest approves a pending access request until expiresAt. decidedBy is nil for the api
+// token. It returns pgx.ErrNoRows if the request doesn't exist or isn't pending.
+func (db *DB) ApproveAccessRequest(id uuid.UUID, decidedBy *uuid.UUID, expiresAt time.Time) error {
+	return db.execOne(decideAccessRequest, id, AccessApproved, decidedBy, expiresAt)
+}
+
+// DenyAccessRequest denies a pending access request. It returns pgx.ErrNoRows if the request doesn't exist
+// or isn't pending.
+func (db *DB) DenyAccessRequest(id uuid.UUID, decidedBy *uuid.UUID) error {
+	return db.execOne(decideAccessRequest, id, AccessDenied, decidedBy, nil)
+}
+
+// RevokeAccessRequest makes an approval expire now. It returns pgx.ErrNoRows if the request isn't an active
+// approval.
+func (db *DB) RevokeAccessRequest(id uuid.UUID) error {
+	return db.execOne(revokeAccessRequest, id)
+}
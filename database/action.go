@@ -1,12 +1,69 @@
 package database
 
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
 const (
 	ActionBlockRequest = "block_request" // blocks the request
-	ActionBlockIP      = "block_ip"
-	ActionRedirect     = "redirect"
+	ActionBlockIP      = "block_ip"      // blocks the request and bans the client ip, data is an optional ban duration (e.g "1h")
+	ActionRedirect     = "redirect"      // redirects the request, data is the url to redirect to
+	ActionAllow        = "allow"         // lets the request through, stopping rules with lower precedence from matching
+	ActionRouteVia     = "route_via"     // sends the request through a parent proxy, data is its name in upstream.proxies or "direct"
+)
+
+// DefaultBanDuration is how long a block_ip action bans an ip for if the action has no duration.
+const DefaultBanDuration = time.Hour
+
+var (
+	ErrInvalidAction = fmt.Errorf("invalid action")
 )
 
 type Action struct {
 	Type string `json:"type"`           // e.g "block_request"
 	Data any    `json:"data,omitempty"` // additional data for the action, e.g. redirect URL
 }
+
+// Validate checks that the action type is known and that its data is valid for the type.
+func (a *Action) Validate() error {
+	switch a.Type {
+	case ActionBlockRequest, ActionAllow:
+		return nil
+	case ActionBlockIP:
+		_, err := a.BanDuration()
+		return err
+	case ActionRedirect:
+		target, ok := a.Data.(string)
+		if !ok {
+			return fmt.Errorf("%w: redirect requires a url", ErrInvalidAction)
+		}
+		if u, err := url.Parse(target); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w: redirect requires an absolute url", ErrInvalidAction)
+		}
+		return nil
+	case ActionRouteVia:
+		if name, ok := a.Data.(string); !ok || name == "" {
+			return fmt.Errorf("%w: route_via requires an upstream proxy name", ErrInvalidAction)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown type: %s", ErrInvalidAction, a.Type)
+}
+
+// BanDuration returns the duration of a block_ip action.
+func (a *Action) BanDuration() (time.Duration, error) {
+	if a.Data == nil {
+		return DefaultBanDuration, nil
+	}
+	s, ok := a.Data.(string)
+	if !ok {
+		return 0, fmt.Errorf("%w: ban duration must be a string", ErrInvalidAction)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: invalid ban duration: %s", ErrInvalidAction, s)
+	}
+	return d, nil
+}
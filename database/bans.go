@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getBans is a SQL string to select all bans, including expired ones.
+	getBans string = `SELECT id, ip, reason, rule_id, created_at, expires_at FROM bans ORDER BY created_at DESC;`
+	// getActiveBans is a SQL string to select the bans that have not expired.
+	getActiveBans string = `SELECT id, ip, reason, rule_id, created_at, expires_at FROM bans WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP;`
+	// saveBan is a SQL string to insert a ban. It returns the newly created ban's ID.
+	saveBan   string = `INSERT INTO bans (ip, reason, rule_id, expires_at) VALUES ($1, $2, $3, $4) RETURNING id;`
+	deleteBan string = `DELETE FROM bans WHERE id = $1;`
+)
+
+// Ban blocks every request from an ip.
+type Ban struct {
+	ID        uuid.UUID  `json:"id"`
+	IP        string     `json:"ip"`
+	Reason    string     `json:"reason"`
+	RuleID    *uuid.UUID `json:"rule_id,omitempty"` // the block_ip rule that created the ban, if any
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil if the ban is permanent
+}
+
+func (b *Ban) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&b.ID, &b.IP, &b.Reason, &b.RuleID, &b.CreatedAt, &b.ExpiresAt)
+}
+
+func (db *DB) GetBans() ([]*Ban, error) {
+	return db.queryBans(getBans)
+}
+
+func (db *DB) GetActiveBans() ([]*Ban, error) {
+	return db.queryBans(getActiveBans)
+}
+
+func (db *DB) queryBans(sql string) ([]*Ban, error) {
+	rows, err := db.conn.Query(context.Background(), sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []*Ban
+	for rows.Next() {
+		var b Ban
+		if err := b.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		bans = append(bans, &b)
+	}
+	return bans, rows.Err()
+}
+
+func (db *DB) InsertBan(b *Ban) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveBan, b.IP, b.Reason, b.RuleID, b.ExpiresAt)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (db *DB) DeleteBan(id uuid.UUID) error {
+	return db.execOne(deleteBan, id)
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	getBlocklists    string = `SELECT id, name, source, refresh_minutes, created_at, refreshed_at, entries, last_error FROM blocklists ORDER BY name;`
+	getBlocklistByID string = `SELECT id, name, source, refresh_minutes, created_at, refreshed_at, entries, last_error FROM blocklists WHERE id = $1;`
+	// saveBlocklist is a SQL string to insert a blocklist. It requires the name, source and refresh_minutes and returns the new list's ID.
+	saveBlocklist string = `INSERT INTO blocklists (name, source, refresh_minutes) VALUES ($1, $2, $3) RETURNING id;`
+	// updateBlocklist is a SQL string to change a blocklist's name, source and refresh_minutes.
+	updateBlocklist string = `UPDATE blocklists SET name = $2, source = $3, refresh_minutes = $4 WHERE id = $1;`
+	deleteBlocklist string = `DELETE FROM blocklists WHERE id = $1;`
+	// updateBlocklistRefresh is a SQL string to record a refresh of a blocklist. entries is only updated if it succeeded (last_error is empty).
+	updateBlocklistRefresh string = `UPDATE blocklists SET refreshed_at = $2, entries = CASE WHEN $4 = '' THEN $3 ELSE entries END, last_error = $4 WHERE id = $1;`
+)
+
+var ErrBlocklistNameTaken = fmt.Errorf("a blocklist with this name already exists")
+
+// Blocklist is a list of domains loaded from a url, referred to by name from conditions with the in_list
+// operator. Only where the list comes from is stored; its domains are kept in memory by the proxy.
+type Blocklist struct {
+	ID             uuid.UUID  `json:"id"`
+	Name           string     `json:"name"`
+	Source         string     `json:"source"`          // an http(s) or file:// url
+	RefreshMinutes int        `json:"refresh_minutes"` // how often the list is loaded again
+	CreatedAt      time.Time  `json:"created_at"`
+	RefreshedAt    *time.Time `json:"refreshed_at,omitempty"` // the last time it was loaded, or tried to be
+	Entries        int        `json:"entries"`
+	LastError      string     `json:"last_error,omitempty"` // why the last refresh failed
+}
+
+func (b *Blocklist) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&b.ID, &b.Name, &b.Source, &b.RefreshMinutes, &b.CreatedAt, &b.RefreshedAt, &b.Entries, &b.LastError)
+}
+
+func (db *DB) GetBlocklists() ([]*Blocklist, error) {
+	rows, err := db.conn.Query(context.Background(), getBlocklists)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Blocklist, error) {
+		var b Blocklist
+		return &b, b.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetBlocklistByID(id uuid.UUID) (*Blocklist, error) {
+	var b Blocklist
+	row := db.conn.QueryRow(context.Background(), getBlocklistByID, id)
+	if err := b.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// InsertBlocklist returns ErrBlocklistNameTaken if another list has the same name.
+func (db *DB) InsertBlocklist(b *Blocklist) (id uuid.UUID, err error) {
+	row := db.conn.QueryRow(context.Background(), saveBlocklist, b.Name, b.Source, b.RefreshMinutes)
+	err = row.Scan(&id)
+	if isUniqueViolation(err) {
+		err = ErrBlocklistNameTaken
+	}
+	return
+}
+
+// UpdateBlocklist returns ErrBlocklistNameTaken if another list has the same name.
+func (db *DB) UpdateBlocklist(b *Blocklist) error {
+	err := db.execOne(updateBlocklist, b.ID, b.Name, b.Source, b.RefreshMinutes)
+	if isUniqueViolation(err) {
+		err = ErrBlocklistNameTaken
+	}
+	return err
+}
+
+func (db *DB) DeleteBlocklist(id uuid.UUID) error {
+	return db.execOne(deleteBlocklist, id)
+}
+
+// UpdateBlocklistRefresh records that the list was loaded at refreshedAt with the number of entries, or
+// that loading it failed with lastError.
+func (db *DB) UpdateBlocklistRefresh(id uuid.UUID, refreshedAt time.Time, entries int, lastError string) error {
+	return db.execOne(updateBlocklistRefresh, id, refreshedAt, entries, lastError)
+}
@@ -4,8 +4,7 @@ import (
 	"fmt"
 	"slices"
 	"strings"
-
-	"github.com/valyala/fasthttp"
+	"time"
 )
 
 const (
@@ -13,46 +12,121 @@ const (
 	OperatorOR  = "OR"
 	OperatorEQ  = "equals"
 	OperatorCT  = "contains"
+	OperatorIn  = "in_list" // the value is the name of a list, see Context.Lists
 )
 
 var (
 	ErrInvalidCondition = fmt.Errorf("invalid condition")
+	ErrInvalidRule      = fmt.Errorf("invalid rule")
 )
 
+// Fields are the fields a condition can refer to. See Context.Get.
+var Fields = []string{"device-id", "device-group", "device-tag", "ctx-host", "ctx-category", "ctx-sni", "ctx-alpn", "ctx-method", "ctx-path", "ctx-body", "time-day"}
+
 type Condition struct {
-	Operator   string      `json:"op"` // "AND", "OR", "equals", "contains", ...
+	Operator   string      `json:"op"` // "AND", "OR", "equals", "contains", "in_list"
 	Field      string      `json:"field,omitempty"`
 	Value      any         `json:"value,omitempty"`
 	Conditions []Condition `json:"conditions,omitempty"` // sub-conditions for AND/OR
 }
 
+// ListMatcher looks values up in named lists, such as blocklists of domains.
+type ListMatcher interface {
+	// InList reports whether value is in the list. It returns an error if there is no list with the name.
+	InList(name, value string) (bool, error)
+}
+
+// Categorizer gives hosts a category, such as social or gaming.
+type Categorizer interface {
+	// Category returns the category of host, or "" if it has none.
+	Category(host string) string
+}
+
+// TLSInfo is what a client sent in its tls client hello.
+type TLSInfo struct {
+	ServerName string   // sni, empty if the client didn't send one
+	ALPN       []string // the protocols the client supports, such as h2 and http/1.1
+}
+
+// Request is a request being handled, from whichever server it came in through.
+type Request interface {
+	Host() string
+	Method() string
+	Path() string
+	Body() string
+}
+
 type Context struct {
-	Device     *Device              // device id of a request (nil if not handling a request)
-	RequestCtx *fasthttp.RequestCtx // fasthttp request context (nil if not handling a request)
+	Device     *Device     // device id of a request (nil if not handling a request)
+	Request    Request     // the request (nil if not handling a request)
+	Host       string      // used instead of the host of Request if set, such as the server name of a tunnel
+	TLS        *TLSInfo    // the client hello of a tunnel (nil if not known)
+	Lists      ListMatcher // the lists in_list looks in (nil if there are none)
+	Categories Categorizer // the categories of ctx-category (nil if there are none)
+}
+
+// RequestHost returns the host the request is for.
+func (ctx *Context) RequestHost() string {
+	if ctx.Host != "" || ctx.Request == nil {
+		return ctx.Host
+	}
+	return ctx.Request.Host()
 }
 
 func (ctx *Context) Get(field string) (any, error) {
-	if strings.HasPrefix(field, "ctx-") && ctx.RequestCtx == nil {
-		return nil, fmt.Errorf("value not available for field: %s", field)
+	available := true
+	switch {
+	case field == "ctx-sni" || field == "ctx-alpn":
+		available = ctx.TLS != nil
+	case field == "ctx-host" || field == "ctx-category":
+		available = ctx.Host != "" || ctx.Request != nil
+	case strings.HasPrefix(field, "ctx-"):
+		available = ctx.Request != nil
+	case strings.HasPrefix(field, "device-"):
+		available = ctx.Device != nil
 	}
-	if strings.HasPrefix(field, "device-") && ctx.Device == nil {
+	if !available {
 		return nil, fmt.Errorf("value not available for field: %s", field)
 	}
 	switch field {
 	case "device-id":
-		return ctx.Device.ID, nil
+		return ctx.Device.ID.String(), nil // a string so it can be compared to values decoded from json
+	case "device-group":
+		return ctx.Device.Group, nil // the name, "" if the device isn't in a group
+	case "device-tag":
+		return ctx.Device.Tags, nil // equals and contains check whether the device has the tag
 	case "ctx-host":
-		return b2s(ctx.RequestCtx.Host()), nil
+		return ctx.RequestHost(), nil
+	case "ctx-category":
+		if ctx.Categories == nil {
+			return "", nil
+		}
+		return ctx.Categories.Category(ctx.RequestHost()), nil
+	case "ctx-sni":
+		return ctx.TLS.ServerName, nil
+	case "ctx-alpn":
+		return ctx.TLS.ALPN, nil // equals and contains check whether the client supports the protocol
 	case "ctx-method":
-		return b2s(ctx.RequestCtx.Method()), nil
+		return ctx.Request.Method(), nil
 	case "ctx-path":
-		return b2s(ctx.RequestCtx.Path()), nil
+		return ctx.Request.Path(), nil
 	case "ctx-body":
-		return b2s(ctx.RequestCtx.Request.Body()), nil
+		return ctx.Request.Body(), nil
+	case "time-day":
+		return timeDay(time.Now()), nil // equals checks whether it is e.g. "monday" or "weekday"
 	}
 	return nil, fmt.Errorf("unknown field: %s", field)
 }
 
+// timeDay returns the lowercase name of the day and whether it is a weekday or in the weekend.
+func timeDay(t time.Time) []string {
+	kind := "weekday"
+	if d := t.Weekday(); d == time.Saturday || d == time.Sunday {
+		kind = "weekend"
+	}
+	return []string{strings.ToLower(t.Weekday().String()), kind}
+}
+
 func (c *Condition) Evaluate(ctx *Context) (bool, error) {
 	switch c.Operator {
 	case OperatorAND:
@@ -79,6 +153,10 @@ func (c *Condition) Evaluate(ctx *Context) (bool, error) {
 		if err != nil {
 			return false, err
 		}
+		if list, ok := v.([]string); ok {
+			s, _ := c.Value.(string)
+			return slices.Contains(list, s), nil
+		}
 		return v == c.Value, nil
 	case OperatorCT:
 		v, err := ctx.Get(c.Field)
@@ -86,10 +164,59 @@ func (c *Condition) Evaluate(ctx *Context) (bool, error) {
 			return false, err
 		}
 		return handleContains(v, c.Value)
+	case OperatorIn:
+		v, err := ctx.Get(c.Field)
+		if err != nil {
+			return false, err
+		}
+		if ctx.Lists == nil {
+			return false, fmt.Errorf("no lists available")
+		}
+		name, _ := c.Value.(string)
+		switch v := v.(type) {
+		case string:
+			return ctx.Lists.InList(name, v)
+		case []string:
+			for _, s := range v {
+				if in, err := ctx.Lists.InList(name, s); in || err != nil {
+					return in, err
+				}
+			}
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot handle in_list for type: %T", v)
 	}
 	return false, fmt.Errorf("unknown operator: %s", c.Operator)
 }
 
+// Validate checks that the condition (and its sub-conditions) only use known operators and fields.
+func (c *Condition) Validate() error {
+	switch c.Operator {
+	case OperatorAND, OperatorOR:
+		if len(c.Conditions) == 0 {
+			return fmt.Errorf("%w: %s without sub-conditions", ErrInvalidCondition, c.Operator)
+		}
+		for i := range c.Conditions {
+			if err := c.Conditions[i].Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case OperatorEQ, OperatorCT, OperatorIn:
+		if !slices.Contains(Fields, c.Field) {
+			return fmt.Errorf("%w: unknown field: %s", ErrInvalidCondition, c.Field)
+		}
+		if c.Value == nil {
+			return fmt.Errorf("%w: %s on %s without a value", ErrInvalidCondition, c.Operator, c.Field)
+		}
+		if _, ok := c.Value.(string); (c.Operator == OperatorCT || c.Operator == OperatorIn) && !ok {
+			return fmt.Errorf("%w: %s requires a string value", ErrInvalidCondition, c.Operator)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown operator: %s", ErrInvalidCondition, c.Operator)
+}
+
 func handleContains(x, subx any) (bool, error) {
 	// assume the types are the same
 	if x == subx {
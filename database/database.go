@@ -2,11 +2,15 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 
 	_ "embed"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/tiredkangaroo/hat/proxy/config"
 )
 
@@ -14,15 +18,16 @@ import (
 var initialize_sql string
 
 type DB struct {
-	conn *pgx.Conn
+	conn *pgxpool.Pool // a pool because the proxy handlers use the db concurrently
 }
 
 func (db *DB) initialize() error {
 	var err error
-	db.conn, err = pgx.Connect(context.Background(), config.DefaultConfig.Database.PostgresURL)
+	db.conn, err = pgxpool.New(context.Background(), config.DefaultConfig.Database.PostgresURL)
 	if err != nil {
-		return fmt.Errorf("pgx connect: %w", err)
+		return fmt.Errorf("pgxpool connect: %w", err)
 	}
+	db.logUsernameConflicts()
 	_, err = db.conn.Exec(context.Background(), initialize_sql)
 	if err != nil {
 		return fmt.Errorf("create tables: %w", err)
@@ -30,6 +35,35 @@ func (db *DB) initialize() error {
 	return nil
 }
 
+// usernameConflicts is a SQL string to select the users initialize.sql renames because another user has the
+// same username in a different case, with their new username. It must match the rename in initialize.sql.
+const usernameConflicts string = `SELECT username, username || '-' || left(id::text, 8) FROM (
+    SELECT id, username, row_number() OVER (PARTITION BY lower(username) ORDER BY created_at, id) AS n FROM users
+) u WHERE n > 1;`
+
+// logUsernameConflicts warns about the users initialize.sql is about to rename so that usernames are unique
+// regardless of case, since they have to log in with the new name.
+func (db *DB) logUsernameConflicts() {
+	var exists bool
+	if err := db.conn.QueryRow(context.Background(), `SELECT to_regclass('users') IS NOT NULL;`).Scan(&exists); err != nil || !exists {
+		return // a new installation
+	}
+	rows, err := db.conn.Query(context.Background(), usernameConflicts)
+	if err != nil {
+		slog.Error("find usernames that differ only in case", "error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var old, renamed string
+		if err := rows.Scan(&old, &renamed); err != nil {
+			slog.Error("find usernames that differ only in case", "error", err)
+			return
+		}
+		slog.Warn("renaming user because another user has the same username in a different case", "username", old, "new_username", renamed)
+	}
+}
+
 // GetDB returns a database instance. It requires that configuration be initialized.
 func GetDB() (*DB, error) {
 	db := &DB{}
@@ -38,3 +72,22 @@ func GetDB() (*DB, error) {
 	}
 	return db, nil
 }
+
+// execOne executes a statement that is expected to affect exactly one row. It returns pgx.ErrNoRows if no
+// row was affected.
+func (db *DB) execOne(sql string, args ...any) error {
+	tag, err := db.conn.Exec(context.Background(), sql, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
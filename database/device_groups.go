@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	getDeviceGroups    string = `SELECT id, name, created_at, pac_bypass, safe_search FROM device_groups ORDER BY name;`
+	getDeviceGroupByID string = `SELECT id, name, created_at, pac_bypass, safe_search FROM device_groups WHERE id = $1;`
+	// saveDeviceGroup is a SQL string to insert a device group. It returns the newly created group's ID.
+	saveDeviceGroup   string = `INSERT INTO device_groups (name) VALUES ($1) RETURNING id;`
+	deleteDeviceGroup string = `DELETE FROM device_groups WHERE id = $1;`
+	// updateDeviceGroup is a SQL string to change a device group's name, pac bypass list and safe search.
+	updateDeviceGroup string = `UPDATE device_groups SET name = $2, pac_bypass = $3, safe_search = $4 WHERE id = $1;`
+)
+
+var ErrDeviceGroupNameTaken = fmt.Errorf("device group name is already taken")
+
+// DeviceGroup is a named group of devices (e.g. "kids", "iot") that rules can apply to. A device is in at
+// most one group.
+type DeviceGroup struct {
+	ID         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	PACBypass  []string  `json:"pac_bypass"`  // added to the pac bypass list of every device in the group
+	SafeSearch bool      `json:"safe_search"` // enforce safe search for every device in the group
+}
+
+func (g *DeviceGroup) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&g.ID, &g.Name, &g.CreatedAt, &g.PACBypass, &g.SafeSearch)
+}
+
+func (db *DB) GetDeviceGroups() ([]*DeviceGroup, error) {
+	rows, err := db.conn.Query(context.Background(), getDeviceGroups)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*DeviceGroup, error) {
+		var g DeviceGroup
+		return &g, g.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetDeviceGroupByID(id uuid.UUID) (*DeviceGroup, error) {
+	var g DeviceGroup
+	row := db.conn.QueryRow(context.Background(), getDeviceGroupByID, id)
+	if err := g.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// InsertDeviceGroup inserts a new device group. It returns ErrDeviceGroupNameTaken if another device group
+// has the same name.
+func (db *DB) InsertDeviceGroup(name string) (id uuid.UUID, err error) {
+	row := db.conn.QueryRow(context.Background(), saveDeviceGroup, name)
+	err = row.Scan(&id)
+	if isUniqueViolation(err) {
+		err = ErrDeviceGroupNameTaken
+	}
+	return
+}
+
+// UpdateDeviceGroup saves the group's name, pac bypass list and safe search. It returns ErrDeviceGroupNameTaken if
+// another device group has the same name.
+func (db *DB) UpdateDeviceGroup(g *DeviceGroup) error {
+	if g.PACBypass == nil {
+		g.PACBypass = []string{}
+	}
+	err := db.execOne(updateDeviceGroup, g.ID, g.Name, g.PACBypass, g.SafeSearch)
+	if isUniqueViolation(err) {
+		err = ErrDeviceGroupNameTaken
+	}
+	return err
+}
+
+// DeleteDeviceGroup deletes the device group. Its devices are left without a group.
+func (db *DB) DeleteDeviceGroup(id uuid.UUID) error {
+	return db.execOne(deleteDeviceGroup, id)
+}
@@ -2,29 +2,63 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 )
 
 const (
-	// getDeviceByID is a SQL string to select a device by its ID. It returns the device's ID, user_id, device_name, and created_at.
-	getDeviceByID string = `SELECT id, user_id, device_name, created_at FROM devices WHERE id = $1;`
-	// getDevicesByUserID is a SQL string to select all devices for a user by their user ID. It returns the devices' ID, user_id, device_name, and created_at.
-	getDevicesByUserID string = `SELECT id, user_id, device_name, created_at FROM devices WHERE user_id = $1;`
+	// selectDevices selects the columns of devices with the name of their group. It is completed by the queries below.
+	selectDevices string = `SELECT d.id, d.user_id, d.device_name, d.created_at, d.group_id, COALESCE(g.name, ''), d.tags, d.proxy_secret_hash, d.pac_bypass, COALESCE(g.pac_bypass, '{}'), d.mitm_bypass, d.addresses, d.safe_search, COALESCE(g.safe_search, false), d.last_seen_at, d.last_ip, d.last_user_agent, d.total_requests, d.total_bytes FROM devices d LEFT JOIN device_groups g ON g.id = d.group_id `
+	// getDeviceByID is a SQL string to select a device by its ID.
+	getDeviceByID string = selectDevices + `WHERE d.id = $1;`
+	// getDeviceByAddress is a SQL string to select the oldest device with one of the addresses in $1.
+	getDeviceByAddress string = selectDevices + `WHERE d.addresses && $1 ORDER BY d.created_at LIMIT 1;`
+	// getDevicesByUserID is a SQL string to select all devices for a user by their user ID.
+	getDevicesByUserID string = selectDevices + `WHERE d.user_id = $1;`
+	// getDevicesByUserIDs is a SQL string to select the devices of any of the users. It requires an array of user IDs.
+	getDevicesByUserIDs string = selectDevices + `WHERE d.user_id = ANY($1) ORDER BY d.created_at;`
+	// getDevices is a SQL string to select all devices.
+	getDevices string = selectDevices + `ORDER BY d.created_at;`
 	// saveDevice is a SQL string to insert a new device into the database. It returns the newly created device's ID.
 	saveDevice string = `INSERT INTO devices (user_id, device_name) VALUES ($1, $2) RETURNING id;`
+	// updateDevice is a SQL string to change a device's name, group, tags, bypass lists, safe search and addresses. It requires the device's ID, name, group_id, tags, pac_bypass, safe_search, mitm_bypass and addresses.
+	updateDevice string = `UPDATE devices SET device_name = $2, group_id = $3, tags = $4, pac_bypass = $5, safe_search = $6, mitm_bypass = $7, addresses = $8 WHERE id = $1;`
+	// updateDeviceProxySecret is a SQL string to change the hash of a device's proxy password.
+	updateDeviceProxySecret string = `UPDATE devices SET proxy_secret_hash = $2 WHERE id = $1;`
+	// deleteDevice is a SQL string to delete a device by its ID.
+	deleteDevice string = `DELETE FROM devices WHERE id = $1;`
 )
 
 type Device struct {
-	ID        uuid.UUID
-	User      User
-	Name      string
-	CreatedAt string
+	ID         uuid.UUID  `json:"id"`
+	User       User       `json:"user"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	GroupID    *uuid.UUID `json:"group_id,omitempty"`
+	Group      string     `json:"group,omitempty"` // name of the group, read only
+	Tags       []string   `json:"tags"`
+	PACBypass  []string   `json:"pac_bypass"`  // see proxy.PAC
+	MITMBypass []string   `json:"mitm_bypass"` // hosts tunneled without mitm, like mitm.bypass of the configuration
+	Addresses  []string   `json:"addresses"`   // ip and mac addresses the device is identified by in transparent mode
+	SafeSearch bool       `json:"safe_search"` // enforce safe search and youtube restricted mode, also on if the group has it on
+
+	// usage, updated by the proxy every few seconds (see UpdateDeviceUsage)
+	LastSeenAt    *time.Time `json:"last_seen_at,omitempty"`
+	LastIP        string     `json:"last_ip,omitempty"`
+	LastUserAgent string     `json:"last_user_agent,omitempty"`
+	TotalRequests int64      `json:"total_requests"`
+	TotalBytes    int64      `json:"total_bytes"`
+
+	ProxySecretHash string   `json:"-"` // see auth.HashToken, empty if the device only needs its id to use the proxy
+	GroupPACBypass  []string `json:"-"` // the pac bypass list of the device's group
+	GroupSafeSearch bool     `json:"-"` // whether the device's group has safe search on
 }
 
 func (d *Device) unmarshalRow(row pgx.Row) error {
-	return row.Scan(&d.ID, &d.User.ID, &d.Name, &d.CreatedAt)
+	return row.Scan(&d.ID, &d.User.ID, &d.Name, &d.CreatedAt, &d.GroupID, &d.Group, &d.Tags, &d.ProxySecretHash, &d.PACBypass, &d.GroupPACBypass, &d.MITMBypass, &d.Addresses, &d.SafeSearch, &d.GroupSafeSearch,
+		&d.LastSeenAt, &d.LastIP, &d.LastUserAgent, &d.TotalRequests, &d.TotalBytes)
 }
 
 func (db *DB) GetDeviceByID(id uuid.UUID) (*Device, error) {
@@ -36,11 +70,42 @@ func (db *DB) GetDeviceByID(id uuid.UUID) (*Device, error) {
 	return &d, nil
 }
 
+// GetDeviceByAddress returns the device with one of addrs (ip or mac addresses) in its addresses. If more
+// than one has, the oldest one is returned.
+func (db *DB) GetDeviceByAddress(addrs []string) (*Device, error) {
+	var d Device
+	row := db.conn.QueryRow(context.Background(), getDeviceByAddress, addrs)
+	if err := d.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
 func (db *DB) GetDevicesByUserID(userID uuid.UUID) ([]*Device, error) {
 	rows, err := db.conn.Query(context.Background(), getDevicesByUserID, userID)
 	if err != nil {
 		return nil, err
 	}
+	return collectDevices(rows)
+}
+
+func (db *DB) GetDevicesByUserIDs(userIDs []uuid.UUID) ([]*Device, error) {
+	rows, err := db.conn.Query(context.Background(), getDevicesByUserIDs, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	return collectDevices(rows)
+}
+
+func (db *DB) GetDevices() ([]*Device, error) {
+	rows, err := db.conn.Query(context.Background(), getDevices)
+	if err != nil {
+		return nil, err
+	}
+	return collectDevices(rows)
+}
+
+func collectDevices(rows pgx.Rows) ([]*Device, error) {
 	defer rows.Close()
 
 	var devices []*Device
@@ -52,7 +117,7 @@ func (db *DB) GetDevicesByUserID(userID uuid.UUID) ([]*Device, error) {
 		devices = append(devices, &d)
 	}
 
-	return devices, nil
+	return devices, rows.Err()
 }
 
 func (db *DB) InsertDevice(userID uuid.UUID, deviceName string) (uuid.UUID, error) {
@@ -63,3 +128,28 @@ func (db *DB) InsertDevice(userID uuid.UUID, deviceName string) (uuid.UUID, erro
 	}
 	return id, nil
 }
+
+// UpdateDevice saves the device's name, group, tags, bypass lists, safe search and addresses.
+func (db *DB) UpdateDevice(d *Device) error {
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+	if d.PACBypass == nil {
+		d.PACBypass = []string{}
+	}
+	if d.MITMBypass == nil {
+		d.MITMBypass = []string{}
+	}
+	if d.Addresses == nil {
+		d.Addresses = []string{}
+	}
+	return db.execOne(updateDevice, d.ID, d.Name, d.GroupID, d.Tags, d.PACBypass, d.SafeSearch, d.MITMBypass, d.Addresses)
+}
+
+func (db *DB) UpdateDeviceProxySecret(id uuid.UUID, secretHash string) error {
+	return db.execOne(updateDeviceProxySecret, id, secretHash)
+}
+
+func (db *DB) DeleteDevice(id uuid.UUID) error {
+	return db.execOne(deleteDevice, id)
+}
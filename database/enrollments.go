@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getPendingEnrollments is a SQL string to select the enrollments that were not used and have not expired.
+	getPendingEnrollments string = `SELECT id, user_id, device_name, created_at, expires_at, used_at, device_id FROM enrollments WHERE used_at IS NULL AND expires_at > CURRENT_TIMESTAMP ORDER BY created_at DESC;`
+	// getPendingEnrollmentsByUserIDs is like getPendingEnrollments for the devices of any of the users. It requires an array of user IDs.
+	getPendingEnrollmentsByUserIDs string = `SELECT id, user_id, device_name, created_at, expires_at, used_at, device_id FROM enrollments WHERE used_at IS NULL AND expires_at > CURRENT_TIMESTAMP AND user_id = ANY($1) ORDER BY created_at DESC;`
+	getEnrollmentByID              string = `SELECT id, user_id, device_name, created_at, expires_at, used_at, device_id FROM enrollments WHERE id = $1;`
+	// saveEnrollment is a SQL string to insert an enrollment. It requires the user_id, device_name, code_hash and expires_at and returns the new enrollment's ID.
+	saveEnrollment   string = `INSERT INTO enrollments (user_id, device_name, code_hash, expires_at) VALUES ($1, $2, $3, $4) RETURNING id;`
+	deleteEnrollment string = `DELETE FROM enrollments WHERE id = $1;`
+	// useEnrollment is a SQL string to mark an unused, unexpired enrollment as used by its code hash. It returns the user_id and device_name.
+	useEnrollment string = `UPDATE enrollments SET used_at = CURRENT_TIMESTAMP WHERE code_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP RETURNING id, user_id, device_name;`
+	// saveEnrolledDevice is a SQL string to insert the device of an enrollment with its proxy secret hash. It returns the device's ID.
+	saveEnrolledDevice string = `INSERT INTO devices (user_id, device_name, proxy_secret_hash) VALUES ($1, $2, $3) RETURNING id;`
+	// setEnrollmentDevice is a SQL string to record the device that was created by an enrollment.
+	setEnrollmentDevice string = `UPDATE enrollments SET device_id = $2 WHERE id = $1;`
+)
+
+var ErrInvalidEnrollmentCode = fmt.Errorf("invalid or expired enrollment code")
+
+// Enrollment lets a device add itself with a one-time code. The code itself is only stored hashed.
+type Enrollment struct {
+	ID         uuid.UUID  `json:"id"`
+	User       User       `json:"user"` // the user the device will belong to
+	DeviceName string     `json:"device_name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	DeviceID   *uuid.UUID `json:"device_id,omitempty"` // the device created when the code was used
+}
+
+func (e *Enrollment) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&e.ID, &e.User.ID, &e.DeviceName, &e.CreatedAt, &e.ExpiresAt, &e.UsedAt, &e.DeviceID)
+}
+
+func (db *DB) GetPendingEnrollments() ([]*Enrollment, error) {
+	return db.queryEnrollments(getPendingEnrollments)
+}
+
+func (db *DB) GetPendingEnrollmentsByUserIDs(userIDs []uuid.UUID) ([]*Enrollment, error) {
+	return db.queryEnrollments(getPendingEnrollmentsByUserIDs, userIDs)
+}
+
+func (db *DB) queryEnrollments(sql string, args ...any) ([]*Enrollment, error) {
+	rows, err := db.conn.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Enrollment, error) {
+		var e Enrollment
+		return &e, e.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetEnrollmentByID(id uuid.UUID) (*Enrollment, error) {
+	var e Enrollment
+	row := db.conn.QueryRow(context.Background(), getEnrollmentByID, id)
+	if err := e.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// InsertEnrollment stores the enrollment with the hash of its code (see auth.HashEnrollmentCode).
+func (db *DB) InsertEnrollment(e *Enrollment, codeHash string) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveEnrollment, e.User.ID, e.DeviceName, codeHash, e.ExpiresAt)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (db *DB) DeleteEnrollment(id uuid.UUID) error {
+	return db.execOne(deleteEnrollment, id)
+}
+
+// ClaimEnrollment uses the enrollment with the code hash and creates its device with the proxy secret hash.
+// It returns ErrInvalidEnrollmentCode if there is no unused, unexpired enrollment with the code.
+func (db *DB) ClaimEnrollment(codeHash, secretHash string) (*Device, error) {
+	tx, err := db.conn.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var enrollmentID uuid.UUID
+	d := &Device{ProxySecretHash: secretHash}
+	err = tx.QueryRow(context.Background(), useEnrollment, codeHash).Scan(&enrollmentID, &d.User.ID, &d.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidEnrollmentCode
+	} else if err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(context.Background(), saveEnrolledDevice, d.User.ID, d.Name, secretHash).Scan(&d.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(context.Background(), setEnrollmentDevice, enrollmentID, d.ID); err != nil {
+		return nil, err
+	}
+	return d, tx.Commit(context.Background())
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getGroups is a SQL string to select all user groups.
+	getGroups string = `SELECT id, name, created_at FROM user_groups ORDER BY name;`
+	// getGroupsByUserID is a SQL string to select the user groups a user is a member of.
+	getGroupsByUserID string = `SELECT g.id, g.name, g.created_at FROM user_groups g JOIN user_group_members m ON m.group_id = g.id WHERE m.user_id = $1 ORDER BY g.name;`
+	getGroupByID      string = `SELECT id, name, created_at FROM user_groups WHERE id = $1;`
+	// getGroupMembers is a SQL string to select the members of a user group and whether they manage it.
+	getGroupMembers string = `SELECT user_id, manager FROM user_group_members WHERE group_id = $1;`
+	// saveGroup is a SQL string to insert a user group. It returns the newly created group's ID.
+	saveGroup   string = `INSERT INTO user_groups (name) VALUES ($1) RETURNING id;`
+	deleteGroup string = `DELETE FROM user_groups WHERE id = $1;`
+	// saveGroupMember is a SQL string to add a user to a group, or change whether they manage it if they're already a member.
+	saveGroupMember   string = `INSERT INTO user_group_members (group_id, user_id, manager) VALUES ($1, $2, $3) ON CONFLICT (group_id, user_id) DO UPDATE SET manager = EXCLUDED.manager;`
+	deleteGroupMember string = `DELETE FROM user_group_members WHERE group_id = $1 AND user_id = $2;`
+)
+
+var ErrGroupNameTaken = fmt.Errorf("group name is already taken")
+
+// Group is a group of users, e.g. a family. Managers of a group can manage the devices and rules of the
+// other members.
+type Group struct {
+	ID        uuid.UUID     `json:"id"`
+	Name      string        `json:"name"`
+	CreatedAt time.Time     `json:"created_at"`
+	Members   []GroupMember `json:"members"`
+}
+
+type GroupMember struct {
+	UserID  uuid.UUID `json:"user_id"`
+	Manager bool      `json:"manager"`
+}
+
+func (db *DB) GetGroups() ([]*Group, error) {
+	return db.queryGroups(getGroups)
+}
+
+func (db *DB) GetGroupsByUserID(userID uuid.UUID) ([]*Group, error) {
+	return db.queryGroups(getGroupsByUserID, userID)
+}
+
+func (db *DB) GetGroupByID(id uuid.UUID) (*Group, error) {
+	var g Group
+	row := db.conn.QueryRow(context.Background(), getGroupByID, id)
+	if err := row.Scan(&g.ID, &g.Name, &g.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := db.loadGroupMembers(&g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (db *DB) queryGroups(sql string, args ...any) ([]*Group, error) {
+	rows, err := db.conn.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Group, error) {
+		var g Group
+		return &g, row.Scan(&g.ID, &g.Name, &g.CreatedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if err := db.loadGroupMembers(g); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (db *DB) loadGroupMembers(g *Group) error {
+	rows, err := db.conn.Query(context.Background(), getGroupMembers, g.ID)
+	if err != nil {
+		return err
+	}
+	g.Members, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (GroupMember, error) {
+		var m GroupMember
+		return m, row.Scan(&m.UserID, &m.Manager)
+	})
+	return err
+}
+
+// InsertGroup inserts a new group. It returns ErrGroupNameTaken if another group has the same name.
+func (db *DB) InsertGroup(name string) (id uuid.UUID, err error) {
+	row := db.conn.QueryRow(context.Background(), saveGroup, name)
+	err = row.Scan(&id)
+	if isUniqueViolation(err) {
+		err = ErrGroupNameTaken
+	}
+	return
+}
+
+func (db *DB) DeleteGroup(id uuid.UUID) error {
+	return db.execOne(deleteGroup, id)
+}
+
+func (db *DB) SaveGroupMember(groupID, userID uuid.UUID, manager bool) error {
+	_, err := db.conn.Exec(context.Background(), saveGroupMember, groupID, userID, manager)
+	return err
+}
+
+func (db *DB) DeleteGroupMember(groupID, userID uuid.UUID) error {
+	return db.execOne(deleteGroupMember, groupID, userID)
+}
@@ -1,11 +1,11 @@
-CREATE TABLE users IF NOT EXISTS (
+CREATE TABLE IF NOT EXISTS users (
     id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
     username TEXT NOT NULL,
     hashed_password TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
-CREATE table devices IF NOT EXISTS (
+CREATE TABLE IF NOT EXISTS devices (
     id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
     user_id uuid REFERENCES users(id) ON DELETE CASCADE,
     device_name TEXT NOT NULL,
@@ -20,4 +20,228 @@ CREATE TABLE IF NOT EXISTS rules (
     condition JSONB NOT NULL,
     rule_action JSONB NOT NULL,
     in_effect boolean DEFAULT FALSE
-)
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS requests (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id uuid REFERENCES devices(id) ON DELETE SET NULL,
+    replay_of uuid REFERENCES requests(id) ON DELETE SET NULL,
+    method text NOT NULL,
+    url text NOT NULL,
+    host text NOT NULL,
+    request_headers JSONB NOT NULL,
+    request_body bytea,
+    status_code integer NOT NULL,
+    response_headers JSONB NOT NULL,
+    response_body bytea,
+    duration_ms bigint NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS rule_id uuid REFERENCES rules(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS bans (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    ip text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    rule_id uuid REFERENCES rules(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ
+);
+
+-- usernames are unique regardless of case. existing installations may have usernames that only differ in
+-- case: the oldest keeps its name and the others get the start of their id appended, which is logged on startup
+UPDATE users SET username = username || '-' || left(id::text, 8) WHERE id IN (
+    SELECT id FROM (SELECT id, row_number() OVER (PARTITION BY lower(username) ORDER BY created_at, id) AS n FROM users) u WHERE n > 1
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (lower(username));
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash text NOT NULL UNIQUE,
+    csrf_token text NOT NULL,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    scope text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash text NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMPTZ
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'member';
+-- existing installations: the first user becomes the owner so someone can still administer hat
+UPDATE users SET role = 'owner' WHERE id = (SELECT id FROM users ORDER BY created_at LIMIT 1) AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'owner');
+
+CREATE TABLE IF NOT EXISTS user_groups (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    name text NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS user_group_members (
+    group_id uuid NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    manager boolean NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_groups (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    name text NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS group_id uuid REFERENCES device_groups(id) ON DELETE SET NULL;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+
+-- rules still belong to a user (who can manage them), but can apply to a device group, a tag or a single device instead
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT 'user';
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS target text NOT NULL DEFAULT '';
+
+-- sha256 of the device's proxy password, empty for devices that authenticate with their id only
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS proxy_secret_hash text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS enrollments (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name text NOT NULL,
+    code_hash text NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    device_id uuid REFERENCES devices(id) ON DELETE SET NULL
+);
+
+-- hosts and networks the proxy auto-config file sends directly instead of through the proxy
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS pac_bypass text[] NOT NULL DEFAULT '{}';
+ALTER TABLE device_groups ADD COLUMN IF NOT EXISTS pac_bypass text[] NOT NULL DEFAULT '{}';
+
+-- usage stats, kept in memory by the proxy and added here periodically
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_ip text NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_user_agent text NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS total_requests bigint NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS total_bytes bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS quotas (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    scope text NOT NULL,
+    target uuid NOT NULL,
+    category text NOT NULL DEFAULT '',
+    max_bytes_per_day bigint NOT NULL DEFAULT 0,
+    max_bytes_per_week bigint NOT NULL DEFAULT 0,
+    max_minutes_per_day bigint NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+-- usage per device and day, for all traffic (category '') and per host category
+CREATE TABLE IF NOT EXISTS device_daily_usage (
+    device_id uuid NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    day date NOT NULL,
+    category text NOT NULL DEFAULT '',
+    bytes bigint NOT NULL DEFAULT 0,
+    minutes bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (device_id, day, category)
+);
+
+CREATE TABLE IF NOT EXISTS access_requests (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id uuid NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    host text NOT NULL,
+    rule_id uuid REFERENCES rules(id) ON DELETE SET NULL,
+    reason text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMPTZ,
+    decided_by uuid REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ
+);
+
+-- a device can only have one pending request per host
+CREATE UNIQUE INDEX IF NOT EXISTS access_requests_pending ON access_requests (device_id, host) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS overrides (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind text NOT NULL,
+    target uuid NOT NULL,
+    created_by uuid REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS blocklists (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    name text NOT NULL UNIQUE,
+    source text NOT NULL,
+    refresh_minutes integer NOT NULL DEFAULT 1440,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    refreshed_at TIMESTAMPTZ,
+    entries integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT ''
+);
+
+-- safe search and youtube restricted mode, enforced for a device if it or its group has it on
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS safe_search boolean NOT NULL DEFAULT false;
+ALTER TABLE device_groups ADD COLUMN IF NOT EXISTS safe_search boolean NOT NULL DEFAULT false;
+
+-- hosts tunneled without mitm for a device, along with mitm.bypass of the configuration
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS mitm_bypass text[] NOT NULL DEFAULT '{}';
+
+-- hosts whose clients kept aborting the handshake with the mitm certificate (e.g. because they pin the
+-- certificate), tunneled without mitm until expires_at
+CREATE TABLE IF NOT EXISTS pinned_hosts (
+    host text PRIMARY KEY,
+    failures integer NOT NULL,
+    learned_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- frames of websocket connections, logged with the handshake's request if capture.websocket_frames is on
+CREATE TABLE IF NOT EXISTS websocket_frames (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    request_id uuid NOT NULL REFERENCES requests(id) ON DELETE CASCADE,
+    from_client boolean NOT NULL,
+    opcode text NOT NULL,
+    size bigint NOT NULL,
+    text text NOT NULL DEFAULT '',
+    close_code integer,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS websocket_frames_request ON websocket_frames (request_id, created_at);
+
+-- ip and mac addresses that identify a device in transparent mode, where connections have no credentials
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS addresses text[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS devices_addresses ON devices USING GIN (addresses);
+
+-- replays refuse to send a body that was cut to capture.max_body_bytes as if it was whole
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS request_body_truncated boolean NOT NULL DEFAULT false;
+
+-- the request log is pruned by age (capture.retention_days). deleting a request sets replay_of of its replays
+-- to null, which needs an index to not scan the table for every deleted request.
+CREATE INDEX IF NOT EXISTS requests_created_at ON requests (created_at);
+CREATE INDEX IF NOT EXISTS requests_replay_of ON requests (replay_of) WHERE replay_of IS NOT NULL;
+CREATE INDEX IF NOT EXISTS websocket_frames_created_at ON websocket_frames (created_at);
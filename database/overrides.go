@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	OverridePauseRule   = "pause_rule"   // the rule doesn't apply
+	OverridePauseDevice = "pause_device" // no rules or quotas apply to the device
+	OverrideBlockDevice = "block_device" // everything the device requests is blocked
+)
+
+// OverrideKinds are the kinds of overrides.
+var OverrideKinds = []string{OverridePauseRule, OverridePauseDevice, OverrideBlockDevice}
+
+const (
+	// getActiveOverrides is a SQL string to select the overrides that have not expired.
+	getActiveOverrides string = `SELECT id, kind, target, created_by, created_at, expires_at FROM overrides WHERE expires_at > CURRENT_TIMESTAMP ORDER BY created_at;`
+	getOverrideByID    string = `SELECT id, kind, target, created_by, created_at, expires_at FROM overrides WHERE id = $1;`
+	// saveOverride is a SQL string to insert an override. It requires the kind, target, created_by and expires_at and returns the new override's ID.
+	saveOverride   string = `INSERT INTO overrides (kind, target, created_by, expires_at) VALUES ($1, $2, $3, $4) RETURNING id;`
+	deleteOverride string = `DELETE FROM overrides WHERE id = $1;`
+	// deleteExpiredOverrides is a SQL string to delete the overrides that expired.
+	deleteExpiredOverrides string = `DELETE FROM overrides WHERE expires_at <= CURRENT_TIMESTAMP;`
+)
+
+var ErrInvalidOverride = fmt.Errorf("invalid override")
+
+// Override temporarily changes how rules apply: it pauses a rule, pauses filtering for a device or blocks a
+// device. It reverts by itself once it expires.
+type Override struct {
+	ID        uuid.UUID  `json:"id"`
+	Kind      string     `json:"kind"`   // see OverrideKinds
+	Target    uuid.UUID  `json:"target"` // the rule for pause_rule, otherwise the device
+	CreatedBy *uuid.UUID `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+func (o *Override) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&o.ID, &o.Kind, &o.Target, &o.CreatedBy, &o.CreatedAt, &o.ExpiresAt)
+}
+
+// Validate checks the kind and target.
+func (o *Override) Validate() error {
+	switch o.Kind {
+	case OverridePauseRule, OverridePauseDevice, OverrideBlockDevice:
+	default:
+		return fmt.Errorf("%w: unknown kind: %s", ErrInvalidOverride, o.Kind)
+	}
+	if o.Target == uuid.Nil {
+		return fmt.Errorf("%w: missing target", ErrInvalidOverride)
+	}
+	return nil
+}
+
+// GetActiveOverrides returns the overrides that have not expired.
+func (db *DB) GetActiveOverrides() ([]*Override, error) {
+	rows, err := db.conn.Query(context.Background(), getActiveOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Override, error) {
+		var o Override
+		return &o, o.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetOverrideByID(id uuid.UUID) (*Override, error) {
+	var o Override
+	row := db.conn.QueryRow(context.Background(), getOverrideByID, id)
+	if err := o.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (db *DB) InsertOverride(o *Override) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveOverride, o.Kind, o.Target, o.CreatedBy, o.ExpiresAt)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (db *DB) DeleteOverride(id uuid.UUID) error {
+	return db.execOne(deleteOverride, id)
+}
+
+// DeleteExpiredOverrides deletes the overrides that expired. They have no effect, so this is only cleanup.
+func (db *DB) DeleteExpiredOverrides() error {
+	_, err := db.conn.Exec(context.Background(), deleteExpiredOverrides)
+	return err
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getPinnedHosts is a SQL string to select all pinned hosts, including expired ones.
+	getPinnedHosts string = `SELECT host, failures, learned_at, expires_at FROM pinned_hosts ORDER BY learned_at DESC;`
+	// getActivePinnedHosts is a SQL string to select the pinned hosts that have not expired.
+	getActivePinnedHosts string = `SELECT host, failures, learned_at, expires_at FROM pinned_hosts WHERE expires_at > CURRENT_TIMESTAMP;`
+	// savePinnedHost is a SQL string to insert a pinned host, or learn it again if it is already there.
+	savePinnedHost string = `INSERT INTO pinned_hosts (host, failures, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (host) DO UPDATE SET failures = EXCLUDED.failures, learned_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at;`
+	deletePinnedHost string = `DELETE FROM pinned_hosts WHERE host = $1;`
+)
+
+// PinnedHost is a host whose clients kept aborting the handshake with the mitm certificate, so the proxy
+// tunnels it without mitm for a while.
+type PinnedHost struct {
+	Host      string    `json:"host"`
+	Failures  int       `json:"failures"` // aborted handshakes it was learned after
+	LearnedAt time.Time `json:"learned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (p *PinnedHost) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&p.Host, &p.Failures, &p.LearnedAt, &p.ExpiresAt)
+}
+
+func (db *DB) GetPinnedHosts() ([]*PinnedHost, error) {
+	return db.queryPinnedHosts(getPinnedHosts)
+}
+
+func (db *DB) GetActivePinnedHosts() ([]*PinnedHost, error) {
+	return db.queryPinnedHosts(getActivePinnedHosts)
+}
+
+func (db *DB) queryPinnedHosts(sql string) ([]*PinnedHost, error) {
+	rows, err := db.conn.Query(context.Background(), sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hosts []*PinnedHost
+	for rows.Next() {
+		var p PinnedHost
+		if err := p.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, &p)
+	}
+	return hosts, rows.Err()
+}
+
+// SavePinnedHost saves that host is pinned until expiresAt.
+func (db *DB) SavePinnedHost(host string, failures int, expiresAt time.Time) error {
+	_, err := db.conn.Exec(context.Background(), savePinnedHost, host, failures, expiresAt)
+	return err
+}
+
+func (db *DB) DeletePinnedHost(host string) error {
+	return db.execOne(deletePinnedHost, host)
+}
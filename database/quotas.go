@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	QuotaScopeDevice = "device" // applies to one device
+	QuotaScopeGroup  = "group"  // applies to each device in a device group on its own
+)
+
+const (
+	getQuotas    string = `SELECT id, scope, target, category, max_bytes_per_day, max_bytes_per_week, max_minutes_per_day, created_at FROM quotas ORDER BY created_at;`
+	getQuotaByID string = `SELECT id, scope, target, category, max_bytes_per_day, max_bytes_per_week, max_minutes_per_day, created_at FROM quotas WHERE id = $1;`
+	// saveQuota is a SQL string to insert a quota. It returns the newly created quota's ID.
+	saveQuota   string = `INSERT INTO quotas (scope, target, category, max_bytes_per_day, max_bytes_per_week, max_minutes_per_day) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;`
+	deleteQuota string = `DELETE FROM quotas WHERE id = $1;`
+	// getQuotaUsage is a SQL string to select the bytes used today, the bytes used since the start of the week and the
+	// active minutes today of a device in a category. It requires the device's ID, the category, today and the first day of the week.
+	getQuotaUsage string = `SELECT COALESCE(SUM(bytes) FILTER (WHERE day = $3), 0), COALESCE(SUM(bytes), 0), COALESCE(SUM(minutes) FILTER (WHERE day = $3), 0) FROM device_daily_usage WHERE device_id = $1 AND category = $2 AND day BETWEEN $4 AND $3;`
+	// addDailyUsage is a SQL string to add bytes and minutes to a device's usage of a day in a category.
+	addDailyUsage string = `INSERT INTO device_daily_usage (device_id, day, category, bytes, minutes) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (device_id, day, category) DO UPDATE SET bytes = device_daily_usage.bytes + EXCLUDED.bytes, minutes = device_daily_usage.minutes + EXCLUDED.minutes;`
+)
+
+var ErrInvalidQuota = fmt.Errorf("invalid quota")
+
+// Quota limits how much a device can use per day or week. Zero limits are not enforced. With a category,
+// only traffic to hosts in the category counts (see the ctx-category field).
+type Quota struct {
+	ID               uuid.UUID `json:"id"`
+	Scope            string    `json:"scope"`  // QuotaScopeDevice or QuotaScopeGroup
+	Target           uuid.UUID `json:"target"` // the device or device group id
+	Category         string    `json:"category,omitempty"`
+	MaxBytesPerDay   int64     `json:"max_bytes_per_day,omitempty"`
+	MaxBytesPerWeek  int64     `json:"max_bytes_per_week,omitempty"`
+	MaxMinutesPerDay int64     `json:"max_minutes_per_day,omitempty"` // minutes with at least one request
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func (q *Quota) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&q.ID, &q.Scope, &q.Target, &q.Category, &q.MaxBytesPerDay, &q.MaxBytesPerWeek, &q.MaxMinutesPerDay, &q.CreatedAt)
+}
+
+// Validate checks the scope and that the quota limits something.
+func (q *Quota) Validate() error {
+	if q.Scope != QuotaScopeDevice && q.Scope != QuotaScopeGroup {
+		return fmt.Errorf("%w: unknown scope: %s", ErrInvalidQuota, q.Scope)
+	}
+	if q.Target == uuid.Nil {
+		return fmt.Errorf("%w: missing target", ErrInvalidQuota)
+	}
+	if q.MaxBytesPerDay < 0 || q.MaxBytesPerWeek < 0 || q.MaxMinutesPerDay < 0 {
+		return fmt.Errorf("%w: limits can't be negative", ErrInvalidQuota)
+	}
+	if q.MaxBytesPerDay == 0 && q.MaxBytesPerWeek == 0 && q.MaxMinutesPerDay == 0 {
+		return fmt.Errorf("%w: no limit set", ErrInvalidQuota)
+	}
+	return nil
+}
+
+func (db *DB) GetQuotas() ([]*Quota, error) {
+	rows, err := db.conn.Query(context.Background(), getQuotas)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Quota, error) {
+		var q Quota
+		return &q, q.unmarshalRow(row)
+	})
+}
+
+func (db *DB) GetQuotaByID(id uuid.UUID) (*Quota, error) {
+	var q Quota
+	row := db.conn.QueryRow(context.Background(), getQuotaByID, id)
+	if err := q.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (db *DB) InsertQuota(q *Quota) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveQuota, q.Scope, q.Target, q.Category, q.MaxBytesPerDay, q.MaxBytesPerWeek, q.MaxMinutesPerDay)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (db *DB) DeleteQuota(id uuid.UUID) error {
+	return db.execOne(deleteQuota, id)
+}
+
+// QuotaUsage is what a device used in a category (or everything for "").
+type QuotaUsage struct {
+	BytesToday    int64 `json:"bytes_today"`
+	BytesThisWeek int64 `json:"bytes_this_week"`
+	MinutesToday  int64 `json:"minutes_today"`
+}
+
+// GetQuotaUsage returns the stored usage of the device in the category on day and in the week starting
+// on weekStart.
+func (db *DB) GetQuotaUsage(deviceID uuid.UUID, category string, day, weekStart time.Time) (QuotaUsage, error) {
+	var u QuotaUsage
+	row := db.conn.QueryRow(context.Background(), getQuotaUsage, deviceID, category, day, weekStart)
+	err := row.Scan(&u.BytesToday, &u.BytesThisWeek, &u.MinutesToday)
+	return u, err
+}
+
+// DailyUsage is usage of a device on a day in a category, to be added to what is stored.
+type DailyUsage struct {
+	DeviceID uuid.UUID
+	Day      time.Time
+	Category string
+	Bytes    int64
+	Minutes  int64
+}
+
+// AddDailyUsage adds the usage in a single round trip.
+func (db *DB) AddDailyUsage(usage []DailyUsage) error {
+	batch := &pgx.Batch{}
+	for _, u := range usage {
+		batch.Queue(addDailyUsage, u.DeviceID, u.Day, u.Category, u.Bytes, u.Minutes)
+	}
+	return db.conn.SendBatch(context.Background(), batch).Close()
+}
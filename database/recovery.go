@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// deleteRecoveryCodesByUserID is a SQL string to delete every recovery code of a user.
+	deleteRecoveryCodesByUserID string = `DELETE FROM recovery_codes WHERE user_id = $1;`
+	// saveRecoveryCode is a SQL string to insert the hash of a recovery code for a user.
+	saveRecoveryCode string = `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2);`
+	// useRecoveryCode is a SQL string to mark an unused recovery code of a user as used. It requires the user's ID and the code's hash.
+	useRecoveryCode string = `UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`
+)
+
+// ReplaceRecoveryCodes deletes the user's recovery codes and stores the new code hashes instead.
+func (db *DB) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := db.conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(context.Background(), deleteRecoveryCodesByUserID, userID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec(context.Background(), saveRecoveryCode, userID, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+func (db *DB) DeleteRecoveryCodes(userID uuid.UUID) error {
+	_, err := db.conn.Exec(context.Background(), deleteRecoveryCodesByUserID, userID)
+	return err
+}
+
+// UseRecoveryCode marks the recovery code with the hash as used. It returns false if the user has no such
+// unused code.
+func (db *DB) UseRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	tag, err := db.conn.Exec(context.Background(), useRecoveryCode, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
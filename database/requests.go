@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getLoggedRequestByID is a SQL string to select a logged request by its ID.
+	getLoggedRequestByID string = `SELECT id, device_id, rule_id, replay_of, method, url, host, request_headers, request_body, request_body_truncated, status_code, response_headers, response_body, duration_ms, created_at FROM requests WHERE id = $1;`
+	// getRecentLoggedRequests is a SQL string to select the most recent logged requests, without their bodies. It
+	// requires a limit as input.
+	getRecentLoggedRequests string = `SELECT id, device_id, rule_id, replay_of, method, url, host, request_headers, request_body_truncated, status_code, response_headers, duration_ms, created_at FROM requests ORDER BY created_at DESC LIMIT $1;`
+	// getRecentLoggedRequestsByDeviceID is a SQL string to select the most recent logged requests of a device, without
+	// their bodies. It requires the device's ID and a limit as input.
+	getRecentLoggedRequestsByDeviceID string = `SELECT id, device_id, rule_id, replay_of, method, url, host, request_headers, request_body_truncated, status_code, response_headers, duration_ms, created_at FROM requests WHERE device_id = $1 ORDER BY created_at DESC LIMIT $2;`
+	// getRecentLoggedRequestsByUserIDs is a SQL string to select the most recent logged requests of the devices of any
+	// of the users, without their bodies. It requires an array of user IDs and a limit as input.
+	getRecentLoggedRequestsByUserIDs string = `SELECT id, device_id, rule_id, replay_of, method, url, host, request_headers, request_body_truncated, status_code, response_headers, duration_ms, created_at FROM requests WHERE device_id IN (SELECT id FROM devices WHERE user_id = ANY($1)) ORDER BY created_at DESC LIMIT $2;`
+	// pruneLoggedRequests is a SQL string to delete a batch of logged requests older than a number of days. It requires
+	// the number of days and the size of the batch.
+	pruneLoggedRequests string = `DELETE FROM requests WHERE id IN (SELECT id FROM requests WHERE created_at < now() - make_interval(days => $1) LIMIT $2);`
+	// saveLoggedRequest is a SQL string to insert a logged request. The id is generated by the proxy so events can
+	// reference the request before it is stored. It returns the id of the newly created row.
+	saveLoggedRequest string = `INSERT INTO requests (id, device_id, rule_id, replay_of, method, url, host, request_headers, request_body, request_body_truncated, status_code, response_headers, response_body, duration_ms) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id;`
+)
+
+// Header is a single header key and value. Headers are kept as an ordered list instead of a map because
+// order and duplicate keys matter when replaying a request.
+type Header struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// LoggedRequest is a request (and its response) that went through the proxy.
+type LoggedRequest struct {
+	ID                   uuid.UUID  `json:"id"`
+	DeviceID             *uuid.UUID `json:"device_id,omitempty"` // nil if the device is unknown
+	RuleID               *uuid.UUID `json:"rule_id,omitempty"`   // the rule that matched the request, if any
+	ReplayOf             *uuid.UUID `json:"replay_of,omitempty"` // set if this request is a replay of another request
+	Method               string     `json:"method"`
+	URL                  string     `json:"url"`
+	Host                 string     `json:"host"`
+	RequestHeaders       []Header   `json:"request_headers"`
+	RequestBody          []byte     `json:"request_body,omitempty"`
+	RequestBodyTruncated bool       `json:"request_body_truncated,omitempty"` // the request body is longer than what was logged
+	StatusCode           int        `json:"status_code"`
+	ResponseHeaders      []Header   `json:"response_headers"`
+	ResponseBody         []byte     `json:"response_body,omitempty"`
+	Duration             int64      `json:"duration_ms"` // in milliseconds
+	CreatedAt            time.Time  `json:"created_at"`
+}
+
+func (r *LoggedRequest) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&r.ID, &r.DeviceID, &r.RuleID, &r.ReplayOf, &r.Method, &r.URL, &r.Host, &r.RequestHeaders, &r.RequestBody,
+		&r.RequestBodyTruncated, &r.StatusCode, &r.ResponseHeaders, &r.ResponseBody, &r.Duration, &r.CreatedAt)
+}
+
+// unmarshalListRow is unmarshalRow for the rows of lists, which leave the bodies out.
+func (r *LoggedRequest) unmarshalListRow(row pgx.Row) error {
+	return row.Scan(&r.ID, &r.DeviceID, &r.RuleID, &r.ReplayOf, &r.Method, &r.URL, &r.Host, &r.RequestHeaders,
+		&r.RequestBodyTruncated, &r.StatusCode, &r.ResponseHeaders, &r.Duration, &r.CreatedAt)
+}
+
+// GetLoggedRequestByID returns the logged request with id, with its bodies.
+func (db *DB) GetLoggedRequestByID(id uuid.UUID) (*LoggedRequest, error) {
+	var r LoggedRequest
+	row := db.conn.QueryRow(context.Background(), getLoggedRequestByID, id)
+	if err := r.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetRecentLoggedRequests returns the most recent logged requests, newest first. Their bodies are left out, they
+// are only returned by GetLoggedRequestByID.
+func (db *DB) GetRecentLoggedRequests(limit int) ([]*LoggedRequest, error) {
+	rows, err := db.conn.Query(context.Background(), getRecentLoggedRequests, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectLoggedRequests(rows)
+}
+
+func (db *DB) GetRecentLoggedRequestsByDeviceID(deviceID uuid.UUID, limit int) ([]*LoggedRequest, error) {
+	rows, err := db.conn.Query(context.Background(), getRecentLoggedRequestsByDeviceID, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectLoggedRequests(rows)
+}
+
+func (db *DB) GetRecentLoggedRequestsByUserIDs(userIDs []uuid.UUID, limit int) ([]*LoggedRequest, error) {
+	rows, err := db.conn.Query(context.Background(), getRecentLoggedRequestsByUserIDs, userIDs, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectLoggedRequests(rows)
+}
+
+func collectLoggedRequests(rows pgx.Rows) ([]*LoggedRequest, error) {
+	defer rows.Close()
+
+	var requests []*LoggedRequest
+	for rows.Next() {
+		var r LoggedRequest
+		if err := r.unmarshalListRow(rows); err != nil {
+			return nil, err
+		}
+		requests = append(requests, &r)
+	}
+	return requests, rows.Err()
+}
+
+// InsertLoggedRequest stores r in the request log. If r.ID is uuid.Nil, a new id is generated.
+func (db *DB) InsertLoggedRequest(r *LoggedRequest) (uuid.UUID, error) {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveLoggedRequest, r.ID, r.DeviceID, r.RuleID, r.ReplayOf, r.Method, r.URL, r.Host,
+		r.RequestHeaders, r.RequestBody, r.RequestBodyTruncated, r.StatusCode, r.ResponseHeaders, r.ResponseBody, r.Duration)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// rows deleted at a time when pruning, so the tables aren't locked for long
+const pruneBatch = 10000
+
+// PruneLoggedRequests deletes the logged requests and websocket frames older than days. It returns how many
+// requests were deleted.
+func (db *DB) PruneLoggedRequests(days int) (int64, error) {
+	if _, err := db.deleteInBatches(pruneWebSocketFrames, days); err != nil {
+		return 0, err
+	}
+	return db.deleteInBatches(pruneLoggedRequests, days)
+}
+
+// deleteInBatches runs a delete statement that takes an argument and the size of a batch until it deletes
+// less than a batch. It returns how many rows were deleted.
+func (db *DB) deleteInBatches(sql string, arg any) (int64, error) {
+	var deleted int64
+	for {
+		tag, err := db.conn.Exec(context.Background(), sql, arg, pruneBatch)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < pruneBatch {
+			return deleted, nil
+		}
+	}
+}
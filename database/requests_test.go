@@ -0,0 +1,20 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListQueriesLeaveBodiesOut(t *testing.T) {
+	for _, q := range []string{getRecentLoggedRequests, getRecentLoggedRequestsByDeviceID, getRecentLoggedRequestsByUserIDs} {
+		if strings.Contains(q, "request_body,") || strings.Contains(q, "response_body") {
+			t.Errorf("list query selects a body: %s", q)
+		}
+		if got, want := strings.Count(q[:strings.Index(q, " FROM ")], ","), 12; got != want {
+			t.Errorf("list query selects %d columns, unmarshalListRow scans %d: %s", got+1, want+1, q)
+		}
+	}
+	if !strings.Contains(getLoggedRequestByID, "request_body,") || !strings.Contains(getLoggedRequestByID, "response_body") {
+		t.Error("getLoggedRequestByID doesn't select the bodies")
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RoleOwner  = "owner"  // can do everything, including managing admins
+	RoleAdmin  = "admin"  // can do everything except managing owners
+	RoleMember = "member" // can manage their own devices and rules, and those of users in groups they manage
+	RoleViewer = "viewer" // can only view their own devices, rules and traffic
+)
+
+// Roles are ordered from most to least access.
+var Roles = []string{RoleOwner, RoleAdmin, RoleMember, RoleViewer}
+
+const (
+	// getManagedUserIDs is a SQL string to select the IDs of users in groups the user is a manager of.
+	getManagedUserIDs string = `SELECT DISTINCT m.user_id FROM user_group_members m JOIN user_group_members me ON me.group_id = m.group_id WHERE me.user_id = $1 AND me.manager;`
+	// updateUserRole is a SQL string to change the role of a user. It requires the user's ID and the new role.
+	updateUserRole string = `UPDATE users SET role = $2 WHERE id = $1;`
+	// countOwners is a SQL string to count the users with the owner role.
+	countOwners string = `SELECT count(*) FROM users WHERE role = 'owner';`
+)
+
+// Access is what a user is allowed to see and change. Every admin api endpoint checks it before using the
+// other DB methods.
+type Access struct {
+	User *User // nil for full access without a user (the configured api token)
+
+	all    bool
+	view   map[uuid.UUID]bool // user ids that can be viewed, true if they can be managed too
+	manage bool               // false for viewers, who can't change anything (not even their own rules)
+}
+
+// FullAccess returns access to everything.
+func FullAccess() *Access {
+	return &Access{all: true, manage: true}
+}
+
+// AccessFor returns what u is allowed to do based on their role and the groups they manage.
+func (db *DB) AccessFor(u *User) (*Access, error) {
+	if u.Role != RoleMember {
+		return NewAccess(u, nil), nil // the managed users only matter to members
+	}
+	rows, err := db.conn.Query(context.Background(), getManagedUserIDs, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var managed []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		managed = append(managed, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return NewAccess(u, managed), nil
+}
+
+// NewAccess returns what u is allowed to do based on their role, given the ids of the users in groups they
+// manage.
+func NewAccess(u *User, managed []uuid.UUID) *Access {
+	a := &Access{User: u, view: map[uuid.UUID]bool{}}
+	switch u.Role {
+	case RoleOwner, RoleAdmin:
+		a.all, a.manage = true, true
+	case RoleMember:
+		a.manage = true
+		a.view[u.ID] = true
+		for _, id := range managed {
+			a.view[id] = true
+		}
+	default: // viewers, and roles this version doesn't know get the least access
+		a.view[u.ID] = false
+	}
+	return a
+}
+
+// IsAdmin reports whether the access is that of an owner or admin.
+func (a *Access) IsAdmin() bool {
+	return a.all
+}
+
+// CanView reports whether the devices, rules and traffic of the user can be viewed.
+func (a *Access) CanView(userID uuid.UUID) bool {
+	if a.all {
+		return true
+	}
+	_, ok := a.view[userID]
+	return ok
+}
+
+// CanManage reports whether the devices and rules of the user can be changed.
+func (a *Access) CanManage(userID uuid.UUID) bool {
+	return a.manage && (a.all || a.view[userID])
+}
+
+// CanAdminister reports whether the target user account itself (role, password, two-factor, deletion) can
+// be changed. Owners can administer everyone, admins everyone except owners.
+func (a *Access) CanAdminister(target *User) bool {
+	if !a.all {
+		return false
+	}
+	return a.User == nil || a.User.Role == RoleOwner || target.Role != RoleOwner
+}
+
+// CanGrant reports whether role can be given to a user.
+func (a *Access) CanGrant(role string) bool {
+	if !a.all || !slices.Contains(Roles, role) {
+		return false
+	}
+	return a.User == nil || a.User.Role == RoleOwner || role != RoleOwner
+}
+
+// UserIDs returns the ids of the users that can be viewed, or nil if every user can be viewed.
+func (a *Access) UserIDs() []uuid.UUID {
+	if a.all {
+		return nil
+	}
+	ids := make([]uuid.UUID, 0, len(a.view))
+	for id := range a.view {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (db *DB) UpdateUserRole(id uuid.UUID, role string) error {
+	return db.execOne(updateUserRole, id, role)
+}
+
+// CountOwners returns the number of users with the owner role, so the last owner isn't removed.
+func (db *DB) CountOwners() (int, error) {
+	var n int
+	err := db.conn.QueryRow(context.Background(), countOwners).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAccessIsolatesTenants(t *testing.T) {
+	alice := &User{ID: uuid.New(), Role: RoleMember}
+	aliceKid := &User{ID: uuid.New(), Role: RoleMember} // in a group alice manages
+	viewer := &User{ID: uuid.New(), Role: RoleViewer}
+	bob := &User{ID: uuid.New(), Role: RoleMember} // another household
+	owner := &User{ID: uuid.New(), Role: RoleOwner}
+	admin := &User{ID: uuid.New(), Role: RoleAdmin}
+
+	tests := []struct {
+		name         string
+		access       *Access
+		target       *User
+		view, manage bool
+	}{
+		{"member, themselves", NewAccess(alice, []uuid.UUID{aliceKid.ID}), alice, true, true},
+		{"member, a user they manage", NewAccess(alice, []uuid.UUID{aliceKid.ID}), aliceKid, true, true},
+		{"member, another user", NewAccess(alice, []uuid.UUID{aliceKid.ID}), bob, false, false},
+		{"member, their manager", NewAccess(aliceKid, nil), alice, false, false},
+		{"viewer, themselves", NewAccess(viewer, nil), viewer, true, false},
+		{"viewer, another user", NewAccess(viewer, nil), bob, false, false},
+		{"viewer in a managed group", NewAccess(&User{ID: viewer.ID, Role: RoleViewer}, []uuid.UUID{bob.ID}), bob, false, false},
+		{"unknown role", NewAccess(&User{ID: uuid.New(), Role: "superuser"}, []uuid.UUID{bob.ID}), bob, false, false},
+		{"admin", NewAccess(admin, nil), bob, true, true},
+		{"api token", FullAccess(), bob, true, true},
+	}
+	for _, tt := range tests {
+		if got := tt.access.CanView(tt.target.ID); got != tt.view {
+			t.Errorf("%s: CanView = %t, want %t", tt.name, got, tt.view)
+		}
+		if got := tt.access.CanManage(tt.target.ID); got != tt.manage {
+			t.Errorf("%s: CanManage = %t, want %t", tt.name, got, tt.manage)
+		}
+		if !tt.access.IsAdmin() && tt.access.CanAdminister(tt.target) {
+			t.Errorf("%s: can administer the account", tt.name)
+		}
+	}
+
+	for _, id := range NewAccess(alice, []uuid.UUID{aliceKid.ID}).UserIDs() {
+		if id != alice.ID && id != aliceKid.ID {
+			t.Errorf("UserIDs of a member contains %s", id)
+		}
+	}
+	if ids := NewAccess(owner, nil).UserIDs(); ids != nil {
+		t.Errorf("UserIDs of an owner = %v, want nil for everyone", ids)
+	}
+}
+
+func TestAccessAdministerAndGrant(t *testing.T) {
+	owner := &User{ID: uuid.New(), Role: RoleOwner}
+	admin := &User{ID: uuid.New(), Role: RoleAdmin}
+	member := &User{ID: uuid.New(), Role: RoleMember}
+
+	tests := []struct {
+		name   string
+		access *Access
+		target *User
+		want   bool
+	}{
+		{"owner, owner", NewAccess(owner, nil), &User{ID: uuid.New(), Role: RoleOwner}, true},
+		{"owner, member", NewAccess(owner, nil), member, true},
+		{"admin, owner", NewAccess(admin, nil), owner, false},
+		{"admin, admin", NewAccess(admin, nil), &User{ID: uuid.New(), Role: RoleAdmin}, true},
+		{"admin, member", NewAccess(admin, nil), member, true},
+		{"member, themselves", NewAccess(member, nil), member, false},
+		{"member, a user they manage", NewAccess(member, []uuid.UUID{admin.ID}), &User{ID: uuid.New(), Role: RoleMember}, false},
+		{"api token, owner", FullAccess(), owner, true},
+	}
+	for _, tt := range tests {
+		if got := tt.access.CanAdminister(tt.target); got != tt.want {
+			t.Errorf("%s: CanAdminister = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		access *Access
+		role   string
+		want   bool
+	}{
+		{NewAccess(owner, nil), RoleOwner, true},
+		{NewAccess(admin, nil), RoleOwner, false},
+		{NewAccess(admin, nil), RoleAdmin, true},
+		{NewAccess(member, nil), RoleMember, false},
+		{NewAccess(member, nil), RoleViewer, false},
+		{FullAccess(), "superuser", false},
+	} {
+		if got := tt.access.CanGrant(tt.role); got != tt.want {
+			t.Errorf("%s granting %s: CanGrant = %t, want %t", roleOf(tt.access), tt.role, got, tt.want)
+		}
+	}
+}
+
+func roleOf(a *Access) string {
+	if a.User == nil {
+		return "api token"
+	}
+	return a.User.Role
+}
@@ -2,36 +2,143 @@ package database
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 )
 
 const (
-	getRuleByID      string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect FROM rules WHERE id = $1;`
-	getRulesByUserID string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect FROM rules WHERE user_id = $1;`
+	getRuleByID       string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect, scope, target FROM rules WHERE id = $1;`
+	getRulesByUserID  string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect, scope, target FROM rules WHERE user_id = $1;`
+	getRulesByUserIDs string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect, scope, target FROM rules WHERE user_id = ANY($1);`
+	getRules          string = `SELECT id, user_id, title, trigger, condition, rule_action, in_effect, scope, target FROM rules;`
+	// saveRule is a SQL string to insert a new rule. It returns the newly created rule's ID.
+	saveRule string = `INSERT INTO rules (user_id, title, trigger, condition, rule_action, in_effect, scope, target) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;`
+	// updateRule is a SQL string to update every field of a rule except its ID and user_id.
+	updateRule string = `UPDATE rules SET title = $2, trigger = $3, condition = $4, rule_action = $5, in_effect = $6, scope = $7, target = $8 WHERE id = $1;`
+	deleteRule string = `DELETE FROM rules WHERE id = $1;`
 )
 
+const (
+	RuleScopeDevice = "device" // applies to one device
+	RuleScopeTag    = "tag"    // applies to devices with a tag
+	RuleScopeGroup  = "group"  // applies to devices in a device group
+	RuleScopeUser   = "user"   // applies to the devices of the rule's user
+)
+
+// RuleScopes are ordered by precedence. Rules of a device are evaluated scope by scope in this order and
+// the first matching rule wins, so e.g. an allow rule for a device overrides a block rule for its group.
+var RuleScopes = []string{RuleScopeDevice, RuleScopeTag, RuleScopeGroup, RuleScopeUser}
+
 type Rule struct {
-	ID         uuid.UUID
-	User       User
-	Title      string
-	Trigger    string
-	Condition  Condition
-	RuleAction Action
-	InEffect   bool
+	ID         uuid.UUID `json:"id"`
+	User       User      `json:"user"`
+	Title      string    `json:"title"`
+	Trigger    string    `json:"trigger"`
+	Condition  Condition `json:"condition"`
+	RuleAction Action    `json:"action"`
+	InEffect   bool      `json:"in_effect"`
+	Scope      string    `json:"scope"`            // what the rule applies to, see RuleScopes
+	Target     string    `json:"target,omitempty"` // the device group id, tag or device id for those scopes
 }
 
 func (r *Rule) unmarshalRow(row pgx.Row) error {
-	return row.Scan(&r.ID, &r.User.ID, &r.Title, &r.Trigger, &r.Condition, &r.RuleAction, &r.InEffect)
+	return row.Scan(&r.ID, &r.User.ID, &r.Title, &r.Trigger, &r.Condition, &r.RuleAction, &r.InEffect, &r.Scope, &r.Target)
+}
+
+// Validate checks that the rule's trigger, scope, condition and action are valid. An empty scope defaults
+// to the user scope.
+func (r *Rule) Validate() error {
+	if r.Title == "" {
+		return fmt.Errorf("%w: missing title", ErrInvalidRule)
+	}
+	if r.Trigger != TriggerIncomingRequest && r.Trigger != TriggerRecievedMITMRequest {
+		return fmt.Errorf("%w: unknown trigger: %s", ErrInvalidRule, r.Trigger)
+	}
+	if r.Scope == "" {
+		r.Scope = RuleScopeUser
+	}
+	switch r.Scope {
+	case RuleScopeUser:
+		r.Target = ""
+	case RuleScopeTag:
+		if r.Target == "" {
+			return fmt.Errorf("%w: missing tag", ErrInvalidRule)
+		}
+	case RuleScopeGroup, RuleScopeDevice:
+		if _, err := uuid.Parse(r.Target); err != nil {
+			return fmt.Errorf("%w: the target of a %s rule must be its id", ErrInvalidRule, r.Scope)
+		}
+	default:
+		return fmt.Errorf("%w: unknown scope: %s", ErrInvalidRule, r.Scope)
+	}
+	if err := r.Condition.Validate(); err != nil {
+		return err
+	}
+	return r.RuleAction.Validate()
 }
 
 func (db *DB) GetRuleByID(id uuid.UUID) (*Rule, error) {
 	row := db.conn.QueryRow(context.Background(), getRuleByID, id)
 	var rule Rule
-	err := row.Scan(&rule.ID, &rule.User.ID, &rule.Title, &rule.Trigger, &rule.Condition, &rule.RuleAction)
-	if err != nil {
+	if err := rule.unmarshalRow(row); err != nil {
 		return nil, err
 	}
 	return &rule, nil
 }
+
+func (db *DB) GetRulesByUserID(userID uuid.UUID) ([]*Rule, error) {
+	rows, err := db.conn.Query(context.Background(), getRulesByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return collectRules(rows)
+}
+
+func (db *DB) GetRulesByUserIDs(userIDs []uuid.UUID) ([]*Rule, error) {
+	rows, err := db.conn.Query(context.Background(), getRulesByUserIDs, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	return collectRules(rows)
+}
+
+func (db *DB) GetRules() ([]*Rule, error) {
+	rows, err := db.conn.Query(context.Background(), getRules)
+	if err != nil {
+		return nil, err
+	}
+	return collectRules(rows)
+}
+
+func collectRules(rows pgx.Rows) ([]*Rule, error) {
+	defer rows.Close()
+
+	var rules []*Rule
+	for rows.Next() {
+		var r Rule
+		if err := r.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &r)
+	}
+	return rules, rows.Err()
+}
+
+func (db *DB) InsertRule(r *Rule) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveRule, r.User.ID, r.Title, r.Trigger, r.Condition, r.RuleAction, r.InEffect, r.Scope, r.Target)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (db *DB) UpdateRule(r *Rule) error {
+	return db.execOne(updateRule, r.ID, r.Title, r.Trigger, r.Condition, r.RuleAction, r.InEffect, r.Scope, r.Target)
+}
+
+func (db *DB) DeleteRule(id uuid.UUID) error {
+	return db.execOne(deleteRule, id)
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getActiveSessionByTokenHash is a SQL string to select a session that is neither expired nor revoked by the hash of its token.
+	getActiveSessionByTokenHash string = `SELECT id, user_id, csrf_token, ip, user_agent, created_at, expires_at, revoked_at FROM sessions WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP;`
+	// getActiveSessionsByUserID is a SQL string to select a user's sessions that are neither expired nor revoked.
+	getActiveSessionsByUserID string = `SELECT id, user_id, csrf_token, ip, user_agent, created_at, expires_at, revoked_at FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP ORDER BY created_at DESC;`
+	// saveSession is a SQL string to insert a session. It returns the newly created session's ID.
+	saveSession string = `INSERT INTO sessions (user_id, token_hash, csrf_token, ip, user_agent, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;`
+	// revokeSession is a SQL string to revoke a session of a user. It requires the session's ID and the user's ID.
+	revokeSession string = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;`
+	// revokeSessionsByUserID is a SQL string to revoke every session of a user.
+	revokeSessionsByUserID string = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL;`
+	// deleteExpiredSessions is a SQL string to delete sessions that expired over a day ago.
+	deleteExpiredSessions string = `DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP - INTERVAL '1 day';`
+)
+
+// Session is a dashboard login. The session token itself is never stored, only its hash.
+type Session struct {
+	ID        uuid.UUID  `json:"id"`
+	User      User       `json:"user"`
+	CSRFToken string     `json:"-"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"user_agent"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (s *Session) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&s.ID, &s.User.ID, &s.CSRFToken, &s.IP, &s.UserAgent, &s.CreatedAt, &s.ExpiresAt, &s.RevokedAt)
+}
+
+func (db *DB) GetActiveSessionByTokenHash(tokenHash string) (*Session, error) {
+	var s Session
+	row := db.conn.QueryRow(context.Background(), getActiveSessionByTokenHash, tokenHash)
+	if err := s.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (db *DB) GetActiveSessionsByUserID(userID uuid.UUID) ([]*Session, error) {
+	rows, err := db.conn.Query(context.Background(), getActiveSessionsByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		var s Session
+		if err := s.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *DB) InsertSession(s *Session, tokenHash string) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveSession, s.User.ID, tokenHash, s.CSRFToken, s.IP, s.UserAgent, s.ExpiresAt)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// RevokeSession revokes the session with the id if it belongs to the user.
+func (db *DB) RevokeSession(id, userID uuid.UUID) error {
+	return db.execOne(revokeSession, id, userID)
+}
+
+func (db *DB) RevokeSessionsByUserID(userID uuid.UUID) error {
+	_, err := db.conn.Exec(context.Background(), revokeSessionsByUserID, userID)
+	return err
+}
+
+func (db *DB) DeleteExpiredSessions() error {
+	_, err := db.conn.Exec(context.Background(), deleteExpiredSessions)
+	return err
+}
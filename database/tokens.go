@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getActiveAPITokenByHash is a SQL string to select an api token that has not been revoked by its hash.
+	getActiveAPITokenByHash string = `SELECT id, user_id, name, scope, created_at, last_used_at, revoked_at FROM api_tokens WHERE token_hash = $1 AND revoked_at IS NULL;`
+	// getAPITokensByUserID is a SQL string to select all api tokens of a user, including revoked ones.
+	getAPITokensByUserID string = `SELECT id, user_id, name, scope, created_at, last_used_at, revoked_at FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC;`
+	// saveAPIToken is a SQL string to insert an api token. It returns the newly created token's ID.
+	saveAPIToken string = `INSERT INTO api_tokens (user_id, name, scope, token_hash) VALUES ($1, $2, $3, $4) RETURNING id;`
+	// revokeAPIToken is a SQL string to revoke an api token of a user. It requires the token's ID and the user's ID.
+	revokeAPIToken string = `UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;`
+	// revokeAPITokensByUserID is a SQL string to revoke every api token of a user.
+	revokeAPITokensByUserID string = `UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL;`
+	// touchAPIToken is a SQL string to set the last time an api token was used to now.
+	touchAPIToken string = `UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1;`
+)
+
+// APIToken is a long lived token for scripts and cli tools. The token itself is never stored, only its hash.
+type APIToken struct {
+	ID         uuid.UUID  `json:"id"`
+	User       User       `json:"user"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"` // see auth.Scopes
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (t *APIToken) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&t.ID, &t.User.ID, &t.Name, &t.Scope, &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt)
+}
+
+func (db *DB) GetActiveAPITokenByHash(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	row := db.conn.QueryRow(context.Background(), getActiveAPITokenByHash, tokenHash)
+	if err := t.unmarshalRow(row); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (db *DB) GetAPITokensByUserID(userID uuid.UUID) ([]*APIToken, error) {
+	rows, err := db.conn.Query(context.Background(), getAPITokensByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := t.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *DB) InsertAPIToken(t *APIToken, tokenHash string) (uuid.UUID, error) {
+	var id uuid.UUID
+	row := db.conn.QueryRow(context.Background(), saveAPIToken, t.User.ID, t.Name, t.Scope, tokenHash)
+	if err := row.Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// RevokeAPIToken revokes the api token with the id if it belongs to the user.
+func (db *DB) RevokeAPIToken(id, userID uuid.UUID) error {
+	return db.execOne(revokeAPIToken, id, userID)
+}
+
+func (db *DB) RevokeAPITokensByUserID(userID uuid.UUID) error {
+	_, err := db.conn.Exec(context.Background(), revokeAPITokensByUserID, userID)
+	return err
+}
+
+func (db *DB) TouchAPIToken(id uuid.UUID) error {
+	return db.execOne(touchAPIToken, id)
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// addDeviceUsage is a SQL string to add usage to a device. It requires the device's ID, last seen time, ip, user agent
+// and the number of requests and bytes to add. An empty user agent keeps the previous one.
+const addDeviceUsage string = `UPDATE devices SET last_seen_at = GREATEST(last_seen_at, $2), last_ip = $3, last_user_agent = COALESCE(NULLIF($4, ''), last_user_agent), total_requests = total_requests + $5, total_bytes = total_bytes + $6 WHERE id = $1;`
+
+// DeviceUsage is the usage of a device since the last time it was stored.
+type DeviceUsage struct {
+	DeviceID  uuid.UUID
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	Requests  int64
+	Bytes     int64
+}
+
+// UpdateDeviceUsage adds the usage to the devices in a single round trip. Usage of devices that were
+// deleted in the meantime is ignored.
+func (db *DB) UpdateDeviceUsage(usage []DeviceUsage) error {
+	batch := &pgx.Batch{}
+	for _, u := range usage {
+		batch.Queue(addDeviceUsage, u.DeviceID, u.LastSeen, u.IP, u.UserAgent, u.Requests, u.Bytes)
+	}
+	return db.conn.SendBatch(context.Background(), batch).Close()
+}
@@ -2,25 +2,50 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 const (
-	// getUserByID is a SQL string to select a user by their ID. It returns the user's ID, created_at, username, and hashed_password.
-	getUserByID string = `SELECT id, created_at, username, hashed_password FROM users WHERE id = $1;`
-	// getUserByUsername is a SQL string to select a user by their username. It returns the user's ID, created_at, username, and hashed_password.
-	getUserByUsername string = `SELECT id, created_at, username, hashed_password FROM users WHERE username = $1;`
-	// saveUser is a SQL string to insert into the users table. It requires the username and hashed_password as input and returns the id of the newly created user.
-	saveUser string = `INSERT INTO users (username, hashed_password) VALUES ($1, $2) RETURNING id;`
+	// getUserByID is a SQL string to select a user by their ID. It returns the user's ID, created_at, username, hashed_password and totp settings.
+	getUserByID string = `SELECT id, created_at, username, hashed_password, totp_secret, totp_enabled, totp_last_step, role FROM users WHERE id = $1;`
+	// getUserByUsername is a SQL string to select a user by their username (case insensitive). It returns the user's ID, created_at, username, hashed_password and totp settings.
+	getUserByUsername string = `SELECT id, created_at, username, hashed_password, totp_secret, totp_enabled, totp_last_step, role FROM users WHERE lower(username) = lower($1);`
+	// getUsers is a SQL string to select all users. It returns the users' ID, created_at, username, hashed_password and totp settings.
+	getUsers string = `SELECT id, created_at, username, hashed_password, totp_secret, totp_enabled, totp_last_step, role FROM users ORDER BY created_at;`
+	// deleteUser is a SQL string to delete a user by their ID. The user's devices and rules are deleted with them.
+	deleteUser string = `DELETE FROM users WHERE id = $1;`
+	// saveUser is a SQL string to insert into the users table. It requires the username, hashed_password and role as input and returns the id of the newly created user.
+	saveUser string = `INSERT INTO users (username, hashed_password, role) VALUES ($1, $2, $3) RETURNING id;`
+	// updateUserPassword is a SQL string to replace a user's hashed_password. It requires the user's ID and the new hash.
+	updateUserPassword string = `UPDATE users SET hashed_password = $2 WHERE id = $1;`
+	// updateUserTOTP is a SQL string to set a user's totp secret and whether totp is enabled. It resets the last used step.
+	updateUserTOTP string = `UPDATE users SET totp_secret = $2, totp_enabled = $3, totp_last_step = 0 WHERE id = $1;`
+	// useTOTPStep is a SQL string to record the totp step a user logged in with. It only succeeds if the step is newer
+	// than the last one used, so a code can't be used twice.
+	useTOTPStep string = `UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2;`
+)
+
+var (
+	ErrUsernameTaken = fmt.Errorf("username is already taken")
 )
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	Username       string
-	HashedPassword string
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at,omitzero"`
+	Username       string    `json:"username,omitempty"`
+	HashedPassword string    `json:"-"`
+	TOTPSecret     string    `json:"-"` // set once enrollment starts, even before totp is enabled
+	TOTPEnabled    bool      `json:"totp_enabled"`
+	TOTPLastStep   int64     `json:"-"`
+	Role           string    `json:"role,omitempty"` // see Roles
+}
+
+func (u *User) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&u.ID, &u.CreatedAt, &u.Username, &u.HashedPassword, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.Role)
 }
 
 func (db *DB) complete(u *User) error {
@@ -32,8 +57,7 @@ func (db *DB) complete(u *User) error {
 func (db *DB) GetUserByID(id uuid.UUID) (*User, error) {
 	row := db.conn.QueryRow(context.Background(), getUserByID, id)
 	var user User
-	err := row.Scan(&user.ID, &user.CreatedAt, &user.Username, &user.HashedPassword)
-	if err != nil {
+	if err := user.unmarshalRow(row); err != nil {
 		return nil, err
 	}
 	return &user, nil
@@ -42,15 +66,59 @@ func (db *DB) GetUserByID(id uuid.UUID) (*User, error) {
 func (db *DB) GetUserByUsername(username string) (*User, error) {
 	row := db.conn.QueryRow(context.Background(), getUserByUsername, username)
 	var user User
-	err := row.Scan(&user.ID, &user.CreatedAt, &user.Username, &user.HashedPassword)
-	if err != nil {
+	if err := user.unmarshalRow(row); err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (db *DB) InsertUser(username, hashedPassword string) (id uuid.UUID, err error) {
-	row := db.conn.QueryRow(context.Background(), saveUser, username, hashedPassword)
+// InsertUser inserts a new user with an already hashed password (see auth.HashPassword). It returns
+// ErrUsernameTaken if another user has the same username.
+func (db *DB) InsertUser(username, hashedPassword, role string) (id uuid.UUID, err error) {
+	row := db.conn.QueryRow(context.Background(), saveUser, username, hashedPassword, role)
 	err = row.Scan(&id)
+	if isUniqueViolation(err) {
+		err = ErrUsernameTaken
+	}
 	return
 }
+
+func (db *DB) UpdateUserPassword(id uuid.UUID, hashedPassword string) error {
+	return db.execOne(updateUserPassword, id, hashedPassword)
+}
+
+func (db *DB) GetUsers() ([]*User, error) {
+	rows, err := db.conn.Query(context.Background(), getUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var user User
+		if err := user.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+func (db *DB) DeleteUser(id uuid.UUID) error {
+	return db.execOne(deleteUser, id)
+}
+
+func (db *DB) UpdateUserTOTP(id uuid.UUID, secret string, enabled bool) error {
+	return db.execOne(updateUserTOTP, id, secret, enabled)
+}
+
+// UseTOTPStep records that the user logged in with the totp code of step. It returns false if the step was
+// already used (or an older one was used after it).
+func (db *DB) UseTOTPStep(id uuid.UUID, step int64) (bool, error) {
+	tag, err := db.conn.Exec(context.Background(), useTOTPStep, id, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// getWebSocketFrames is a SQL string to select the frames of the websocket connection of a logged request, oldest
+	// first. It requires the request's ID and a limit.
+	getWebSocketFrames string = `SELECT id, request_id, from_client, opcode, size, text, close_code, created_at FROM websocket_frames WHERE request_id = $1 ORDER BY created_at LIMIT $2;`
+	// pruneWebSocketFrames is a SQL string to delete a batch of websocket frames older than a number of days. It
+	// requires the number of days and the size of the batch.
+	pruneWebSocketFrames string = `DELETE FROM websocket_frames WHERE id IN (SELECT id FROM websocket_frames WHERE created_at < now() - make_interval(days => $1) LIMIT $2);`
+	// saveWebSocketFrame is a SQL string to insert a websocket frame.
+	saveWebSocketFrame string = `INSERT INTO websocket_frames (request_id, from_client, opcode, size, text, close_code, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7);`
+)
+
+// WebSocketFrame is a frame sent over a websocket connection that went through the proxy.
+type WebSocketFrame struct {
+	ID         uuid.UUID `json:"id"`
+	RequestID  uuid.UUID `json:"request_id"`  // the logged handshake
+	FromClient bool      `json:"from_client"` // false if the server sent it
+	Opcode     string    `json:"opcode"`      // "text", "binary", "close", "ping", "pong" or "continuation"
+	Size       int64     `json:"size"`        // of the payload
+	Text       string    `json:"text,omitempty"`
+	CloseCode  *int      `json:"close_code,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (f *WebSocketFrame) unmarshalRow(row pgx.Row) error {
+	return row.Scan(&f.ID, &f.RequestID, &f.FromClient, &f.Opcode, &f.Size, &f.Text, &f.CloseCode, &f.CreatedAt)
+}
+
+func (db *DB) GetWebSocketFrames(requestID uuid.UUID, limit int) ([]*WebSocketFrame, error) {
+	rows, err := db.conn.Query(context.Background(), getWebSocketFrames, requestID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var frames []*WebSocketFrame
+	for rows.Next() {
+		var f WebSocketFrame
+		if err := f.unmarshalRow(rows); err != nil {
+			return nil, err
+		}
+		frames = append(frames, &f)
+	}
+	return frames, rows.Err()
+}
+
+func (db *DB) InsertWebSocketFrame(f *WebSocketFrame) error {
+	_, err := db.conn.Exec(context.Background(), saveWebSocketFrame, f.RequestID, f.FromClient, f.Opcode, f.Size, f.Text, f.CloseCode, f.CreatedAt)
+	return err
+}
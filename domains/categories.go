@@ -0,0 +1,93 @@
+package domains
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Categories maps domains to categories. A host gets the category of the most specific domain it is (a
+// subdomain of).
+type Categories struct {
+	t     trie[string]
+	names map[string]bool
+}
+
+func NewCategories() *Categories {
+	return &Categories{names: make(map[string]bool)}
+}
+
+// Add sets the category of domain (and its subdomains). Categories are lowercased.
+func (c *Categories) Add(domain, category string) {
+	category = strings.ToLower(strings.TrimSpace(category))
+	c.t.insert(Normalize(domain), category)
+	c.names[category] = true
+}
+
+// Category returns the category of host, or "" if it has none. host may have a port.
+func (c *Categories) Category(host string) string {
+	category, _ := c.t.lookup(Normalize(host))
+	return category
+}
+
+// Names returns the categories in alphabetical order.
+func (c *Categories) Names() []string {
+	return slices.Sorted(maps.Keys(c.names))
+}
+
+// Len returns the number of domains with a category.
+func (c *Categories) Len() int {
+	return c.t.size
+}
+
+// ReadCSV adds the categories of a csv file with a domain and a category on each line. A header line
+// ("domain,category") and lines starting with # are skipped.
+func (c *Categories) ReadCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read csv: %w", err)
+		}
+		domain := strings.TrimPrefix(strings.TrimSpace(record[0]), "*.")
+		if line == 1 && strings.EqualFold(domain, "domain") {
+			continue
+		}
+		if !isDomain(domain) || strings.TrimSpace(record[1]) == "" {
+			return fmt.Errorf("read csv: line %d: invalid domain or category", line)
+		}
+		c.Add(domain, record[1])
+	}
+}
+
+// ReadJSON adds the categories of a json object mapping each category to its domains, e.g.
+// {"social": ["facebook.com", "instagram.com"], "gaming": ["roblox.com"]}.
+func (c *Categories) ReadJSON(r io.Reader) error {
+	var categories map[string][]string
+	if err := json.NewDecoder(r).Decode(&categories); err != nil {
+		return fmt.Errorf("read json: %w", err)
+	}
+	for category, list := range categories {
+		if strings.TrimSpace(category) == "" {
+			return fmt.Errorf("read json: empty category")
+		}
+		for _, domain := range list {
+			domain = strings.TrimPrefix(strings.TrimSpace(domain), "*.")
+			if !isDomain(domain) {
+				return fmt.Errorf("read json: %s: invalid domain: %q", category, domain)
+			}
+			c.Add(domain, category)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package domains
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxListSize is the largest list Fetch reads.
+const MaxListSize = 64 << 20
+
+// hosts that hosts files map to themselves rather than block
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// ParseList reads a blocklist into a set. Each line can be in any of these formats:
+//
+//   - hosts file: an ip followed by one or more hosts, e.g. "0.0.0.0 ads.example.com"
+//   - a plain domain, optionally as a wildcard, e.g. "ads.example.com" or "*.example.com"
+//   - domain level adblock plus filters: "||ads.example.com^" and exceptions like "@@||example.com^"
+//
+// Comments ("#" and "!"), adblock plus headers and filters that aren't domain level (paths, cosmetic
+// filters and options other than $important) are skipped.
+func ParseList(r io.Reader) (*Set, error) {
+	set := NewSet()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		parseLine(set, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read list: %w", err)
+	}
+	return set, nil
+}
+
+func parseLine(set *Set, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		parseFilter(set, line)
+		return
+	}
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		if line[i-1] != ' ' && line[i-1] != '\t' {
+			return // a cosmetic filter like "example.com##.ad"
+		}
+		line = line[:i] // inline comment
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	if net.ParseIP(fields[0]) != nil {
+		for _, host := range fields[1:] {
+			if !hostsFileNames[strings.ToLower(host)] && isDomain(host) {
+				set.Add(host)
+			}
+		}
+		return
+	}
+	if len(fields) == 1 {
+		domain := strings.TrimPrefix(strings.TrimPrefix(fields[0], "*."), ".")
+		if isDomain(domain) {
+			set.Add(domain)
+		}
+	}
+}
+
+// parseFilter adds an adblock plus filter like "||example.com^" or "@@||example.com^$important".
+func parseFilter(set *Set, filter string) {
+	exception := strings.HasPrefix(filter, "@@")
+	filter = strings.TrimPrefix(strings.TrimPrefix(filter, "@@"), "||")
+	filter, options, _ := strings.Cut(filter, "$")
+	for _, option := range strings.Split(options, ",") {
+		if option != "" && option != "important" {
+			return // e.g. $third-party, which can't be decided from the host alone
+		}
+	}
+	// without the ^ separator "||example.com" would also match example.company, which isn't domain level
+	domain, ok := strings.CutSuffix(strings.TrimSuffix(filter, "|"), "^")
+	if !ok || !isDomain(domain) {
+		return
+	}
+	if exception {
+		set.AddException(domain)
+	} else {
+		set.Add(domain)
+	}
+}
+
+// isDomain reports whether s looks like a domain name.
+func isDomain(s string) bool {
+	if s == "" || len(s) > 253 || !strings.Contains(s, ".") {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Open opens a list from an http(s) url or a file:// url, reading at most MaxListSize bytes.
+func Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("parse source: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("open list: %w", err)
+		}
+		return limitReadCloser(f), nil
+	case "http", "https":
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("create request: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("get list: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			cancel()
+			return nil, fmt.Errorf("get list: %s", resp.Status)
+		}
+		return limitReadCloser(&cancelOnClose{resp.Body, cancel}), nil
+	}
+	return nil, fmt.Errorf("unsupported source scheme: %q", u.Scheme)
+}
+
+// ValidSource reports whether source is a url Open can open.
+func ValidSource(source string) bool {
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "file":
+		return u.Path != ""
+	case "http", "https":
+		return u.Host != ""
+	}
+	return false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func limitReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return limitedReadCloser{io.LimitReader(rc, MaxListSize), rc}
+}
@@ -0,0 +1,139 @@
+package domains
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testList = `# a hosts file
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.com # two hosts and a comment
+::1 ip6-localhost
+0.0.0.0 notadomain
+
+! plain domains
+popups.example.org
+*.wild.example.org
+.dot.example.org
+
+[Adblock Plus 2.0]
+! adblock plus filters
+||adblock.example.net^
+||important.example.net^$important
+||cdn.example.net^
+@@||ok.cdn.example.net^
+||thirdparty.example.net^$third-party
+||path.example.net/ads
+||noseparator.example.net
+example.net##.banner
+`
+
+func TestParseList(t *testing.T) {
+	set, err := ParseList(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"localhost":               false,
+		"ads.example.com":         true,
+		"tracker.example.com":     true,
+		"www.tracker.example.com": true,
+		"example.com":             false,
+		"notadomain":              false,
+		"popups.example.org":      true,
+		"a.wild.example.org":      true,
+		"wild.example.org":        true,
+		"dot.example.org":         true,
+		"adblock.example.net":     true,
+		"important.example.net":   true,
+		"img.cdn.example.net":     true,
+		"ok.cdn.example.net":      false,
+		"thirdparty.example.net":  false,
+		"path.example.net":        false,
+		"noseparator.example.net": false,
+		"example.net":             false,
+	}
+	for host, want := range tests {
+		if got := set.Contains(host); got != want {
+			t.Errorf("Contains(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	source := "file://" + filepath.ToSlash(path)
+	if !ValidSource(source) {
+		t.Fatalf("ValidSource(%q) = false", source)
+	}
+	rc, err := Open(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	set, err := ParseList(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.Contains("ads.example.com") || set.Len() != 1 {
+		t.Errorf("list from %s has %d domains", source, set.Len())
+	}
+
+	if _, err := Open(context.Background(), "file://"+filepath.ToSlash(filepath.Join(t.TempDir(), "missing.txt"))); err == nil {
+		t.Error("opening a missing file didn't fail")
+	}
+}
+
+func TestOpenHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "||ads.example.com^\n")
+	}))
+	defer srv.Close()
+
+	rc, err := Open(context.Background(), srv.URL+"/list.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := ParseList(rc)
+	rc.Close()
+	if err != nil || !set.Contains("ads.example.com") {
+		t.Errorf("list from http: %v, contains ads.example.com: %t", err, err == nil && set.Contains("ads.example.com"))
+	}
+	if _, err := Open(context.Background(), srv.URL+"/missing.txt"); err == nil {
+		t.Error("a 404 didn't fail")
+	}
+}
+
+func TestValidSource(t *testing.T) {
+	tests := map[string]bool{
+		"https://example.com/list.txt": true,
+		"http://example.com/list.txt":  true,
+		"file:///etc/hosts":            true,
+		"file://":                      false,
+		"https:///list.txt":            false,
+		"ftp://example.com/list.txt":   false,
+		"/etc/hosts":                   false,
+	}
+	for source, want := range tests {
+		if got := ValidSource(source); got != want {
+			t.Errorf("ValidSource(%q) = %t, want %t", source, got, want)
+		}
+	}
+	if _, err := Open(context.Background(), "ftp://example.com/list.txt"); err == nil {
+		t.Error("opening an ftp url didn't fail")
+	}
+}
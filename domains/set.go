@@ -0,0 +1,32 @@
+package domains
+
+// Set is a set of blocked domains with exceptions. A host is in the set if the most specific domain it
+// is (a subdomain of) was added as blocked rather than as an exception.
+type Set struct {
+	t trie[bool] // true for blocked, false for exceptions
+}
+
+func NewSet() *Set {
+	return &Set{}
+}
+
+// Add adds a blocked domain.
+func (s *Set) Add(domain string) {
+	s.t.insert(Normalize(domain), true)
+}
+
+// AddException adds a domain that isn't blocked even if a domain it is a subdomain of is.
+func (s *Set) AddException(domain string) {
+	s.t.insert(Normalize(domain), false)
+}
+
+// Contains reports whether host is blocked. host may have a port.
+func (s *Set) Contains(host string) bool {
+	blocked, _ := s.t.lookup(Normalize(host))
+	return blocked
+}
+
+// Len returns the number of domains added, including exceptions.
+func (s *Set) Len() int {
+	return s.t.size
+}
@@ -0,0 +1,75 @@
+// Package domains matches hosts against large sets of domains, such as blocklists and category databases.
+// A domain matches itself and all of its subdomains.
+package domains
+
+import (
+	"net"
+	"strings"
+)
+
+// trie stores a value per domain, keyed by labels from the top level domain down, so the domains a host is
+// a subdomain of are found by walking its labels in reverse.
+type trie[V any] struct {
+	root node[V]
+	size int
+}
+
+type node[V any] struct {
+	children map[string]*node[V]
+	value    V
+	set      bool
+}
+
+// Normalize lowercases host and removes a port, brackets around an ipv6 address and a trailing dot.
+func Normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (t *trie[V]) insert(domain string, v V) {
+	n := &t.root
+	for labels := domain; labels != ""; {
+		var label string
+		if i := strings.LastIndexByte(labels, '.'); i >= 0 {
+			label, labels = labels[i+1:], labels[:i]
+		} else {
+			label, labels = labels, ""
+		}
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*node[V])
+			}
+			child = &node[V]{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	if !n.set {
+		t.size++
+	}
+	n.value, n.set = v, true
+}
+
+// lookup returns the value of the most specific domain host is (a subdomain of).
+func (t *trie[V]) lookup(host string) (v V, ok bool) {
+	n := &t.root
+	for labels := host; labels != ""; {
+		var label string
+		if i := strings.LastIndexByte(labels, '.'); i >= 0 {
+			label, labels = labels[i+1:], labels[:i]
+		} else {
+			label, labels = labels, ""
+		}
+		if n = n.children[label]; n == nil {
+			break
+		}
+		if n.set {
+			v, ok = n.value, true
+		}
+	}
+	return v, ok
+}
@@ -0,0 +1,77 @@
+package domains
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM":        "example.com",
+		"example.com:443":    "example.com",
+		"example.com.":       "example.com",
+		"[2001:db8::1]:8080": "2001:db8::1",
+		"[2001:db8::1]":      "2001:db8::1",
+		"192.0.2.1:80":       "192.0.2.1",
+	}
+	for host, want := range tests {
+		if got := Normalize(host); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTrieLookup(t *testing.T) {
+	var tr trie[string]
+	tr.insert("example.com", "example")
+	tr.insert("ads.example.com", "ads")
+	tr.insert("com", "tld")
+	tr.insert("example.com", "example again") // replaces, doesn't add
+	if tr.size != 3 {
+		t.Errorf("size = %d, want 3", tr.size)
+	}
+
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example again", true},
+		{"www.example.com", "example again", true},
+		{"ads.example.com", "ads", true},
+		{"cdn.ads.example.com", "ads", true},
+		{"notexample.com", "tld", true},
+		{"com", "tld", true},
+		{"example.org", "", false},
+		{"example", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := tr.lookup(tt.host); got != tt.want || ok != tt.ok {
+			t.Errorf("lookup(%q) = %q, %t, want %q, %t", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSetExceptions(t *testing.T) {
+	s := NewSet()
+	s.Add("Example.com")
+	s.AddException("safe.example.com")
+	s.Add("ads.safe.example.com")
+
+	tests := map[string]bool{
+		"example.com":             true,
+		"www.example.com:443":     true,
+		"safe.example.com":        false,
+		"www.safe.example.com":    false,
+		"ads.safe.example.com":    true,
+		"x.ads.safe.example.com.": true,
+		"example.org":             false,
+		"anexample.com":           false,
+	}
+	for host, want := range tests {
+		if got := s.Contains(host); got != want {
+			t.Errorf("Contains(%q) = %t, want %t", host, got, want)
+		}
+	}
+	if s.Len() != 3 {
+		t.Errorf("Len = %d, want 3", s.Len())
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"log/slog"
+	"os"
 
+	"github.com/tiredkangaroo/hat/admin"
+	"github.com/tiredkangaroo/hat/database"
 	"github.com/tiredkangaroo/hat/proxy"
 	"github.com/tiredkangaroo/hat/proxy/config"
 )
@@ -14,7 +17,27 @@ func main() {
 	}
 	slog.Info("configuration initialized")
 
-	if err := proxy.Start(); err != nil {
+	db, err := database.GetDB()
+	if err != nil {
+		slog.Error("initialize database", "error", err)
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1], os.Args[2:]); err != nil {
+			slog.Error("run command", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	go func() {
+		if err := admin.Start(db); err != nil {
+			slog.Error("run admin", "error", err)
+		}
+	}()
+
+	if err := proxy.Start(db); err != nil {
 		slog.Error("run proxy", "error", err)
 		return
 	}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// accessExceptions holds the hosts each device was given access to, with when the access expires.
+type accessExceptions map[uuid.UUID]map[string]time.Time
+
+var exceptionCache = newTTLCache[struct{}, accessExceptions](30 * time.Second)
+
+const maxAccessReason = 500
+
+func loadAccessExceptions() (accessExceptions, error) {
+	approved, err := env.db.GetActiveAccessExceptions()
+	if err != nil {
+		return nil, err
+	}
+	exceptions := accessExceptions{}
+	for _, a := range approved {
+		hosts, ok := exceptions[a.DeviceID]
+		if !ok {
+			hosts = make(map[string]time.Time)
+			exceptions[a.DeviceID] = hosts
+		}
+		if until := *a.ExpiresAt; until.After(hosts[a.Host]) {
+			hosts[a.Host] = until
+		}
+	}
+	return exceptions, nil
+}
+
+// hasAccessException reports whether the device was given access to host (or a domain it is a subdomain
+// of) that has not expired.
+func hasAccessException(device *database.Device, host string) (bool, error) {
+	exceptions, err := exceptionCache.get(struct{}{}, loadAccessExceptions)
+	if err != nil {
+		return false, fmt.Errorf("get access exceptions: %w", err)
+	}
+	hosts := exceptions[device.ID]
+	if len(hosts) == 0 {
+		return false, nil
+	}
+	now := time.Now()
+	host = strings.ToLower(stripPort(host))
+	for host != "" {
+		if until, ok := hosts[host]; ok && now.Before(until) {
+			return true, nil
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false, nil
+}
+
+// InvalidateAccessExceptions makes the proxy reload the approved access requests on the next request.
+func InvalidateAccessExceptions() {
+	exceptionCache.invalidate(struct{}{})
+}
+
+var accessPage = template.Must(template.New("access").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Request access</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em">
+<h1>Request access</h1>
+{{if .Error}}<p style="color: #b00">{{.Error}}</p>{{else}}<p>Access to <b>{{.Host}}</b> was requested. Try again once it is approved.</p>{{end}}
+</body></html>
+`))
+
+type accessPageData struct {
+	Host  string
+	Error string
+}
+
+// handleAccessRequest creates a pending access request from the form on the block page. The device is the
+// one the form was sent through, not one named in the form.
+func handleAccessRequest(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	device, ok := authenticate(ctx)
+	if !ok {
+		return
+	}
+	data := accessPageData{Host: strings.ToLower(stripPort(string(ctx.PostArgs().Peek("host"))))}
+	if device == nil {
+		data.Error = "Access can only be requested from an enrolled device."
+		writePage(ctx, accessPage, data)
+		return
+	}
+	if data.Host == "" || len(data.Host) > 253 {
+		ctx.Error("missing host", fasthttp.StatusBadRequest)
+		return
+	}
+
+	reason := string(ctx.PostArgs().Peek("reason"))
+	if len(reason) > maxAccessReason {
+		reason = reason[:maxAccessReason]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	a := &database.AccessRequest{DeviceID: device.ID, Host: data.Host, Reason: reason}
+	if id, err := uuid.ParseBytes(ctx.PostArgs().Peek("rule")); err == nil {
+		a.RuleID = &id
+	}
+	_, err := env.db.InsertAccessRequest(a)
+	if errors.Is(err, database.ErrAccessRequestPending) {
+		// the request is already waiting for a decision
+	} else if err != nil {
+		slog.Error("insert access request", "device", device.ID, "host", data.Host, "error", err)
+		data.Error = "Something went wrong, try again."
+	} else {
+		slog.Info("access requested", "device", device.ID, "host", data.Host)
+	}
+	writePage(ctx, accessPage, data)
+}
+
+// accessRequestURL returns the url the block page's request access form is sent to. It goes through the
+// proxy like any other request, so the proxy knows which device sent it.
+func accessRequestURL() string {
+	return "http://" + config.DefaultConfig.Enroll.Host + "/access"
+}
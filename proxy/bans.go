@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+)
+
+// bans are cached as one set of ips under a single key
+var banCache = newTTLCache[struct{}, map[string]struct{}](10 * time.Second)
+
+// isBanned reports whether ip has an active ban.
+func isBanned(ip string) bool {
+	if env.db == nil {
+		return false
+	}
+	banned, err := banCache.get(struct{}{}, func() (map[string]struct{}, error) {
+		bans, err := env.db.GetActiveBans()
+		if err != nil {
+			return nil, err
+		}
+		banned := make(map[string]struct{}, len(bans))
+		for _, b := range bans {
+			banned[b.IP] = struct{}{}
+		}
+		return banned, nil
+	})
+	if err != nil {
+		slog.Error("get active bans", "error", err)
+		return false
+	}
+	_, ok := banned[ip]
+	return ok
+}
+
+// banIP bans ip because it matched a block_ip rule.
+func banIP(ip string, rule *database.Rule) {
+	if env.db == nil {
+		return
+	}
+	d, err := rule.RuleAction.BanDuration()
+	if err != nil {
+		d = database.DefaultBanDuration
+	}
+	expires := time.Now().Add(d)
+	if _, err := env.db.InsertBan(&database.Ban{IP: ip, Reason: "matched rule: " + rule.Title, RuleID: &rule.ID, ExpiresAt: &expires}); err != nil {
+		slog.Error("insert ban", "ip", ip, "error", err)
+		return
+	}
+	slog.Info("banned ip", "ip", ip, "rule", rule.ID, "expires", expires)
+	InvalidateBans()
+}
+
+// InvalidateBans makes the proxy reload bans from the database on the next request.
+func InvalidateBans() {
+	banCache.invalidate(struct{}{})
+}
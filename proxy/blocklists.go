@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/domains"
+)
+
+// a list that failed to load is tried again after this long (or its refresh interval, if that is shorter)
+const blocklistRetry = 5 * time.Minute
+
+// blocklistRegistry holds the loaded blocklists by name. It is the database.ListMatcher rules use for
+// in_list.
+type blocklistRegistry struct {
+	mu    sync.RWMutex
+	sets  map[string]*domains.Set
+	names map[uuid.UUID]string    // the name each list was loaded under, so renamed lists can be dropped
+	next  map[uuid.UUID]time.Time // when each list is due to be loaded again
+}
+
+var blocklists = &blocklistRegistry{
+	sets:  make(map[string]*domains.Set),
+	names: make(map[uuid.UUID]string),
+	next:  make(map[uuid.UUID]time.Time),
+}
+
+// InList reports whether the host value is in the named list.
+func (r *blocklistRegistry) InList(name, value string) (bool, error) {
+	r.mu.RLock()
+	set, ok := r.sets[name]
+	r.mu.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("unknown or unloaded list: %s", name)
+	}
+	return set.Contains(value), nil
+}
+
+// RefreshBlocklist loads the list from its source and records the result in the database. If loading
+// fails, the previously loaded domains (if any) are kept.
+func RefreshBlocklist(b *database.Blocklist) error {
+	set, err := loadBlocklist(b.Source)
+	now := time.Now()
+	blocklists.mu.Lock()
+	if err != nil {
+		blocklists.next[b.ID] = now.Add(min(blocklistRetry, time.Duration(b.RefreshMinutes)*time.Minute))
+	} else {
+		if old, ok := blocklists.names[b.ID]; ok && old != b.Name {
+			delete(blocklists.sets, old)
+		}
+		blocklists.sets[b.Name] = set
+		blocklists.names[b.ID] = b.Name
+		blocklists.next[b.ID] = now.Add(time.Duration(b.RefreshMinutes) * time.Minute)
+	}
+	blocklists.mu.Unlock()
+
+	entries, lastError := 0, ""
+	if err != nil {
+		lastError = err.Error()
+		slog.Error("refresh blocklist", "name", b.Name, "source", b.Source, "error", err)
+	} else {
+		entries = set.Len()
+		slog.Info("blocklist refreshed", "name", b.Name, "entries", entries)
+	}
+	if env.db != nil {
+		if dberr := env.db.UpdateBlocklistRefresh(b.ID, now, entries, lastError); dberr != nil {
+			slog.Error("update blocklist refresh", "name", b.Name, "error", dberr)
+		}
+	}
+	return err
+}
+
+func loadBlocklist(source string) (*domains.Set, error) {
+	rc, err := domains.Open(context.Background(), source)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return domains.ParseList(rc)
+}
+
+// RemoveBlocklist drops a deleted list from memory.
+func RemoveBlocklist(id uuid.UUID) {
+	blocklists.mu.Lock()
+	defer blocklists.mu.Unlock()
+	if name, ok := blocklists.names[id]; ok {
+		delete(blocklists.sets, name)
+	}
+	delete(blocklists.names, id)
+	delete(blocklists.next, id)
+}
+
+// refreshDue loads the lists that were never loaded by this process or are due to be refreshed.
+func (r *blocklistRegistry) refreshDue() {
+	lists, err := env.db.GetBlocklists()
+	if err != nil {
+		slog.Error("get blocklists", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, b := range lists {
+		r.mu.RLock()
+		next, ok := r.next[b.ID]
+		r.mu.RUnlock()
+		if !ok || now.After(next) {
+			RefreshBlocklist(b)
+		}
+	}
+}
+
+// run loads the lists on start and refreshes them when they are due.
+func (r *blocklistRegistry) run() {
+	if env.db == nil {
+		return
+	}
+	r.refreshDue()
+	for range time.Tick(time.Minute) {
+		r.refreshDue()
+	}
+}
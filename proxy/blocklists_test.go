@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+func TestRefreshBlocklistFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ads.txt")
+	write := func(list string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &database.Blocklist{ID: uuid.New(), Name: "ads", Source: "file://" + filepath.ToSlash(path), RefreshMinutes: 60}
+	t.Cleanup(func() { RemoveBlocklist(b.ID) })
+	inList := func(host string) bool {
+		t.Helper()
+		ok, err := blocklists.InList(b.Name, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	write("0.0.0.0 ads.example.com\n")
+	if err := RefreshBlocklist(b); err != nil {
+		t.Fatal(err)
+	}
+	if !inList("www.ads.example.com") || inList("tracker.example.com") {
+		t.Error("the first refresh didn't load the list")
+	}
+
+	write("||tracker.example.com^\n")
+	if err := RefreshBlocklist(b); err != nil {
+		t.Fatal(err)
+	}
+	if inList("ads.example.com") || !inList("tracker.example.com") {
+		t.Error("a refresh didn't replace the list")
+	}
+
+	os.Remove(path)
+	if err := RefreshBlocklist(b); err == nil {
+		t.Error("refreshing from a missing file didn't fail")
+	}
+	if !inList("tracker.example.com") {
+		t.Error("a failed refresh dropped the loaded list")
+	}
+
+	b.Name = "renamed"
+	write("0.0.0.0 ads.example.com\n")
+	if err := RefreshBlocklist(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blocklists.InList("ads", "ads.example.com"); err == nil {
+		t.Error("the list is still loaded under its old name")
+	}
+}
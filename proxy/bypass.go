@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// aborted handshakes of a host are counted within this window
+const pinnedWindow = 10 * time.Minute
+
+// pinned hosts are cached as one map of when they expire, by host
+var pinnedCache = newTTLCache[struct{}, map[string]time.Time](30 * time.Second)
+
+// bypassMITM reports whether a tunnel of the device to host goes through without mitm, because the host is
+// in the bypass list of the configuration or the device, or its clients pin their certificates.
+func bypassMITM(device *database.Device, host string) bool {
+	host = strings.ToLower(stripPort(host))
+	if isPinned(host) {
+		return true
+	}
+	bypass := config.DefaultConfig.MITM.Bypass
+	if device != nil {
+		bypass = append(bypass[:len(bypass):len(bypass)], device.MITMBypass...)
+	}
+	for _, entry := range bypass {
+		if bypassMatches(entry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassMatches reports whether host matches an entry of a bypass list: a category ("category:banking"), a
+// wildcard ("*.bank.com") or an exact host.
+func bypassMatches(entry, host string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	switch {
+	case strings.HasPrefix(entry, "category:"):
+		return hostCategory(host) == strings.TrimPrefix(entry, "category:")
+	case strings.ContainsAny(entry, "*?"):
+		return shExpMatch(host, entry)
+	default:
+		return host == entry
+	}
+}
+
+func isPinned(host string) bool {
+	if env.db == nil {
+		return false
+	}
+	pinned, err := pinnedCache.get(struct{}{}, func() (map[string]time.Time, error) {
+		hosts, err := env.db.GetActivePinnedHosts()
+		if err != nil {
+			return nil, err
+		}
+		pinned := make(map[string]time.Time, len(hosts))
+		for _, p := range hosts {
+			pinned[p.Host] = p.ExpiresAt
+		}
+		return pinned, nil
+	})
+	if err != nil {
+		slog.Error("get pinned hosts", "error", err)
+		return false
+	}
+	until, ok := pinned[host]
+	return ok && time.Now().Before(until)
+}
+
+// InvalidatePinnedHosts makes the proxy reload the pinned hosts from the database on the next request.
+func InvalidatePinnedHosts() {
+	pinnedCache.invalidate(struct{}{})
+}
+
+// pinningTracker counts the handshakes clients aborted against the mitm certificate of each host. A host
+// whose clients abort mitm.pinned_failures handshakes within pinnedWindow is learned as pinned.
+type pinningTracker struct {
+	mu       sync.Mutex
+	failures map[string]*handshakeFailures
+}
+
+type handshakeFailures struct {
+	count int
+	first time.Time
+}
+
+var pinning = &pinningTracker{failures: make(map[string]*handshakeFailures)}
+
+// failed counts an aborted handshake for host.
+func (t *pinningTracker) failed(host string) {
+	host = strings.ToLower(stripPort(host))
+	t.mu.Lock()
+	f, ok := t.failures[host]
+	if !ok || time.Since(f.first) > pinnedWindow {
+		f = &handshakeFailures{first: time.Now()}
+		t.failures[host] = f
+	}
+	f.count++
+	count := f.count
+	if count >= config.DefaultConfig.MITM.PinnedFailures {
+		delete(t.failures, host)
+	}
+	t.mu.Unlock()
+
+	if count < config.DefaultConfig.MITM.PinnedFailures || env.db == nil {
+		return
+	}
+	expires := time.Now().Add(time.Duration(config.DefaultConfig.MITM.PinnedMinutes) * time.Minute)
+	if err := env.db.SavePinnedHost(host, count, expires); err != nil {
+		slog.Error("save pinned host", "host", host, "error", err)
+		return
+	}
+	slog.Info("learned pinned host, tunneling it without mitm", "host", host, "failures", count, "expires", expires)
+	InvalidatePinnedHosts()
+}
+
+// succeeded forgets the aborted handshakes of host, since its clients accept the mitm certificate.
+func (t *pinningTracker) succeeded(host string) {
+	host = strings.ToLower(stripPort(host))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, host)
+}
+
+// isHandshakeAbort reports whether a handshake failed because the client gave up on it: it sent an alert
+// (such as bad_certificate or unknown_ca) or closed the connection.
+func isHandshakeAbort(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
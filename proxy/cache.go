@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a small concurrency safe cache whose entries expire after a fixed duration. It is used to avoid
+// a database round trip on every proxied request.
+type ttlCache[K comparable, V any] struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[K]ttlEntry[V]
+	err     error // returned instead of loading, by tests that need the database to be down
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{ttl: ttl, entries: make(map[K]ttlEntry[V])}
+}
+
+// get returns the cached value for key, calling load (and caching its result) if there is no fresh entry.
+// Errors from load are not cached.
+func (c *ttlCache[K, V]) get(key K, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	failed := c.err
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.value, nil
+	}
+	if failed != nil {
+		var zero V
+		return zero, failed
+	}
+
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	c.mu.Lock()
+	c.entries[key] = ttlEntry[V]{value: v, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return v, nil
+}
+
+// clear removes every entry from the cache.
+func (c *ttlCache[K, V]) clear() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// invalidate removes key from the cache so the next get loads it again.
+func (c *ttlCache[K, V]) invalidate(key K) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
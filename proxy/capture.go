@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// requests waiting to be stored in the request log, more are dropped
+const requestLogBuffer = 1024
+
+// requestLog stores logged requests in the background, one at a time, so a slow database holds at most
+// requestLogBuffer of them (and their bodies) in memory.
+var requestLog = &requestQueue{requests: make(chan *database.LoggedRequest, requestLogBuffer)}
+
+type requestQueue struct {
+	start    sync.Once
+	requests chan *database.LoggedRequest
+	dropped  atomic.Int64
+}
+
+func (q *requestQueue) run() {
+	for lr := range q.requests {
+		if _, err := env.db.InsertLoggedRequest(lr); err != nil {
+			slog.Error("insert logged request", "url", lr.URL, "error", err)
+		}
+		if n := q.dropped.Swap(0); n > 0 {
+			slog.Warn("dropped requests from the request log", "dropped", n)
+		}
+	}
+}
+
+func (q *requestQueue) add(lr *database.LoggedRequest) {
+	q.start.Do(func() { go q.run() })
+	select {
+	case q.requests <- lr:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// capture copies a request and its response into a database.LoggedRequest. Everything is copied because
+// fasthttp reuses the request and response once the handler returns.
+func capture(req *fasthttp.Request, resp *fasthttp.Response, deviceID, ruleID *uuid.UUID, start time.Time) *database.LoggedRequest {
+	lr := &database.LoggedRequest{
+		ID:         uuid.New(),
+		DeviceID:   deviceID,
+		RuleID:     ruleID,
+		Method:     string(req.Header.Method()),
+		URL:        req.URI().String(),
+		Host:       string(req.Host()),
+		StatusCode: resp.StatusCode(),
+		Duration:   time.Since(start).Milliseconds(),
+		CreatedAt:  start,
+	}
+	for k, v := range req.Header.All() {
+		if h, ok := loggedHeader(string(k), string(v)); ok {
+			lr.RequestHeaders = append(lr.RequestHeaders, h)
+		}
+	}
+	for k, v := range resp.Header.All() {
+		if h, ok := loggedHeader(string(k), string(v)); ok {
+			lr.ResponseHeaders = append(lr.ResponseHeaders, h)
+		}
+	}
+	lr.RequestBody = truncatedCopy(req.Body())
+	lr.RequestBodyTruncated = len(lr.RequestBody) < len(req.Body())
+	lr.ResponseBody = truncatedCopy(resp.Body())
+	return lr
+}
+
+func truncatedCopy(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	b = b[:min(len(b), config.DefaultConfig.Capture.MaxBodyBytes)]
+	return append([]byte(nil), b...)
+}
+
+// logRequest queues the request to be stored in the request log without blocking the caller. It is dropped
+// if requestLogBuffer requests are already waiting.
+func logRequest(lr *database.LoggedRequest) {
+	if config.DefaultConfig.Capture.Disabled || env.db == nil {
+		return
+	}
+	requestLog.add(lr)
+}
+
+// how often the request log is pruned
+const pruneInterval = time.Hour
+
+// pruneRequestLog deletes the logged requests older than capture.retention_days, now and then every
+// pruneInterval.
+func pruneRequestLog() {
+	days := config.DefaultConfig.Capture.RetentionDays
+	if days < 0 || env.db == nil {
+		return
+	}
+	for {
+		if n, err := env.db.PruneLoggedRequests(days); err != nil {
+			slog.Error("prune request log", "error", err)
+		} else if n > 0 {
+			slog.Info("pruned request log", "deleted", n, "retention_days", days)
+		}
+		time.Sleep(pruneInterval)
+	}
+}
+
+// record stores a handled request in the request log, publishes it to Events and adds it to the device's
+// usage.
+func record(typ string, ctx *fasthttp.RequestCtx, device *database.Device, rule *database.Rule, start time.Time) {
+	req, resp := &ctx.Request, &ctx.Response
+	usage.seen(device, string(req.Host()), ctx.RemoteIP().String(), string(req.Header.UserAgent()), messageSize(req, resp))
+	lr := capture(req, resp, deviceID(device), ruleID(rule), start)
+	logRequest(lr)
+	Events.Publish(eventFromLoggedRequest(typ, lr))
+}
+
+// recordHTTP is record for requests served by net/http.
+func recordHTTP(typ string, x *stdExchange, device *database.Device, rule *database.Rule, start time.Time) {
+	r := x.r
+	usage.seen(device, r.Host, x.ClientIP(), r.UserAgent(), x.size())
+	lr := &database.LoggedRequest{
+		ID:         uuid.New(),
+		DeviceID:   deviceID(device),
+		RuleID:     ruleID(rule),
+		Method:     r.Method,
+		URL:        "https://" + r.Host + r.URL.RequestURI(),
+		Host:       r.Host,
+		StatusCode: x.status,
+		Duration:   time.Since(start).Milliseconds(),
+		CreatedAt:  start,
+	}
+	lr.RequestHeaders = loggedHeaders(r.Header)
+	lr.ResponseHeaders = loggedHeaders(x.header)
+	lr.RequestBody = x.reqBody.Bytes()
+	lr.RequestBodyTruncated = x.reqBody.Total() > int64(len(lr.RequestBody))
+	if lr.RequestBody == nil {
+		lr.RequestBody = truncatedCopy(x.body) // the request was blocked after a rule read its body
+		lr.RequestBodyTruncated = len(lr.RequestBody) < len(x.body) || x.r.ContentLength > int64(len(lr.RequestBody))
+	}
+	lr.ResponseBody = x.respBody.Bytes()
+	logRequest(lr)
+	Events.Publish(eventFromLoggedRequest(typ, lr))
+}
+
+func loggedHeaders(h http.Header) []database.Header {
+	var headers []database.Header
+	for k, vs := range h {
+		for _, v := range vs {
+			if lh, ok := loggedHeader(k, v); ok {
+				headers = append(headers, lh)
+			}
+		}
+	}
+	return headers
+}
+
+// redacted is the value stored instead of the value of a header with credentials
+const redacted = "[redacted]"
+
+// headers with the credentials of users on the sites they visit, redacted in the request log unless
+// capture.keep_credentials is on
+var credentialHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// loggedHeader returns the header as it is stored in the request log. It reports false for a header that
+// isn't stored at all.
+func loggedHeader(key, value string) (database.Header, bool) {
+	if strings.EqualFold(key, "Proxy-Authorization") {
+		return database.Header{}, false // never store device credentials
+	}
+	if !config.DefaultConfig.Capture.KeepCredentials && slices.ContainsFunc(credentialHeaders, func(h string) bool { return strings.EqualFold(key, h) }) {
+		value = redacted
+	}
+	return database.Header{Key: key, Value: value}, true
+}
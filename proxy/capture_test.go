@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestCaptureTruncatesBodies(t *testing.T) {
+	max := config.DefaultConfig.Capture.MaxBodyBytes
+	config.DefaultConfig.Capture.MaxBodyBytes = 8
+	defer func() { config.DefaultConfig.Capture.MaxBodyBytes = max }()
+
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://example.com/")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.SetBodyString("short")
+	resp.SetBodyString(strings.Repeat("r", 20))
+
+	lr := capture(req, resp, nil, nil, time.Now())
+	if string(lr.RequestBody) != "short" || lr.RequestBodyTruncated {
+		t.Errorf("request body = %q, truncated %t, want whole", lr.RequestBody, lr.RequestBodyTruncated)
+	}
+	if len(lr.ResponseBody) != 8 {
+		t.Errorf("response body is %d bytes, want 8", len(lr.ResponseBody))
+	}
+	for _, h := range lr.RequestHeaders {
+		if strings.EqualFold(h.Key, "Proxy-Authorization") {
+			t.Error("Proxy-Authorization was captured")
+		}
+	}
+
+	req.SetBodyString(strings.Repeat("q", 20))
+	lr = capture(req, resp, nil, nil, time.Now())
+	if len(lr.RequestBody) != 8 || !lr.RequestBodyTruncated {
+		t.Errorf("request body = %q, truncated %t, want 8 bytes and truncated", lr.RequestBody, lr.RequestBodyTruncated)
+	}
+}
+
+func TestRequestQueueDrops(t *testing.T) {
+	q := &requestQueue{requests: make(chan *database.LoggedRequest, 2)}
+	q.start.Do(func() {}) // no writer, the queue stays full
+	for range 5 {
+		q.add(&database.LoggedRequest{})
+	}
+	if len(q.requests) != 2 || q.dropped.Load() != 3 {
+		t.Errorf("queued %d, dropped %d, want 2 and 3", len(q.requests), q.dropped.Load())
+	}
+}
+
+func TestCaptureRedactsCredentials(t *testing.T) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://example.com/")
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Other", "kept")
+	resp.Header.Set("Set-Cookie", "session=secret")
+
+	values := func() map[string]string {
+		lr := capture(req, resp, nil, nil, time.Now())
+		got := map[string]string{}
+		for _, h := range append(lr.RequestHeaders, lr.ResponseHeaders...) {
+			got[h.Key] = h.Value
+		}
+		return got
+	}
+	got := values()
+	for _, k := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+		if got[k] != redacted {
+			t.Errorf("%s = %q, want it redacted", k, got[k])
+		}
+	}
+	if got["X-Other"] != "kept" {
+		t.Errorf("X-Other = %q, want kept", got["X-Other"])
+	}
+
+	config.DefaultConfig.Capture.KeepCredentials = true
+	defer func() { config.DefaultConfig.Capture.KeepCredentials = false }()
+	if got := values(); got["Cookie"] != "session=secret" || got["Set-Cookie"] != "session=secret" {
+		t.Errorf("with keep_credentials: Cookie %q, Set-Cookie %q", got["Cookie"], got["Set-Cookie"])
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/hat/domains"
+)
+
+// categories holds the loaded category databases, nil until they are loaded.
+var categories atomic.Pointer[domains.Categories]
+
+// hostCategory returns the category of host, or "" if it has none.
+func hostCategory(host string) string {
+	c := categories.Load()
+	if c == nil {
+		return ""
+	}
+	return c.Category(host)
+}
+
+// HostCategory is hostCategory for the admin api.
+func HostCategory(host string) string {
+	return hostCategory(host)
+}
+
+// CategoryNames returns the categories in the loaded category databases.
+func CategoryNames() []string {
+	c := categories.Load()
+	if c == nil {
+		return []string{}
+	}
+	return c.Names()
+}
+
+// categorizer is the database.Categorizer rules use for ctx-category.
+type categorizer struct{}
+
+func (categorizer) Category(host string) string {
+	return hostCategory(host)
+}
+
+// loadCategories reads the category databases. The format of each file is decided by its extension: .csv
+// or .json (see domains.Categories).
+func loadCategories(files []string) (*domains.Categories, error) {
+	c := domains.NewCategories()
+	for _, name := range files {
+		if err := readCategoryFile(c, name); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+func readCategoryFile(c *domains.Categories, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return c.ReadCSV(f)
+	case ".json":
+		return c.ReadJSON(f)
+	}
+	return fmt.Errorf("unknown category file format, expected .csv or .json")
+}
+
+// watchCategories loads the category databases and loads them again whenever one of the files changes.
+func watchCategories(files []string) {
+	if len(files) == 0 {
+		return
+	}
+	watchFiles("categories", files, func() error {
+		c, err := loadCategories(files)
+		if err != nil {
+			return err
+		}
+		categories.Store(c)
+		slog.Info("categories loaded", "domains", c.Len(), "categories", len(c.Names()))
+		return nil
+	})
+}
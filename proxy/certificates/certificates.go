@@ -149,7 +149,7 @@ func (c *Service) TLSConn(conn net.Conn, host string) (*tls.Conn, error) {
 		MinVersion:               tls.VersionTLS12,
 		MaxVersion:               tls.VersionTLS13,
 		Certificates:             []tls.Certificate{cert},
-		NextProtos:               []string{"http/1.1"},
+		NextProtos:               []string{"h2", "http/1.1"},
 	}
 	return tls.Server(conn, tlsConfig), nil
 }
@@ -0,0 +1,80 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var errNotReady = fmt.Errorf("the certificate service is not ready")
+
+// CertificatePEM returns the root certificate devices need to trust for MITM, PEM encoded.
+func (c *Service) CertificatePEM() ([]byte, error) {
+	if !c.Ready {
+		return nil, errNotReady
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), nil
+}
+
+// CertificateDER returns the root certificate DER encoded (what Android and Windows expect in a .crt/.cer).
+func (c *Service) CertificateDER() ([]byte, error) {
+	if !c.Ready {
+		return nil, errNotReady
+	}
+	return c.cert.Raw, nil
+}
+
+// MobileConfig returns an Apple configuration profile that installs the root certificate. The payload ids
+// are derived from the certificate, so installing the profile again replaces it instead of adding another.
+func (c *Service) MobileConfig(name string) ([]byte, error) {
+	if !c.Ready {
+		return nil, errNotReady
+	}
+	var escapedName bytes.Buffer
+	xml.EscapeText(&escapedName, []byte(name))
+	certUUID := uuid.NewSHA1(uuid.NameSpaceOID, c.cert.Raw)
+	profileUUID := uuid.NewSHA1(certUUID, []byte("profile"))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>hat.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDisplayName</key>
+			<string>%s root certificate</string>
+			<key>PayloadIdentifier</key>
+			<string>hat.root.%s</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>%s</string>
+	<key>PayloadIdentifier</key>
+	<string>hat.profile.%s</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(c.cert.Raw), escapedName.String(), certUUID, certUUID, escapedName.String(), profileUUID, profileUUID)
+	return b.Bytes(), nil
+}
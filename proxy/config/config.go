@@ -9,17 +9,97 @@ import (
 )
 
 type Configuration struct {
-	Addr string `toml:"addr"`
+	Addr       string `toml:"addr"`
+	PublicAddr string `toml:"public_addr"` // host:port devices use to reach the proxy, defaults to the address they connected to
+
+	AllowAnonymous bool `toml:"allow_anonymous"` // let clients without device credentials through unfiltered, as unknown devices, instead of asking for credentials
+	FailOpen       bool `toml:"fail_open"`       // let requests through unfiltered when the rules, overrides or quotas can't be loaded (the database is down), instead of refusing them
 
 	MITM struct {
 		CertificateFile          string `toml:"certificate_file"`
 		KeyFile                  string `toml:"key_file"`
 		CertificateLifetimeHours int64  `toml:"certificate_lifetime_hours"`
+
+		Bypass         []string `toml:"bypass"`          // hosts tunneled without mitm: exact hosts, wildcards (*.bank.com) and categories (category:banking)
+		PinnedFailures int      `toml:"pinned_failures"` // aborted handshakes within 10 minutes after which a host is tunneled without mitm, defaults to 3
+		PinnedMinutes  int64    `toml:"pinned_minutes"`  // how long a host is tunneled without mitm after that, defaults to 1440
 	} `toml:"mitm"`
 
 	Database struct {
 		PostgresURL string `toml:"postgres_url"`
 	} `toml:"database"`
+
+	Capture struct {
+		Disabled        bool `toml:"disabled"`
+		MaxBodyBytes    int  `toml:"max_body_bytes"`   // bodies larger than this are truncated in the request log
+		WebSocketFrames bool `toml:"websocket_frames"` // log the frames of websocket connections (text, sizes and close codes) with their handshake
+		KeepCredentials bool `toml:"keep_credentials"` // store the Authorization, Cookie and Set-Cookie headers, which are redacted by default
+		RetentionDays   int  `toml:"retention_days"`   // logged requests and websocket frames older than this are deleted, defaults to 30, -1 keeps them
+	} `toml:"capture"`
+
+	Replay struct {
+		AllowPrivateTargets bool `toml:"allow_private_targets"` // let replays reach loopback, private and link-local addresses, which they can't by default
+	} `toml:"replay"`
+
+	Usage struct {
+		FlushSeconds int64 `toml:"flush_seconds"` // how often device usage is written to the database, defaults to 30
+	} `toml:"usage"`
+
+	Auth struct {
+		Argon2 struct {
+			MemoryKiB   uint32 `toml:"memory_kib"`
+			Iterations  uint32 `toml:"iterations"`
+			Parallelism uint8  `toml:"parallelism"`
+		} `toml:"argon2"` // for passwords set from now on, existing hashes keep the parameters they were created with
+		MaxLoginFailures int    `toml:"max_login_failures"` // per username and per ip before being locked out
+		LockoutSeconds   int64  `toml:"lockout_seconds"`
+		RequireTOTP      bool   `toml:"require_totp"` // users must set up two-factor authentication before using the admin api
+		TOTPIssuer       string `toml:"totp_issuer"`  // shown in authenticator apps, defaults to "hat"
+	} `toml:"auth"`
+
+	PAC struct {
+		Bypass             []string `toml:"bypass"`               // hosts (example.com also matches its subdomains), wildcards (*.lan) and networks (10.0.0.0/8) every device reaches directly
+		ProxyLocalNetworks bool     `toml:"proxy_local_networks"` // also proxy private networks and plain host names, which are reached directly by default
+	} `toml:"pac"`
+
+	SOCKS struct {
+		Addr string `toml:"addr"` // address of a socks5 listener next to the http one, disabled if empty
+	} `toml:"socks"`
+
+	Transparent struct {
+		Addr   string `toml:"addr"`   // address redirected connections arrive at (linux only), disabled if empty. devices are identified by their addresses, others are refused unless allow_anonymous
+		TProxy bool   `toml:"tproxy"` // connections are redirected with tproxy, which keeps their destination as the local address, instead of redirect
+	} `toml:"transparent"`
+
+	Tunnel struct {
+		HelloTimeoutSeconds int64 `toml:"hello_timeout_seconds"` // how long to wait for the tls client hello of a tunnel without mitm, defaults to 5
+		BlockSNIMismatch    bool  `toml:"block_sni_mismatch"`    // close tunnels to a host name whose client hello names another server
+		TLSPorts            []int `toml:"tls_ports"`             // ports whose tunnels are expected to be tls and screened by their client hello, defaults to 443 and 8443. others are only screened by their host so servers that speak first aren't held up
+	} `toml:"tunnel"`
+
+	Upstream struct {
+		Proxies map[string]string `toml:"proxies"` // parent proxies by name: http://, https:// or socks5:// urls, with user:password@ for authentication
+		Default string            `toml:"default"` // name of the parent proxy connections go through unless a rule or upstream.hosts picks another, directly if empty
+		Hosts   map[string]string `toml:"hosts"`   // parent proxy name (or "direct") by host, which also matches its subdomains
+	} `toml:"upstream"`
+
+	Categories struct {
+		Files []string `toml:"files"` // category databases, .csv (a domain and a category per line) or .json ({"category": ["domain", ...]}), loaded again when changed
+	} `toml:"categories"`
+
+	SafeSearch struct {
+		File string `toml:"file"` // json file with the safe search engines, replacing the built in ones (see proxy/safesearch.json), loaded again when changed
+	} `toml:"safe_search"`
+
+	Enroll struct {
+		Host           string `toml:"host"`             // devices visit http://<host>/ through the proxy to enroll, defaults to hat.enroll
+		CodeTTLMinutes int64  `toml:"code_ttl_minutes"` // how long enrollment codes are valid, defaults to 60
+	} `toml:"enroll"`
+
+	Admin struct {
+		Addr     string `toml:"addr"`      // defaults to 127.0.0.1:8081
+		APIToken string `toml:"api_token"` // bearer token with full access to the admin api, disabled if empty
+	} `toml:"admin"`
 }
 
 var DefaultConfig = &Configuration{}
@@ -52,10 +132,53 @@ func (c *Configuration) Init() error {
 	if c.Addr == "" || c.Database.PostgresURL == "" {
 		return fmt.Errorf("config file is missing some required fields")
 	}
-
+	c.SetDefaults()
 	return nil
 }
 
+// SetDefaults sets the fields that have a default and are not set.
+func (c *Configuration) SetDefaults() {
+	if c.Capture.MaxBodyBytes == 0 {
+		c.Capture.MaxBodyBytes = 1 << 20
+	}
+	if c.Capture.RetentionDays == 0 {
+		c.Capture.RetentionDays = 30
+	}
+	if c.Usage.FlushSeconds == 0 {
+		c.Usage.FlushSeconds = 30
+	}
+	if c.MITM.PinnedFailures == 0 {
+		c.MITM.PinnedFailures = 3
+	}
+	if c.MITM.PinnedMinutes == 0 {
+		c.MITM.PinnedMinutes = 1440
+	}
+	if c.Tunnel.HelloTimeoutSeconds == 0 {
+		c.Tunnel.HelloTimeoutSeconds = 5
+	}
+	if c.Tunnel.TLSPorts == nil {
+		c.Tunnel.TLSPorts = []int{443, 8443}
+	}
+	if c.Auth.MaxLoginFailures == 0 {
+		c.Auth.MaxLoginFailures = 5
+	}
+	if c.Auth.LockoutSeconds == 0 {
+		c.Auth.LockoutSeconds = 30
+	}
+	if c.Auth.TOTPIssuer == "" {
+		c.Auth.TOTPIssuer = "hat"
+	}
+	if c.Enroll.Host == "" {
+		c.Enroll.Host = "hat.enroll"
+	}
+	if c.Enroll.CodeTTLMinutes == 0 {
+		c.Enroll.CodeTTLMinutes = 60
+	}
+	if c.Admin.Addr == "" {
+		c.Admin.Addr = "127.0.0.1:8081"
+	}
+}
+
 func Init() error {
 	return DefaultConfig.Init()
 }
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+var deviceCache = newTTLCache[uuid.UUID, *database.Device](time.Minute)
+
+// devices of client ips in transparent mode, nil for ips of no device
+var addressCache = newTTLCache[string, *database.Device](time.Minute)
+
+var (
+	errNoProxyCredentials = errors.New("no proxy credentials")
+	errUnknownDevice      = errors.New("unknown device")
+	errWrongProxyPassword = errors.New("wrong proxy password")
+)
+
+// identifyDevice returns the device that sent the request. Devices identify themselves with
+// Proxy-Authorization basic auth, using their device id as the username and their proxy secret (given when
+// they enrolled) as the password. Devices without a secret only need their id. A request without
+// credentials is from an unknown device (nil) if allow_anonymous is set. Otherwise, and for credentials that
+// aren't of a device, the error is one isCredentialError reports, so the request can be rejected instead of
+// escaping the rules of every device.
+func identifyDevice(ctx *fasthttp.RequestCtx) (*database.Device, error) {
+	username, password, ok := parseProxyAuthorization(string(ctx.Request.Header.Peek("Proxy-Authorization")))
+	if !ok {
+		if config.DefaultConfig.AllowAnonymous {
+			return nil, nil
+		}
+		return nil, errNoProxyCredentials
+	}
+	return deviceByCredentials(username, password, ctx.RemoteIP().String())
+}
+
+// deviceByCredentials returns the device whose id is username, checking password like identifyDevice. ip is
+// where the credentials came from, for the log. It returns errUnknownDevice if there is no such device.
+func deviceByCredentials(username, password, ip string) (*database.Device, error) {
+	id, err := uuid.Parse(username)
+	if err != nil {
+		slog.Debug("proxy username isn't a device id", "ip", ip)
+		return nil, errUnknownDevice
+	}
+	device, err := deviceCache.get(id, func() (*database.Device, error) {
+		if env.db == nil {
+			return nil, errUnknownDevice
+		}
+		device, err := env.db.GetDeviceByID(id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errUnknownDevice
+		}
+		return device, err
+	})
+	if errors.Is(err, errUnknownDevice) {
+		slog.Debug("unknown device", "id", id, "ip", ip)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("get device: %w", err)
+	}
+	if device.ProxySecretHash != "" &&
+		subtle.ConstantTimeCompare([]byte(auth.HashToken(password)), []byte(device.ProxySecretHash)) != 1 {
+		slog.Debug("wrong proxy password", "device", id, "ip", ip)
+		return nil, errWrongProxyPassword
+	}
+	return device, nil
+}
+
+// isCredentialError reports whether err means that the client has to send other credentials, as opposed to
+// the device not being found because of a database error.
+func isCredentialError(err error) bool {
+	return errors.Is(err, errNoProxyCredentials) || errors.Is(err, errUnknownDevice) || errors.Is(err, errWrongProxyPassword)
+}
+
+// authenticate returns the device that sent the request, like identifyDevice. If there is none, it writes
+// the response and returns false: a request for credentials, or an error if the device couldn't be looked
+// up.
+func authenticate(ctx *fasthttp.RequestCtx) (*database.Device, bool) {
+	device, err := identifyDevice(ctx)
+	if err == nil {
+		return device, true
+	}
+	if isCredentialError(err) {
+		requireProxyAuth(ctx)
+	} else {
+		slog.Error("identify device", "ip", ctx.RemoteIP(), "error", err)
+		ctx.Error("the device couldn't be identified, try again later", fasthttp.StatusServiceUnavailable)
+	}
+	return nil, false
+}
+
+// identifyAddress returns the device of a connection without credentials from ip (in transparent mode), like
+// identifyDevice: nil for an unknown device if allow_anonymous is set, otherwise errUnknownDevice.
+func identifyAddress(ip string) (*database.Device, error) {
+	device, err := deviceByAddress(ip)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil && !config.DefaultConfig.AllowAnonymous {
+		slog.Debug("no device with the address", "ip", ip)
+		return nil, errUnknownDevice
+	}
+	return device, nil
+}
+
+// deviceByAddress returns the device with ip, or the mac address ip has in the arp table, in its addresses.
+// It returns nil if there is none.
+func deviceByAddress(ip string) (*database.Device, error) {
+	if env.db == nil {
+		return nil, nil
+	}
+	device, err := addressCache.get(ip, func() (*database.Device, error) {
+		addrs := []string{ip}
+		if mac := macAddress(ip); mac != "" {
+			addrs = append(addrs, mac)
+		}
+		device, err := env.db.GetDeviceByAddress(addrs)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return device, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get device by address: %w", err)
+	}
+	return device, nil
+}
+
+// requireProxyAuth asks the client for proxy credentials.
+func requireProxyAuth(ctx *fasthttp.RequestCtx) {
+	ctx.Error("proxy credentials of a device are required", fasthttp.StatusProxyAuthRequired)
+	ctx.Response.Header.Set("Proxy-Authenticate", `Basic realm="hat"`)
+}
+
+// InvalidateDevice makes the proxy reload the device from the database on the next request.
+func InvalidateDevice(id uuid.UUID) {
+	deviceCache.invalidate(id)
+	addressCache.clear() // its addresses may have changed
+}
+
+// InvalidateDevices makes the proxy reload every device from the database, e.g. after a device group they
+// could be in was deleted.
+func InvalidateDevices() {
+	deviceCache.clear()
+	addressCache.clear()
+}
+
+// parseProxyAuthorization parses a basic Proxy-Authorization header value.
+func parseProxyAuthorization(v string) (username, password string, ok bool) {
+	scheme, encoded, ok := strings.Cut(v, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func deviceID(device *database.Device) *uuid.UUID {
+	if device == nil {
+		return nil
+	}
+	return &device.ID
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseProxyAuthorization(t *testing.T) {
+	tests := []struct {
+		header             string
+		username, password string
+		ok                 bool
+	}{
+		{"Basic dXNlcjpwYXNz", "user", "pass", true},
+		{"basic dXNlcjpwYXNz", "user", "pass", true},
+		{"Basic dXNlcjo=", "user", "", true},
+		{"Basic dXNlcg==", "user", "", false}, // no colon
+		{"Bearer dXNlcjpwYXNz", "", "", false},
+		{"Basic !!!", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		username, password, ok := parseProxyAuthorization(tt.header)
+		if username != tt.username || password != tt.password || ok != tt.ok {
+			t.Errorf("parseProxyAuthorization(%q) = %q, %q, %t, want %q, %q, %t", tt.header, username, password, ok, tt.username, tt.password, tt.ok)
+		}
+	}
+}
+
+func TestIdentifyDevice(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	open := testDevice() // enrolled before devices had proxy passwords
+	enroll(t, open, "")
+
+	tests := []struct {
+		name               string
+		username, password string
+		anonymous          bool
+		want               *database.Device
+		err                error
+	}{
+		{"no credentials", "", "", false, nil, errNoProxyCredentials},
+		{"no credentials, anonymous allowed", "", "", true, nil, nil},
+		{"device", device.ID.String(), "secret", false, device, nil},
+		{"wrong password", device.ID.String(), "guess", false, nil, errWrongProxyPassword},
+		{"wrong password, anonymous allowed", device.ID.String(), "guess", true, nil, errWrongProxyPassword},
+		{"device without a password", open.ID.String(), "", false, open, nil},
+		{"unknown device", uuid.NewString(), "secret", false, nil, errUnknownDevice},
+		{"unknown device, anonymous allowed", uuid.NewString(), "secret", true, nil, errUnknownDevice},
+		{"not a device id", "admin", "secret", false, nil, errUnknownDevice},
+	}
+	for _, tt := range tests {
+		config.DefaultConfig.AllowAnonymous = tt.anonymous
+		got, err := identifyDevice(requestCtx("GET", "http://example.com/", tt.username, tt.password))
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: identifyDevice = %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+		if err != nil && !isCredentialError(err) {
+			t.Errorf("%s: %v is not a credential error", tt.name, err)
+		}
+	}
+	config.DefaultConfig.AllowAnonymous = false
+}
+
+func TestProxyRequiresCredentials(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+
+	for _, ctx := range []*fasthttp.RequestCtx{
+		requestCtx("GET", srv.URL+"/", "", ""),
+		requestCtx("GET", srv.URL+"/", "not-a-device", ""),
+		requestCtx("GET", srv.URL+"/", uuid.NewString(), ""),
+	} {
+		if err := handleHTTP(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.Response.StatusCode() != fasthttp.StatusProxyAuthRequired {
+			t.Errorf("status = %d, want %d", ctx.Response.StatusCode(), fasthttp.StatusProxyAuthRequired)
+		}
+		if len(ctx.Response.Header.Peek("Proxy-Authenticate")) == 0 {
+			t.Error("missing Proxy-Authenticate")
+		}
+	}
+	connect := requestCtx("CONNECT", "example.com:443", "", "")
+	connect.Request.SetHost("example.com:443")
+	if err := handleHTTPS(connect); err != nil {
+		t.Fatal(err)
+	}
+	if connect.Response.StatusCode() != fasthttp.StatusProxyAuthRequired || connect.Hijacked() {
+		t.Errorf("CONNECT without credentials: status %d, hijacked %t", connect.Response.StatusCode(), connect.Hijacked())
+	}
+	if hits.Load() != 0 {
+		t.Errorf("server got %d requests, want 0", hits.Load())
+	}
+
+	config.DefaultConfig.AllowAnonymous = true
+	defer func() { config.DefaultConfig.AllowAnonymous = false }()
+	ctx := requestCtx("GET", srv.URL+"/", "", "")
+	if err := handleHTTP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || hits.Load() != 1 {
+		t.Errorf("anonymous request: status %d, server got %d requests", ctx.Response.StatusCode(), hits.Load())
+	}
+}
+
+func TestProxyScreensDevice(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-path", "/blocked"))
+
+	ctx := requestCtx("GET", srv.URL+"/blocked", device.ID.String(), "secret")
+	if err := handleHTTP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || hits.Load() != 0 {
+		t.Errorf("blocked request: status %d, server got %d requests", ctx.Response.StatusCode(), hits.Load())
+	}
+
+	ctx = requestCtx("GET", srv.URL+"/fine", device.ID.String(), "secret")
+	if err := handleHTTP(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || hits.Load() != 1 {
+		t.Errorf("allowed request: status %d, server got %d requests", ctx.Response.StatusCode(), hits.Load())
+	}
+	if ctx.Request.Header.Peek("Proxy-Authorization") != nil {
+		t.Error("Proxy-Authorization was sent to the server")
+	}
+}
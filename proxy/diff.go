@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/valyala/fasthttp"
+)
+
+// maxDiffCells bounds the size of the table used for the line diff of bodies (lines in original * lines in replayed).
+const maxDiffCells = 4_000_000
+
+// headers that change between any two responses and only add noise to a diff
+var ignoredDiffHeaders = []string{"Date", "Age"}
+
+// Diff is the difference between the responses of two logged requests.
+type Diff struct {
+	OriginalStatus int            `json:"original_status"`
+	ReplayedStatus int            `json:"replayed_status"`
+	Headers        []HeaderChange `json:"headers,omitempty"`
+	BodyChanged    bool           `json:"body_changed"`
+	Body           []string       `json:"body,omitempty"` // changed lines, prefixed with "- " (original) or "+ " (replayed)
+}
+
+// HeaderChange is a response header whose value differs. An empty value means the header was not present.
+type HeaderChange struct {
+	Key      string `json:"key"`
+	Original string `json:"original"`
+	Replayed string `json:"replayed"`
+}
+
+func diffResponses(original, replayed *database.LoggedRequest) *Diff {
+	d := &Diff{
+		OriginalStatus: original.StatusCode,
+		ReplayedStatus: replayed.StatusCode,
+	}
+
+	oh, rh := headerMap(original.ResponseHeaders), headerMap(replayed.ResponseHeaders)
+	keys := make([]string, 0, len(oh)+len(rh))
+	for k := range oh {
+		keys = append(keys, k)
+	}
+	for k := range rh {
+		if _, ok := oh[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if slices.Contains(ignoredDiffHeaders, k) || oh[k] == rh[k] {
+			continue
+		}
+		d.Headers = append(d.Headers, HeaderChange{Key: k, Original: oh[k], Replayed: rh[k]})
+	}
+
+	ob, rb := decodedBody(original), decodedBody(replayed)
+	if bytes.Equal(ob, rb) {
+		return d
+	}
+	d.BodyChanged = true
+	d.Body = diffLines(strings.Split(string(ob), "\n"), strings.Split(string(rb), "\n"))
+	return d
+}
+
+// headerMap returns the headers keyed by their canonical name. Repeated headers are joined with ", ".
+func headerMap(headers []database.Header) map[string]string {
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		k := textproto.CanonicalMIMEHeaderKey(h.Key)
+		if v, ok := m[k]; ok {
+			m[k] = v + ", " + h.Value
+		} else {
+			m[k] = h.Value
+		}
+	}
+	return m
+}
+
+// decodedBody returns the response body of r with any content encoding removed. If decoding fails (e.g.
+// because the body was truncated when it was logged), the raw body is returned.
+func decodedBody(r *database.LoggedRequest) []byte {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	for _, h := range r.ResponseHeaders {
+		if strings.EqualFold(h.Key, "Content-Encoding") {
+			resp.Header.Set(h.Key, h.Value)
+		}
+	}
+	resp.SetBodyRaw(r.ResponseBody)
+	body, err := resp.BodyUncompressed()
+	if err != nil {
+		return r.ResponseBody
+	}
+	return append([]byte(nil), body...)
+}
+
+// diffLines returns the lines removed from a and added in b, using the longest common subsequence of lines.
+func diffLines(a, b []string) []string {
+	if len(a)*len(b) > maxDiffCells {
+		return []string{"- (body too large to diff)", "+ (body too large to diff)"}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
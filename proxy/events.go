@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+)
+
+const (
+	EventHTTP   = "http"   // a plain http request
+	EventMITM   = "mitm"   // a request inside an intercepted https connection
+	EventTunnel = "tunnel" // an https tunnel that is not intercepted
+	EventUDP    = "udp"    // the datagrams of a socks udp association to one host
+)
+
+// Event describes a proxied request as it happens. It has the same fields as the request log, without
+// the headers and bodies.
+type Event struct {
+	ID         uuid.UUID  `json:"id"` // id of the request in the request log
+	Type       string     `json:"type"`
+	DeviceID   *uuid.UUID `json:"device_id,omitempty"`
+	RuleID     *uuid.UUID `json:"rule_id,omitempty"`
+	Method     string     `json:"method"`
+	URL        string     `json:"url"`
+	Host       string     `json:"host"`
+	StatusCode int        `json:"status_code"`
+	Duration   int64      `json:"duration_ms"`
+	Time       time.Time  `json:"time"`
+}
+
+func eventFromLoggedRequest(typ string, lr *database.LoggedRequest) Event {
+	return Event{
+		ID:         lr.ID,
+		Type:       typ,
+		DeviceID:   lr.DeviceID,
+		RuleID:     lr.RuleID,
+		Method:     lr.Method,
+		URL:        lr.URL,
+		Host:       lr.Host,
+		StatusCode: lr.StatusCode,
+		Duration:   lr.Duration,
+		Time:       lr.CreatedAt,
+	}
+}
+
+// Filter selects which events a subscription receives. Zero fields match everything.
+type Filter struct {
+	DeviceID *uuid.UUID
+	RuleID   *uuid.UUID
+	Host     string // matches the host and its subdomains
+}
+
+func (f Filter) matches(e Event) bool {
+	if f.DeviceID != nil && (e.DeviceID == nil || *e.DeviceID != *f.DeviceID) {
+		return false
+	}
+	if f.RuleID != nil && (e.RuleID == nil || *e.RuleID != *f.RuleID) {
+		return false
+	}
+	if f.Host != "" {
+		host := e.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != f.Host && !strings.HasSuffix(host, "."+f.Host) {
+			return false
+		}
+	}
+	return true
+}
+
+// Bus fans out events to its subscribers. Publishing never blocks: if a subscriber's buffer is full, the
+// event is dropped for that subscriber.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the events matching its filter on C until it is closed.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	filter  Filter
+	bus     *Bus
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Events is the bus that the proxy handlers publish to.
+var Events = &Bus{}
+
+// Subscribe returns a new subscription for events matching filter, buffering up to buffer events.
+func (b *Bus) Subscribe(filter Filter, buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Publish sends e to every subscriber whose filter matches.
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.filter.matches(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events that were dropped because the subscriber was too slow.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes s and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.c)
+	})
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFilterMatches(t *testing.T) {
+	device, rule := uuid.New(), uuid.New()
+	other := uuid.New()
+	e := Event{DeviceID: &device, RuleID: &rule, Host: "www.example.com:443"}
+
+	tests := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{DeviceID: &device}, true},
+		{Filter{DeviceID: &other}, false},
+		{Filter{RuleID: &rule}, true},
+		{Filter{RuleID: &other}, false},
+		{Filter{Host: "www.example.com"}, true},
+		{Filter{Host: "example.com"}, true},
+		{Filter{Host: "ample.com"}, false},
+		{Filter{DeviceID: &device, Host: "other.com"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(e); got != tt.want {
+			t.Errorf("%+v matches = %t, want %t", tt.filter, got, tt.want)
+		}
+	}
+	if (Filter{RuleID: &rule}).matches(Event{Host: "example.com"}) {
+		t.Error("a rule filter matches an event without a rule")
+	}
+}
+
+func TestBusDoesNotBlock(t *testing.T) {
+	b := &Bus{}
+	device := uuid.New()
+	slow := b.Subscribe(Filter{}, 1)
+	defer slow.Close()
+	mine := b.Subscribe(Filter{DeviceID: &device}, 10)
+	defer mine.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for range 5 {
+			b.Publish(Event{DeviceID: &device})
+		}
+		b.Publish(Event{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+
+	if got := slow.Dropped(); got != 5 {
+		t.Errorf("slow subscriber dropped %d events, want 5", got)
+	}
+	if got := len(mine.C); got != 5 {
+		t.Errorf("filtered subscriber got %d events, want 5", got)
+	}
+
+	mine.Close()
+	mine.Close() // closing twice is fine
+	if _, ok := <-drain(mine.C); ok {
+		t.Error("C is still open after Close")
+	}
+	b.Publish(Event{DeviceID: &device}) // doesn't send on the closed channel
+}
+
+// drain returns c once the events buffered in it are read.
+func drain(c <-chan Event) <-chan Event {
+	for len(c) > 0 {
+		<-c
+	}
+	return c
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+
+	"github.com/valyala/fasthttp"
+)
+
+// exchange is a request being handled with its response, so that requests are screened the same way
+// whether fasthttp or net/http (for http/2) serves them.
+type exchange interface {
+	Host() string
+	Method() string
+	Path() string
+	Body() string
+	ClientIP() string
+
+	// respond replaces the response.
+	respond(status int, contentType string, body []byte)
+	// redirect replaces the response with a redirect to url.
+	redirect(url string)
+}
+
+// fastExchange is an exchange served by fasthttp.
+type fastExchange struct {
+	ctx *fasthttp.RequestCtx
+}
+
+func (x fastExchange) Host() string     { return b2s(x.ctx.Host()) }
+func (x fastExchange) Method() string   { return b2s(x.ctx.Method()) }
+func (x fastExchange) Path() string     { return b2s(x.ctx.Path()) }
+func (x fastExchange) Body() string     { return b2s(x.ctx.Request.Body()) }
+func (x fastExchange) ClientIP() string { return x.ctx.RemoteIP().String() }
+
+func (x fastExchange) respond(status int, contentType string, body []byte) {
+	x.ctx.Response.Reset()
+	x.ctx.SetStatusCode(status)
+	x.ctx.SetContentType(contentType)
+	x.ctx.SetBody(body)
+}
+
+func (x fastExchange) redirect(url string) {
+	x.ctx.Redirect(url, fasthttp.StatusFound)
+}
+
+// dstExchange is a request of a transparent connection screened as if it was for dst, the server the
+// connection was made to, instead of the one its Host header names.
+type dstExchange struct {
+	fastExchange
+	dst string // host:port
+}
+
+func (x dstExchange) Host() string { return x.dst }
+
+// respondPage replaces the response of x with page.
+func respondPage(x exchange, status int, page *template.Template, data any) {
+	var b bytes.Buffer
+	if err := page.Execute(&b, data); err != nil {
+		slog.Error("render page", "page", page.Name(), "error", err)
+		x.respond(fasthttp.StatusInternalServerError, "text/plain; charset=utf-8", []byte("internal error"))
+		return
+	}
+	x.respond(status, "text/html; charset=utf-8", b.Bytes())
+}
+
+// connExchange is a connection being opened without an http request, such as a socks connect. There is no
+// response to write a page in, so respond and redirect only keep the status for the log.
+type connExchange struct {
+	host     string // host:port
+	method   string // "CONNECT" or "UDP"
+	clientIP string
+	status   int
+}
+
+func (x *connExchange) Host() string     { return x.host }
+func (x *connExchange) Method() string   { return x.method }
+func (x *connExchange) Path() string     { return "" }
+func (x *connExchange) Body() string     { return "" }
+func (x *connExchange) ClientIP() string { return x.clientIP }
+
+func (x *connExchange) respond(status int, _ string, _ []byte) { x.status = status }
+func (x *connExchange) redirect(string)                        { x.status = fasthttp.StatusFound }
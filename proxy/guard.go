@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// isAdminAddr reports whether hostport points at the admin listener, so that the admin API can never be
+// reached through the proxy (e.g. by a device on the network asking the proxy for http://127.0.0.1:8081).
+func isAdminAddr(hostport string) bool {
+	return pointsAt(config.DefaultConfig.Admin.Addr, hostport)
+}
+
+// isProxyAddr reports whether hostport points at one of the proxy's own listeners (http, socks or
+// transparent), so that a redirected connection to one of them isn't dialed by the proxy itself.
+func isProxyAddr(hostport string) bool {
+	c := config.DefaultConfig
+	for _, addr := range []string{c.Addr, c.SOCKS.Addr, c.Transparent.Addr} {
+		if addr != "" && pointsAt(addr, hostport) {
+			return true
+		}
+	}
+	return false
+}
+
+// pointsAt reports whether hostport reaches the listener on addr. Any address of this machine does if the
+// port is the same, whether addr is a wildcard (":8080", "0.0.0.0:8080", "[::]:8080") or not.
+func pointsAt(addr, hostport string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "80"
+	}
+	if port != listenPort {
+		return false
+	}
+	if host == listenHost {
+		return true
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() || isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip belongs to one of this machine's interfaces.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,75 +1,306 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
 	"github.com/valyala/fasthttp"
 )
 
+const mitmHandshakeTimeout = 30 * time.Second
+
 func handleHTTP(ctx *fasthttp.RequestCtx) error {
+	device, ok := authenticate(ctx)
+	if !ok {
+		return nil
+	}
+	return serveHTTP(ctx, device, "")
+}
+
+// serveHTTP sends a plain http request of the device to its server, once the rules let it. If dst isn't
+// empty, the request goes to dst (the server of a transparent connection) whatever its Host header says.
+func serveHTTP(ctx *fasthttp.RequestCtx, device *database.Device, dst string) error {
 	slog.Info("http proxy request", "method", ctx.Method(), "host", ctx.Host())
-	return perform(&ctx.Request, &ctx.Response)
+	start := time.Now()
+	if rule, blocked := screen(device, database.TriggerIncomingRequest, fastExchange{ctx}); blocked {
+		record(EventHTTP, ctx, device, rule, start)
+		return nil
+	}
+	// the Host header can name any server, so the one the request goes to has to get past the rules too
+	if dst != "" && !strings.EqualFold(string(ctx.Host()), dst) {
+		if rule, blocked := screen(device, database.TriggerIncomingRequest, dstExchange{fastExchange{ctx}, dst}); blocked {
+			record(EventHTTP, ctx, device, rule, start)
+			return nil
+		}
+	}
+	enforceSafeSearch(device, &ctx.Request)
+	via := route(device, database.TriggerIncomingRequest, requestContext(device, fastExchange{ctx}))
+	if ctx.Request.Header.ConnectionUpgrade() {
+		addr := string(ctx.Host())
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "80")
+		}
+		if dst != "" {
+			addr = dst
+		}
+		handleUpgrade(ctx, addr, false, device, via, EventHTTP, start, nil)
+		return nil
+	}
+	restore := func() {}
+	if dst != "" {
+		restore = sendTo(&ctx.Request, dst)
+	}
+	err := perform(&ctx.Request, &ctx.Response, via)
+	restore()
+	if err != nil {
+		return err
+	}
+	record(EventHTTP, ctx, device, nil, start)
+	return nil
 }
 
 func handleHTTPS(ctx *fasthttp.RequestCtx) error {
 	host := string(ctx.Host()) // string conversion because i do not want to mess with fasthttp memory management
+	device, ok := authenticate(ctx)
+	if !ok {
+		return nil
+	}
+	if rule, blocked := screen(device, database.TriggerIncomingRequest, fastExchange{ctx}); blocked {
+		usage.seen(device, host, ctx.RemoteIP().String(), string(ctx.UserAgent()), 0)
+		Events.Publish(tunnelEvent(host, device, rule, ctx.Response.StatusCode()))
+		return nil
+	}
+
+	clientIP, userAgent := ctx.RemoteIP().String(), string(ctx.UserAgent()) // ctx can't be used once hijacked
+	via := route(device, database.TriggerIncomingRequest, requestContext(device, fastExchange{ctx}))
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.Hijack(func(c net.Conn) {
 		defer c.Close()
 
-		if env.certService.Enabled { // use mitm if enabled
-			handleMITM(host, c)
+		if env.certService.Enabled && expectsTLS(host) && !bypassMITM(device, host) { // use mitm if enabled
+			if err := handleMITM(host, c, device, via); err != nil {
+				slog.Error("mitm", "host", host, "error", err)
+			}
 			return
 		}
 		slog.Info("https tunnel request", "host", host)
 
-		hostConn, err := net.Dial("tcp", host) // connect to the target server
+		// without mitm, the client hello is the only thing to know about the tunnel besides its host
+		var peeked []byte
+		if expectsTLS(host) {
+			var info *database.TLSInfo
+			var err error
+			info, peeked, err = peekClientHello(c)
+			if err != nil {
+				slog.Debug("tunnel without client hello", "host", host, "error", err)
+			} else if rule, err := screenTunnel(device, host, clientIP, info); rule != nil || err != nil {
+				slog.Info("tunnel blocked", "host", host, "sni", info.ServerName, "error", err)
+				usage.seen(device, host, clientIP, userAgent, 0)
+				Events.Publish(tunnelEvent(host, device, rule, fasthttp.StatusForbidden))
+				return
+			}
+		}
+
+		hostConn, err := via.dial(context.Background(), dialAddr(device, host)) // connect to the target server
 		if err != nil {
-			slog.Error("dial target server", "host", host, "error", err)
+			slog.Error("dial target server", "host", host, "upstream", via, "error", err)
 			return
 		}
-		defer hostConn.Close()
-
-		wg := &sync.WaitGroup{}
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			io.Copy(c, hostConn) // copy data from server to client
-		}()
-		go func() {
-			defer wg.Done()
-			io.Copy(hostConn, c) // copy data from client to server
-		}()
-		wg.Wait()
+		tunnel(c, hostConn, host, device, clientIP, userAgent, peeked)
 	})
 	return nil
 }
 
-func handleMITM(host string, c net.Conn) error {
+// tunnel copies between the client's connection c and hostConn, the connection to host, until either side
+// closes. peeked is what was already read from c, which is sent first.
+func tunnel(c, hostConn net.Conn, host string, device *database.Device, clientIP, userAgent string, peeked []byte) {
+	defer hostConn.Close()
+	if _, err := hostConn.Write(peeked); err != nil { // replay what was read while peeking
+		slog.Error("write client hello", "host", host, "error", err)
+		return
+	}
+	Events.Publish(tunnelEvent(host, device, nil, fasthttp.StatusOK))
+	usage.seen(device, host, clientIP, userAgent, int64(len(peeked)))
+
+	// both directions are counted as they are copied. if the device goes over a quota or is blocked,
+	// both connections are closed so the other direction stops too.
+	stop := func(err error) {
+		if err != nil {
+			slog.Info("tunnel closed", "host", host, "device", deviceID(device), "reason", err)
+			c.Close()
+			hostConn.Close()
+		}
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stop(copyTunnel(c, hostConn, device, host)) // copy data from server to client
+	}()
+	go func() {
+		defer wg.Done()
+		stop(copyTunnel(hostConn, c, device, host)) // copy data from client to server
+	}()
+	wg.Wait()
+}
+
+// serveTLS serves a connection of the device to host that may be tls, once the rules let it be made (from
+// socks or transparent mode). If it is tls, it is intercepted with mitm unless the host is bypassed, in which
+// case it is screened by its client hello. A host that is an ip is replaced by the server name of the client
+// hello, though a tunnel still connects to the ip. hostConn is a connection to host that was already made
+// through via, or nil to make one when it is needed; it is closed if it isn't used.
+func serveTLS(c net.Conn, host string, device *database.Device, clientIP string, via *parentProxy, hostConn net.Conn) {
+	addr := host
+	dial := func(to string) (net.Conn, error) {
+		if hostConn != nil && to == addr {
+			conn := hostConn
+			hostConn = nil
+			return conn, nil
+		}
+		return via.dial(context.Background(), to)
+	}
+	defer func() {
+		if hostConn != nil {
+			hostConn.Close()
+		}
+	}()
+
+	info, peeked, err := peekClientHello(c)
+	if err != nil {
+		slog.Debug("tunnel without client hello", "host", host, "error", err)
+		if conn, err := dial(addr); err != nil {
+			slog.Error("dial target server", "host", host, "upstream", via, "error", err)
+		} else {
+			tunnel(c, conn, host, device, clientIP, "", peeked)
+		}
+		return
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil && net.ParseIP(h) != nil && info.ServerName != "" {
+		host = net.JoinHostPort(info.ServerName, port)
+	}
+
+	if env.certService.Enabled && !bypassMITM(device, host) {
+		replayed := &bufferedConn{Conn: c, r: io.MultiReader(bytes.NewReader(peeked), c)}
+		if err := handleMITM(host, replayed, device, via); err != nil {
+			slog.Error("mitm", "host", host, "error", err)
+		}
+		return
+	}
+	if rule, err := screenTunnel(device, host, clientIP, info); rule != nil || err != nil {
+		slog.Info("tunnel blocked", "host", host, "sni", info.ServerName, "error", err)
+		usage.seen(device, host, clientIP, "", 0)
+		Events.Publish(tunnelEvent(host, device, rule, fasthttp.StatusForbidden))
+		return
+	}
+	to := addr
+	if safe := dialAddr(device, host); safe != host {
+		to = safe
+	}
+	conn, err := dial(to)
+	if err != nil {
+		slog.Error("dial target server", "host", host, "upstream", via, "error", err)
+		return
+	}
+	tunnel(c, conn, host, device, clientIP, "", peeked)
+}
+
+// handleMITM serves the tunnel c of the device to host with mitm. Its requests go through via unless a
+// route_via rule for mitm requests picks another parent proxy.
+func handleMITM(host string, c net.Conn, device *database.Device, via *parentProxy) error {
 	tlsConn, err := env.certService.TLSConn(c, host)
 	if err != nil {
 		return fmt.Errorf("convert to TLS connection: %w", err)
 	}
 	defer tlsConn.Close()
 
-	// we're not doing anything special with the request, just proxying it for now
-	fasthttp.ServeConn(tlsConn, func(ctx *fasthttp.RequestCtx) {
+	hctx, cancel := context.WithTimeout(context.Background(), mitmHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hctx); err != nil {
+		if isHandshakeAbort(err) { // the client may pin the certificate of the host
+			pinning.failed(host)
+		}
+		return fmt.Errorf("handshake: %w", err)
+	}
+	pinning.succeeded(host)
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return serveHTTP2(tlsConn, host, device, via)
+	}
+
+	// an upgraded connection is spliced after ServeConn returns, tlsConn has to stay open until it is done
+	var upgraded atomic.Bool
+	spliced := make(chan struct{})
+	err = fasthttp.ServeConn(tlsConn, func(ctx *fasthttp.RequestCtx) {
 		slog.Info("https mitm proxy request", "method", ctx.Method(), "host", host)
-		if err := fasthttp.Do(&ctx.Request, &ctx.Response); err != nil {
-			slog.Error("perform request", "error", err)
+		start := time.Now()
+		if rule, blocked := screen(device, database.TriggerRecievedMITMRequest, fastExchange{ctx}); blocked {
+			record(EventMITM, ctx, device, rule, start)
+			return
+		}
+		enforceSafeSearch(device, &ctx.Request)
+		via := via
+		if p, ok := routeRule(device, database.TriggerRecievedMITMRequest, requestContext(device, fastExchange{ctx})); ok {
+			via = p
+		}
+		if ctx.Request.Header.ConnectionUpgrade() {
+			if handleUpgrade(ctx, host, true, device, via, EventMITM, start, func() { close(spliced) }) {
+				upgraded.Store(true)
+			}
+			return
+		}
+		if err := via.do(&ctx.Request, &ctx.Response); err != nil {
+			slog.Error("perform request", "upstream", via, "error", err)
 			ctx.SetStatusCode(fasthttp.StatusBadGateway)
+			return
 		}
+		record(EventMITM, ctx, device, nil, start)
 	})
-
+	if err == nil && upgraded.Load() { // ServeConn returns nil once the connection is hijacked
+		<-spliced
+	}
 	return nil
 }
 
-func perform(req *fasthttp.Request, resp *fasthttp.Response) error {
+// perform sends req through via (directly if it is nil) and reads the response into resp.
+func perform(req *fasthttp.Request, resp *fasthttp.Response, via *parentProxy) error {
 	req.Header.Del("Proxy-Authorization")
 	req.Header.Del("Proxy-Connection")
-	return fasthttp.Do(req, resp)
+	return via.do(req, resp)
+}
+
+// sendTo makes req go to the server at dst, with its Host header unchanged, until the returned func is
+// called, which gives the url its host back for the log.
+func sendTo(req *fasthttp.Request, dst string) func() {
+	uri := req.URI()
+	host := string(uri.Host())
+	req.Header.SetHost(host)
+	req.UseHostHeader = true
+	uri.SetHost(dst)
+	return func() {
+		uri.SetHost(host)
+		req.UseHostHeader = false
+	}
+}
+
+func tunnelEvent(host string, device *database.Device, rule *database.Rule, statusCode int) Event {
+	return Event{
+		ID:         uuid.New(),
+		Type:       EventTunnel,
+		DeviceID:   deviceID(device),
+		RuleID:     ruleID(rule),
+		Method:     fasthttp.MethodConnect,
+		URL:        host,
+		Host:       host,
+		StatusCode: statusCode,
+		Time:       time.Now(),
+	}
 }
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+var (
+	errHelloRead   = fmt.Errorf("client hello read")
+	errSNIMismatch = fmt.Errorf("server name does not match the tunnel's host")
+)
+
+// helloConn is a connection a tls server reads a client hello from without being able to answer it.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (helloConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekClientHello reads the tls client hello of a tunnel. It returns everything that was read, which has to
+// be sent to the server before the rest of the tunnel, even if there was no client hello (the tunnel isn't
+// tls, or the client waits for the server to speak first).
+func peekClientHello(c net.Conn) (*database.TLSInfo, []byte, error) {
+	var peeked bytes.Buffer
+	var info *database.TLSInfo
+	c.SetReadDeadline(time.Now().Add(time.Duration(config.DefaultConfig.Tunnel.HelloTimeoutSeconds) * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	err := tls.Server(helloConn{Conn: c, r: io.TeeReader(c, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = &database.TLSInfo{ServerName: strings.ToLower(hello.ServerName), ALPN: hello.SupportedProtos}
+			return nil, errHelloRead // stop the handshake, the server's answer comes from the real server
+		},
+	}).Handshake()
+	if info == nil {
+		return nil, peeked.Bytes(), fmt.Errorf("read client hello: %w", err)
+	}
+	return info, peeked.Bytes(), nil
+}
+
+// expectsTLS reports whether a tunnel to host is expected to start with a tls client hello, going by its
+// port. Other tunnels aren't peeked at: the client of a protocol where the server speaks first (smtp, ssh)
+// would wait for the server while the proxy waits for a client hello.
+func expectsTLS(host string) bool {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(config.DefaultConfig.Tunnel.TLSPorts, n)
+}
+
+// screenTunnel decides whether a tunnel of the device to host may go on now that its client hello is known.
+// Rules are evaluated again with the server name as the host, so a client can't get past them by connecting
+// to an ip, and with ctx-sni and ctx-alpn available. A rule that blocks the tunnel is returned, otherwise an
+// error if the server name doesn't match host and that is blocked by the configuration, or if the rules
+// can't be loaded and fail_open isn't set.
+func screenTunnel(device *database.Device, host, clientIP string, info *database.TLSInfo) (*database.Rule, error) {
+	if device == nil {
+		return nil, nil
+	}
+	if _, ok, err := overridden(database.OverridePauseDevice, device.ID); ok || err != nil {
+		return nil, unscreened(err)
+	}
+	name := stripPort(host)
+	if info.ServerName != "" {
+		if config.DefaultConfig.Tunnel.BlockSNIMismatch && net.ParseIP(name) == nil && !strings.EqualFold(name, info.ServerName) {
+			return nil, errSNIMismatch
+		}
+		name = info.ServerName
+	}
+	evalCtx := &database.Context{Device: device, Host: name, TLS: info, Lists: blocklists, Categories: categorizer{}}
+	rule, err := matchRule(device, database.TriggerIncomingRequest, evalCtx)
+	if rule == nil || err != nil {
+		return nil, unscreened(err)
+	}
+	slog.Info("tunnel matched rule", "host", host, "sni", info.ServerName, "rule", rule.ID)
+	if rule.RuleAction.Type == database.ActionBlockIP {
+		go banIP(clientIP, rule)
+	}
+	return rule, nil // there is no response to write a block page or redirect in, the tunnel is closed
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+)
+
+func TestExpectsTLS(t *testing.T) {
+	tests := map[string]bool{
+		"example.com:443":   true,
+		"example.com:8443":  true,
+		"[::1]:443":         true,
+		"example.com:25":    false,
+		"example.com:22":    false,
+		"example.com":       false,
+		"example.com:https": false,
+	}
+	for host, want := range tests {
+		if got := expectsTLS(host); got != want {
+			t.Errorf("expectsTLS(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go tls.Client(client, &tls.Config{ServerName: "Example.COM", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+
+	info, peeked, err := peekClientHello(server)
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerName != "example.com" || !slices.Equal(info.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("info = %+v", info)
+	}
+	if len(peeked) == 0 || peeked[0] != 0x16 {
+		t.Errorf("peeked %d bytes that aren't the client hello", len(peeked))
+	}
+}
+
+func TestPeekNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	const greeting = "SSH-2.0-OpenSSH_9.6\r\n"
+	go io.WriteString(client, greeting)
+
+	if _, peeked, err := peekClientHello(server); err == nil || !bytes.HasPrefix([]byte(greeting), peeked) {
+		t.Errorf("peekClientHello = %q, %v, want an error and what was read", peeked, err)
+	}
+}
+
+// serverFirst listens on addr for connections that get greeting as soon as they are made, and counts them.
+// The connections are closed when the test ends.
+func serverFirst(t *testing.T, addr, greeting string) (string, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen on %s: %v", addr, err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			accepted <- struct{}{}
+			io.WriteString(c, greeting)
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+func TestTunnelServerSpeaksFirst(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t)
+	proxy := startProxy(t)
+	addr, _ := serverFirst(t, "127.0.0.1:0", "220 mail.example ESMTP\r\n")
+	c := connect(t, proxy, addr, device, "secret")
+
+	// the client waits for the greeting, which must not wait for the hello timeout
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	greeting := make([]byte, 4)
+	if _, err := io.ReadFull(c, greeting); err != nil || string(greeting) != "220 " {
+		t.Errorf("read greeting = %q, %v", greeting, err)
+	}
+}
+
+func TestTunnelScreenedByClientHello(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-host", "blocked.example"))
+	proxy := startProxy(t)
+	addr, accepted := serverFirst(t, "127.0.0.1:8443", "") // one of the default tls ports
+
+	c := connect(t, proxy, addr, device, "secret")
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tls.Client(c, &tls.Config{ServerName: "www.blocked.example"}).Handshake(); err == nil {
+		t.Error("handshake with a blocked server name succeeded")
+	}
+	select {
+	case <-accepted:
+		t.Error("the tunnel to a blocked server name was made")
+	default:
+	}
+
+	c = connect(t, proxy, addr, device, "secret")
+	go tls.Client(c, &tls.Config{ServerName: "fine.example"}).Handshake()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Error("the tunnel to an allowed server name wasn't made")
+	}
+}
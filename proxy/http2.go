@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// at most this much of a request body is read for rules that look at it, like fasthttp's default max
+// request body size
+const maxRuleBody = 4 << 20
+
+// upstream sends the requests of http/2 mitm connections. It negotiates http/2 with servers that support it.
+var upstream = &http.Transport{
+	ForceAttemptHTTP2:   true,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+type exchangeKey struct{}
+
+// serveHTTP2 serves a mitm connection that negotiated http/2 with net/http, which multiplexes its streams
+// and does the flow control. Each stream is screened and logged like a request served by fasthttp.
+func serveHTTP2(conn *tls.Conn, host string, device *database.Device, via *parentProxy) error {
+	done := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler: mitmHandler(host, device, via),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() { close(done) })
+			}
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+	err := srv.Serve(&connListener{conn: conn, done: done})
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// connListener hands a connection that was already accepted to http.Server. Accept returns it once, then
+// blocks until done is closed.
+type connListener struct {
+	conn net.Conn
+	done <-chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil { // http.Server calls Accept from a single goroutine
+		l.conn = nil
+		return c, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return dummyAddr{} }
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "mitm" }
+
+// mitmHandler returns the handler of the streams of an http/2 mitm connection to host. Each stream is sent
+// through via unless a route_via rule picks another parent proxy.
+func mitmHandler(host string, device *database.Device, via *parentProxy) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = pr.In.Host
+			if pr.Out.URL.Host == "" {
+				pr.Out.URL.Host = host
+			}
+		},
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return r.Context().Value(exchangeKey{}).(*stdExchange).via.roundTripper().RoundTrip(r)
+		}),
+		FlushInterval: -1, // stream responses as they come
+		ModifyResponse: func(resp *http.Response) error {
+			x := resp.Request.Context().Value(exchangeKey{}).(*stdExchange)
+			x.status = resp.StatusCode
+			x.header = resp.Header.Clone()
+			resp.Body = teeReadCloser{io.TeeReader(resp.Body, &x.respBody), resp.Body}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("perform request", "error", err)
+			x := r.Context().Value(exchangeKey{}).(*stdExchange)
+			x.status = http.StatusBadGateway
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("https mitm proxy request", "method", r.Method, "host", host, "proto", r.Proto)
+		start := time.Now()
+		x := &stdExchange{w: w, r: r, via: via}
+		if rule, blocked := screen(device, database.TriggerRecievedMITMRequest, x); blocked {
+			recordHTTP(EventMITM, x, device, rule, start)
+			return
+		}
+		enforceSafeSearchHTTP(device, r)
+		if p, ok := routeRule(device, database.TriggerRecievedMITMRequest, requestContext(device, x)); ok {
+			x.via = p
+		}
+		r.Body = teeReadCloser{io.TeeReader(r.Body, &x.reqBody), r.Body}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, x)))
+		recordHTTP(EventMITM, x, device, nil, start)
+	})
+}
+
+// stdExchange is an exchange served by net/http. It keeps what the request log needs as the request and
+// response are streamed through.
+type stdExchange struct {
+	w http.ResponseWriter
+	r *http.Request
+
+	via      *parentProxy // the parent proxy the request is sent through, nil if directly
+	body     []byte       // the start of the request body, once a rule read it
+	bodyRead bool
+	reqBody  cappedBuffer
+	status   int
+	header   http.Header // of the response
+	respBody cappedBuffer
+}
+
+func (x *stdExchange) Host() string   { return x.r.Host }
+func (x *stdExchange) Method() string { return x.r.Method }
+func (x *stdExchange) Path() string   { return x.r.URL.Path }
+
+// Body reads the start of the request body. The body is put back together so it is still sent upstream.
+func (x *stdExchange) Body() string {
+	if !x.bodyRead {
+		x.bodyRead = true
+		b, err := io.ReadAll(io.LimitReader(x.r.Body, maxRuleBody))
+		if err != nil {
+			slog.Debug("read request body", "host", x.r.Host, "error", err)
+		}
+		x.body = b
+		x.r.Body = teeReadCloser{io.MultiReader(bytes.NewReader(b), x.r.Body), x.r.Body}
+	}
+	return string(x.body)
+}
+
+func (x *stdExchange) ClientIP() string {
+	return stripPort(x.r.RemoteAddr)
+}
+
+func (x *stdExchange) respond(status int, contentType string, body []byte) {
+	x.w.Header().Set("Content-Type", contentType)
+	x.w.WriteHeader(status)
+	x.w.Write(body)
+	x.status, x.header = status, x.w.Header().Clone()
+	x.respBody.Write(body)
+}
+
+func (x *stdExchange) redirect(url string) {
+	http.Redirect(x.w, x.r, url, http.StatusFound)
+	x.status, x.header = http.StatusFound, x.w.Header().Clone()
+}
+
+// size returns the approximate number of bytes of the request and its response.
+func (x *stdExchange) size() int64 {
+	return x.reqBody.Total() + x.respBody.Total()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cappedBuffer keeps the first capture.max_body_bytes written to it and counts the rest. It is safe for
+// concurrent use, since the transport may still be sending a request body while the response is read.
+type cappedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := config.DefaultConfig.Capture.MaxBodyBytes - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	b.total += int64(len(p))
+	return len(p), nil
+}
+
+// Bytes returns a copy of what was kept.
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return truncatedCopy(b.buf.Bytes())
+}
+
+func (b *cappedBuffer) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
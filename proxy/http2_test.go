@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// h2Upstream starts an https server that negotiates http/2 and echoes the protocol and body of requests,
+// and makes the proxy trust it for the rest of the test.
+func h2Upstream(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("X-Proto", r.Proto)
+		io.Copy(w, r.Body)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tlsConfig := upstream.TLSClientConfig
+	upstream.TLSClientConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs, NextProtos: []string{"h2", "http/1.1"}}
+	t.Cleanup(func() {
+		upstream.CloseIdleConnections()
+		upstream.TLSClientConfig = tlsConfig
+	})
+	return srv
+}
+
+// h2Front serves handler over http/2 like a mitm connection and returns a client for it.
+func h2Front(t *testing.T, handler http.Handler) (*httptest.Server, *http.Client) {
+	t.Helper()
+	front := httptest.NewUnstartedServer(handler)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	t.Cleanup(front.Close)
+	return front, front.Client()
+}
+
+func TestMITMHandlerHTTP2(t *testing.T) {
+	var hits atomic.Int32
+	device := testDevice()
+	useRules(t,
+		blockRule(device, database.TriggerRecievedMITMRequest, "ctx-path", "/blocked"),
+		blockRule(device, database.TriggerRecievedMITMRequest, "ctx-body", "password="),
+	)
+	up := h2Upstream(t, &hits)
+	host := strings.TrimPrefix(up.URL, "https://")
+	front, client := h2Front(t, mitmHandler(host, device, nil))
+
+	do := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, front.URL+path, strings.NewReader(body))
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	resp, body := do("POST", "/echo", "hello")
+	if resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Fatalf("allowed request: %s %q", resp.Status, body)
+	}
+	if resp.ProtoMajor != 2 || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Errorf("client got %s and the server %s, want http/2 on both sides", resp.Proto, resp.Header.Get("X-Proto"))
+	}
+
+	long := strings.Repeat("x", 1<<20) // a rule reading the body must not cut it
+	if _, body := do("POST", "/upload", long); body != long {
+		t.Errorf("a body a rule read arrived with %d of %d bytes", len(body), len(long))
+	}
+
+	before := hits.Load()
+	if resp, _ := do("GET", "/blocked/page", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked path: %s", resp.Status)
+	}
+	if resp, _ := do("POST", "/login", "user=me&password=hunter2"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked body: %s", resp.Status)
+	}
+	if hits.Load() != before {
+		t.Error("a blocked stream reached the server")
+	}
+}
+
+func TestMITMHandlerMultiplexes(t *testing.T) {
+	var hits atomic.Int32
+	device := testDevice()
+	useRules(t)
+	up := h2Upstream(t, &hits)
+	host := strings.TrimPrefix(up.URL, "https://")
+	front, client := h2Front(t, mitmHandler(host, device, nil))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", front.URL+"/", strings.NewReader(fmt.Sprint(i)))
+			req.Host = host
+			resp, err := client.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			if b, _ := io.ReadAll(resp.Body); string(b) != fmt.Sprint(i) {
+				errs <- fmt.Errorf("stream %d got %q", i, b)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if hits.Load() != 20 {
+		t.Errorf("server got %d requests, want 20", hits.Load())
+	}
+}
+
+func TestServeHTTP2ReturnsWhenClosed(t *testing.T) {
+	device := testDevice()
+	useRules(t, blockRule(device, database.TriggerRecievedMITMRequest, "ctx-path", "/"))
+	front := httptest.NewUnstartedServer(nil)
+	front.EnableHTTP2 = true
+	front.StartTLS() // only for its certificate
+	front.Close()
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, &tls.Config{Certificates: front.TLS.Certificates, NextProtos: []string{"h2"}})
+		if err := conn.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		done <- serveHTTP2(conn, "example.com", device, nil)
+	}()
+
+	tr := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			return conn, conn.HandshakeContext(ctx)
+		},
+	}
+	resp, err := (&http.Client{Transport: tr}).Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("response %s %s, want a blocked http/2 stream", resp.Proto, resp.Status)
+	}
+
+	tr.CloseIdleConnections()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveHTTP2 = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("serveHTTP2 didn't return after the client closed the connection")
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	max := config.DefaultConfig.Capture.MaxBodyBytes
+	config.DefaultConfig.Capture.MaxBodyBytes = 5
+	defer func() { config.DefaultConfig.Capture.MaxBodyBytes = max }()
+
+	var b cappedBuffer
+	b.Write([]byte("abc"))
+	b.Write([]byte("defgh"))
+	b.Write([]byte("ij"))
+	if string(b.Bytes()) != "abcde" || b.Total() != 10 {
+		t.Errorf("kept %q of %d bytes, want \"abcde\" of 10", b.Bytes(), b.Total())
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// enrollThrottler limits guessing enrollment codes, per client ip.
+var enrollThrottler = auth.NewThrottler(5, time.Minute)
+
+var enrollPage = template.Must(template.New("enroll").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Enroll this device</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em">
+<h1>Enroll this device</h1>
+{{if .Device}}
+<p>This device is now enrolled as <b>{{.Device.Name}}</b>. Set its proxy to use these credentials:</p>
+<table>
+<tr><td>Proxy</td><td><code>{{.ProxyAddr}}</code></td></tr>
+<tr><td>Username</td><td><code>{{.Device.ID}}</code></td></tr>
+<tr><td>Password</td><td><code>{{.Secret}}</code></td></tr>
+<tr><td>Automatic configuration (PAC) url</td><td><code>{{.PACURL}}</code></td></tr>
+</table>
+<p>The password is only shown once.</p>
+{{else}}
+{{if .Error}}<p style="color: #b00">{{.Error}}</p>{{end}}
+<form method="post" action="/">
+<input name="code" placeholder="XXXX-XXXX-XXXX" autocomplete="off" autocapitalize="characters" required>
+<button type="submit">Enroll</button>
+</form>
+{{end}}
+<h2>Root certificate</h2>
+<p>To filter https traffic, install and trust the root certificate:
+<a href="/ca.pem">PEM</a>, <a href="/ca.der">DER</a> (Android, Windows) or <a href="/ca.mobileconfig">configuration profile</a> (iOS, macOS).</p>
+</body></html>
+`))
+
+type enrollPageData struct {
+	Device    *database.Device
+	Secret    string
+	ProxyAddr string
+	PACURL    string
+	Error     string
+}
+
+// isLocalRequest reports whether the request is for hat itself instead of being proxied: either a request
+// for the enrollment host or a request sent directly to the proxy listener (not in proxy form).
+func isLocalRequest(ctx *fasthttp.RequestCtx) bool {
+	if bytes.HasPrefix(ctx.Request.Header.RequestURI(), []byte("/")) {
+		return true
+	}
+	return strings.EqualFold(stripPort(string(ctx.Host())), config.DefaultConfig.Enroll.Host)
+}
+
+// handleLocal serves the pages hat serves itself: device enrollment, the root certificate, the proxy
+// auto-config file (also as /wpad.dat for web proxy auto-discovery) and access requests from the block page.
+func handleLocal(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/":
+		handleEnroll(ctx)
+	case "/ca.pem":
+		writeCertificate(ctx, "application/x-pem-file", "hat.pem", env.certService.CertificatePEM)
+	case "/ca.der":
+		writeCertificate(ctx, "application/x-x509-ca-cert", "hat.der", env.certService.CertificateDER)
+	case "/ca.mobileconfig":
+		writeCertificate(ctx, "application/x-apple-aspen-config", "hat.mobileconfig", func() ([]byte, error) {
+			return env.certService.MobileConfig("hat")
+		})
+	case "/proxy.pac", "/wpad.dat":
+		handlePAC(ctx)
+	case "/access":
+		handleAccessRequest(ctx)
+	default:
+		ctx.Error("not found", fasthttp.StatusNotFound)
+	}
+}
+
+func handleEnroll(ctx *fasthttp.RequestCtx) {
+	data := enrollPageData{}
+	if ctx.IsPost() {
+		data = claimEnrollment(ctx)
+	}
+	writePage(ctx, enrollPage, data)
+}
+
+// writePage renders one of the pages hat serves itself.
+func writePage(ctx *fasthttp.RequestCtx, page *template.Template, data any) {
+	var b bytes.Buffer
+	if err := page.Execute(&b, data); err != nil {
+		slog.Error("render page", "page", page.Name(), "error", err)
+		ctx.Error("internal error", fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetBody(b.Bytes())
+}
+
+// claimEnrollment creates the device for the enrollment code in the form and gives it a new proxy password.
+func claimEnrollment(ctx *fasthttp.RequestCtx) enrollPageData {
+	key := "enroll:" + ctx.RemoteIP().String()
+	if ok, wait := enrollThrottler.Allow(key); !ok {
+		return enrollPageData{Error: fmt.Sprintf("Too many attempts, try again in %s.", wait.Round(time.Second))}
+	}
+	if env.db == nil {
+		return enrollPageData{Error: "Enrollment is not available."}
+	}
+
+	secret, secretHash := auth.NewToken("")
+	code := string(ctx.PostArgs().Peek("code"))
+	device, err := env.db.ClaimEnrollment(auth.HashEnrollmentCode(code), secretHash)
+	if errors.Is(err, database.ErrInvalidEnrollmentCode) {
+		enrollThrottler.Failure(key)
+		return enrollPageData{Error: "This code is invalid, expired or was already used."}
+	} else if err != nil {
+		slog.Error("claim enrollment", "error", err)
+		return enrollPageData{Error: "Something went wrong, try again."}
+	}
+	enrollThrottler.Success(key)
+	slog.Info("device enrolled", "device", device.ID, "user", device.User.ID, "ip", ctx.RemoteIP())
+
+	addr := publicAddr(ctx)
+	return enrollPageData{
+		Device:    device,
+		Secret:    secret,
+		ProxyAddr: addr,
+		PACURL:    "http://" + addr + "/proxy.pac?device=" + device.ID.String(),
+	}
+}
+
+func writeCertificate(ctx *fasthttp.RequestCtx, contentType, filename string, get func() ([]byte, error)) {
+	if env.certService == nil {
+		ctx.Error("no root certificate is configured", fasthttp.StatusNotFound)
+		return
+	}
+	b, err := get()
+	if err != nil {
+		ctx.Error("no root certificate is configured", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.SetContentType(contentType)
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	ctx.SetBody(b)
+}
+
+// publicAddr returns the address devices use to reach the proxy.
+func publicAddr(ctx *fasthttp.RequestCtx) string {
+	if config.DefaultConfig.PublicAddr != "" {
+		return config.DefaultConfig.PublicAddr
+	}
+	return ctx.LocalAddr().String()
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// overrideIndex holds when each active override of a kind expires, by target. If a target has several
+// overrides of the same kind, the latest expiry is kept.
+type overrideIndex map[string]map[uuid.UUID]time.Time
+
+var overrideCache = newTTLCache[struct{}, overrideIndex](30 * time.Second)
+
+var errDeviceBlocked = fmt.Errorf("device is blocked")
+
+func loadOverrideIndex() (overrideIndex, error) {
+	overrides, err := env.db.GetActiveOverrides()
+	if err != nil {
+		return nil, err
+	}
+	index := overrideIndex{}
+	for _, o := range overrides {
+		targets, ok := index[o.Kind]
+		if !ok {
+			targets = make(map[uuid.UUID]time.Time)
+			index[o.Kind] = targets
+		}
+		if o.ExpiresAt.After(targets[o.Target]) {
+			targets[o.Target] = o.ExpiresAt
+		}
+	}
+	return index, nil
+}
+
+// overridden returns when the override of kind for target expires, if there is one that is active.
+func overridden(kind string, target uuid.UUID) (time.Time, bool, error) {
+	if env.db == nil {
+		return time.Time{}, false, nil
+	}
+	index, err := overrideCache.get(struct{}{}, loadOverrideIndex)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("get overrides: %w", err)
+	}
+	until, ok := index[kind][target]
+	return until, ok && time.Now().Before(until), nil
+}
+
+// InvalidateOverrides makes the proxy reload the overrides from the database on the next request.
+func InvalidateOverrides() {
+	overrideCache.invalidate(struct{}{})
+}
+
+// screen decides whether a request of the device may go through. An override blocking the device comes
+// first, then an override pausing filtering for it, then the rules and last the quotas. If the request
+// may not go through, the response is written and blocked is true, with the rule that blocked it if any.
+// A request can't go through if what it is screened by can't be loaded either, unless fail_open is set.
+func screen(device *database.Device, trigger string, x exchange) (rule *database.Rule, blocked bool) {
+	rule, blocked, err := screenRequest(device, trigger, x)
+	if err = unscreened(err); err != nil {
+		slog.Error("screen request", "host", x.Host(), "error", err)
+		x.respond(fasthttp.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte("the request couldn't be checked, try again later"))
+		return nil, true
+	}
+	return rule, blocked
+}
+
+func screenRequest(device *database.Device, trigger string, x exchange) (*database.Rule, bool, error) {
+	if device == nil {
+		return nil, false, nil
+	}
+	until, ok, err := overridden(database.OverrideBlockDevice, device.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		writeDeviceBlockedPage(x, until)
+		return nil, true, nil
+	}
+	if _, ok, err := overridden(database.OverridePauseDevice, device.ID); ok || err != nil {
+		return nil, false, err
+	}
+	rule, err := matchRule(device, trigger, requestContext(device, x))
+	if err != nil {
+		return nil, false, err
+	}
+	if rule != nil {
+		slog.Info("request matched rule", "host", x.Host(), "trigger", trigger, "rule", rule.ID)
+		applyRule(rule, x)
+		return rule, true, nil
+	}
+	within, err := checkQuota(device, x)
+	return nil, !within, err
+}
+
+// unscreened returns err, the error of loading what a request is screened by, unless fail_open lets
+// requests that can't be screened through unfiltered. Then it is only logged.
+func unscreened(err error) error {
+	if err != nil && config.DefaultConfig.FailOpen {
+		slog.Error("letting a request through unfiltered", "error", err)
+		return nil
+	}
+	return err
+}
+
+// checkTunnel returns an error if an open tunnel of the device to host has to be closed, because the
+// device was blocked or went over a quota after the tunnel was opened, or that can't be checked.
+func checkTunnel(device *database.Device, host string) error {
+	if device == nil {
+		return nil
+	}
+	_, ok, err := overridden(database.OverrideBlockDevice, device.ID)
+	if err != nil {
+		return unscreened(err)
+	}
+	if ok {
+		return errDeviceBlocked
+	}
+	if _, ok, err := overridden(database.OverridePauseDevice, device.ID); ok || err != nil {
+		return unscreened(err)
+	}
+	q, _, err := exceededQuota(device, host)
+	if err != nil {
+		return unscreened(err)
+	}
+	if q != nil {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// tunnelCheckInterval is how often an open tunnel checks whether it has to be closed, instead of on every
+// write.
+const tunnelCheckInterval = time.Second
+
+// tunnelCheck is checkTunnel for a tunnel, checking again at most every tunnelCheckInterval. It isn't safe
+// for concurrent use.
+type tunnelCheck struct {
+	device *database.Device
+	host   string
+	at     time.Time
+	err    error
+}
+
+// check returns the result of the last checkTunnel, checking again if it is old. Once the tunnel has to be
+// closed it stays that way.
+func (c *tunnelCheck) check() error {
+	if now := time.Now(); c.err == nil && now.Sub(c.at) >= tunnelCheckInterval {
+		c.err, c.at = checkTunnel(c.device, c.host), now
+	}
+	return c.err
+}
+
+var deviceBlockedPage = template.Must(template.New("device-blocked").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Internet is off</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em">
+<h1>Internet is off</h1>
+<p>The internet is turned off for this device until {{.Format "Monday, January 2 at 15:04"}}.</p>
+</body></html>
+`))
+
+func writeDeviceBlockedPage(x exchange, until time.Time) {
+	respondPage(x, fasthttp.StatusForbidden, deviceBlockedPage, until)
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// private networks, reached directly unless pac.proxy_local_networks is set
+var localNetworks = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+}
+
+// PAC is a proxy auto-config file that sends everything through the proxy except its bypass list. The
+// Script and FindProxy methods implement the same logic in javascript and go, so what a device will do
+// can be checked without a javascript interpreter.
+type PAC struct {
+	Proxy          string         `json:"proxy"`            // host:port of the proxy
+	Domains        []string       `json:"domains"`          // reached directly, along with their subdomains
+	Wildcards      []string       `json:"wildcards"`        // shExpMatch patterns of hosts reached directly
+	Networks       []netip.Prefix `json:"networks"`         // ipv4 networks of ip hosts reached directly
+	PlainHostNames bool           `json:"plain_host_names"` // host names without a dot (e.g. "printer") are reached directly
+}
+
+// NewPAC returns the PAC of the device with the bypass lists of the configuration, its group and the
+// device itself. device can be nil (e.g. for wpad), which only uses the configuration's list.
+func NewPAC(device *database.Device, proxyAddr string) *PAC {
+	p := &PAC{Proxy: proxyAddr}
+	if !config.DefaultConfig.PAC.ProxyLocalNetworks {
+		p.Networks = slices.Clone(localNetworks)
+		p.PlainHostNames = true
+	}
+	bypass := slices.Clone(config.DefaultConfig.PAC.Bypass)
+	if device != nil {
+		bypass = append(bypass, device.GroupPACBypass...)
+		bypass = append(bypass, device.PACBypass...)
+	}
+	for _, entry := range bypass {
+		p.add(entry)
+	}
+	return p
+}
+
+// add adds an entry of a bypass list: a network ("10.0.0.0/8"), an ip, a wildcard ("*.lan") or a domain.
+func (p *PAC) add(entry string) {
+	entry = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(entry)), ".")
+	switch {
+	case entry == "":
+	case strings.Contains(entry, "/"):
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil || !prefix.Addr().Is4() {
+			slog.Warn("ignoring pac bypass entry, only ipv4 networks are supported", "entry", entry)
+			return
+		}
+		p.Networks = append(p.Networks, prefix.Masked())
+	case strings.ContainsAny(entry, "*?"):
+		p.Wildcards = append(p.Wildcards, entry)
+	default:
+		if addr, err := netip.ParseAddr(entry); err == nil && addr.Is4() {
+			p.Networks = append(p.Networks, netip.PrefixFrom(addr, 32))
+			return
+		}
+		p.Domains = append(p.Domains, entry)
+	}
+}
+
+// FindProxy returns what the script's FindProxyForURL returns for host.
+func (p *PAC) FindProxy(host string) string {
+	proxy := "PROXY " + p.Proxy
+	host = strings.ToLower(host)
+	if host == strings.ToLower(config.DefaultConfig.Enroll.Host) {
+		return proxy
+	}
+	if p.PlainHostNames && !strings.Contains(host, ".") {
+		return "DIRECT"
+	}
+	for _, d := range p.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return "DIRECT"
+		}
+	}
+	for _, w := range p.Wildcards {
+		if shExpMatch(host, w) {
+			return "DIRECT"
+		}
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is4() {
+		for _, n := range p.Networks {
+			if n.Contains(addr) {
+				return "DIRECT"
+			}
+		}
+	}
+	return proxy
+}
+
+// shExpMatch is the pac function: * matches any characters and ? a single character.
+func shExpMatch(s, pattern string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	ok, _ := regexp.MatchString("^"+expr+"$", s)
+	return ok
+}
+
+// Script returns the javascript of the pac file.
+func (p *PAC) Script() string {
+	networks := make([][2]string, len(p.Networks))
+	for i, n := range p.Networks {
+		networks[i] = [2]string{n.Addr().String(), net.IP(net.CIDRMask(n.Bits(), 32)).String()}
+	}
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar proxy = %s;\n", jsValue("PROXY "+p.Proxy))
+	b.WriteString("\thost = host.toLowerCase();\n")
+	fmt.Fprintf(&b, "\tif (host == %s) return proxy;\n", jsValue(strings.ToLower(config.DefaultConfig.Enroll.Host)))
+	if p.PlainHostNames {
+		b.WriteString("\tif (isPlainHostName(host)) return \"DIRECT\";\n")
+	}
+	fmt.Fprintf(&b, "\tvar domains = %s;\n", jsValue(p.Domains))
+	b.WriteString("\tfor (var i = 0; i < domains.length; i++) {\n\t\tif (host == domains[i] || dnsDomainIs(host, \".\" + domains[i])) return \"DIRECT\";\n\t}\n")
+	fmt.Fprintf(&b, "\tvar wildcards = %s;\n", jsValue(p.Wildcards))
+	b.WriteString("\tfor (var i = 0; i < wildcards.length; i++) {\n\t\tif (shExpMatch(host, wildcards[i])) return \"DIRECT\";\n\t}\n")
+	fmt.Fprintf(&b, "\tvar networks = %s;\n", jsValue(networks))
+	b.WriteString("\tif (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host)) {\n")
+	b.WriteString("\t\tfor (var i = 0; i < networks.length; i++) {\n\t\t\tif (isInNet(host, networks[i][0], networks[i][1])) return \"DIRECT\";\n\t\t}\n\t}\n")
+	b.WriteString("\treturn proxy;\n}\n")
+	return b.String()
+}
+
+// jsValue encodes v as a javascript literal.
+func jsValue(v any) string {
+	b, _ := json.Marshal(v)
+	if string(b) == "null" {
+		return "[]"
+	}
+	return string(b)
+}
+
+// handlePAC serves the proxy auto-config file of the device in the device query parameter, or the one
+// without a device's bypass lists for wpad and requests without a known device.
+func handlePAC(ctx *fasthttp.RequestCtx) {
+	var device *database.Device
+	if id, err := uuid.Parse(string(ctx.QueryArgs().Peek("device"))); err == nil && env.db != nil {
+		device, err = deviceCache.get(id, func() (*database.Device, error) {
+			return env.db.GetDeviceByID(id)
+		})
+		if err != nil {
+			slog.Debug("pac for unknown device", "id", id, "error", err)
+		}
+	}
+	ctx.SetContentType("application/x-ns-proxy-autoconfig")
+	ctx.SetBodyString(NewPAC(device, publicAddr(ctx)).Script())
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/netip"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+func TestFindProxy(t *testing.T) {
+	bypass := config.DefaultConfig.PAC.Bypass
+	config.DefaultConfig.PAC.Bypass = []string{"Bank.example", "*.lan", "203.0.113.0/24"}
+	defer func() { config.DefaultConfig.PAC.Bypass = bypass }()
+	device := &database.Device{
+		GroupPACBypass: []string{".school.example"},
+		PACBypass:      []string{"198.51.100.7", "printer-??.office", "hat.enroll", "2001:db8::/32", "not a network/8"},
+	}
+	p := NewPAC(device, "proxy.example:8080")
+	const proxy = "PROXY proxy.example:8080"
+
+	tests := []struct {
+		host, want string
+	}{
+		{"bank.example", "DIRECT"},
+		{"www.BANK.example", "DIRECT"},
+		{"notbank.example", proxy},
+		{"bank.example.evil", proxy},
+		{"mail.school.example", "DIRECT"},
+		{"nas.lan", "DIRECT"},
+		{"lan", "DIRECT"}, // a plain host name
+		{"nas.lan.example", proxy},
+		{"printer-01.office", "DIRECT"},
+		{"printer-001.office", proxy},
+		{"203.0.113.9", "DIRECT"},
+		{"203.0.114.9", proxy},
+		{"198.51.100.7", "DIRECT"},
+		{"198.51.100.8", proxy},
+		{"192.168.1.1", "DIRECT"},
+		{"10.1.2.3", "DIRECT"},
+		{"8.8.8.8", proxy},
+		{"printer", "DIRECT"},
+		{"hat.enroll", proxy}, // the enroll host always goes through the proxy, even if it is bypassed
+		{"example.com", proxy},
+	}
+	for _, tt := range tests {
+		if got := p.FindProxy(tt.host); got != tt.want {
+			t.Errorf("FindProxy(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+
+	config.DefaultConfig.PAC.ProxyLocalNetworks = true
+	defer func() { config.DefaultConfig.PAC.ProxyLocalNetworks = false }()
+	p = NewPAC(nil, "proxy.example:8080")
+	for _, host := range []string{"printer", "192.168.1.1", "10.1.2.3"} {
+		if got := p.FindProxy(host); got != proxy {
+			t.Errorf("with proxy_local_networks FindProxy(%q) = %q, want %q", host, got, proxy)
+		}
+	}
+	if got := p.FindProxy("bank.example"); got != "DIRECT" {
+		t.Errorf("without a device FindProxy(bank.example) = %q, want the configured bypass", got)
+	}
+}
+
+func TestShExpMatch(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		want       bool
+	}{
+		{"nas.lan", "*.lan", true},
+		{"lan", "*.lan", false},
+		{"a.b.lan", "*.lan", true},
+		{"printer-1.office", "printer-?.office", true},
+		{"printer-12.office", "printer-?.office", false},
+		{"xlan", "*.lan", false}, // the dot is literal
+		{"a+b.lan", "a+b.lan", true},
+	}
+	for _, tt := range tests {
+		if got := shExpMatch(tt.s, tt.pattern); got != tt.want {
+			t.Errorf("shExpMatch(%q, %q) = %t, want %t", tt.s, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// TestScriptMatchesFindProxy checks that the script has the same lists FindProxy uses.
+func TestScriptMatchesFindProxy(t *testing.T) {
+	device := &database.Device{PACBypass: []string{"bank.example", "*.lan", "203.0.113.0/24", `quo"te.example`}}
+	p := NewPAC(device, "proxy.example:8080")
+	script := p.Script()
+
+	var proxy string
+	scriptVar(t, script, "proxy", &proxy)
+	if proxy != "PROXY proxy.example:8080" {
+		t.Errorf("script proxy = %q", proxy)
+	}
+	var domains, wildcards []string
+	scriptVar(t, script, "domains", &domains)
+	scriptVar(t, script, "wildcards", &wildcards)
+	if !slices.Equal(domains, p.Domains) {
+		t.Errorf("script domains = %q, want %q", domains, p.Domains)
+	}
+	if !slices.Equal(wildcards, p.Wildcards) {
+		t.Errorf("script wildcards = %q, want %q", wildcards, p.Wildcards)
+	}
+
+	var networks [][2]string
+	scriptVar(t, script, "networks", &networks)
+	if len(networks) != len(p.Networks) {
+		t.Fatalf("script has %d networks, want %d", len(networks), len(p.Networks))
+	}
+	for i, n := range networks {
+		addr, mask := netip.MustParseAddr(n[0]), netip.MustParseAddr(n[1])
+		bits := 0
+		for _, b := range mask.As4() {
+			for ; b != 0; b <<= 1 {
+				bits++
+			}
+		}
+		if got := netip.PrefixFrom(addr, bits); got != p.Networks[i] {
+			t.Errorf("script network %d = %s, want %s", i, got, p.Networks[i])
+		}
+	}
+	if !regexp.MustCompile(`if \(host == "hat\.enroll"\) return proxy;`).MatchString(script) {
+		t.Error("script doesn't send the enroll host through the proxy")
+	}
+	if !regexp.MustCompile(`isPlainHostName\(host\)`).MatchString(script) {
+		t.Error("script doesn't reach plain host names directly")
+	}
+}
+
+// scriptVar decodes the value of the javascript variable name in script into v.
+func scriptVar(t *testing.T, script, name string, v any) {
+	t.Helper()
+	m := regexp.MustCompile(`(?m)^\tvar ` + name + ` = (.*);$`).FindStringSubmatch(script)
+	if m == nil {
+		t.Fatalf("script has no %s variable:\n%s", name, script)
+	}
+	if err := json.Unmarshal([]byte(m[1]), v); err != nil {
+		t.Fatalf("script %s variable: %v", name, err)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"log/slog"
 
 	"net"
+	"time"
 
+	"github.com/tiredkangaroo/hat/database"
 	"github.com/tiredkangaroo/hat/proxy/certificates"
 	"github.com/tiredkangaroo/hat/proxy/config"
 
@@ -13,37 +15,100 @@ import (
 )
 
 type environment struct {
-	listener    net.Listener
-	certService *certificates.Service
+	listener      net.Listener
+	socksListener net.Listener // nil if socks is disabled
+	transparent   net.Listener // nil if transparent mode is disabled
+	certService   *certificates.Service
+	db            *database.DB
 }
 
 var env *environment = &environment{}
 
-func initialize() error {
+func initialize(db *database.DB) error {
 	listener, err := net.Listen("tcp4", config.DefaultConfig.Addr)
 	if err != nil {
 		return fmt.Errorf("listen on %s: %w", config.DefaultConfig.Addr, err)
 	}
 	slog.Info("listening on", "address", config.DefaultConfig.Addr)
 
+	parents, err := loadUpstreams(config.DefaultConfig)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("load upstream proxies: %w", err)
+	}
+
+	var socksListener net.Listener
+	if addr := config.DefaultConfig.SOCKS.Addr; addr != "" {
+		socksListener, err = net.Listen("tcp", addr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		slog.Info("socks listening on", "address", addr)
+	}
+
+	var transparent net.Listener
+	if addr := config.DefaultConfig.Transparent.Addr; addr != "" {
+		transparent, err = listenTransparent(addr, config.DefaultConfig.Transparent.TProxy)
+		if err != nil {
+			listener.Close()
+			if socksListener != nil {
+				socksListener.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		slog.Info("transparent listening on", "address", addr)
+	}
+
 	certService, err := certificates.GetService()
 	if err != nil {
 		slog.Warn("certificate service could not be initialized", "error", err.Error())
 	}
 
 	env.listener = listener
+	env.socksListener = socksListener
+	env.transparent = transparent
 	env.certService = certService
+	env.db = db
+	upstreams = parents
 	return nil
 }
 
-func Start() error {
-	if err := initialize(); err != nil {
+// Start runs the proxy on the configured address. Requests are logged to db.
+func Start(db *database.DB) error {
+	if err := initialize(db); err != nil {
 		return fmt.Errorf("initialize: %w", err)
 	}
 
 	defer env.listener.Close()
+	if env.socksListener != nil {
+		defer env.socksListener.Close()
+		go serveSOCKS(env.socksListener)
+	}
+	if env.transparent != nil {
+		defer env.transparent.Close()
+		go serveTransparent(env.transparent)
+	}
+	go usage.run(time.Duration(config.DefaultConfig.Usage.FlushSeconds) * time.Second)
+	go blocklists.run()
+	go pruneRequestLog()
+	go watchCategories(config.DefaultConfig.Categories.Files)
+	go watchSafeSearch(config.DefaultConfig.SafeSearch.File)
 
 	if err := fasthttp.Serve(env.listener, func(ctx *fasthttp.RequestCtx) {
+		if isBanned(ctx.RemoteIP().String()) {
+			ctx.Error("your ip is banned", fasthttp.StatusForbidden)
+			return
+		}
+		if isAdminAddr(string(ctx.Host())) {
+			ctx.Error("the admin api is not reachable through the proxy", fasthttp.StatusForbidden)
+			return
+		}
+		if isLocalRequest(ctx) {
+			handleLocal(ctx)
+			return
+		}
+
 		var err error
 		if ctx.Method()[0] == 'C' { // CONNECT method (secure tunnel)
 			err = handleHTTPS(ctx)
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/auth"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/certificates"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMain(m *testing.M) {
+	config.DefaultConfig.SetDefaults()
+	env.certService = &certificates.Service{} // mitm is off
+	os.Exit(m.Run())
+}
+
+// useRules makes the proxy screen requests with rules and no overrides, access exceptions, quotas or bans
+// for the rest of the test, instead of what is in the database. env.db has no connection, so a test that
+// reaches the database panics instead of passing by accident.
+func useRules(t *testing.T, rules ...*database.Rule) {
+	t.Helper()
+	db, capture := env.db, config.DefaultConfig.Capture
+	env.db = &database.DB{}
+	config.DefaultConfig.Capture.Disabled = true
+	seed(ruleCache, newRuleIndex(rules))
+	seed(overrideCache, overrideIndex{})
+	seed(exceptionCache, accessExceptions{})
+	seed(quotaCache, quotaIndex{})
+	seed(banCache, map[string]struct{}{})
+	t.Cleanup(func() {
+		env.db = db
+		config.DefaultConfig.Capture = capture
+		ruleCache.clear()
+		overrideCache.clear()
+		exceptionCache.clear()
+		quotaCache.clear()
+		banCache.clear()
+	})
+}
+
+// seed makes v the entry of a cache with a single entry.
+func seed[V any](c *ttlCache[struct{}, V], v V) {
+	c.invalidate(struct{}{})
+	c.get(struct{}{}, func() (V, error) { return v, nil })
+}
+
+// failLoads makes loading c fail for the rest of the test, as if the database was down.
+func failLoads[V any](t *testing.T, c *ttlCache[struct{}, V]) {
+	c.mu.Lock()
+	clear(c.entries)
+	c.err = errors.New("the database is down")
+	c.mu.Unlock()
+	t.Cleanup(func() {
+		c.mu.Lock()
+		c.err = nil
+		c.mu.Unlock()
+	})
+}
+
+// testDevice returns a device of a new user.
+func testDevice() *database.Device {
+	return &database.Device{ID: uuid.New(), User: database.User{ID: uuid.New()}, Name: "test"}
+}
+
+// blockRule returns a rule of the device's user that blocks requests whose field contains value.
+func blockRule(device *database.Device, trigger, field, value string) *database.Rule {
+	return &database.Rule{
+		ID:         uuid.New(),
+		User:       device.User,
+		Title:      "block " + value,
+		Trigger:    trigger,
+		Condition:  database.Condition{Operator: database.OperatorCT, Field: field, Value: value},
+		RuleAction: database.Action{Type: database.ActionBlockRequest},
+		InEffect:   true,
+		Scope:      database.RuleScopeUser,
+	}
+}
+
+// enroll makes device known to the proxy for the rest of the test, with secret as its proxy password (none
+// if it is empty).
+func enroll(t *testing.T, device *database.Device, secret string) {
+	t.Helper()
+	if secret != "" {
+		device.ProxySecretHash = auth.HashToken(secret)
+	}
+	deviceCache.invalidate(device.ID)
+	deviceCache.get(device.ID, func() (*database.Device, error) { return device, nil })
+	t.Cleanup(func() { deviceCache.invalidate(device.ID) })
+}
+
+// requestCtx returns a request to the proxy from 192.0.2.1, with Proxy-Authorization if username isn't
+// empty.
+func requestCtx(method, uri, username, password string) *fasthttp.RequestCtx {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, nil)
+	return ctx
+}
+
+// startProxy serves the proxy's CONNECT and http handlers on a loopback address for the rest of the test
+// and returns the address. The test waits for the proxy to close every connection before it ends, so the
+// connections have to end before the test's other cleanups (start servers tunnels go to after the proxy).
+func startProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &trackingListener{Listener: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		tl.wg.Wait()
+	})
+	go fasthttp.Serve(tl, func(ctx *fasthttp.RequestCtx) {
+		var err error
+		if ctx.IsConnect() {
+			err = handleHTTPS(ctx)
+		} else {
+			err = handleHTTP(ctx)
+		}
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// trackingListener counts the connections it accepted that aren't closed yet.
+type trackingListener struct {
+	net.Listener
+	wg sync.WaitGroup
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.wg.Add(1)
+	return &trackedConn{Conn: c, closed: sync.OnceFunc(l.wg.Done)}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *trackedConn) Close() error {
+	defer c.closed()
+	return c.Conn.Close()
+}
+
+// connect opens a tunnel to host through the proxy at proxyAddr as the device with the proxy password
+// secret. It fails the test unless the proxy answers 200.
+func connect(t *testing.T, proxyAddr, host string, device *database.Device, secret string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	credentials := base64.StdEncoding.EncodeToString([]byte(device.ID.String() + ":" + secret))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", host, host, credentials)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(&oneByteReader{c}), nil)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %s", host, resp.Status)
+	}
+	return c
+}
+
+// oneByteReader reads a byte at a time so a bufio.Reader on it doesn't read past the CONNECT response into
+// the tunnel.
+type oneByteReader struct{ r io.Reader }
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/valyala/fasthttp"
+)
+
+// quotaIndex holds the quotas keyed by what they apply to (see indexKey).
+type quotaIndex map[string][]*database.Quota
+
+var quotaCache = newTTLCache[struct{}, quotaIndex](30 * time.Second)
+
+var errQuotaExceeded = fmt.Errorf("quota exceeded")
+
+func loadQuotaIndex() (quotaIndex, error) {
+	quotas, err := env.db.GetQuotas()
+	if err != nil {
+		return nil, err
+	}
+	index := quotaIndex{}
+	for _, q := range quotas {
+		key := indexKey(q.Scope, q.Target.String())
+		index[key] = append(index[key], q)
+	}
+	return index, nil
+}
+
+func (index quotaIndex) quotasFor(device *database.Device) []*database.Quota {
+	quotas := index[indexKey(database.QuotaScopeDevice, device.ID.String())]
+	if device.GroupID != nil {
+		quotas = append(quotas, index[indexKey(database.QuotaScopeGroup, device.GroupID.String())]...)
+	}
+	return quotas
+}
+
+// InvalidateQuotas makes the proxy reload the quotas from the database on the next request.
+func InvalidateQuotas() {
+	quotaCache.invalidate(struct{}{})
+}
+
+// day returns the start of the day t is in.
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// weekStart returns the start of the week (starting on monday) t is in.
+func weekStart(t time.Time) time.Time {
+	d := day(t)
+	return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+}
+
+type quotaKey struct {
+	device   uuid.UUID
+	category string // "" for all traffic
+	day      time.Time
+}
+
+// quotaCounter is the usage of a device in a category on a day. Usage is added up in memory and the stored
+// usage is loaded once, the first time the quota is checked.
+type quotaCounter struct {
+	loaded     bool
+	base       database.QuotaUsage // the stored usage, without what was flushed from this counter
+	bytes      int64
+	minutes    int64
+	flushed    database.DailyUsage // the part of bytes and minutes that is stored
+	lastMinute int64
+}
+
+func (c *quotaCounter) usage() database.QuotaUsage {
+	return database.QuotaUsage{
+		BytesToday:    c.base.BytesToday + c.bytes,
+		BytesThisWeek: c.base.BytesThisWeek + c.bytes,
+		MinutesToday:  c.base.MinutesToday + c.minutes,
+	}
+}
+
+// quotaTracker counts what devices use for quotas. Active minutes are the minutes in which a device made at
+// least one request or transferred data through a tunnel.
+type quotaTracker struct {
+	mu       sync.Mutex
+	counters map[quotaKey]*quotaCounter
+}
+
+var quotaUsage = &quotaTracker{counters: make(map[quotaKey]*quotaCounter)}
+
+// add counts bytes to or from host for the device, in all traffic and in the host's category.
+func (t *quotaTracker) add(deviceID uuid.UUID, host string, bytes int64) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addTo(quotaKey{deviceID, "", day(now)}, now, bytes)
+	if category := hostCategory(stripPort(host)); category != "" {
+		t.addTo(quotaKey{deviceID, category, day(now)}, now, bytes)
+	}
+}
+
+// addTo adds to the counter of key. t.mu must be held.
+func (t *quotaTracker) addTo(key quotaKey, now time.Time, bytes int64) {
+	c := t.get(key)
+	c.bytes += bytes
+	if minute := now.Unix() / 60; minute != c.lastMinute {
+		c.lastMinute = minute
+		c.minutes++
+	}
+}
+
+// get returns the counter of key. t.mu must be held.
+func (t *quotaTracker) get(key quotaKey) *quotaCounter {
+	c, ok := t.counters[key]
+	if !ok {
+		c = &quotaCounter{}
+		t.counters[key] = c
+	}
+	return c
+}
+
+// usage returns what the device used today in the category, loading the stored usage if needed.
+func (t *quotaTracker) usage(deviceID uuid.UUID, category string) (database.QuotaUsage, error) {
+	return t.usageAt(deviceID, category, time.Now())
+}
+
+func (t *quotaTracker) usageAt(deviceID uuid.UUID, category string, now time.Time) (database.QuotaUsage, error) {
+	key := quotaKey{deviceID, category, day(now)}
+	t.mu.Lock()
+	c := t.get(key)
+	loaded := c.loaded
+	t.mu.Unlock()
+	if !loaded {
+		stored, err := env.db.GetQuotaUsage(deviceID, category, key.day, weekStart(now))
+		if err != nil {
+			return database.QuotaUsage{}, err
+		}
+		t.mu.Lock()
+		if !c.loaded {
+			// what was flushed from this counter is both stored and counted in memory
+			stored.BytesToday -= c.flushed.Bytes
+			stored.BytesThisWeek -= c.flushed.Bytes
+			stored.MinutesToday -= c.flushed.Minutes
+			c.base, c.loaded = stored, true
+		}
+		t.mu.Unlock()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := c.usage()
+	// earlier days of the week may still have counters with usage that isn't stored yet
+	for d := weekStart(now); d.Before(key.day); d = d.AddDate(0, 0, 1) {
+		if earlier, ok := t.counters[quotaKey{deviceID, category, d}]; ok {
+			u.BytesThisWeek += earlier.bytes - earlier.flushed.Bytes
+		}
+	}
+	return u, nil
+}
+
+// flush stores the usage that isn't stored yet. Counters of past days are dropped once they are stored.
+func (t *quotaTracker) flush() {
+	today := day(time.Now())
+	t.mu.Lock()
+	var batch []database.DailyUsage
+	var counters []*quotaCounter
+	for key, c := range t.counters {
+		u := database.DailyUsage{DeviceID: key.device, Day: key.day, Category: key.category, Bytes: c.bytes - c.flushed.Bytes, Minutes: c.minutes - c.flushed.Minutes}
+		if u.Bytes == 0 && u.Minutes == 0 {
+			if key.day.Before(today) {
+				delete(t.counters, key)
+			}
+			continue
+		}
+		batch = append(batch, u)
+		counters = append(counters, c)
+	}
+	t.mu.Unlock()
+	if len(batch) == 0 || env.db == nil {
+		return
+	}
+
+	if err := env.db.AddDailyUsage(batch); err != nil {
+		slog.Error("add daily usage", "counters", len(batch), "error", err)
+		return
+	}
+	t.mu.Lock()
+	for i, c := range counters {
+		c.flushed.Bytes += batch[i].Bytes
+		c.flushed.Minutes += batch[i].Minutes
+	}
+	t.mu.Unlock()
+}
+
+// QuotaStatus is a quota of a device and how much of it is used.
+type QuotaStatus struct {
+	Quota    *database.Quota     `json:"quota"`
+	Usage    database.QuotaUsage `json:"usage"`
+	Exceeded bool                `json:"exceeded"`
+	ResetsAt *time.Time          `json:"resets_at,omitempty"` // when it is exceeded
+}
+
+// QuotaStatuses returns the quotas that apply to the device with their usage.
+func QuotaStatuses(device *database.Device) ([]QuotaStatus, error) {
+	index, err := quotaCache.get(struct{}{}, loadQuotaIndex)
+	if err != nil {
+		return nil, fmt.Errorf("get quotas: %w", err)
+	}
+	statuses := []QuotaStatus{}
+	for _, q := range index.quotasFor(device) {
+		u, err := quotaUsage.usage(device.ID, q.Category)
+		if err != nil {
+			return nil, fmt.Errorf("get quota usage: %w", err)
+		}
+		status := QuotaStatus{Quota: q, Usage: u}
+		if resets, ok := exceededUntil(q, u, time.Now()); ok {
+			status.Exceeded, status.ResetsAt = true, &resets
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// exceededUntil reports whether the usage exceeds a limit of the quota and when that limit resets. If
+// both a daily and the weekly limit are exceeded, the later reset is returned.
+func exceededUntil(q *database.Quota, u database.QuotaUsage, now time.Time) (time.Time, bool) {
+	var until time.Time
+	if (q.MaxBytesPerDay > 0 && u.BytesToday >= q.MaxBytesPerDay) || (q.MaxMinutesPerDay > 0 && u.MinutesToday >= q.MaxMinutesPerDay) {
+		until = day(now).AddDate(0, 0, 1)
+	}
+	if q.MaxBytesPerWeek > 0 && u.BytesThisWeek >= q.MaxBytesPerWeek {
+		until = weekStart(now).AddDate(0, 0, 7)
+	}
+	return until, !until.IsZero()
+}
+
+// exceededQuota returns a quota of the device that is exceeded and limits requests to host, with when
+// it resets. It returns nil if requests to host are within all quotas.
+func exceededQuota(device *database.Device, host string) (*database.Quota, time.Time, error) {
+	if device == nil || env.db == nil {
+		return nil, time.Time{}, nil
+	}
+	index, err := quotaCache.get(struct{}{}, loadQuotaIndex)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("get quotas: %w", err)
+	}
+	quotas := index.quotasFor(device)
+	if len(quotas) == 0 {
+		return nil, time.Time{}, nil
+	}
+	category := hostCategory(stripPort(host))
+	for _, q := range quotas {
+		if q.Category != "" && q.Category != category {
+			continue
+		}
+		u, err := quotaUsage.usage(device.ID, q.Category)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("get quota usage: %w", err)
+		}
+		if resets, ok := exceededUntil(q, u, time.Now()); ok {
+			return q, resets, nil
+		}
+	}
+	return nil, time.Time{}, nil
+}
+
+// checkQuota writes the quota exceeded page and returns false if the device is over a quota for the
+// requested host.
+func checkQuota(device *database.Device, x exchange) (bool, error) {
+	q, resets, err := exceededQuota(device, x.Host())
+	if q == nil || err != nil {
+		return true, err
+	}
+	slog.Info("quota exceeded", "device", device.ID, "host", x.Host(), "quota", q.ID)
+	writeQuotaPage(x, resets)
+	return false, nil
+}
+
+var quotaPage = template.Must(template.New("quota").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Quota exceeded</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em">
+<h1>Quota exceeded</h1>
+<p>This device used up its quota for {{.Host}}. It resets {{.Resets.Format "Monday, January 2 at 15:04"}}.</p>
+</body></html>
+`))
+
+func writeQuotaPage(x exchange, resets time.Time) {
+	respondPage(x, fasthttp.StatusForbidden, quotaPage, struct {
+		Host   string
+		Resets time.Time
+	}{x.Host(), resets})
+}
+
+// meteredWriter counts the bytes written through a tunnel as they are copied, so long running tunnels count
+// toward quotas while they are open. Writing fails once the tunnel isn't allowed anymore (see checkTunnel).
+type meteredWriter struct {
+	w      io.Writer
+	device *database.Device
+	host   string
+	check  tunnelCheck
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	if err := m.check.check(); err != nil {
+		return 0, err
+	}
+	n, err := m.w.Write(p)
+	usage.addBytes(m.device, m.host, int64(n))
+	return n, err
+}
+
+// copyTunnel copies src to dst, counting the bytes for the device. It returns an error only if it stopped
+// because the tunnel isn't allowed anymore.
+func copyTunnel(dst io.Writer, src io.Reader, device *database.Device, host string) error {
+	_, err := io.Copy(&meteredWriter{w: dst, device: device, host: host, check: tunnelCheck{device: device, host: host}}, src)
+	if errors.Is(err, errQuotaExceeded) || errors.Is(err, errDeviceBlocked) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/valyala/fasthttp"
+)
+
+func TestWeekStart(t *testing.T) {
+	wednesday := time.Date(2026, 10, 14, 15, 4, 5, 0, time.UTC)
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for _, now := range []time.Time{monday, wednesday, time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)} {
+		if got := weekStart(now); !got.Equal(monday) {
+			t.Errorf("weekStart(%s) = %s, want %s", now, got, monday)
+		}
+	}
+}
+
+func TestExceededUntil(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 4, 5, 0, time.UTC) // a wednesday
+	tomorrow, nextWeek := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	q := &database.Quota{MaxBytesPerDay: 100, MaxBytesPerWeek: 500, MaxMinutesPerDay: 60}
+
+	tests := []struct {
+		name  string
+		usage database.QuotaUsage
+		until time.Time
+	}{
+		{"within", database.QuotaUsage{BytesToday: 99, BytesThisWeek: 499, MinutesToday: 59}, time.Time{}},
+		{"daily bytes", database.QuotaUsage{BytesToday: 100, BytesThisWeek: 100}, tomorrow},
+		{"daily minutes", database.QuotaUsage{MinutesToday: 60}, tomorrow},
+		{"weekly bytes", database.QuotaUsage{BytesToday: 10, BytesThisWeek: 500}, nextWeek},
+		{"daily and weekly", database.QuotaUsage{BytesToday: 100, BytesThisWeek: 500}, nextWeek},
+	}
+	for _, tt := range tests {
+		until, ok := exceededUntil(q, tt.usage, now)
+		if !until.Equal(tt.until) || ok != !tt.until.IsZero() {
+			t.Errorf("%s: exceededUntil = %s, %t, want %s", tt.name, until, ok, tt.until)
+		}
+	}
+	if _, ok := exceededUntil(&database.Quota{}, database.QuotaUsage{BytesToday: 1 << 40}, now); ok {
+		t.Error("a quota without limits is exceeded")
+	}
+}
+
+func TestQuotaUsageCountsUnflushedDaysOfTheWeek(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 4, 5, 0, time.Local) // a wednesday
+	device := uuid.New()
+	tr := &quotaTracker{counters: map[quotaKey]*quotaCounter{
+		// stored until this morning, 5 bytes since
+		{device, "", day(now)}: {loaded: true, base: database.QuotaUsage{BytesToday: 10, BytesThisWeek: 500}, bytes: 5},
+		// monday: 100 of 300 bytes are stored and part of the stored weekly usage
+		{device, "", day(now).AddDate(0, 0, -2)}: {bytes: 300, flushed: database.DailyUsage{Bytes: 100}},
+		// last week doesn't count
+		{device, "", day(now).AddDate(0, 0, -3)}: {bytes: 1000},
+		// neither do other categories and devices
+		{device, "games", day(now).AddDate(0, 0, -1)}: {bytes: 1000},
+		{uuid.New(), "", day(now).AddDate(0, 0, -1)}:  {bytes: 1000},
+	}}
+
+	u, err := tr.usageAt(device, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := database.QuotaUsage{BytesToday: 15, BytesThisWeek: 500 + 5 + 200}
+	if u != want {
+		t.Errorf("usage = %+v, want %+v", u, want)
+	}
+}
+
+func TestTunnelCheckIsCached(t *testing.T) {
+	device := testDevice()
+	useRules(t)
+	c := &tunnelCheck{device: device, host: "example.com:443"}
+	if err := c.check(); err != nil {
+		t.Fatalf("check = %v before the device is blocked", err)
+	}
+
+	seed(overrideCache, overrideIndex{database.OverrideBlockDevice: {device.ID: time.Now().Add(time.Hour)}})
+	if err := c.check(); err != nil {
+		t.Errorf("check = %v, want the cached result within %s", err, tunnelCheckInterval)
+	}
+	c.at = c.at.Add(-tunnelCheckInterval)
+	if err := c.check(); !errors.Is(err, errDeviceBlocked) {
+		t.Errorf("check = %v, want %v", err, errDeviceBlocked)
+	}
+
+	seed(overrideCache, overrideIndex{})
+	c.at = c.at.Add(-tunnelCheckInterval)
+	if err := c.check(); !errors.Is(err, errDeviceBlocked) {
+		t.Errorf("check = %v after the block ended, want the tunnel to stay closed", err)
+	}
+}
+
+func TestCopyTunnelStopsOverQuota(t *testing.T) {
+	device := testDevice()
+	useRules(t)
+	quota := &database.Quota{ID: uuid.New(), Scope: database.QuotaScopeDevice, Target: device.ID, MaxBytesPerDay: 10}
+	seed(quotaCache, quotaIndex{indexKey(database.QuotaScopeDevice, device.ID.String()): {quota}})
+	quotaUsage.mu.Lock()
+	quotaUsage.get(quotaKey{device.ID, "", day(time.Now())}).loaded = true
+	quotaUsage.mu.Unlock()
+	t.Cleanup(func() {
+		quotaUsage.mu.Lock()
+		delete(quotaUsage.counters, quotaKey{device.ID, "", day(time.Now())})
+		quotaUsage.mu.Unlock()
+	})
+
+	var dst bytes.Buffer
+	if err := copyTunnel(&dst, strings.NewReader("0123456789abc"), device, "example.com:443"); err != nil {
+		t.Fatalf("copyTunnel = %v within the quota", err)
+	}
+	if dst.Len() != 13 {
+		t.Errorf("copied %d bytes, want 13", dst.Len())
+	}
+	dst.Reset()
+	if err := copyTunnel(&dst, strings.NewReader("more"), device, "example.com:443"); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("copyTunnel = %v over the quota, want %v", err, errQuotaExceeded)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("copied %d bytes over the quota", dst.Len())
+	}
+}
+
+func TestQuotaPage(t *testing.T) {
+	ctx := requestCtx("GET", "/", "", "")
+	ctx.Request.Header.SetHost("games<b>.example")
+	writeQuotaPage(fastExchange{ctx}, time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC))
+	body := string(ctx.Response.Body())
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || !strings.Contains(string(ctx.Response.Header.ContentType()), "text/html") {
+		t.Errorf("status %d, content type %s", ctx.Response.StatusCode(), ctx.Response.Header.ContentType())
+	}
+	if !strings.Contains(body, "games&lt;b&gt;.example") || !strings.Contains(body, "Monday, October 19 at 18:00") {
+		t.Errorf("page doesn't name the escaped host and when the quota resets: %s", body)
+	}
+}
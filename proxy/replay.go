@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	ErrInvalidTarget   = fmt.Errorf("target must be an absolute http(s) url")
+	ErrForbiddenTarget = fmt.Errorf("target can't be reached by replays")
+	ErrTruncatedBody   = fmt.Errorf("the logged request body was truncated, it can only be replayed with a new body")
+)
+
+// replayClient sends replays that don't go through a parent proxy. It connects to the address it checked,
+// so a host can't resolve to a public address for the check and to a private one for the connection.
+var replayClient = &fasthttp.Client{Dial: func(addr string) (net.Conn, error) {
+	checked, err := replayTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", checked, upstreamDialTimeout)
+}}
+
+// Modification describes how a logged request should be changed before it is replayed. The zero value
+// replays the request unmodified.
+type Modification struct {
+	Method        string            `json:"method,omitempty"`
+	Target        string            `json:"target,omitempty"` // full URL to send the request to instead
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Body          *string           `json:"body,omitempty"` // nil keeps the original body
+}
+
+// ReplayResult is the outcome of a replay: the original request, the newly performed request and
+// the difference between their responses.
+type ReplayResult struct {
+	Original *database.LoggedRequest `json:"original"`
+	Replayed *database.LoggedRequest `json:"replayed"`
+	Diff     *Diff                   `json:"diff"`
+}
+
+// UseDatabase makes the proxy read rules, overrides and quotas from db without starting it, so commands
+// can replay requests.
+func UseDatabase(db *database.DB) {
+	env.db = db
+}
+
+// Replay performs the logged request with the given id again (applying mod) and diffs the new response
+// against the original one. The replayed request is stored in the request log as well.
+func Replay(db *database.DB, id uuid.UUID, mod Modification) (*ReplayResult, error) {
+	original, err := db.GetLoggedRequestByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("get logged request: %w", err)
+	}
+	var device *database.Device
+	if original.DeviceID != nil {
+		device, err = db.GetDeviceByID(*original.DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("get device: %w", err)
+		}
+	}
+
+	replayed, err := replay(original, device, mod)
+	if err != nil {
+		return nil, err
+	}
+	replayed.ID, err = db.InsertLoggedRequest(replayed)
+	if err != nil {
+		return nil, fmt.Errorf("insert replayed request: %w", err)
+	}
+
+	return &ReplayResult{
+		Original: original,
+		Replayed: replayed,
+		Diff:     diffResponses(original, replayed),
+	}, nil
+}
+
+// replay sends the logged request again as the device that sent it (nil if it is unknown) and returns the
+// new request. Like the requests of the device, it goes through the device's rules and quotas first, and
+// the block page is its response if they block it.
+func replay(original *database.LoggedRequest, device *database.Device, mod Modification) (*database.LoggedRequest, error) {
+	if original.RequestBodyTruncated && mod.Body == nil {
+		return nil, ErrTruncatedBody
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := buildReplayRequest(req, original, mod); err != nil {
+		return nil, err
+	}
+	if _, err := replayTarget(replayAddr(req)); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	x := replayExchange{req: req, resp: resp}
+	rule, blocked := screen(device, database.TriggerIncomingRequest, x)
+	if !blocked && string(req.URI().Scheme()) == "https" { // the request would have been intercepted with mitm
+		rule, blocked = screen(device, database.TriggerRecievedMITMRequest, x)
+	}
+	if !blocked {
+		enforceSafeSearch(device, req)
+		var err error
+		if via := route(device, database.TriggerIncomingRequest, requestContext(device, x)); via != nil {
+			err = perform(req, resp, via)
+		} else {
+			err = replayClient.Do(req, resp)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("perform request: %w", err)
+		}
+	}
+	replayed := capture(req, resp, deviceID(device), ruleID(rule), start)
+	replayed.ReplayOf = &original.ID
+	return replayed, nil
+}
+
+// replayAddr returns the host:port req is sent to.
+func replayAddr(req *fasthttp.Request) string {
+	addr := string(req.URI().Host())
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	port := "80"
+	if string(req.URI().Scheme()) == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// replayTarget resolves hostport and returns the address a replay to it connects to. It returns an error
+// wrapping ErrForbiddenTarget if hostport is the admin api or, unless replay.allow_private_targets is set,
+// if the host resolves to an address that isn't public.
+func replayTarget(hostport string) (string, error) {
+	if isAdminAddr(hostport) {
+		return "", fmt.Errorf("%w: %s is the admin api", ErrForbiddenTarget, hostport)
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidTarget, hostport)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", host, err)
+	}
+	if !config.DefaultConfig.Replay.AllowPrivateTargets {
+		for _, ip := range ips {
+			if !isPublicIP(ip.IP) {
+				return "", fmt.Errorf("%w: %s is at %s, which isn't a public address", ErrForbiddenTarget, host, ip.IP)
+			}
+		}
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+// isPublicIP reports whether ip is reachable on the internet, rather than being this machine, the local
+// network or a link-local address like that of cloud metadata services.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified() && !isLocalIP(ip)
+}
+
+// replayExchange is a replayed request with its response. It has no client, so block_ip rules don't ban
+// anything.
+type replayExchange struct {
+	req  *fasthttp.Request
+	resp *fasthttp.Response
+}
+
+func (x replayExchange) Host() string     { return b2s(x.req.Host()) }
+func (x replayExchange) Method() string   { return b2s(x.req.Header.Method()) }
+func (x replayExchange) Path() string     { return b2s(x.req.URI().Path()) }
+func (x replayExchange) Body() string     { return b2s(x.req.Body()) }
+func (x replayExchange) ClientIP() string { return "" }
+
+func (x replayExchange) respond(status int, contentType string, body []byte) {
+	x.resp.Reset()
+	x.resp.SetStatusCode(status)
+	x.resp.Header.SetContentType(contentType)
+	x.resp.SetBody(body)
+}
+
+func (x replayExchange) redirect(url string) {
+	x.resp.Reset()
+	x.resp.SetStatusCode(fasthttp.StatusFound)
+	x.resp.Header.Set("Location", url)
+}
+
+func buildReplayRequest(req *fasthttp.Request, original *database.LoggedRequest, mod Modification) error {
+	target := original.URL
+	if mod.Target != "" {
+		target = mod.Target
+	}
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+
+	for _, h := range original.RequestHeaders {
+		if strings.EqualFold(h.Key, "Content-Length") {
+			continue // set by fasthttp from the body
+		}
+		if h.Value == redacted {
+			continue // the credentials weren't stored, set_headers can send them again
+		}
+		req.Header.Add(h.Key, h.Value)
+	}
+	req.SetRequestURI(target)
+	if mod.Target != "" {
+		req.Header.SetHostBytes(req.URI().Host()) // the original Host header would be wrong now
+	}
+	for _, k := range mod.RemoveHeaders {
+		req.Header.Del(k)
+	}
+	for k, v := range mod.SetHeaders {
+		req.Header.Set(k, v)
+	}
+
+	req.Header.SetMethod(original.Method)
+	if mod.Method != "" {
+		req.Header.SetMethod(mod.Method)
+	}
+
+	if mod.Body != nil {
+		req.SetBodyString(*mod.Body)
+	} else {
+		req.SetBody(original.RequestBody)
+	}
+	return nil
+}
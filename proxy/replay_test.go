@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestBuildReplayRequest(t *testing.T) {
+	original := &database.LoggedRequest{
+		Method: "POST",
+		URL:    "http://example.com/a?b=c",
+		RequestHeaders: []database.Header{
+			{Key: "Host", Value: "example.com"},
+			{Key: "Content-Length", Value: "4"},
+			{Key: "X-Keep", Value: "1"},
+			{Key: "X-Remove", Value: "1"},
+			{Key: "Cookie", Value: redacted},
+		},
+		RequestBody: []byte("body"),
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	if err := buildReplayRequest(req, original, Modification{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.URI().String(); got != original.URL {
+		t.Errorf("url = %s, want %s", got, original.URL)
+	}
+	if got := string(req.Header.Method()); got != "POST" {
+		t.Errorf("method = %s, want POST", got)
+	}
+	if got := string(req.Body()); got != "body" {
+		t.Errorf("body = %q, want %q", got, "body")
+	}
+	if req.Header.Peek("Cookie") != nil {
+		t.Error("the redacted Cookie was sent")
+	}
+
+	body := "new"
+	mod := Modification{
+		Method:        "PUT",
+		Target:        "https://other.example/x",
+		SetHeaders:    map[string]string{"X-Set": "2"},
+		RemoveHeaders: []string{"X-Remove"},
+		Body:          &body,
+	}
+	req.Reset()
+	if err := buildReplayRequest(req, original, mod); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(req.Host()); got != "other.example" {
+		t.Errorf("host = %s, want other.example", got)
+	}
+	if got := string(req.Header.Method()); got != "PUT" {
+		t.Errorf("method = %s, want PUT", got)
+	}
+	if got := string(req.Header.Peek("X-Keep")); got != "1" {
+		t.Errorf("X-Keep = %q, want 1", got)
+	}
+	if got := string(req.Header.Peek("X-Set")); got != "2" {
+		t.Errorf("X-Set = %q, want 2", got)
+	}
+	if req.Header.Peek("X-Remove") != nil {
+		t.Error("X-Remove wasn't removed")
+	}
+	if got := string(req.Body()); got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+
+	req.Reset()
+	if err := buildReplayRequest(req, original, Modification{Target: "file:///etc/passwd"}); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("file target: err = %v, want ErrInvalidTarget", err)
+	}
+}
+
+func TestReplayTarget(t *testing.T) {
+	tests := []struct {
+		hostport     string
+		allowPrivate bool
+		want         string // "" if forbidden
+	}{
+		{"8.8.8.8:80", false, "8.8.8.8:80"},
+		{"[2001:4860:4860::8888]:443", false, "[2001:4860:4860::8888]:443"},
+		{"127.0.0.1:80", false, ""},
+		{"[::1]:80", false, ""},
+		{"10.1.2.3:80", false, ""},
+		{"192.168.1.1:443", false, ""},
+		{"169.254.169.254:80", false, ""}, // cloud metadata
+		{"0.0.0.0:80", false, ""},
+		{"10.1.2.3:80", true, "10.1.2.3:80"},
+		{"127.0.0.1:80", true, "127.0.0.1:80"},
+		{config.DefaultConfig.Admin.Addr, true, ""}, // the admin api never is
+	}
+	for _, tt := range tests {
+		config.DefaultConfig.Replay.AllowPrivateTargets = tt.allowPrivate
+		got, err := replayTarget(tt.hostport)
+		if tt.want == "" {
+			if !errors.Is(err, ErrForbiddenTarget) {
+				t.Errorf("replayTarget(%s, private %t) = %s, %v, want ErrForbiddenTarget", tt.hostport, tt.allowPrivate, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("replayTarget(%s, private %t) = %s, %v, want %s", tt.hostport, tt.allowPrivate, got, err, tt.want)
+		}
+	}
+	config.DefaultConfig.Replay.AllowPrivateTargets = false
+}
+
+func TestReplayAddr(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/":      "example.com:80",
+		"https://example.com/":     "example.com:443",
+		"http://example.com:8080/": "example.com:8080",
+		"https://[::1]/":           "[::1]:443",
+	}
+	for uri, want := range tests {
+		req := fasthttp.AcquireRequest()
+		req.SetRequestURI(uri)
+		if got := replayAddr(req); got != want {
+			t.Errorf("replayAddr(%s) = %s, want %s", uri, got, want)
+		}
+		fasthttp.ReleaseRequest(req)
+	}
+}
+
+// replayServer returns a server on loopback, which replays can reach for the rest of the test, and the number
+// of requests it got.
+func replayServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("X-Method", r.Method)
+		w.Write([]byte("replayed " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	config.DefaultConfig.Replay.AllowPrivateTargets = true
+	t.Cleanup(func() { config.DefaultConfig.Replay.AllowPrivateTargets = false })
+	return srv, &hits
+}
+
+func TestReplay(t *testing.T) {
+	srv, hits := replayServer(t)
+	original := &database.LoggedRequest{ID: uuid.New(), Method: "GET", URL: srv.URL + "/page", StatusCode: http.StatusOK}
+
+	replayed, err := replay(original, nil, Modification{Method: "DELETE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("server got %d requests, want 1", hits.Load())
+	}
+	if replayed.StatusCode != http.StatusOK || string(replayed.ResponseBody) != "replayed /page" {
+		t.Errorf("replayed response = %d %q", replayed.StatusCode, replayed.ResponseBody)
+	}
+	if replayed.Method != "DELETE" {
+		t.Errorf("replayed method = %s, want DELETE", replayed.Method)
+	}
+	if replayed.ReplayOf == nil || *replayed.ReplayOf != original.ID {
+		t.Errorf("replay_of = %v, want %s", replayed.ReplayOf, original.ID)
+	}
+}
+
+func TestReplayForbiddenTarget(t *testing.T) {
+	srv, hits := replayServer(t)
+	config.DefaultConfig.Replay.AllowPrivateTargets = false
+
+	original := &database.LoggedRequest{ID: uuid.New(), Method: "GET", URL: "http://example.com/"}
+	if _, err := replay(original, nil, Modification{Target: srv.URL + "/"}); !errors.Is(err, ErrForbiddenTarget) {
+		t.Errorf("err = %v, want ErrForbiddenTarget", err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("server got %d requests, want 0", hits.Load())
+	}
+}
+
+func TestReplayTruncatedBody(t *testing.T) {
+	srv, hits := replayServer(t)
+	original := &database.LoggedRequest{ID: uuid.New(), Method: "POST", URL: srv.URL + "/upload", RequestBody: []byte("the start"), RequestBodyTruncated: true}
+
+	if _, err := replay(original, nil, Modification{}); !errors.Is(err, ErrTruncatedBody) {
+		t.Errorf("err = %v, want ErrTruncatedBody", err)
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("server got %d requests, want 0", hits.Load())
+	}
+
+	body := "a whole body"
+	if _, err := replay(original, nil, Modification{Body: &body}); err != nil {
+		t.Errorf("replay with a new body: %v", err)
+	}
+}
+
+func TestReplayScreenedByDeviceRules(t *testing.T) {
+	srv, hits := replayServer(t)
+	device := testDevice()
+	rule := blockRule(device, database.TriggerIncomingRequest, "ctx-path", "/blocked")
+	useRules(t, rule)
+
+	original := &database.LoggedRequest{ID: uuid.New(), DeviceID: &device.ID, Method: "GET", URL: srv.URL + "/blocked"}
+	replayed, err := replay(original, device, Modification{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("server got %d requests, want 0", hits.Load())
+	}
+	if replayed.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", replayed.StatusCode, http.StatusForbidden)
+	}
+	if replayed.RuleID == nil || *replayed.RuleID != rule.ID {
+		t.Errorf("rule = %v, want %s", replayed.RuleID, rule.ID)
+	}
+
+	// a modified target goes through the rules too
+	original.URL = srv.URL + "/fine"
+	if _, err := replay(original, device, Modification{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replay(original, device, Modification{Target: srv.URL + "/blocked"}); err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("server got %d requests, want 1", hits.Load())
+	}
+}
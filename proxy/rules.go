@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/valyala/fasthttp"
+)
+
+// ruleIndex holds the rules in effect keyed by what they apply to (see indexKey).
+type ruleIndex map[string][]*database.Rule
+
+// there is a single entry with every rule since rules of any scope can apply to a device
+var ruleCache = newTTLCache[struct{}, ruleIndex](30 * time.Second)
+
+// requestContext returns the context rules are evaluated in for a request of the device.
+func requestContext(device *database.Device, x exchange) *database.Context {
+	return &database.Context{Device: device, Request: x, Lists: blocklists, Categories: categorizer{}}
+}
+
+func indexKey(scope, target string) string {
+	return scope + ":" + target
+}
+
+func loadRuleIndex() (ruleIndex, error) {
+	rules, err := env.db.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	return newRuleIndex(rules), nil
+}
+
+// newRuleIndex indexes the rules that are in effect.
+func newRuleIndex(rules []*database.Rule) ruleIndex {
+	index := ruleIndex{}
+	for _, rule := range rules {
+		if !rule.InEffect {
+			continue
+		}
+		target := rule.Target
+		if rule.Scope == database.RuleScopeUser {
+			target = rule.User.ID.String()
+		}
+		key := indexKey(rule.Scope, target)
+		index[key] = append(index[key], rule)
+	}
+	return index
+}
+
+// rulesFor returns the rules that apply to the device in order of precedence: rules for the device itself,
+// then for each of its tags, then for its group and last for its user.
+func (index ruleIndex) rulesFor(device *database.Device) []*database.Rule {
+	rules := index[indexKey(database.RuleScopeDevice, device.ID.String())]
+	for _, tag := range device.Tags {
+		rules = append(rules, index[indexKey(database.RuleScopeTag, tag)]...)
+	}
+	if device.GroupID != nil {
+		rules = append(rules, index[indexKey(database.RuleScopeGroup, device.GroupID.String())]...)
+	}
+	return append(rules, index[indexKey(database.RuleScopeUser, device.User.ID.String())]...)
+}
+
+// matchRule returns the first rule in effect for the device with the given trigger whose condition matches
+// evalCtx, or nil if no rule matches (or the device is unknown). A matching allow rule also returns nil
+// since the request goes through as if nothing matched, as does any rule while the device has an approved
+// access request for the host. route_via rules are left to route.
+func matchRule(device *database.Device, trigger string, evalCtx *database.Context) (*database.Rule, error) {
+	if device == nil || env.db == nil {
+		return nil, nil
+	}
+	rule, err := firstMatch(device, trigger, evalCtx, func(rule *database.Rule) bool {
+		return rule.RuleAction.Type != database.ActionRouteVia
+	})
+	if rule == nil || err != nil || rule.RuleAction.Type == database.ActionAllow {
+		return nil, err
+	}
+	if excepted, err := hasAccessException(device, evalCtx.RequestHost()); excepted || err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// firstMatch returns the first rule in effect for the device with the given trigger that isn't paused, that
+// want accepts, and whose condition matches evalCtx.
+func firstMatch(device *database.Device, trigger string, evalCtx *database.Context, want func(*database.Rule) bool) (*database.Rule, error) {
+	index, err := ruleCache.get(struct{}{}, loadRuleIndex)
+	if err != nil {
+		return nil, fmt.Errorf("get rules: %w", err)
+	}
+
+	for _, rule := range index.rulesFor(device) {
+		if rule.Trigger != trigger || !want(rule) {
+			continue
+		}
+		_, paused, err := overridden(database.OverridePauseRule, rule.ID)
+		if err != nil {
+			return nil, err
+		}
+		if paused {
+			continue
+		}
+		matched, err := rule.Condition.Evaluate(evalCtx)
+		if err != nil {
+			slog.Debug("evaluate rule", "rule", rule.ID, "error", err)
+			continue
+		}
+		if matched {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyRule writes the response for a request that matched rule.
+func applyRule(rule *database.Rule, x exchange) {
+	switch rule.RuleAction.Type {
+	case database.ActionRedirect:
+		if target, ok := rule.RuleAction.Data.(string); ok {
+			x.redirect(target)
+			return
+		}
+		slog.Warn("redirect rule without a target, blocking instead", "rule", rule.ID)
+	case database.ActionBlockIP:
+		if ip := x.ClientIP(); ip != "" { // replays have no client
+			go banIP(ip, rule)
+		}
+	case database.ActionBlockRequest:
+	default:
+		slog.Warn("unknown rule action, blocking instead", "rule", rule.ID, "action", rule.RuleAction.Type)
+	}
+	writeBlockPage(x, rule)
+}
+
+var blockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Blocked</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em">
+<h1>Blocked</h1>
+<p>{{.Host}} was blocked by the rule "{{.Rule.Title}}".</p>
+{{if .AccessURL}}
+<form method="post" action="{{.AccessURL}}">
+<input type="hidden" name="host" value="{{.Host}}">
+<input type="hidden" name="rule" value="{{.Rule.ID}}">
+<p><textarea name="reason" rows="3" cols="40" maxlength="500" placeholder="Why do you need it?"></textarea></p>
+<button type="submit">Request access</button>
+</form>
+{{end}}
+</body></html>
+`))
+
+type blockPageData struct {
+	Host      string
+	Rule      *database.Rule
+	AccessURL string // empty if access can't be requested
+}
+
+// writeBlockPage writes the page for a request blocked by rule. Unless the ip was banned, it has a form
+// to request access to the host.
+func writeBlockPage(x exchange, rule *database.Rule) {
+	data := blockPageData{Host: stripPort(x.Host()), Rule: rule}
+	if rule.RuleAction.Type != database.ActionBlockIP {
+		data.AccessURL = accessRequestURL()
+	}
+	respondPage(x, fasthttp.StatusForbidden, blockPage, data)
+}
+
+// InvalidateRules makes the proxy reload the rules from the database on the next request.
+func InvalidateRules() {
+	ruleCache.invalidate(struct{}{})
+}
+
+func ruleID(rule *database.Rule) *uuid.UUID {
+	if rule == nil {
+		return nil
+	}
+	return &rule.ID
+}
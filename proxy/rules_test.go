@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMatchRule(t *testing.T) {
+	device := testDevice()
+	block := blockRule(device, database.TriggerIncomingRequest, "ctx-host", "blocked.example")
+	mitm := blockRule(device, database.TriggerRecievedMITMRequest, "ctx-path", "/admin")
+	off := blockRule(device, database.TriggerIncomingRequest, "ctx-host", "off.example")
+	off.InEffect = false
+	other := blockRule(testDevice(), database.TriggerIncomingRequest, "ctx-host", "other.example")
+	useRules(t, block, mitm, off, other)
+
+	tests := []struct {
+		name    string
+		device  *database.Device
+		trigger string
+		uri     string
+		want    *database.Rule
+	}{
+		{"matching rule", device, database.TriggerIncomingRequest, "http://blocked.example/", block},
+		{"no matching rule", device, database.TriggerIncomingRequest, "http://fine.example/", nil},
+		{"other trigger", device, database.TriggerIncomingRequest, "http://fine.example/admin", nil},
+		{"mitm trigger", device, database.TriggerRecievedMITMRequest, "https://fine.example/admin", mitm},
+		{"rule not in effect", device, database.TriggerIncomingRequest, "http://off.example/", nil},
+		{"rule of another user", device, database.TriggerIncomingRequest, "http://other.example/", nil},
+		{"unknown device", nil, database.TriggerIncomingRequest, "http://blocked.example/", nil},
+	}
+	for _, tt := range tests {
+		ctx := requestCtx("GET", tt.uri, "", "")
+		if got, err := matchRule(tt.device, tt.trigger, requestContext(tt.device, fastExchange{ctx})); got != tt.want || err != nil {
+			t.Errorf("%s: matchRule = %v, %v, want %v", tt.name, ruleID(got), err, ruleID(tt.want))
+		}
+	}
+}
+
+func TestApplyRule(t *testing.T) {
+	rule := &database.Rule{ID: uuid.New(), Title: "no <games>", RuleAction: database.Action{Type: database.ActionBlockRequest}}
+	ctx := requestCtx("GET", "http://games.example/", "", "")
+	applyRule(rule, fastExchange{ctx})
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("block: status = %d, want %d", ctx.Response.StatusCode(), fasthttp.StatusForbidden)
+	}
+	body := string(ctx.Response.Body())
+	if !strings.Contains(body, "games.example") || !strings.Contains(body, "no &lt;games&gt;") {
+		t.Errorf("block page doesn't name the host and the escaped rule: %s", body)
+	}
+
+	rule.RuleAction = database.Action{Type: database.ActionRedirect, Data: "https://homework.example/"}
+	ctx = requestCtx("GET", "http://games.example/", "", "")
+	applyRule(rule, fastExchange{ctx})
+	if ctx.Response.StatusCode() != fasthttp.StatusFound || string(ctx.Response.Header.Peek("Location")) != "https://homework.example/" {
+		t.Errorf("redirect: status = %d, location %q", ctx.Response.StatusCode(), ctx.Response.Header.Peek("Location"))
+	}
+
+	rule.RuleAction = database.Action{Type: database.ActionRedirect} // without a target it blocks
+	ctx = requestCtx("GET", "http://games.example/", "", "")
+	applyRule(rule, fastExchange{ctx})
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("redirect without a target: status = %d, want %d", ctx.Response.StatusCode(), fasthttp.StatusForbidden)
+	}
+}
+
+func TestScreenFailsClosed(t *testing.T) {
+	device := testDevice()
+	tests := []struct {
+		name         string
+		fail         func(t *testing.T)
+		host         string
+		tunnel, open bool // whether an open tunnel and one being opened depend on what fails
+	}{
+		{"overrides", func(t *testing.T) { failLoads(t, overrideCache) }, "blocked.example", true, true},
+		{"rules", func(t *testing.T) { failLoads(t, ruleCache) }, "blocked.example", false, true},
+		{"access exceptions", func(t *testing.T) { failLoads(t, exceptionCache) }, "blocked.example", false, true},
+		{"quotas", func(t *testing.T) { failLoads(t, quotaCache) }, "fine.example", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-host", "blocked.example"))
+			tt.fail(t)
+
+			ctx := requestCtx("GET", "http://"+tt.host+"/", "", "")
+			if _, blocked := screen(device, database.TriggerIncomingRequest, fastExchange{ctx}); !blocked {
+				t.Error("the request went through")
+			}
+			if status := ctx.Response.StatusCode(); status != fasthttp.StatusServiceUnavailable {
+				t.Errorf("status %d, want %d", status, fasthttp.StatusServiceUnavailable)
+			}
+			if err := checkTunnel(device, tt.host); tt.tunnel && err == nil {
+				t.Error("an open tunnel stays open")
+			}
+			if _, err := screenTunnel(device, tt.host+":443", "", &database.TLSInfo{}); tt.open && err == nil {
+				t.Error("a tunnel was let through")
+			}
+
+			config.DefaultConfig.FailOpen = true
+			defer func() { config.DefaultConfig.FailOpen = false }()
+			ctx = requestCtx("GET", "http://"+tt.host+"/", "", "")
+			if _, blocked := screen(device, database.TriggerIncomingRequest, fastExchange{ctx}); blocked {
+				t.Errorf("fail_open: the request was blocked with status %d", ctx.Response.StatusCode())
+			}
+			if err := checkTunnel(device, tt.host); err != nil {
+				t.Errorf("fail_open: checkTunnel = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/domains"
+	"github.com/valyala/fasthttp"
+)
+
+// the built in safe search mappings, used unless the configuration has a file with others
+//
+//go:embed safesearch.json
+var defaultSafeSearch []byte
+
+// SafeSearchEngine says how safe search is enforced for the hosts of a search engine (or youtube). Requests
+// that are intercepted get the params and headers set. Tunnels that aren't intercepted are connected to
+// SafeHost instead, the address the engine serves safe results from for all of its hosts.
+type SafeSearchEngine struct {
+	Name     string            `json:"name"`
+	Hosts    []string          `json:"hosts"` // patterns, * matches anything (see path.Match)
+	SafeHost string            `json:"safe_host,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+var safeSearchEngines atomic.Pointer[[]SafeSearchEngine]
+
+func parseSafeSearch(b []byte) ([]SafeSearchEngine, error) {
+	var engines []SafeSearchEngine
+	if err := json.Unmarshal(b, &engines); err != nil {
+		return nil, fmt.Errorf("decode safe search engines: %w", err)
+	}
+	for _, e := range engines {
+		for _, pattern := range e.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid host pattern %q: %w", e.Name, pattern, err)
+			}
+		}
+	}
+	return engines, nil
+}
+
+// watchSafeSearch loads the safe search engines from file, or the built in ones if it is empty, and loads
+// the file again whenever it changes.
+func watchSafeSearch(file string) {
+	if file == "" {
+		engines, err := parseSafeSearch(defaultSafeSearch)
+		if err != nil {
+			panic(err) // the embedded file is broken
+		}
+		safeSearchEngines.Store(&engines)
+		return
+	}
+	watchFiles("safe search engines", []string{file}, func() error {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		engines, err := parseSafeSearch(b)
+		if err != nil {
+			return err
+		}
+		safeSearchEngines.Store(&engines)
+		slog.Info("safe search engines loaded", "engines", len(engines))
+		return nil
+	})
+}
+
+// safeSearchFor returns the engine of host if safe search is enforced for the device, or nil.
+func safeSearchFor(device *database.Device, host string) *SafeSearchEngine {
+	if device == nil || !(device.SafeSearch || device.GroupSafeSearch) {
+		return nil
+	}
+	engines := safeSearchEngines.Load()
+	if engines == nil {
+		return nil
+	}
+	host = domains.Normalize(host)
+	for i, e := range *engines {
+		for _, pattern := range e.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				return &(*engines)[i]
+			}
+		}
+	}
+	return nil
+}
+
+// enforceSafeSearch sets the safe search params and headers on a request of the device.
+func enforceSafeSearch(device *database.Device, req *fasthttp.Request) {
+	e := safeSearchFor(device, string(req.Host()))
+	if e == nil {
+		return
+	}
+	args := req.URI().QueryArgs()
+	for k, v := range e.Params {
+		args.Set(k, v)
+	}
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// enforceSafeSearchHTTP is enforceSafeSearch for requests served by net/http.
+func enforceSafeSearchHTTP(device *database.Device, r *http.Request) {
+	e := safeSearchFor(device, r.Host)
+	if e == nil {
+		return
+	}
+	query := r.URL.Query()
+	for k, v := range e.Params {
+		query.Set(k, v)
+	}
+	r.URL.RawQuery = query.Encode()
+	for k, v := range e.Headers {
+		r.Header.Set(k, v)
+	}
+}
+
+// dialAddr returns the address a tunnel of the device to hostport connects to: the engine's safe host if
+// safe search is enforced, otherwise hostport itself.
+func dialAddr(device *database.Device, hostport string) string {
+	e := safeSearchFor(device, hostport)
+	if e == nil || e.SafeHost == "" {
+		return hostport
+	}
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		port = "443"
+	}
+	return net.JoinHostPort(e.SafeHost, port)
+}
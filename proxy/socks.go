@@ -0,0 +1,425 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// the client has this long to negotiate and send its request
+const socksHandshakeTimeout = 30 * time.Second
+
+// socks5 methods, commands, address types and replies (rfc 1928, rfc 1929)
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksNoMethod     = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksNetworkUnreachable  = 3
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksTTLExpired          = 6
+	socksCommandNotSupported = 7
+	socksAddrNotSupported    = 8
+)
+
+var (
+	errSOCKSVersion  = errors.New("not socks5")
+	errSOCKSMethod   = errors.New("no acceptable socks authentication method")
+	errSOCKSAddrType = errors.New("unknown socks address type")
+)
+
+// serveSOCKS serves socks5 clients from l until it is closed. Connections go through the same screening,
+// mitm and logging as the ones opened with CONNECT.
+func serveSOCKS(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("accept socks connection", "error", err)
+			}
+			return
+		}
+		go handleSOCKS(c)
+	}
+}
+
+func handleSOCKS(c net.Conn) {
+	defer c.Close()
+	clientIP := stripPort(c.RemoteAddr().String())
+	if isBanned(clientIP) {
+		return
+	}
+
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	device, err := socksAuthenticate(c, clientIP)
+	if err != nil {
+		slog.Debug("socks authentication", "ip", clientIP, "error", err)
+		return
+	}
+	head := make([]byte, 3) // version, command, reserved
+	if _, err := io.ReadFull(c, head); err != nil {
+		slog.Debug("read socks request", "ip", clientIP, "error", err)
+		return
+	}
+	host, err := readSOCKSAddr(c)
+	if err != nil {
+		slog.Debug("read socks request", "ip", clientIP, "error", err)
+		if errors.Is(err, errSOCKSAddrType) {
+			writeSOCKSReply(c, socksAddrNotSupported, nil)
+		}
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	switch head[1] {
+	case socksCmdConnect:
+		slog.Info("socks connect request", "host", host)
+		socksConnect(c, host, device, clientIP)
+	case socksCmdUDPAssociate:
+		slog.Info("socks udp associate request", "ip", clientIP)
+		socksAssociate(c, device, clientIP)
+	default:
+		writeSOCKSReply(c, socksCommandNotSupported, nil)
+	}
+}
+
+// socksAuthenticate negotiates how the client authenticates and returns its device. A client that sends a
+// username and password is identified like one that sends them in Proxy-Authorization, and is told that
+// authentication failed unless they are those of a device. A client without them is an unknown device like an
+// http request without Proxy-Authorization, which is only let in with allow_anonymous.
+func socksAuthenticate(c net.Conn, clientIP string) (*database.Device, error) {
+	head := make([]byte, 2) // version, number of methods
+	if _, err := io.ReadFull(c, head); err != nil {
+		return nil, fmt.Errorf("read methods: %w", err)
+	}
+	if head[0] != socksVersion {
+		return nil, errSOCKSVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, fmt.Errorf("read methods: %w", err)
+	}
+
+	switch {
+	case bytes.IndexByte(methods, socksAuthPassword) >= 0:
+		if _, err := c.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+			return nil, err
+		}
+		username, password, err := readSOCKSCredentials(c)
+		if err != nil {
+			return nil, err
+		}
+		device, err := deviceByCredentials(username, password, clientIP)
+		if err != nil {
+			c.Write([]byte{1, 1})
+			return nil, err
+		}
+		_, err = c.Write([]byte{1, 0})
+		return device, err
+	case bytes.IndexByte(methods, socksAuthNone) >= 0 && config.DefaultConfig.AllowAnonymous:
+		_, err := c.Write([]byte{socksVersion, socksAuthNone})
+		return nil, err
+	}
+	c.Write([]byte{socksVersion, socksNoMethod})
+	return nil, errSOCKSMethod
+}
+
+// readSOCKSCredentials reads a username and password request (rfc 1929).
+func readSOCKSCredentials(r io.Reader) (string, string, error) {
+	fields := make([]string, 2)
+	b := make([]byte, 2) // version, username length
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", fmt.Errorf("read credentials: %w", err)
+	}
+	for i := range fields {
+		if i > 0 {
+			if _, err := io.ReadFull(r, b[1:]); err != nil { // password length
+				return "", "", fmt.Errorf("read credentials: %w", err)
+			}
+		}
+		field := make([]byte, b[1])
+		if _, err := io.ReadFull(r, field); err != nil {
+			return "", "", fmt.Errorf("read credentials: %w", err)
+		}
+		fields[i] = string(field)
+	}
+	return fields[0], fields[1], nil
+}
+
+// socksConnect connects the client to host, once the rules let it. Like a CONNECT tunnel, it is intercepted
+// with mitm if it is tls to a port in tunnel.tls_ports, and screened by its client hello otherwise.
+func socksConnect(c net.Conn, host string, device *database.Device, clientIP string) {
+	if isAdminAddr(host) {
+		writeSOCKSReply(c, socksNotAllowed, nil)
+		return
+	}
+	x := &connExchange{host: host, method: fasthttp.MethodConnect, clientIP: clientIP}
+	if rule, blocked := screen(device, database.TriggerIncomingRequest, x); blocked {
+		writeSOCKSReply(c, socksNotAllowed, nil)
+		usage.seen(device, host, clientIP, "", 0)
+		Events.Publish(tunnelEvent(host, device, rule, x.status))
+		return
+	}
+	via := route(device, database.TriggerIncomingRequest, requestContext(device, x))
+
+	hostConn, err := via.dial(context.Background(), host)
+	if err != nil {
+		slog.Error("dial target server", "host", host, "upstream", via, "error", err)
+		writeSOCKSReply(c, socksReplyFor(err), nil)
+		return
+	}
+	if err := writeSOCKSReply(c, socksSucceeded, hostConn.LocalAddr()); err != nil {
+		hostConn.Close()
+		return
+	}
+	if expectsTLS(host) {
+		// the client only speaks once the connection is made, so it is made before knowing if it is tls
+		serveTLS(c, host, device, clientIP, via, hostConn)
+		return
+	}
+	tunnel(c, hostConn, host, device, clientIP, "", nil)
+}
+
+// socksReplyFor returns the reply for a connection that couldn't be made because of err.
+func socksReplyFor(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksTTLExpired
+	}
+	return socksGeneralFailure
+}
+
+// writeSOCKSReply answers the client's request. bound is the address the proxy uses for it, which may be nil.
+func writeSOCKSReply(c net.Conn, reply byte, bound net.Addr) error {
+	b := []byte{socksVersion, reply, 0}
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		b = appendSOCKSAddr(b, a.IP.String(), uint16(a.Port))
+	case *net.UDPAddr:
+		b = appendSOCKSAddr(b, a.IP.String(), uint16(a.Port))
+	default:
+		b = appendSOCKSAddr(b, "0.0.0.0", 0)
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+// appendSOCKSAddr appends host and port to b as a socks address. host must be at most 255 bytes.
+func appendSOCKSAddr(b []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(append(b, socksAddrDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksAddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAddrIPv6), ip...)
+	}
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+// readSOCKSAddr reads a socks address and returns it as host:port.
+func readSOCKSAddr(r io.Reader) (string, error) {
+	b := make([]byte, 1, 256)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", fmt.Errorf("read address: %w", err)
+	}
+	var host string
+	switch b[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if b[0] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		name := b[:b[0]]
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w: %d", errSOCKSAddrType, b[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", fmt.Errorf("read address: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksAssociate relays the udp datagrams of the client until it closes c. Each host the client sends to is
+// screened by the rules like a tunnel when the first datagram to it is sent. Datagrams aren't sent through
+// parent proxies, which only tunnel tcp.
+func socksAssociate(c net.Conn, device *database.Device, clientIP string) {
+	local := c.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP}) // where the client reached the proxy
+	if err != nil {
+		slog.Error("listen for udp association", "error", err)
+		writeSOCKSReply(c, socksGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	if err := writeSOCKSReply(c, socksSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	a := &udpAssociation{
+		relay:    relay,
+		device:   device,
+		clientIP: net.ParseIP(clientIP),
+		hosts:    make(map[string]*udpHost),
+		servers:  make(map[string]string),
+	}
+	go a.run()
+	io.Copy(io.Discard, c) // the association ends with the connection it was made on
+}
+
+// udpAssociation relays datagrams between a socks client and the hosts it sends to, all through one socket
+// that is only read by run.
+type udpAssociation struct {
+	relay    *net.UDPConn
+	device   *database.Device
+	clientIP net.IP
+	client   *net.UDPAddr        // where the client sends from, known once it sent a datagram
+	hosts    map[string]*udpHost // by host:port as the client named it
+	servers  map[string]string   // the host:port of each resolved address that was sent to
+}
+
+type udpHost struct {
+	addr    *net.UDPAddr // nil if the host is blocked
+	blocked bool
+	check   tunnelCheck
+}
+
+func (a *udpAssociation) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("read udp datagram", "error", err)
+			}
+			return
+		}
+		if from.IP.Equal(a.clientIP) && (a.client == nil || a.client.Port == from.Port) {
+			a.client = from
+			a.fromClient(buf[:n])
+		} else {
+			a.fromServer(buf[:n], from)
+		}
+	}
+}
+
+// fromClient sends a datagram of the client to the host in its header.
+func (a *udpAssociation) fromClient(datagram []byte) {
+	if len(datagram) < 4 || datagram[2] != 0 { // fragments aren't supported, they are dropped
+		return
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, err := readSOCKSAddr(r)
+	if err != nil {
+		return
+	}
+	h := a.host(host)
+	if h.blocked || h.check.check() != nil {
+		return
+	}
+	payload := datagram[len(datagram)-r.Len():]
+	if _, err := a.relay.WriteToUDP(payload, h.addr); err != nil {
+		slog.Debug("send udp datagram", "host", host, "error", err)
+		return
+	}
+	usage.addBytes(a.device, host, int64(len(payload)))
+}
+
+// fromServer passes a datagram from a host the client sent to back to the client.
+func (a *udpAssociation) fromServer(payload []byte, from *net.UDPAddr) {
+	host, ok := a.servers[from.String()]
+	if !ok || a.client == nil {
+		return
+	}
+	datagram := appendSOCKSAddr([]byte{0, 0, 0}, from.IP.String(), uint16(from.Port))
+	if _, err := a.relay.WriteToUDP(append(datagram, payload...), a.client); err != nil {
+		slog.Debug("send udp datagram to client", "error", err)
+		return
+	}
+	usage.addBytes(a.device, host, int64(len(payload)))
+}
+
+// host screens and resolves host the first time the client sends to it.
+func (a *udpAssociation) host(host string) *udpHost {
+	if h, ok := a.hosts[host]; ok {
+		return h
+	}
+	h := &udpHost{check: tunnelCheck{device: a.device, host: host}}
+	a.hosts[host] = h
+	clientIP := a.clientIP.String()
+	x := &connExchange{host: host, method: "UDP", clientIP: clientIP, status: fasthttp.StatusForbidden}
+	var rule *database.Rule
+	blocked := isAdminAddr(host)
+	if !blocked {
+		rule, blocked = screen(a.device, database.TriggerIncomingRequest, x)
+	}
+	usage.seen(a.device, host, clientIP, "", 0)
+	if blocked {
+		h.blocked = true
+		Events.Publish(udpEvent(host, a.device, rule, x.status))
+		return h
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		slog.Debug("resolve udp host", "host", host, "error", err)
+		h.blocked = true
+		Events.Publish(udpEvent(host, a.device, nil, fasthttp.StatusBadGateway))
+		return h
+	}
+	h.addr = addr
+	a.servers[addr.String()] = host
+	Events.Publish(udpEvent(host, a.device, nil, fasthttp.StatusOK))
+	return h
+}
+
+func udpEvent(host string, device *database.Device, rule *database.Rule, statusCode int) Event {
+	e := tunnelEvent(host, device, rule, statusCode)
+	e.Type, e.Method = EventUDP, "UDP"
+	return e
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// startSOCKS serves socks5 clients on a loopback address for the rest of the test and returns the address.
+// Like startProxy, the test waits for every connection to be closed before it ends.
+func startSOCKS(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &trackingListener{Listener: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		tl.wg.Wait()
+	})
+	go serveSOCKS(tl)
+	return ln.Addr().String()
+}
+
+// socksGreet sends the client's methods, and username and password if the proxy picks them, and returns
+// the method the proxy picked and its answer to the credentials (0 without them).
+func socksGreet(t *testing.T, c net.Conn, methods []byte, username, password string) (method, status byte) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("read method: %v", err)
+	}
+	if reply[1] != socksAuthPassword {
+		return reply[1], 0
+	}
+	auth := append([]byte{1, byte(len(username))}, username...)
+	auth = append(append(auth, byte(len(password))), password...)
+	if _, err := c.Write(auth); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatalf("read authentication: %v", err)
+	}
+	return socksAuthPassword, reply[1]
+}
+
+func TestSOCKSAuthentication(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+
+	both := []byte{socksAuthNone, socksAuthPassword}
+	tests := []struct {
+		name               string
+		methods            []byte
+		username, password string
+		anonymous          bool
+		method, status     byte
+	}{
+		{"device", both, device.ID.String(), "secret", false, socksAuthPassword, 0},
+		{"wrong password", both, device.ID.String(), "guess", false, socksAuthPassword, 1},
+		{"unknown device", both, uuid.NewString(), "secret", false, socksAuthPassword, 1},
+		{"unknown device, anonymous allowed", both, uuid.NewString(), "secret", true, socksAuthPassword, 1},
+		{"not a device id", both, "admin", "secret", false, socksAuthPassword, 1},
+		{"no credentials", []byte{socksAuthNone}, "", "", false, socksNoMethod, 0},
+		{"no credentials, anonymous allowed", []byte{socksAuthNone}, "", "", true, socksAuthNone, 0},
+	}
+	for _, tt := range tests {
+		config.DefaultConfig.AllowAnonymous = tt.anonymous
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleSOCKS(server)
+		}()
+
+		method, status := socksGreet(t, client, tt.methods, tt.username, tt.password)
+		if method != tt.method || status != tt.status {
+			t.Errorf("%s: method %#x, status %d, want method %#x, status %d", tt.name, method, status, tt.method, tt.status)
+		}
+		if method == socksNoMethod || status != 0 {
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Errorf("%s: the connection is still open after the refusal: %v", tt.name, err)
+			}
+		}
+		client.Close()
+		<-done
+	}
+	config.DefaultConfig.AllowAnonymous = false
+}
+
+func TestSOCKSRepliesAfterDialing(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t)
+	proxy := startSOCKS(t)
+	const port = 8443 // a tls port, where the client is peeked at once the connection is made
+	host := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	request := func() (net.Conn, byte) {
+		t.Helper()
+		c, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if _, status := socksGreet(t, c, []byte{socksAuthPassword}, device.ID.String(), "secret"); status != 0 {
+			t.Fatalf("authentication failed: %d", status)
+		}
+		if _, err := c.Write(appendSOCKSAddr([]byte{socksVersion, socksCmdConnect, 0}, "127.0.0.1", port)); err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, 3)
+		if _, err := io.ReadFull(c, head); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		if _, err := readSOCKSAddr(c); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return c, head[1]
+	}
+
+	if _, reply := request(); reply != socksConnectionRefused {
+		t.Errorf("nothing listening: reply %d, want %d", reply, socksConnectionRefused)
+	}
+
+	var accepted atomic.Int32
+	stubServerOn(t, host, func(c net.Conn) {
+		accepted.Add(1)
+		io.Copy(c, c)
+	})
+	c, reply := request()
+	if reply != socksSucceeded {
+		t.Fatalf("reply %d, want %d", reply, socksSucceeded)
+	}
+	io.WriteString(c, "hello") // not a client hello, so it is tunneled
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("read %q, %v through the tunnel", b, err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("server got %d connections, want the one made before the reply", n)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+var errTransparentUnsupported = errors.New("transparent mode is only supported on linux")
+
+// methods a connection in transparent mode can start with to be served as http
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE"}
+
+// serveTransparent serves the connections redirected to l (by iptables redirect or tproxy) until it is
+// closed. Each is served like the proxy would serve it if it was asked to: as http, with mitm or as a tunnel.
+func serveTransparent(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("accept transparent connection", "error", err)
+			}
+			return
+		}
+		go handleTransparent(c)
+	}
+}
+
+func handleTransparent(c net.Conn) {
+	clientIP := stripPort(c.RemoteAddr().String())
+	if isBanned(clientIP) {
+		c.Close()
+		return
+	}
+	// without credentials, the address is all there is to know which device it is. a connection that can't
+	// be told apart isn't let through unfiltered, unless allow_anonymous says so.
+	device, err := identifyAddress(clientIP)
+	if err != nil {
+		if !isCredentialError(err) {
+			slog.Error("identify device", "ip", clientIP, "error", err)
+		}
+		c.Close()
+		return
+	}
+	dst, err := originalDst(c, config.DefaultConfig.Transparent.TProxy)
+	if err != nil {
+		slog.Error("get original destination", "ip", clientIP, "error", err)
+		c.Close()
+		return
+	}
+	host := dst.String()
+	if isAdminAddr(host) {
+		c.Close()
+		return
+	}
+	if isProxyAddr(host) { // dialing it would come back here
+		slog.Warn("transparent connection to the proxy itself", "ip", clientIP, "host", host)
+		c.Close()
+		return
+	}
+
+	// what the client sends first tells http from tls. a client that waits for the server to speak first
+	// gets a tunnel.
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(time.Duration(config.DefaultConfig.Tunnel.HelloTimeoutSeconds) * time.Second))
+	first, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		c.Close()
+		return
+	}
+	var conn net.Conn = c // nothing was read if the client didn't speak, br only keeps the timeout
+	if err == nil {
+		conn = &bufferedConn{Conn: c, r: br}
+	}
+	if err == nil && isHTTPRequest(br) {
+		serveTransparentHTTP(conn, host, device)
+		return
+	}
+	defer conn.Close()
+
+	x := &connExchange{host: host, method: fasthttp.MethodConnect, clientIP: clientIP}
+	if rule, blocked := screen(device, database.TriggerIncomingRequest, x); blocked {
+		usage.seen(device, host, clientIP, "", 0)
+		Events.Publish(tunnelEvent(host, device, rule, x.status))
+		return
+	}
+	via := route(device, database.TriggerIncomingRequest, requestContext(device, x))
+	if err == nil && first[0] == 0x16 { // a tls handshake record
+		serveTLS(conn, host, device, clientIP, via, nil)
+		return
+	}
+	slog.Info("transparent tunnel", "host", host)
+	hostConn, err := via.dial(context.Background(), host)
+	if err != nil {
+		slog.Error("dial target server", "host", host, "upstream", via, "error", err)
+		return
+	}
+	tunnel(conn, hostConn, host, device, clientIP, "", nil)
+}
+
+// isHTTPRequest reports whether what br has buffered starts with an http request line.
+func isHTTPRequest(br *bufio.Reader) bool {
+	b, _ := br.Peek(br.Buffered())
+	method, _, ok := bytes.Cut(b, []byte(" "))
+	if !ok {
+		return false
+	}
+	for _, m := range httpMethods {
+		if string(method) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransparentHTTP serves the http requests of a connection to dst. Their Host header is screened like the
+// url of a request to the proxy would be, but they are sent to dst, the server the client picked, so they are
+// screened as requests for dst too: a Host header naming another server mustn't get past the rules of dst.
+func serveTransparentHTTP(c net.Conn, dst string, device *database.Device) {
+	err := fasthttp.ServeConn(c, func(ctx *fasthttp.RequestCtx) {
+		if len(ctx.Request.Header.Host()) == 0 { // http/1.0
+			ctx.Request.Header.SetHost(dst)
+		}
+		host := string(ctx.Host())
+		switch {
+		case isBanned(ctx.RemoteIP().String()):
+			ctx.Error("your ip is banned", fasthttp.StatusForbidden)
+		case isAdminAddr(host):
+			ctx.Error("the admin api is not reachable through the proxy", fasthttp.StatusForbidden)
+		case strings.EqualFold(stripPort(host), config.DefaultConfig.Enroll.Host):
+			handleLocal(ctx)
+		default:
+			if err := serveHTTP(ctx, device, dst); err != nil {
+				slog.Error("handle request", "error", err)
+				ctx.SetStatusCode(fasthttp.StatusBadGateway)
+			}
+		}
+	})
+	if err != nil {
+		slog.Debug("serve transparent http", "host", dst, "error", err)
+	}
+}
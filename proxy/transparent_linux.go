@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h, the ipv6 SO_ORIGINAL_DST
+const ip6tSOOriginalDst = 80
+
+// listenTransparent listens for redirected connections on addr. With tproxy, the socket may accept
+// connections to addresses that aren't local.
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, _ string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				} else {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("set transparent: %w", serr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns where a redirected connection was going. A connection redirected with tproxy keeps
+// it as its local address, one redirected with iptables redirect has it in conntrack.
+func originalDst(c net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	if tproxy {
+		return c.LocalAddr().(*net.TCPAddr), nil
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection has no socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := c.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// the sockaddr_in6 fits in the value of any getsockopt that returns an ipv6 mtu info
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			var port [2]byte // in network byte order, as it is in memory
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			return
+		}
+		// likewise for the sockaddr_in of an ipv4 multicast request
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			serr = err
+			return
+		}
+		dst = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("getsockopt original destination: %w", serr)
+	}
+	return dst, nil
+}
+
+// macAddress returns the mac address of ip in the arp table, or "" if it isn't there (e.g. it isn't on the
+// local network).
+func macAddress(ip string) string {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan() // the header
+	for s.Scan() {
+		// ip address, hw type, flags, hw address, mask, device
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 4 && fields[0] == ip && fields[3] != "00:00:00:00:00:00" {
+			return strings.ToLower(fields[3])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+func listenTransparent(string, bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(net.Conn, bool) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func macAddress(string) string {
+	return ""
+}
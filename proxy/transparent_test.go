@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+func TestIdentifyAddress(t *testing.T) {
+	device := testDevice()
+	useRules(t)
+	for ip, d := range map[string]*database.Device{"192.0.2.10": device, "192.0.2.11": nil} {
+		addressCache.get(ip, func() (*database.Device, error) { return d, nil })
+		t.Cleanup(func() { addressCache.invalidate(ip) })
+	}
+
+	tests := []struct {
+		name      string
+		ip        string
+		anonymous bool
+		want      *database.Device
+		err       error
+	}{
+		{"device", "192.0.2.10", false, device, nil},
+		{"unknown address", "192.0.2.11", false, nil, errUnknownDevice},
+		{"unknown address, anonymous allowed", "192.0.2.11", true, nil, nil},
+	}
+	for _, tt := range tests {
+		config.DefaultConfig.AllowAnonymous = tt.anonymous
+		got, err := identifyAddress(tt.ip)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: identifyAddress = %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+	config.DefaultConfig.AllowAnonymous = false
+}
+
+// transparentGet sends a request with hostHeader over a transparent connection of device to dst and returns
+// the status of its response.
+func transparentGet(t *testing.T, dst string, device *database.Device, hostHeader string) int {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveTransparentHTTP(server, dst, device)
+	}()
+	go io.WriteString(client, "GET /path HTTP/1.1\r\nHost: "+hostHeader+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.Close()
+	<-done
+	return resp.StatusCode
+}
+
+func TestTransparentHTTPGoesToDst(t *testing.T) {
+	device := testDevice()
+	useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-host", "blocked.example"))
+	var hits atomic.Int32
+	var host atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		host.Store(r.Host + r.URL.Path)
+	}))
+	defer srv.Close()
+	dst := srv.Listener.Addr().String()
+
+	get := func(hostHeader string) int {
+		t.Helper()
+		return transparentGet(t, dst, device, hostHeader)
+	}
+
+	// the Host header names a server that doesn't exist, the request still goes to the one connected to
+	if status := get("elsewhere.invalid"); status != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("status %d, server got %d requests", status, hits.Load())
+	}
+	if got := host.Load(); got != "elsewhere.invalid/path" {
+		t.Errorf("server got %v, want the client's Host header and path", got)
+	}
+	if status := get("blocked.example"); status != http.StatusForbidden || hits.Load() != 1 {
+		t.Errorf("blocked host: status %d, server got %d requests", status, hits.Load())
+	}
+}
+
+func TestTransparentHTTPScreensDst(t *testing.T) {
+	device := testDevice()
+	useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-host", "127.0.0.1"))
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+
+	// the Host header names an allowed server, but the connection was made to a blocked one
+	if status := transparentGet(t, srv.Listener.Addr().String(), device, "allowed.example"); status != http.StatusForbidden {
+		t.Errorf("status %d, want %d", status, http.StatusForbidden)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("server got %d requests, want 0", n)
+	}
+}
+
+func TestIsProxyAddr(t *testing.T) {
+	c := config.DefaultConfig
+	defer func(addr, socks, transparent string) {
+		c.Addr, c.SOCKS.Addr, c.Transparent.Addr = addr, socks, transparent
+	}(c.Addr, c.SOCKS.Addr, c.Transparent.Addr)
+	c.Addr, c.SOCKS.Addr, c.Transparent.Addr = "127.0.0.1:8080", ":1080", "[::]:3129"
+
+	tests := map[string]bool{
+		"127.0.0.1:8080":  true,
+		"localhost:8080":  true,
+		"[::1]:1080":      true,
+		"127.0.0.1:1080":  true,
+		"0.0.0.0:3129":    true,
+		"127.0.0.1:3129":  true,
+		"127.0.0.1:8081":  false,
+		"192.0.2.1:8080":  false,
+		"192.0.2.1:1080":  false,
+		"example.com:443": false,
+	}
+	for hostport, want := range tests {
+		if got := isProxyAddr(hostport); got != want {
+			t.Errorf("isProxyAddr(%s) = %t, want %t", hostport, got, want)
+		}
+	}
+
+	c.SOCKS.Addr = ""
+	if isProxyAddr("127.0.0.1:1080") {
+		t.Error("a disabled listener still counts")
+	}
+}
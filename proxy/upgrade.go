@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+const upgradeTimeout = 30 * time.Second
+
+// handleUpgrade passes a request of the device that asks to upgrade the connection (such as a websocket
+// handshake) to the server at addr, through via. If the server switches protocols, the client's connection is hijacked
+// and spliced to the server's once the response is written, and done (if not nil) is called when both are
+// closed. It reports whether the connection was hijacked.
+func handleUpgrade(ctx *fasthttp.RequestCtx, addr string, secure bool, device *database.Device, via *parentProxy, typ string, start time.Time, done func()) bool {
+	req, resp := &ctx.Request, &ctx.Response
+	logFrames := config.DefaultConfig.Capture.WebSocketFrames && !config.DefaultConfig.Capture.Disabled && env.db != nil && isWebSocket(req)
+	if logFrames {
+		req.Header.Del("Sec-WebSocket-Extensions") // compressed frames can't be logged
+	}
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+
+	write := req.Write
+	if via.forwards(secure) {
+		write = func(w *bufio.Writer) error { return via.writeRequest(w, req) }
+	}
+	upConn, err := dialUpgrade(addr, secure, via)
+	if err != nil {
+		slog.Error("dial upgrade", "addr", addr, "error", err)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		record(typ, ctx, device, nil, start)
+		return false
+	}
+	br := bufio.NewReader(upConn)
+	if err := sendUpgrade(upConn, br, write, resp); err != nil {
+		upConn.Close()
+		slog.Error("upgrade", "addr", addr, "error", err)
+		resp.Reset()
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		record(typ, ctx, device, nil, start)
+		return false
+	}
+	if resp.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		upConn.Close()
+		record(typ, ctx, device, nil, start)
+		return false
+	}
+
+	resp.Header.SetNoDefaultContentType(true)
+	host := string(req.Host())
+	usage.seen(device, host, ctx.RemoteIP().String(), string(req.Header.UserAgent()), messageSize(req, resp))
+	lr := capture(req, resp, deviceID(device), nil, start)
+	Events.Publish(eventFromLoggedRequest(typ, lr))
+	ctx.Hijack(func(c net.Conn) {
+		defer upConn.Close()
+		if done != nil {
+			defer done()
+		}
+		var frames *frameLog
+		if logFrames {
+			// stored before any frame, which references it
+			if _, err := env.db.InsertLoggedRequest(lr); err != nil {
+				slog.Error("insert logged request", "url", lr.URL, "error", err)
+			} else {
+				frames = newFrameLog(lr.ID)
+				defer frames.close()
+			}
+		} else {
+			logRequest(lr)
+		}
+		splice(c, upConn, br, device, host, frames)
+	})
+	return true
+}
+
+func isWebSocket(req *fasthttp.Request) bool {
+	return strings.EqualFold(string(req.Header.Peek("Upgrade")), "websocket")
+}
+
+// dialUpgrade connects to the server at addr through via, or to via itself if it forwards the request.
+func dialUpgrade(addr string, secure bool, via *parentProxy) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	if via.forwards(secure) {
+		return via.dialParent(ctx)
+	}
+	conn, err := via.dial(ctx, addr)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: stripPort(addr), NextProtos: []string{"http/1.1"}})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// sendUpgrade writes the request to conn with write and reads the response into resp. The body is only read
+// if the server didn't switch protocols, since after that the connection speaks the new protocol.
+func sendUpgrade(conn net.Conn, br *bufio.Reader, write func(*bufio.Writer) error, resp *fasthttp.Response) error {
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	bw := bufio.NewWriter(conn)
+	if err := write(bw); err != nil {
+		return fmt.Errorf("write request: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write request: %w", err)
+	}
+	if err := resp.Header.Read(br); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode() == fasthttp.StatusSwitchingProtocols {
+		return nil
+	}
+	if err := resp.ReadBody(br, 0); err != nil {
+		return fmt.Errorf("read response body: %w", err)
+	}
+	return nil
+}
+
+// splice copies between the client and the server until either side closes, counting the bytes like a
+// tunnel. upstream reads from the server, with what was buffered while reading the response. The frames
+// of both directions are logged if frames is not nil.
+func splice(c, upConn net.Conn, upstream io.Reader, device *database.Device, host string, frames *frameLog) {
+	var downstream io.Reader = c
+	if frames != nil {
+		downstream = io.TeeReader(c, frames.parser(true))
+		upstream = io.TeeReader(upstream, frames.parser(false))
+	}
+
+	// closing upConn stops the copy from the server. c may be hijacked from fasthttp, which closes it
+	// itself, so the copy from the client is stopped with a deadline instead.
+	var once sync.Once
+	stop := func(err error) {
+		if err != nil {
+			slog.Info("upgraded connection closed", "host", host, "reason", err)
+		}
+		once.Do(func() {
+			upConn.Close()
+			c.SetDeadline(time.Now())
+		})
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stop(copyTunnel(c, upstream, device, host))
+	}()
+	go func() {
+		defer wg.Done()
+		stop(copyTunnel(upConn, downstream, device, host))
+	}()
+	wg.Wait()
+}
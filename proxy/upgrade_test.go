@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+)
+
+// upgradeServer switches requests for /ws to an echo protocol and answers others with 426. It sends the
+// headers of each request it got on the returned channel. Its connections are closed when the test ends.
+func upgradeServer(t *testing.T) (string, <-chan http.Header) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	headers := make(chan http.Header, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go func() {
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				headers <- req.Header
+				if req.URL.Path != "/ws" {
+					io.WriteString(c, "HTTP/1.1 426 Upgrade Required\r\nContent-Length: 4\r\n\r\nnope")
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				io.Copy(c, br)
+			}()
+		}
+	}()
+	return ln.Addr().String(), headers
+}
+
+// upgrade asks the proxy at proxyAddr to upgrade a request for path on addr as the device and returns the
+// connection with the response.
+func upgrade(t *testing.T, proxyAddr, addr, path string, device *database.Device, secret string) (net.Conn, *http.Response) {
+	t.Helper()
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	credentials := base64.StdEncoding.EncodeToString([]byte(device.ID.String() + ":" + secret))
+	fmt.Fprintf(c, "GET http://%s%s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nProxy-Authorization: Basic %s\r\n\r\n", addr, path, addr, credentials)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(&oneByteReader{c}), nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	return c, resp
+}
+
+func TestUpgradeSplicesConnection(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t)
+	proxy := startProxy(t)
+	addr, headers := upgradeServer(t)
+
+	c, resp := upgrade(t, proxy, addr, "/ws", device, "secret")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: %s", resp.Status)
+	}
+	if h := <-headers; h.Get("Proxy-Authorization") != "" || h.Get("Upgrade") != "websocket" {
+		t.Errorf("server got Proxy-Authorization %q and Upgrade %q", h.Get("Proxy-Authorization"), h.Get("Upgrade"))
+	}
+	for _, msg := range []string{"ping", "pong"} {
+		io.WriteString(c, msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != msg {
+			t.Errorf("echo of %q = %q, %v", msg, got, err)
+		}
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	device := testDevice()
+	enroll(t, device, "secret")
+	useRules(t, blockRule(device, database.TriggerIncomingRequest, "ctx-path", "/blocked"))
+	proxy := startProxy(t)
+	addr, headers := upgradeServer(t)
+
+	if _, resp := upgrade(t, proxy, addr, "/blocked/ws", device, "secret"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked upgrade: %s", resp.Status)
+	}
+	select {
+	case <-headers:
+		t.Error("a blocked upgrade reached the server")
+	default:
+	}
+
+	_, resp := upgrade(t, proxy, addr, "/other", device, "secret")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUpgradeRequired || string(body) != "nope" {
+		t.Errorf("upgrade the server refused: %s %q", resp.Status, body)
+	}
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+const upstreamDialTimeout = 30 * time.Second
+
+// direct is the name for going to servers without a parent proxy, in rules and upstream.hosts.
+const direct = "direct"
+
+var errParentRefused = errors.New("parent proxy refused the connection")
+
+// upstreams are the parent proxies of the configuration, by name.
+var upstreams = map[string]*parentProxy{}
+
+// parentProxy is a proxy that connections to servers go through, such as the egress proxy of an office
+// network. Plain http requests are forwarded to http and https parents in absolute-form, everything else is
+// tunneled through it (with CONNECT for http and https parents). A nil *parentProxy connects to servers
+// directly.
+type parentProxy struct {
+	name      string
+	url       *url.URL
+	client    *fasthttp.Client // sends requests through tunnels
+	transport *http.Transport  // sends the requests of http/2 mitm connections
+}
+
+// loadUpstreams parses the parent proxies of the configuration and checks that the names it routes through
+// exist.
+func loadUpstreams(c *config.Configuration) (map[string]*parentProxy, error) {
+	parents := make(map[string]*parentProxy, len(c.Upstream.Proxies))
+	for name, raw := range c.Upstream.Proxies {
+		if name == direct {
+			return nil, fmt.Errorf("upstream proxy can't be named %q", direct)
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse upstream proxy %s: %w", name, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("upstream proxy %s: unsupported scheme %q", name, u.Scheme)
+		}
+		if u.Port() == "" {
+			return nil, fmt.Errorf("upstream proxy %s: missing port", name)
+		}
+		p := &parentProxy{name: name, url: u}
+		p.client = &fasthttp.Client{Dial: func(addr string) (net.Conn, error) {
+			return p.dial(context.Background(), addr)
+		}}
+		p.transport = upstream.Clone()
+		p.transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return p.dial(ctx, addr)
+		}
+		parents[name] = p
+	}
+
+	routes := []string{c.Upstream.Default}
+	for _, name := range c.Upstream.Hosts {
+		routes = append(routes, name)
+	}
+	for _, name := range routes {
+		if _, ok := parents[name]; !ok && name != "" && name != direct {
+			return nil, fmt.Errorf("unknown upstream proxy: %s", name)
+		}
+	}
+	return parents, nil
+}
+
+// UpstreamNames returns the names route_via rules can use: the parent proxies and "direct".
+func UpstreamNames() []string {
+	names := []string{direct}
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	slices.Sort(names[1:])
+	return names
+}
+
+// IsUpstream reports whether name can be used by a route_via rule.
+func IsUpstream(name string) bool {
+	_, ok := upstreams[name]
+	return ok || name == direct
+}
+
+// route returns the parent proxy a request of the device is sent through: the one of the first route_via
+// rule with the given trigger that matches evalCtx, otherwise the one upstream.hosts or upstream.default
+// picks for the host. It returns nil if the request goes directly to the server.
+func route(device *database.Device, trigger string, evalCtx *database.Context) *parentProxy {
+	if p, ok := routeRule(device, trigger, evalCtx); ok {
+		return p
+	}
+	return hostRoute(evalCtx.RequestHost())
+}
+
+// routeRule returns the parent proxy of the first route_via rule with the given trigger that matches
+// evalCtx. It reports false if no rule does.
+func routeRule(device *database.Device, trigger string, evalCtx *database.Context) (*parentProxy, bool) {
+	if device == nil || env.db == nil {
+		return nil, false
+	}
+	rule, err := firstMatch(device, trigger, evalCtx, func(rule *database.Rule) bool {
+		return rule.RuleAction.Type == database.ActionRouteVia
+	})
+	if err != nil {
+		slog.Error("route by rules", "error", err) // the request was screened, it goes the way it would without them
+		return nil, false
+	}
+	if rule == nil {
+		return nil, false
+	}
+	name, _ := rule.RuleAction.Data.(string)
+	if name == direct {
+		return nil, true
+	}
+	p, ok := upstreams[name]
+	if !ok {
+		slog.Warn("route_via rule with an unknown upstream proxy, ignoring it", "rule", rule.ID, "upstream", name)
+	}
+	return p, ok
+}
+
+// hostRoute returns the parent proxy of host in upstream.hosts, where the longest matching host wins, or
+// the default one. Hosts that only differ in case tie, the smallest of them wins so the pick doesn't depend
+// on the order of the map.
+func hostRoute(host string) *parentProxy {
+	host = strings.ToLower(stripPort(host))
+	name, matched := config.DefaultConfig.Upstream.Default, ""
+	for h, n := range config.DefaultConfig.Upstream.Hosts {
+		lower := strings.ToLower(h)
+		if host != lower && !strings.HasSuffix(host, "."+lower) {
+			continue
+		}
+		if matched == "" || len(h) > len(matched) || len(h) == len(matched) && h < matched {
+			name, matched = n, h
+		}
+	}
+	return upstreams[name] // nil for "direct" and ""
+}
+
+func (p *parentProxy) String() string {
+	if p == nil {
+		return direct
+	}
+	return p.name
+}
+
+// do sends req and reads the response into resp.
+func (p *parentProxy) do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	if p == nil {
+		return fasthttp.Do(req, resp)
+	}
+	if p.forwards(string(req.URI().Scheme()) == "https") {
+		return p.forward(req, resp)
+	}
+	return p.client.Do(req, resp)
+}
+
+// forwards reports whether requests to servers are sent to the parent proxy in absolute-form, as http
+// proxies expect for plain http, instead of through a tunnel. It is false for socks5 parents and for
+// requests over tls, which the parent mustn't see.
+func (p *parentProxy) forwards(secure bool) bool {
+	return p != nil && !secure && p.url.Scheme != "socks5"
+}
+
+// forward sends req to the parent proxy in absolute-form and reads the response into resp. Every request
+// gets its own connection to the parent.
+func (p *parentProxy) forward(req *fasthttp.Request, resp *fasthttp.Response) error {
+	conn, err := p.dialParent(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	bw := bufio.NewWriter(conn)
+	if err := p.writeRequest(bw, req); err != nil {
+		return fmt.Errorf("write request to upstream proxy %s: %w", p.name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write request to upstream proxy %s: %w", p.name, err)
+	}
+	resp.SkipBody = req.Header.IsHead()
+	if err := resp.Read(bufio.NewReader(conn)); err != nil {
+		return fmt.Errorf("read response from upstream proxy %s: %w", p.name, err)
+	}
+	return nil
+}
+
+// writeRequest writes req to w in absolute-form (without the fragment), authenticated to the parent proxy
+// if its url has a username and password.
+func (p *parentProxy) writeRequest(w *bufio.Writer, req *fasthttp.Request) error {
+	uri := req.URI()
+	if len(req.Header.Host()) == 0 {
+		req.Header.SetHostBytes(uri.Host())
+	}
+	target := append(append(append(append([]byte(nil), uri.Scheme()...), "://"...), uri.Host()...), uri.RequestURI()...)
+	req.Header.SetRequestURIBytes(target)
+	if auth := p.authorization(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+		defer req.Header.Del("Proxy-Authorization") // the request is captured afterwards
+	}
+	if err := req.Header.Write(w); err != nil {
+		return err
+	}
+	return req.BodyWriteTo(w)
+}
+
+// authorization returns the Proxy-Authorization header of the parent proxy, or "" if its url has no
+// username.
+func (p *parentProxy) authorization() string {
+	u := p.url.User
+	if u == nil {
+		return ""
+	}
+	password, _ := u.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password))
+}
+
+// roundTripper returns the transport of the requests of http/2 mitm connections.
+func (p *parentProxy) roundTripper() http.RoundTripper {
+	if p == nil {
+		return upstream
+	}
+	return p.transport
+}
+
+// dial connects to addr through the parent proxy.
+func (p *parentProxy) dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamDialTimeout)
+	defer cancel()
+	if p == nil {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := p.dialParent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if p.url.Scheme == "socks5" {
+		err = p.socksConnect(conn, addr)
+	} else {
+		conn, err = p.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connect to %s through upstream proxy %s: %w", addr, p.name, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialParent connects to the parent proxy itself, with tls for https parents.
+func (p *parentProxy) dialParent(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamDialTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.url.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream proxy %s: %w", p.name, err)
+	}
+	if p.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy %s handshake: %w", p.name, err)
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// httpConnect asks an http parent proxy to tunnel conn to addr.
+func (p *parentProxy) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if auth := p.authorization(); auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return conn, fmt.Errorf("read response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: %s", errParentRefused, resp.Status)
+	}
+	if br.Buffered() > 0 { // the server may speak first
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// socks5 replies to a request that failed
+var socksReplies = map[byte]string{
+	socksGeneralFailure:      "general failure",
+	socksNotAllowed:          "connection not allowed by ruleset",
+	socksNetworkUnreachable:  "network unreachable",
+	socksHostUnreachable:     "host unreachable",
+	socksConnectionRefused:   "connection refused",
+	socksTTLExpired:          "ttl expired",
+	socksCommandNotSupported: "command not supported",
+	socksAddrNotSupported:    "address type not supported",
+}
+
+// socksConnect asks a socks5 parent proxy to connect conn to addr (rfc 1928), authenticating with the
+// username and password of its url (rfc 1929) if it has them.
+func (p *parentProxy) socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name too long: %s", host)
+	}
+
+	method := byte(socksAuthNone)
+	if p.url.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read method: %w", err)
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return fmt.Errorf("%w: %w", errParentRefused, errSOCKSMethod)
+	}
+	if method == socksAuthPassword {
+		username := p.url.User.Username()
+		password, _ := p.url.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5 username and password must be at most 255 bytes")
+		}
+		auth := append([]byte{1, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("read authentication: %w", err)
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: authentication failed", errParentRefused)
+		}
+	}
+
+	req := appendSOCKSAddr([]byte{socksVersion, socksCmdConnect, 0}, host, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 3) // version, reply, reserved
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("read reply: %w", err)
+	}
+	if head[1] != socksSucceeded {
+		reason := socksReplies[head[1]]
+		if reason == "" {
+			reason = "reply " + strconv.Itoa(int(head[1]))
+		}
+		return fmt.Errorf("%w: %s", errParentRefused, reason)
+	}
+	if _, err := readSOCKSAddr(conn); err != nil { // the bound address, which isn't needed
+		return fmt.Errorf("read reply: %w", err)
+	}
+	return nil
+}
+
+// bufferedConn is a connection that was read ahead of. Reads return what was read ahead first.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+	"github.com/valyala/fasthttp"
+)
+
+// stubServer serves every connection to a loopback address with serve for the rest of the test and returns
+// the address. The connections are closed when the test ends.
+func stubServer(t *testing.T, serve func(c net.Conn)) string {
+	t.Helper()
+	return stubServerOn(t, "127.0.0.1:0", serve)
+}
+
+// stubServerOn is stubServer on addr.
+func stubServerOn(t *testing.T, addr string, serve func(c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoServer returns the address of a server that sends back what it is sent.
+func echoServer(t *testing.T) string {
+	return stubServer(t, func(c net.Conn) { io.Copy(c, c) })
+}
+
+// httpParent returns the address of an http parent proxy that wants username and password (none if
+// username is empty). It tunnels CONNECT requests to the address asked for, except to refused, and
+// answers the requests it forwards with their request line. The request lines it gets are sent on the
+// returned channel.
+func httpParent(t *testing.T, username, password, refused string) (string, <-chan string) {
+	seen := make(chan string, 10)
+	addr := stubServer(t, func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		seen <- r.Method + " " + r.RequestURI
+		if username != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		if r.Method != http.MethodConnect {
+			body := r.Method + " " + r.RequestURI
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+			return
+		}
+		if r.RequestURI == refused {
+			io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		server, err := net.Dial("tcp", r.RequestURI)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer server.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(server, br)
+		io.Copy(c, server)
+	})
+	return addr, seen
+}
+
+// socksParent returns the address of a socks5 parent proxy that wants username and password (no
+// authentication if username is empty) and answers every request with reply. It connects the requests it
+// accepts to the address asked for.
+func socksParent(t *testing.T, username, password string, reply byte) string {
+	return stubServer(t, func(c net.Conn) {
+		defer c.Close()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(c, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(c, methods); err != nil {
+			return
+		}
+		method := byte(socksAuthNone)
+		if username != "" {
+			method = socksAuthPassword
+		}
+		if bytes.IndexByte(methods, method) < 0 {
+			c.Write([]byte{socksVersion, socksNoMethod})
+			return
+		}
+		c.Write([]byte{socksVersion, method})
+		if method == socksAuthPassword {
+			u, p, err := readSOCKSCredentials(c)
+			if err != nil {
+				return
+			}
+			if u != username || p != password {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+		if _, err := io.ReadFull(c, make([]byte, 3)); err != nil {
+			return
+		}
+		addr, err := readSOCKSAddr(c)
+		if err != nil {
+			return
+		}
+		if reply != socksSucceeded {
+			writeSOCKSReply(c, reply, nil)
+			return
+		}
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			writeSOCKSReply(c, socksReplyFor(err), nil)
+			return
+		}
+		defer server.Close()
+		writeSOCKSReply(c, socksSucceeded, server.LocalAddr())
+		go io.Copy(server, c)
+		io.Copy(c, server)
+	})
+}
+
+// parent returns the parent proxy named name at rawURL, loaded like the ones of the configuration.
+func parent(t *testing.T, name, rawURL string) *parentProxy {
+	t.Helper()
+	c := &config.Configuration{}
+	c.Upstream.Proxies = map[string]string{name: rawURL}
+	parents, err := loadUpstreams(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parents[name]
+}
+
+// echoes checks that conn is connected to an echo server.
+func echoes(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("read %q, %v, want the echo", b, err)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	addr, seen := httpParent(t, "office", "s3cret", "refused.example:443")
+
+	conn, err := parent(t, "office", "http://office:s3cret@"+addr).dial(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-seen; got != "CONNECT "+echo {
+		t.Errorf("parent got %q, want a CONNECT to %s", got, echo)
+	}
+	echoes(t, conn)
+
+	_, err = parent(t, "office", "http://office:guess@"+addr).dial(context.Background(), echo)
+	if !errors.Is(err, errParentRefused) || !strings.Contains(err.Error(), "407") {
+		t.Errorf("wrong password: err = %v, want a 407 refusal", err)
+	}
+	_, err = parent(t, "office", "http://office:s3cret@"+addr).dial(context.Background(), "refused.example:443")
+	if !errors.Is(err, errParentRefused) || !strings.Contains(err.Error(), "403") {
+		t.Errorf("refused host: err = %v, want a 403 refusal", err)
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	echo := echoServer(t)
+
+	tests := []struct {
+		name   string
+		parent string
+		err    string // "" if the connection is made
+	}{
+		{"no authentication", "socks5://" + socksParent(t, "", "", socksSucceeded), ""},
+		{"authentication", "socks5://office:s3cret@" + socksParent(t, "office", "s3cret", socksSucceeded), ""},
+		{"wrong password", "socks5://office:guess@" + socksParent(t, "office", "s3cret", socksSucceeded), "authentication failed"},
+		{"no credentials", "socks5://" + socksParent(t, "office", "s3cret", socksSucceeded), errSOCKSMethod.Error()},
+		{"refused", "socks5://" + socksParent(t, "", "", socksNotAllowed), "connection not allowed by ruleset"},
+		{"unknown reply", "socks5://" + socksParent(t, "", "", 0x42), "reply 66"},
+	}
+	for _, tt := range tests {
+		conn, err := parent(t, "office", tt.parent).dial(context.Background(), echo)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			echoes(t, conn)
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+		}
+		if !errors.Is(err, errParentRefused) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want a refusal with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	addr, seen := httpParent(t, "office", "s3cret", "")
+	p := parent(t, "office", "http://office:s3cret@"+addr)
+
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://www.example.com/search?q=hat#results")
+	if err := p.do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := "GET http://www.example.com/search?q=hat"
+	if got := <-seen; got != want {
+		t.Errorf("parent got %q, want %q", got, want)
+	}
+	if string(resp.Body()) != want {
+		t.Errorf("response = %d %q", resp.StatusCode(), resp.Body())
+	}
+	if req.Header.Peek("Proxy-Authorization") != nil {
+		t.Error("the parent's credentials are left in the request")
+	}
+
+	// a socks5 parent doesn't understand absolute-form, the request is tunneled
+	var hits atomic.Int32
+	server := stubServer(t, func(c net.Conn) {
+		fasthttp.ServeConn(c, func(ctx *fasthttp.RequestCtx) {
+			hits.Add(1)
+			ctx.WriteString(string(ctx.RequestURI()))
+		})
+	})
+	req.SetRequestURI("http://" + server + "/search?q=hat")
+	if err := parent(t, "office", "socks5://"+socksParent(t, "", "", socksSucceeded)).do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 1 || string(resp.Body()) != "/search?q=hat" {
+		t.Errorf("server got %d requests, response %q", hits.Load(), resp.Body())
+	}
+}
+
+func TestRoute(t *testing.T) {
+	office := &parentProxy{name: "office"}
+	lab := &parentProxy{name: "lab"}
+	hosts, def := config.DefaultConfig.Upstream.Hosts, config.DefaultConfig.Upstream.Default
+	saved := upstreams
+	upstreams = map[string]*parentProxy{"office": office, "lab": lab}
+	t.Cleanup(func() {
+		upstreams = saved
+		config.DefaultConfig.Upstream.Hosts, config.DefaultConfig.Upstream.Default = hosts, def
+	})
+	config.DefaultConfig.Upstream.Default = "office"
+	config.DefaultConfig.Upstream.Hosts = map[string]string{
+		"example.com":     "lab",
+		"www.example.com": "office",
+		"intranet":        direct,
+		"Tie.example":     "lab",
+		"tie.example":     "office",
+	}
+
+	device := testDevice()
+	viaLab := blockRule(device, database.TriggerIncomingRequest, "ctx-host", "routed.example")
+	viaLab.RuleAction = database.Action{Type: database.ActionRouteVia, Data: "lab"}
+	viaDirect := blockRule(device, database.TriggerIncomingRequest, "ctx-host", "direct.example.com")
+	viaDirect.RuleAction = database.Action{Type: database.ActionRouteVia, Data: direct}
+	unknown := blockRule(device, database.TriggerIncomingRequest, "ctx-host", "gone.example")
+	unknown.RuleAction = database.Action{Type: database.ActionRouteVia, Data: "gone"}
+	useRules(t, viaLab, viaDirect, unknown)
+
+	tests := []struct {
+		name string
+		uri  string
+		want *parentProxy
+	}{
+		{"rule", "http://routed.example/", lab},
+		{"rule to direct", "http://direct.example.com/", nil},
+		{"rule with an unknown upstream", "http://gone.example/", office},
+		{"host", "http://example.com/", lab},
+		{"subdomain", "http://api.example.com:8080/", lab},
+		{"longest host", "http://www.example.com/", office},
+		{"host to direct", "http://wiki.intranet/", nil},
+		{"case", "http://WWW.Example.COM/", office},
+		{"default", "http://other.example/", office},
+		{"not a subdomain", "http://notexample.com/", office},
+		{"tie", "http://tie.example/", lab},
+	}
+	for _, tt := range tests {
+		for range 10 { // map order changes between iterations
+			ctx := requestCtx("GET", tt.uri, "", "")
+			if got := route(device, database.TriggerIncomingRequest, requestContext(device, fastExchange{ctx})); got != tt.want {
+				t.Errorf("%s: route = %s, want %s", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/valyala/fasthttp"
+)
+
+// usageTracker adds up the usage of devices in memory so the proxy doesn't write to the database on every
+// request. flush stores it periodically.
+type usageTracker struct {
+	mu      sync.Mutex
+	pending map[uuid.UUID]*database.DeviceUsage
+}
+
+var usage = &usageTracker{pending: make(map[uuid.UUID]*database.DeviceUsage)}
+
+// seen records a request (or tunnel) of the device to host from ip. userAgent may be empty (e.g. for tunnels).
+func (t *usageTracker) seen(device *database.Device, host, ip, userAgent string, bytes int64) {
+	if device == nil {
+		return
+	}
+	quotaUsage.add(device.ID, host, bytes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(device.ID)
+	u.LastSeen = time.Now()
+	u.IP = ip
+	if userAgent != "" {
+		u.UserAgent = userAgent
+	}
+	u.Requests++
+	u.Bytes += bytes
+}
+
+// addBytes adds bytes transferred to or from host after the request was seen, e.g. through a tunnel.
+func (t *usageTracker) addBytes(device *database.Device, host string, bytes int64) {
+	if device == nil || bytes == 0 {
+		return
+	}
+	quotaUsage.add(device.ID, host, bytes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(device.ID)
+	u.LastSeen = time.Now()
+	u.Bytes += bytes
+}
+
+// get returns the pending usage of the device. t.mu must be held.
+func (t *usageTracker) get(id uuid.UUID) *database.DeviceUsage {
+	u, ok := t.pending[id]
+	if !ok {
+		u = &database.DeviceUsage{DeviceID: id}
+		t.pending[id] = u
+	}
+	return u
+}
+
+// flush stores the pending usage in the database. If that fails, the usage is kept for the next flush.
+func (t *usageTracker) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[uuid.UUID]*database.DeviceUsage, len(pending))
+	t.mu.Unlock()
+	if len(pending) == 0 || env.db == nil {
+		return
+	}
+
+	batch := make([]database.DeviceUsage, 0, len(pending))
+	for _, u := range pending {
+		batch = append(batch, *u)
+	}
+	if err := env.db.UpdateDeviceUsage(batch); err != nil {
+		slog.Error("update device usage", "devices", len(batch), "error", err)
+		t.mu.Lock()
+		for id, u := range pending {
+			if newer, ok := t.pending[id]; ok {
+				u.Requests += newer.Requests
+				u.Bytes += newer.Bytes
+				u.LastSeen, u.IP = newer.LastSeen, newer.IP
+				if newer.UserAgent != "" {
+					u.UserAgent = newer.UserAgent
+				}
+			}
+			t.pending[id] = u
+		}
+		t.mu.Unlock()
+	}
+}
+
+// run flushes the usage (and the usage counted for quotas) every interval.
+func (t *usageTracker) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.flush()
+		quotaUsage.flush()
+	}
+}
+
+// messageSize returns the approximate number of bytes of a request and its response on the wire.
+func messageSize(req *fasthttp.Request, resp *fasthttp.Response) int64 {
+	return int64(len(req.Header.Header()) + len(req.Body()) + len(resp.Header.Header()) + len(resp.Body()))
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net"
+	"unsafe"
+)
+
+// b2s converts b to a string without copying. The string must not outlive b.
+func b2s(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+// stripPort returns host without its port, if it has one.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// watchFiles calls load, and calls it again whenever one of the files changes. Files are checked every
+// minute. If load fails, whatever was loaded before should be kept; it is tried again on the next change.
+func watchFiles(what string, files []string, load func() error) {
+	var loaded map[string]time.Time
+	for ; ; time.Sleep(time.Minute) {
+		modified := make(map[string]time.Time, len(files))
+		for _, name := range files {
+			if info, err := os.Stat(name); err == nil {
+				modified[name] = info.ModTime()
+			}
+		}
+		if loaded != nil && sameModTimes(loaded, modified) {
+			continue
+		}
+		loaded = modified
+		if err := load(); err != nil {
+			slog.Error("load "+what, "error", err)
+		}
+	}
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, t := range a {
+		if !t.Equal(b[name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// frames waiting to be stored per connection, more are dropped
+const frameLogBuffer = 256
+
+var opcodes = map[byte]string{0: "continuation", 1: "text", 2: "binary", 8: "close", 9: "ping", 10: "pong"}
+
+// frameLog stores the frames of a websocket connection in the background, in the order they were sent.
+type frameLog struct {
+	requestID uuid.UUID
+	frames    chan *database.WebSocketFrame
+	dropped   atomic.Int64
+}
+
+func newFrameLog(requestID uuid.UUID) *frameLog {
+	l := &frameLog{requestID: requestID, frames: make(chan *database.WebSocketFrame, frameLogBuffer)}
+	go l.run()
+	return l
+}
+
+func (l *frameLog) run() {
+	for f := range l.frames {
+		if err := env.db.InsertWebSocketFrame(f); err != nil {
+			slog.Error("insert websocket frame", "request", l.requestID, "error", err)
+		}
+	}
+}
+
+func (l *frameLog) add(f *database.WebSocketFrame) {
+	select {
+	case l.frames <- f:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// close stops the log once the frames that are waiting are stored. No frames can be added after.
+func (l *frameLog) close() {
+	close(l.frames)
+	if n := l.dropped.Load(); n > 0 {
+		slog.Warn("dropped websocket frames from the log", "request", l.requestID, "dropped", n)
+	}
+}
+
+// parser returns a writer that follows the frames of one direction of the connection as it is copied.
+func (l *frameLog) parser(fromClient bool) *frameParser {
+	return &frameParser{log: l, fromClient: fromClient}
+}
+
+// frameParser reads websocket frames from what is written to it, which can split them anywhere, and adds
+// each frame to the log once it is complete.
+type frameParser struct {
+	log        *frameLog
+	fromClient bool
+
+	header    []byte // of the frame being read
+	inFrame   bool   // the header is complete and the payload is being read
+	opcode    byte
+	mask      []byte // empty if the payload isn't masked
+	size      int64
+	remaining int64
+	payload   []byte // the start of the payload, unmasked
+	text      bool   // the message being continued is text
+	deflated  bool   // the message being continued is compressed (rsv1 was set on its first frame)
+}
+
+func (p *frameParser) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if !p.inFrame {
+			take := min(p.headerLen()-len(p.header), len(b))
+			p.header = append(p.header, b[:take]...)
+			b = b[take:]
+			if len(p.header) == p.headerLen() { // the length may have grown with the second byte
+				p.start()
+			}
+			continue
+		}
+		take := int(min(int64(len(b)), p.remaining))
+		p.keep(b[:take])
+		b = b[take:]
+		p.remaining -= int64(take)
+		if p.remaining == 0 {
+			p.finish()
+		}
+	}
+	return n, nil
+}
+
+// headerLen returns the length of the frame's header, as far as it is known from what was read of it.
+func (p *frameParser) headerLen() int {
+	if len(p.header) < 2 {
+		return 2
+	}
+	n := 2
+	switch p.header[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if p.header[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (p *frameParser) start() {
+	h := p.header
+	p.opcode = h[0] & 0x0f
+	if p.opcode == 1 || p.opcode == 2 {
+		p.deflated = h[0]&0x40 != 0
+	}
+	p.size = int64(h[1] & 0x7f)
+	rest := h[2:]
+	switch p.size {
+	case 126:
+		p.size = int64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		p.size = int64(binary.BigEndian.Uint64(rest) & (1<<63 - 1))
+		rest = rest[8:]
+	}
+	p.mask = rest // the masking key if there is one
+	p.remaining = p.size
+	p.payload = p.payload[:0]
+	p.inFrame = true
+	if p.remaining == 0 {
+		p.finish()
+	}
+}
+
+// keep unmasks and keeps the part of b that fits in the logged payload.
+func (p *frameParser) keep(b []byte) {
+	limit := max(config.DefaultConfig.Capture.MaxBodyBytes, 125) // close frames always fit
+	offset := int(p.size - p.remaining)
+	for i := 0; i < len(b) && len(p.payload) < limit; i++ {
+		c := b[i]
+		if len(p.mask) == 4 {
+			c ^= p.mask[(offset+i)%4]
+		}
+		p.payload = append(p.payload, c)
+	}
+}
+
+func (p *frameParser) finish() {
+	fin := p.header[0]&0x80 != 0
+	f := &database.WebSocketFrame{RequestID: p.log.requestID, FromClient: p.fromClient, Size: p.size, CreatedAt: time.Now()}
+	f.Opcode = opcodes[p.opcode]
+	if f.Opcode == "" {
+		f.Opcode = "unknown"
+	}
+	switch p.opcode {
+	case 1:
+		p.text = !fin
+		if !p.deflated {
+			f.Text = frameText(p.payload)
+		}
+	case 0:
+		if p.text && !p.deflated {
+			f.Text = frameText(p.payload)
+		}
+		p.text = p.text && !fin
+	case 2:
+		p.text = false
+	case 8:
+		if len(p.payload) >= 2 {
+			code := int(binary.BigEndian.Uint16(p.payload))
+			f.CloseCode = &code
+			f.Text = frameText(p.payload[2:]) // the reason
+		}
+	}
+	p.log.add(f)
+	p.header = p.header[:0]
+	p.inFrame = false
+}
+
+// frameText returns b as text that can be stored, even if it was cut off in the middle of a character.
+func frameText(b []byte) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(string(b), "�"), "\x00", "")
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tiredkangaroo/hat/database"
+	"github.com/tiredkangaroo/hat/proxy/config"
+)
+
+// wsFrame encodes a websocket frame, masked with mask if it isn't nil.
+func wsFrame(fin, rsv1 bool, opcode byte, payload, mask []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	f := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		f = append(f, maskBit|byte(n))
+	case n <= 0xffff:
+		f = append(f, maskBit|126)
+		f = binary.BigEndian.AppendUint16(f, uint16(n))
+	default:
+		f = append(f, maskBit|127)
+		f = binary.BigEndian.AppendUint64(f, uint64(n))
+	}
+	if mask == nil {
+		return append(f, payload...)
+	}
+	f = append(f, mask...)
+	for i, c := range payload {
+		f = append(f, c^mask[i%4])
+	}
+	return f
+}
+
+func TestFrameParser(t *testing.T) {
+	maxBody := config.DefaultConfig.Capture.MaxBodyBytes
+	config.DefaultConfig.Capture.MaxBodyBytes = 1000
+	defer func() { config.DefaultConfig.Capture.MaxBodyBytes = maxBody }()
+	mask := []byte{1, 2, 3, 4}
+	closePayload := binary.BigEndian.AppendUint16(nil, 1001)
+	closePayload = append(closePayload, "going away"...)
+	long := bytes.Repeat([]byte("a"), 70000)
+
+	var stream []byte
+	stream = append(stream, wsFrame(true, false, 1, []byte("hello"), mask)...)
+	stream = append(stream, wsFrame(false, false, 1, []byte("split "), mask)...)
+	stream = append(stream, wsFrame(true, false, 9, nil, mask)...) // a ping between fragments
+	stream = append(stream, wsFrame(true, false, 0, []byte("message"), mask)...)
+	stream = append(stream, wsFrame(true, false, 2, []byte{0, 1, 2}, mask)...)
+	stream = append(stream, wsFrame(true, true, 1, []byte{0xf2, 0x48}, mask)...) // compressed
+	stream = append(stream, wsFrame(true, false, 1, long, mask)...)
+	stream = append(stream, wsFrame(true, false, 8, closePayload, mask)...)
+
+	want := []database.WebSocketFrame{
+		{Opcode: "text", Size: 5, Text: "hello"},
+		{Opcode: "text", Size: 6, Text: "split "},
+		{Opcode: "ping"},
+		{Opcode: "continuation", Size: 7, Text: "message"},
+		{Opcode: "binary", Size: 3},
+		{Opcode: "text", Size: 2},
+		{Opcode: "text", Size: 70000, Text: string(long[:1000])},
+		{Opcode: "close", Size: int64(len(closePayload)), Text: "going away"},
+	}
+
+	// the same frames, written at once and a byte at a time
+	for _, chunk := range []int{len(stream), 1} {
+		l := &frameLog{requestID: uuid.New(), frames: make(chan *database.WebSocketFrame, 16)}
+		p := l.parser(true)
+		for b := stream; len(b) > 0; b = b[min(chunk, len(b)):] {
+			p.Write(b[:min(chunk, len(b))])
+		}
+		close(l.frames)
+
+		var got []*database.WebSocketFrame
+		for f := range l.frames {
+			got = append(got, f)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("writing %d bytes at a time: %d frames, want %d", chunk, len(got), len(want))
+		}
+		for i, f := range got {
+			w := want[i]
+			if f.Opcode != w.Opcode || f.Size != w.Size || f.Text != w.Text || !f.FromClient || f.RequestID != l.requestID {
+				t.Errorf("writing %d bytes at a time, frame %d: %s of %d bytes %.20q, want %s of %d bytes %.20q", chunk, i, f.Opcode, f.Size, f.Text, w.Opcode, w.Size, w.Text)
+			}
+		}
+		if c := got[len(got)-1].CloseCode; c == nil || *c != 1001 {
+			t.Errorf("close code = %v, want 1001", c)
+		}
+	}
+}
+
+func TestFrameText(t *testing.T) {
+	if got := frameText([]byte("caf\xc3")); got != "caf�" {
+		t.Errorf("frameText of a cut character = %q", got)
+	}
+	if got := frameText([]byte("a\x00b")); got != "ab" {
+		t.Errorf("frameText with a nul = %q", got)
+	}
+}